@@ -18,6 +18,7 @@ func main() {
 		cli.NewKeygenCommand(),
 		cli.NewUpCommand(),
 		cli.NewDownCommand(),
+		cli.NewRotateKeyCommand(),
 		cli.NewStatusCommand(),
 	)
 
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"migration-to-zero-trust/agent/internal/config"
+	"migration-to-zero-trust/agent/internal/controlplane"
+	"migration-to-zero-trust/agent/internal/wireguard"
+	"migration-to-zero-trust/internal/configbundle"
+)
+
+// newControlPlaneClient creates the control plane client. Over HTTPS it
+// presents the device's mTLS client certificate once one is issued.
+func newControlPlaneClient(boot config.Bootstrap) (*controlplane.Client, error) {
+	cp := controlplane.New(boot.ControlPlaneURL)
+	if strings.HasPrefix(boot.ControlPlaneURL, "https://") {
+		certPath, keyPath := config.CertPathsForInterface(boot.InterfaceName)
+		if err := cp.EnableMTLS(certPath, keyPath, boot.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return cp, nil
+}
+
+// newConfigVerifier pins the config signing key: --config-key, else the key
+// stored on first use, else the controlplane's current key, which is stored
+// and pinned from then on.
+func newConfigVerifier(ctx context.Context, out io.Writer, cp *controlplane.Client, boot config.Bootstrap) (*configbundle.Verifier, error) {
+	key := boot.SigningKey
+	if key == "" {
+		path := config.SigningKeyPathForInterface(boot.InterfaceName)
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			key = strings.TrimSpace(string(data))
+		case errors.Is(err, os.ErrNotExist):
+			if key, err = cp.FetchSigningKey(ctx); err != nil {
+				return nil, fmt.Errorf("fetch config signing key: %w", err)
+			}
+			if err := os.MkdirAll(config.DefaultDir, 0o700); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(out, "pinned config signing key %s\n", key)
+		default:
+			return nil, err
+		}
+	}
+	return configbundle.NewVerifier(key, config.ConfigVersionPathForInterface(boot.InterfaceName))
+}
+
+// loginDevice logs in with the device key in keyPath and returns the session
+// and the key. If the control plane took the key of an unfinished rotation
+// instead, that key replaces the device key. On first use the key is
+// registered as a new device, and the call blocks until an admin approves it.
+func loginDevice(ctx context.Context, out io.Writer, cp *controlplane.Client, boot config.Bootstrap, keyPath string, privKey wgtypes.Key) (controlplane.Session, wgtypes.Key, error) {
+	pubKey := privKey.PublicKey().String()
+	registered, announced := false, false
+	for {
+		session, err := cp.Login(ctx, boot.Username, boot.Password, pubKey)
+		switch {
+		case err == nil:
+			return session, privKey, nil
+		case errors.Is(err, controlplane.ErrDeviceNotRegistered) && !registered:
+			session, nextKey, ok, err := loginNextKey(ctx, cp, boot, keyPath)
+			if err != nil {
+				return controlplane.Session{}, wgtypes.Key{}, err
+			}
+			if ok {
+				fmt.Fprintf(out, "switched to rotated device key %s\n", nextKey.PublicKey())
+				return session, nextKey, nil
+			}
+			name, _ := os.Hostname()
+			if _, err := cp.RegisterDevice(ctx, boot.Username, boot.Password, name, privKey[:]); err != nil {
+				return controlplane.Session{}, wgtypes.Key{}, fmt.Errorf("register device: %w", err)
+			}
+			registered = true
+			continue
+		case errors.Is(err, controlplane.ErrDevicePending):
+			if !announced {
+				fmt.Fprintf(out, "device %s is waiting for admin approval\n", pubKey)
+				announced = true
+			}
+		default:
+			return controlplane.Session{}, wgtypes.Key{}, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return controlplane.Session{}, wgtypes.Key{}, ctx.Err()
+		case <-time.After(controlplane.DefaultPollInterval):
+		}
+	}
+}
+
+// nextKeyPath is where `agent rotate-key` keeps the new key until the control
+// plane has taken it.
+func nextKeyPath(keyPath string) string {
+	return keyPath + ".next"
+}
+
+// loginNextKey logs in with the key of a rotation whose outcome was not
+// seen. If the control plane took it, it replaces the key in keyPath and ok
+// is set; if not, it is removed.
+func loginNextKey(ctx context.Context, cp *controlplane.Client, boot config.Bootstrap, keyPath string) (session controlplane.Session, key wgtypes.Key, ok bool, err error) {
+	nextPath := nextKeyPath(keyPath)
+	key, pubKey, err := wireguard.LoadKeyPair(nextPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return controlplane.Session{}, wgtypes.Key{}, false, nil
+	}
+	if err != nil {
+		return controlplane.Session{}, wgtypes.Key{}, false, err
+	}
+	session, err = cp.Login(ctx, boot.Username, boot.Password, pubKey.String())
+	if errors.Is(err, controlplane.ErrDeviceNotRegistered) {
+		_ = os.Remove(nextPath)
+		return controlplane.Session{}, wgtypes.Key{}, false, nil
+	}
+	if err != nil {
+		return controlplane.Session{}, wgtypes.Key{}, false, err
+	}
+	if err := os.Rename(nextPath, keyPath); err != nil {
+		return controlplane.Session{}, wgtypes.Key{}, false, fmt.Errorf("replace key: %w", err)
+	}
+	return session, key, true, nil
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"migration-to-zero-trust/agent/internal/connection"
+	"migration-to-zero-trust/agent/internal/wireguard"
+	"migration-to-zero-trust/internal/metrics"
+)
+
+// registerMetrics exposes the handshake age and traffic of every enforcer
+// peer, read from the interface at scrape time. Peers are labelled with the
+// enforcer ID from the last applied config.
+func registerMetrics(ifaceName, connPath string) {
+	peers := func(emit func(wireguard.PeerStats, string)) {
+		state, err := connection.Load(connPath)
+		if err != nil {
+			return
+		}
+		enforcers := make(map[string]string, len(state.Config.Enforcers)) // public key -> enforcer ID
+		for _, enf := range state.Config.Enforcers {
+			enforcers[enf.EnforcerPublicKey] = enf.EnforcerID
+		}
+		stats, err := wireguard.ReadPeerStats(ifaceName)
+		if err != nil {
+			return
+		}
+		for _, s := range stats {
+			if id, ok := enforcers[s.PublicKey]; ok {
+				emit(s, id)
+			}
+		}
+	}
+
+	metrics.NewCollector("agent_wireguard_handshake_age_seconds", "Seconds since the last handshake with each enforcer. Peers without a handshake are left out.", metrics.TypeGauge, func(emit metrics.Emit) {
+		now := time.Now()
+		peers(func(s wireguard.PeerStats, id string) {
+			if !s.LastHandshake.IsZero() {
+				emit(now.Sub(s.LastHandshake).Seconds(), id)
+			}
+		})
+	}, "enforcer")
+	metrics.NewCollector("agent_wireguard_received_bytes_total", "Bytes received from each enforcer.", metrics.TypeCounter, func(emit metrics.Emit) {
+		peers(func(s wireguard.PeerStats, id string) { emit(float64(s.ReceiveBytes), id) })
+	}, "enforcer")
+	metrics.NewCollector("agent_wireguard_transmitted_bytes_total", "Bytes sent to each enforcer.", metrics.TypeCounter, func(emit metrics.Emit) {
+		peers(func(s wireguard.PeerStats, id string) { emit(float64(s.TransmitBytes), id) })
+	}, "enforcer")
+}
+
+// listenMetrics binds the Prometheus endpoint to addr, so that a bad address
+// fails `agent up` before the tunnel comes up.
+func listenMetrics(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics listen: %w", err)
+	}
+	return ln, nil
+}
+
+// serveMetrics serves the Prometheus endpoint on ln until ctx is done.
+func serveMetrics(ctx context.Context, ln net.Listener, errOut io.Writer) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(errOut, "warning: metrics server: %v\n", err)
+	}
+}
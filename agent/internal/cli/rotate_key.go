@@ -0,0 +1,115 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+
+	"migration-to-zero-trust/agent/internal/config"
+	"migration-to-zero-trust/agent/internal/controlplane"
+	"migration-to-zero-trust/agent/internal/wireguard"
+)
+
+type rotateKeyOptions struct {
+	ControlPlaneURL string
+	Username        string
+	Password        string
+	InterfaceName   string
+	CAFile          string
+}
+
+func NewRotateKeyCommand() *cobra.Command {
+	opts := &rotateKeyOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Generate a new WireGuard key and register it for this device",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			boot, err := config.Load(config.Input{
+				ControlPlaneURL: opts.ControlPlaneURL,
+				Username:        opts.Username,
+				Password:        opts.Password,
+				InterfaceName:   opts.InterfaceName,
+				CAFile:          opts.CAFile,
+			})
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			keyPath := config.KeyPathForInterface(boot.InterfaceName)
+			_, oldPub, err := wireguard.LoadKeyPair(keyPath)
+			if err != nil {
+				return fmt.Errorf("load current key (run `agent up` first): %w", err)
+			}
+
+			cp, err := newControlPlaneClient(boot)
+			if err != nil {
+				return err
+			}
+			session, err := cp.Login(ctx, boot.Username, boot.Password, oldPub.String())
+			if errors.Is(err, controlplane.ErrDeviceNotRegistered) {
+				// An earlier rotation may have gone through unseen
+				var ok bool
+				session, _, ok, err = loginNextKey(ctx, cp, boot, keyPath)
+				if err == nil && !ok {
+					err = controlplane.ErrDeviceNotRegistered
+				}
+			}
+			if err != nil {
+				return err
+			}
+
+			newKey, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return fmt.Errorf("generate key: %w", err)
+			}
+			// Keep the new key on disk before the control plane switches to it,
+			// so it is not lost if this process dies halfway or the response
+			// is lost. `agent up` logs in with it if the current key is gone.
+			nextPath := nextKeyPath(keyPath)
+			if err := wireguard.SaveKey(nextPath, newKey); err != nil {
+				return err
+			}
+			if _, err := cp.RotateKey(ctx, session.Token, newKey[:]); err != nil {
+				if errors.Is(err, controlplane.ErrKeyRejected) {
+					_ = os.Remove(nextPath)
+					return err
+				}
+				return fmt.Errorf("%w (the new key is kept in %s and used by `agent up` if the control plane took it)", err, nextPath)
+			}
+			if err := os.Rename(nextPath, keyPath); err != nil {
+				return fmt.Errorf("replace key: %w", err)
+			}
+
+			// A running `agent up` picks the new key up from disk; switch the live
+			// interface now so the tunnel re-handshakes as soon as enforcers
+			// have the new peer key.
+			if err := wireguard.SetPrivateKey(boot.InterfaceName, newKey); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "warning: failed to update interface key: %v\n", err)
+			}
+
+			fmt.Fprintln(cmd.OutOrStdout(), newKey.PublicKey().String())
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.ControlPlaneURL, "cp-url", "", "control plane base URL")
+	cmd.Flags().StringVar(&opts.Username, "username", "", "client username")
+	cmd.Flags().StringVar(&opts.Password, "password", "", "client password")
+	cmd.Flags().StringVar(&opts.InterfaceName, "iface", "", "wireguard interface name")
+	cmd.Flags().StringVar(&opts.CAFile, "ca-file", "", "CA certificate that signed the control plane's TLS certificate")
+	cmd.MarkFlagRequired("cp-url")
+	cmd.MarkFlagRequired("username")
+	cmd.MarkFlagRequired("password")
+
+	return cmd
+}
@@ -7,15 +7,15 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 
 	"migration-to-zero-trust/agent/internal/config"
 	"migration-to-zero-trust/agent/internal/connection"
 	"migration-to-zero-trust/agent/internal/controlplane"
+	"migration-to-zero-trust/agent/internal/posture"
 	"migration-to-zero-trust/agent/internal/wireguard"
-
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type upOptions struct {
@@ -23,6 +23,9 @@ type upOptions struct {
 	Username        string
 	Password        string
 	InterfaceName   string
+	CAFile          string
+	SigningKey      string
+	MetricsAddr     string
 }
 
 func NewUpCommand() *cobra.Command {
@@ -37,6 +40,8 @@ func NewUpCommand() *cobra.Command {
 				Username:        opts.Username,
 				Password:        opts.Password,
 				InterfaceName:   opts.InterfaceName,
+				CAFile:          opts.CAFile,
+				SigningKey:      opts.SigningKey,
 			})
 			if err != nil {
 				return err
@@ -45,22 +50,52 @@ func NewUpCommand() *cobra.Command {
 			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer stop()
 
-			cp := controlplane.New(boot.ControlPlaneURL)
-			session, err := cp.Login(ctx, boot.Username, boot.Password)
+			keyPath := config.KeyPathForInterface(boot.InterfaceName)
+			privKey, _, err := wireguard.LoadOrGenerateKeyPair(keyPath)
 			if err != nil {
 				return err
 			}
 
-			privKey, _, err := wireguard.LoadOrGenerateKeyPair(config.KeyPathForInterface(boot.InterfaceName))
+			cp, err := newControlPlaneClient(boot)
+			if err != nil {
+				return err
+			}
+			cp.Verifier, err = newConfigVerifier(ctx, cmd.OutOrStdout(), cp, boot)
+			if err != nil {
+				return err
+			}
+			session, privKey, err := loginDevice(ctx, cmd.OutOrStdout(), cp, boot, keyPath, privKey)
 			if err != nil {
 				return err
 			}
 
+			if cp.CertificateNeedsRenewal(time.Now()) {
+				if err := cp.RenewCertificate(ctx, session.Token); err != nil {
+					fmt.Fprintf(cmd.ErrOrStderr(), "warning: device certificate request failed: %v\n", err)
+				}
+			}
+
 			connPath := connection.PathForInterface(boot.InterfaceName)
-			applyFn := makeApplyFunc(boot.ControlPlaneURL, boot.InterfaceName, privKey, connPath)
+			applyFn := makeApplyFunc(boot.ControlPlaneURL, boot.InterfaceName, keyPath, connPath)
+
+			if opts.MetricsAddr != "" {
+				ln, err := listenMetrics(opts.MetricsAddr)
+				if err != nil {
+					return err
+				}
+				registerMetrics(boot.InterfaceName, connPath)
+				go serveMetrics(ctx, ln, cmd.ErrOrStderr())
+			}
+
+			// Report posture first so posture-gated resources are included.
+			// A failed report only leaves them out until the poller reports
+			// posture again before its next fetch.
+			if err := cp.ReportPosture(ctx, session.Token, posture.Collect()); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "warning: posture report failed, retrying on next poll: %v\n", err)
+			}
 
 			// Initial apply
-			cfg, err := cp.FetchConfig(ctx, session.Token)
+			cfg, _, err := cp.FetchConfig(ctx, session.Token, privKey.PublicKey().String(), 0, 0)
 			if err != nil {
 				return err
 			}
@@ -68,13 +103,18 @@ func NewUpCommand() *cobra.Command {
 				_ = wireguard.Down(boot.InterfaceName)
 				return err
 			}
+			if err := cp.ConfigApplied(cfg); err != nil {
+				fmt.Fprintf(cmd.ErrOrStderr(), "warning: failed to record config version: %v\n", err)
+			}
 
 			poller := &controlplane.Poller{
-				Client:   cp,
-				Username: boot.Username,
-				Password: boot.Password,
-				Interval: controlplane.DefaultPollInterval,
-				OnChange: applyFn,
+				Client:    cp,
+				Username:  boot.Username,
+				Password:  boot.Password,
+				PublicKey: currentPublicKey(keyPath),
+				Interval:  controlplane.DefaultPollInterval,
+				OnChange:  applyFn,
+				Posture:   posture.Collect,
 			}
 
 			fmt.Fprintln(cmd.OutOrStdout(), "client is running; press Ctrl+C to stop")
@@ -94,6 +134,9 @@ func NewUpCommand() *cobra.Command {
 	cmd.Flags().StringVar(&opts.Username, "username", "", "client username")
 	cmd.Flags().StringVar(&opts.Password, "password", "", "client password")
 	cmd.Flags().StringVar(&opts.InterfaceName, "iface", "", "wireguard interface name")
+	cmd.Flags().StringVar(&opts.CAFile, "ca-file", "", "CA certificate that signed the control plane's TLS certificate")
+	cmd.Flags().StringVar(&opts.SigningKey, "config-key", "", "control plane config signing public key to pin (base64)")
+	cmd.Flags().StringVar(&opts.MetricsAddr, "metrics-addr", "", "local address to serve Prometheus metrics on, such as 127.0.0.1:9102 (off if empty)")
 	cmd.MarkFlagRequired("cp-url")
 	cmd.MarkFlagRequired("username")
 	cmd.MarkFlagRequired("password")
@@ -101,11 +144,27 @@ func NewUpCommand() *cobra.Command {
 	return cmd
 }
 
-func makeApplyFunc(cpURL, ifaceName string, privKey wgtypes.Key, connPath string) func(controlplane.ClientConfig) error {
+// currentPublicKey reads the device key on every call so that a key swapped
+// by `agent rotate-key` is picked up without restarting.
+func currentPublicKey(keyPath string) func() string {
+	return func() string {
+		_, pubKey, err := wireguard.LoadKeyPair(keyPath)
+		if err != nil {
+			return ""
+		}
+		return pubKey.String()
+	}
+}
+
+func makeApplyFunc(cpURL, ifaceName, keyPath, connPath string) func(controlplane.ClientConfig) error {
 	return func(cfg controlplane.ClientConfig) error {
 		if len(cfg.Enforcers) == 0 {
 			return errors.New("no enforcers in client config")
 		}
+		privKey, _, err := wireguard.LoadKeyPair(keyPath)
+		if err != nil {
+			return err
+		}
 
 		var enforcers []wireguard.EnforcerPeer
 		for _, enf := range cfg.Enforcers {
@@ -17,11 +17,38 @@ func KeyPathForInterface(ifaceName string) string {
 	return DefaultDir + "/" + ifaceName + ".key"
 }
 
+// CertPathsForInterface returns where the device's mTLS client certificate
+// and its private key are kept.
+func CertPathsForInterface(ifaceName string) (certPath, keyPath string) {
+	if ifaceName == "" {
+		ifaceName = DefaultInterfaceName
+	}
+	return DefaultDir + "/" + ifaceName + ".crt", DefaultDir + "/" + ifaceName + ".tls.key"
+}
+
+// SigningKeyPathForInterface returns where the pinned config signing key is
+// kept, and ConfigVersionPathForInterface the last applied config version.
+func SigningKeyPathForInterface(ifaceName string) string {
+	if ifaceName == "" {
+		ifaceName = DefaultInterfaceName
+	}
+	return DefaultDir + "/" + ifaceName + ".config-signing.pub"
+}
+
+func ConfigVersionPathForInterface(ifaceName string) string {
+	if ifaceName == "" {
+		ifaceName = DefaultInterfaceName
+	}
+	return DefaultDir + "/" + ifaceName + ".config-version"
+}
+
 type Input struct {
 	ControlPlaneURL string
 	Username        string
 	Password        string
 	InterfaceName   string
+	CAFile          string
+	SigningKey      string
 }
 
 type Bootstrap struct {
@@ -29,6 +56,8 @@ type Bootstrap struct {
 	Username        string
 	Password        string
 	InterfaceName   string
+	CAFile          string // pins the CA of the controlplane's TLS certificate
+	SigningKey      string // pins the key that signs config bundles
 }
 
 func Load(input Input) (Bootstrap, error) {
@@ -49,5 +78,7 @@ func Load(input Input) (Bootstrap, error) {
 		Username:        user,
 		Password:        pass,
 		InterfaceName:   iface,
+		CAFile:          strings.TrimSpace(input.CAFile),
+		SigningKey:      strings.TrimSpace(input.SigningKey),
 	}, nil
 }
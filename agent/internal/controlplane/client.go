@@ -2,23 +2,46 @@ package controlplane
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+
+	"migration-to-zero-trust/internal/configbundle"
 )
 
 const (
-	pathLogin  = "/api/client/login"
-	pathConfig = "/api/client/config"
+	pathLogin   = "/api/client/login"
+	pathConfig  = "/api/client/config"
+	pathPosture = "/api/client/posture"
 )
 
-var ErrUnauthorized = errors.New("unauthorized")
+var (
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrDeviceNotRegistered = errors.New("device key is not registered")
+	ErrDevicePending       = errors.New("device is pending admin approval")
+	// ErrKeyRejected means the control plane did not take a new device key.
+	// Other RotateKey errors leave open whether it did.
+	ErrKeyRejected = errors.New("new device key rejected")
+)
 
 type Client struct {
 	resty *resty.Client
+
+	// Verifier checks every fetched config bundle.
+	Verifier *configbundle.Verifier
+
+	// mTLS client certificate, see EnableMTLS
+	certPath string
+	keyPath  string
+	cert     atomic.Pointer[tls.Certificate]
 }
 
 type Session struct {
@@ -28,8 +51,12 @@ type Session struct {
 // ClientConfig contains configurations for all enforcers the client needs to connect to.
 type ClientConfig struct {
 	ClientID    string                 `json:"client_id"`
+	DeviceID    string                 `json:"device_id"`
 	WGPublicKey string                 `json:"wg_public_key"`
 	Enforcers   []ClientEnforcerConfig `json:"enforcers"`
+
+	// Version of the signed bundle the config came from
+	Version uint64 `json:"version,omitempty"`
 }
 
 // ClientEnforcerConfig contains the configuration for connecting to a single enforcer.
@@ -41,9 +68,21 @@ type ClientEnforcerConfig struct {
 	AllowedCIDRs      []string `json:"allowed_cidrs"`
 }
 
+// PostureReport contains the device posture facts sent to the control plane.
+type PostureReport struct {
+	OS                string `json:"os"`
+	OSVersion         string `json:"os_version"`
+	KernelVersion     string `json:"kernel_version"`
+	AgentVersion      string `json:"agent_version"`
+	DiskEncrypted     bool   `json:"disk_encrypted"`
+	FirewallEnabled   bool   `json:"firewall_enabled"`
+	ScreenLockEnabled bool   `json:"screen_lock_enabled"`
+}
+
 type loginRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	WGPublicKey string `json:"wg_public_key"`
 }
 
 type loginResponse struct {
@@ -53,22 +92,28 @@ type loginResponse struct {
 func New(baseURL string) *Client {
 	client := resty.New().
 		SetBaseURL(strings.TrimRight(baseURL, "/")).
-		SetTimeout(10 * time.Second)
+		SetTimeout(DefaultPollInterval + 10*time.Second)
 	return &Client{resty: client}
 }
 
-func (c *Client) Login(ctx context.Context, username, password string) (Session, error) {
+// Login authenticates the user on behalf of the device holding wgPublicKey.
+func (c *Client) Login(ctx context.Context, username, password, wgPublicKey string) (Session, error) {
 	var result loginResponse
 	resp, err := c.resty.R().
 		SetContext(ctx).
-		SetBody(&loginRequest{Username: username, Password: password}).
+		SetBody(&loginRequest{Username: username, Password: password, WGPublicKey: wgPublicKey}).
 		SetResult(&result).
 		Post(pathLogin)
 	if err != nil {
 		return Session{}, err
 	}
-	if resp.StatusCode() == http.StatusUnauthorized {
+	switch resp.StatusCode() {
+	case http.StatusUnauthorized:
 		return Session{}, ErrUnauthorized
+	case http.StatusNotFound:
+		return Session{}, ErrDeviceNotRegistered
+	case http.StatusForbidden:
+		return Session{}, ErrDevicePending
 	}
 	if resp.IsError() {
 		return Session{}, errors.New(resp.String())
@@ -76,21 +121,73 @@ func (c *Client) Login(ctx context.Context, username, password string) (Session,
 	return Session{Token: result.Token}, nil
 }
 
-func (c *Client) FetchConfig(ctx context.Context, token string) (ClientConfig, error) {
+// FetchConfig fetches the signed config bundle and returns its config after
+// checking the signature, expiry and version, and that the bundle is for the
+// device holding wgPublicKey. If applied is set, it waits up to wait for a
+// config newer than that version and reports false if there is none.
+func (c *Client) FetchConfig(ctx context.Context, token, wgPublicKey string, applied uint64, wait time.Duration) (ClientConfig, bool, error) {
+	if c.Verifier == nil {
+		return ClientConfig{}, false, errors.New("no config verifier")
+	}
+	req := c.resty.R().
+		SetContext(ctx).
+		SetAuthToken(token)
+	if applied > 0 {
+		req.SetHeader("If-None-Match", strconv.Quote(strconv.FormatUint(applied, 10)))
+		if wait > 0 {
+			req.SetQueryParam("wait", strconv.Itoa(int(wait/time.Second)))
+		}
+	}
+	var signed configbundle.Signed
+	resp, err := req.SetResult(&signed).Get(pathConfig)
+	if err != nil {
+		return ClientConfig{}, false, err
+	}
+	if resp.StatusCode() == http.StatusNotModified {
+		return ClientConfig{}, false, nil
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return ClientConfig{}, false, ErrUnauthorized
+	}
+	if resp.IsError() {
+		return ClientConfig{}, false, errors.New(resp.String())
+	}
+
+	bundle, err := c.Verifier.Verify(signed, time.Now())
+	if err != nil {
+		return ClientConfig{}, false, err
+	}
 	var cfg ClientConfig
+	if err := json.Unmarshal(bundle.Config, &cfg); err != nil {
+		return ClientConfig{}, false, fmt.Errorf("%w: %v", configbundle.ErrRejected, err)
+	}
+	if bundle.Target != "device:"+cfg.DeviceID || cfg.WGPublicKey != wgPublicKey {
+		return ClientConfig{}, false, fmt.Errorf("%w: bundle is for another device", configbundle.ErrRejected)
+	}
+	cfg.Version = bundle.Version
+	return cfg, true, nil
+}
+
+// ConfigApplied records that cfg has been applied, so older bundles are
+// refused from now on.
+func (c *Client) ConfigApplied(cfg ClientConfig) error {
+	return c.Verifier.Applied(cfg.Version)
+}
+
+func (c *Client) ReportPosture(ctx context.Context, token string, report PostureReport) error {
 	resp, err := c.resty.R().
 		SetContext(ctx).
 		SetAuthToken(token).
-		SetResult(&cfg).
-		Get(pathConfig)
+		SetBody(&report).
+		Put(pathPosture)
 	if err != nil {
-		return ClientConfig{}, err
+		return err
 	}
 	if resp.StatusCode() == http.StatusUnauthorized {
-		return ClientConfig{}, ErrUnauthorized
+		return ErrUnauthorized
 	}
 	if resp.IsError() {
-		return ClientConfig{}, errors.New(resp.String())
+		return errors.New(resp.String())
 	}
-	return cfg, nil
+	return nil
 }
@@ -0,0 +1,191 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	pathDeviceChallenge    = "/api/client/devices/challenge"
+	pathDevices            = "/api/client/devices"
+	pathDeviceKeyChallenge = "/api/client/device/challenge"
+	pathDeviceKey          = "/api/client/device/public-key"
+)
+
+// DeviceChallenge is issued by the control plane to verify that the agent
+// holds the private key of the public key it registers.
+type DeviceChallenge struct {
+	ChallengeID     string `json:"challenge_id"`
+	ServerPublicKey string `json:"server_public_key"`
+	Nonce           string `json:"nonce"`
+}
+
+// Device is the control plane's view of a registered device.
+type Device struct {
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"`
+}
+
+type challengeRequest struct {
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	WGPublicKey string `json:"wg_public_key"`
+}
+
+type registerDeviceRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Name        string `json:"name,omitempty"`
+	WGPublicKey string `json:"wg_public_key"`
+	ChallengeID string `json:"challenge_id"`
+	Proof       string `json:"proof"`
+}
+
+type rotateKeyRequest struct {
+	WGPublicKey string `json:"wg_public_key"`
+	ChallengeID string `json:"challenge_id"`
+	Proof       string `json:"proof"`
+}
+
+// Prove answers the challenge with HMAC-SHA256 over nonce and public key,
+// keyed by the X25519 secret shared between privateKey and the server key.
+func (c DeviceChallenge) Prove(privateKey []byte) (string, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("private key: %w", err)
+	}
+	serverKeyBytes, err := base64.StdEncoding.DecodeString(c.ServerPublicKey)
+	if err != nil {
+		return "", fmt.Errorf("server public key: %w", err)
+	}
+	serverKey, err := ecdh.X25519().NewPublicKey(serverKeyBytes)
+	if err != nil {
+		return "", fmt.Errorf("server public key: %w", err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(c.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("nonce: %w", err)
+	}
+	secret, err := priv.ECDH(serverKey)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	mac.Write(priv.PublicKey().Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// RegisterDevice registers the key as a new device of the user. The device
+// stays pending until an admin approves it.
+func (c *Client) RegisterDevice(ctx context.Context, username, password, name string, privateKey []byte) (Device, error) {
+	wgPublicKey, challenge, proof, err := c.prove(ctx, privateKey, func(req *resty.Request, body *challengeRequest) string {
+		body.Username, body.Password = username, password
+		return pathDeviceChallenge
+	})
+	if err != nil {
+		return Device{}, err
+	}
+	var result Device
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetBody(&registerDeviceRequest{
+			Username:    username,
+			Password:    password,
+			Name:        name,
+			WGPublicKey: wgPublicKey,
+			ChallengeID: challenge.ChallengeID,
+			Proof:       proof,
+		}).
+		SetResult(&result).
+		Post(pathDevices)
+	if err != nil {
+		return Device{}, err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return Device{}, ErrUnauthorized
+	}
+	if resp.IsError() {
+		return Device{}, errors.New(resp.String())
+	}
+	return result, nil
+}
+
+// RotateKey replaces the key of the device the session belongs to with the
+// public key of newPrivateKey. It returns an error wrapping ErrKeyRejected if
+// the key was certainly not taken.
+func (c *Client) RotateKey(ctx context.Context, token string, newPrivateKey []byte) (Device, error) {
+	wgPublicKey, challenge, proof, err := c.prove(ctx, newPrivateKey, func(req *resty.Request, _ *challengeRequest) string {
+		req.SetAuthToken(token)
+		return pathDeviceKeyChallenge
+	})
+	if err != nil {
+		return Device{}, fmt.Errorf("%w: %w", ErrKeyRejected, err)
+	}
+	var result Device
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetAuthToken(token).
+		SetBody(&rotateKeyRequest{
+			WGPublicKey: wgPublicKey,
+			ChallengeID: challenge.ChallengeID,
+			Proof:       proof,
+		}).
+		SetResult(&result).
+		Put(pathDeviceKey)
+	if err != nil {
+		return Device{}, err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return Device{}, fmt.Errorf("%w: %w", ErrKeyRejected, ErrUnauthorized)
+	}
+	if resp.StatusCode() >= 400 && resp.StatusCode() < 500 {
+		return Device{}, fmt.Errorf("%w: %s", ErrKeyRejected, resp.String())
+	}
+	if resp.IsError() {
+		return Device{}, errors.New(resp.String())
+	}
+	return result, nil
+}
+
+// prove fetches a challenge for the public key of privateKey and answers it.
+// authenticate adds the client's credentials or session to the challenge
+// request and returns the path to send it to.
+func (c *Client) prove(ctx context.Context, privateKey []byte, authenticate func(*resty.Request, *challengeRequest) string) (string, DeviceChallenge, string, error) {
+	priv, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return "", DeviceChallenge{}, "", fmt.Errorf("private key: %w", err)
+	}
+	wgPublicKey := base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes())
+
+	var challenge DeviceChallenge
+	req := c.resty.R().SetContext(ctx)
+	body := challengeRequest{WGPublicKey: wgPublicKey}
+	path := authenticate(req, &body)
+	resp, err := req.
+		SetBody(&body).
+		SetResult(&challenge).
+		Post(path)
+	if err != nil {
+		return "", DeviceChallenge{}, "", err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return "", DeviceChallenge{}, "", ErrUnauthorized
+	}
+	if resp.IsError() {
+		return "", DeviceChallenge{}, "", errors.New(resp.String())
+	}
+	proof, err := challenge.Prove(privateKey)
+	if err != nil {
+		return "", DeviceChallenge{}, "", err
+	}
+	return wgPublicKey, challenge, proof, nil
+}
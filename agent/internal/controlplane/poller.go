@@ -3,18 +3,26 @@ package controlplane
 import (
 	"context"
 	"log"
-	"reflect"
 	"time"
 )
 
+// DefaultPollInterval is how long a config request waits for a change, and
+// the delay before retrying after a failure.
 const DefaultPollInterval = 15 * time.Second
 
+// Poller long-polls the control plane for configs newer than the applied
+// one. Posture is reported before each request, so it is at most one
+// interval old.
 type Poller struct {
-	Client   *Client
-	Username string
-	Password string
-	Interval time.Duration
-	OnChange func(cfg ClientConfig) error
+	Client    *Client
+	Username  string
+	Password  string
+	PublicKey func() string // current device WireGuard public key used to log in
+	Interval  time.Duration
+	OnChange  func(cfg ClientConfig) error
+	// Posture, if set, is collected and reported before every config fetch
+	// so posture-gated resources track the device's current state.
+	Posture func() PostureReport
 }
 
 func (p *Poller) Run(ctx context.Context) error {
@@ -24,7 +32,6 @@ func (p *Poller) Run(ctx context.Context) error {
 	}
 
 	var token string
-	var lastCfg *ClientConfig
 
 	for {
 		select {
@@ -34,7 +41,7 @@ func (p *Poller) Run(ctx context.Context) error {
 		}
 
 		if token == "" {
-			session, err := p.Client.Login(ctx, p.Username, p.Password)
+			session, err := p.Client.Login(ctx, p.Username, p.Password, p.PublicKey())
 			if err != nil {
 				log.Printf("login failed: %v", err)
 				wait(ctx, interval)
@@ -43,8 +50,30 @@ func (p *Poller) Run(ctx context.Context) error {
 			token = session.Token
 		}
 
-		cfg, err := p.Client.FetchConfig(ctx, token)
+		if p.Client.CertificateNeedsRenewal(time.Now()) {
+			if err := p.Client.RenewCertificate(ctx, token); err != nil {
+				log.Printf("renew certificate failed: %v", err)
+			}
+		}
+
+		if p.Posture != nil {
+			if err := p.Client.ReportPosture(ctx, token, p.Posture()); err != nil {
+				if err == ErrUnauthorized {
+					token = ""
+					wait(ctx, interval)
+					continue
+				}
+				log.Printf("report posture failed: %v", err)
+			}
+		}
+
+		// A config that failed to apply is not recorded, so it is
+		// fetched again and retried after the interval
+		cfg, modified, err := p.Client.FetchConfig(ctx, token, p.PublicKey(), p.Client.Verifier.AppliedVersion(), interval)
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			if err == ErrUnauthorized {
 				token = ""
 				wait(ctx, interval)
@@ -54,18 +83,18 @@ func (p *Poller) Run(ctx context.Context) error {
 			wait(ctx, interval)
 			continue
 		}
-
-		if lastCfg == nil || !reflect.DeepEqual(*lastCfg, cfg) {
-			if p.OnChange != nil {
-				if err := p.OnChange(cfg); err != nil {
-					log.Printf("apply failed: %v", err)
-				} else {
-					lastCfg = &cfg
-				}
-			}
+		if !modified || p.OnChange == nil {
+			continue
+		}
+		if err := p.OnChange(cfg); err != nil {
+			log.Printf("apply failed: %v", err)
+			wait(ctx, interval)
+			continue
+		}
+		if err := p.Client.ConfigApplied(cfg); err != nil {
+			log.Printf("record config version failed: %v", err)
+			wait(ctx, interval)
 		}
-
-		wait(ctx, interval)
 	}
 }
 
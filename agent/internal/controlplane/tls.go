@@ -0,0 +1,129 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const pathCertificate = "/api/client/device/certificate"
+
+type certificateRequest struct {
+	CSR string `json:"csr"`
+}
+
+type issuedCertificate struct {
+	Certificate string    `json:"certificate"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// EnableMTLS presents the device client certificate stored at certPath and
+// keyPath. caFile, if set, replaces the system roots for verifying the
+// controlplane.
+func (c *Client) EnableMTLS(certPath, keyPath, caFile string) error {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := c.cert.Load(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return errors.New("no certificates in CA file")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	c.certPath, c.keyPath = certPath, keyPath
+	c.resty.SetTLSClientConfig(tlsCfg)
+
+	if cert, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		c.cert.Store(&cert)
+	}
+	return nil
+}
+
+// CertificateNeedsRenewal reports whether mTLS is enabled and the device
+// certificate is missing or has less than a third of its lifetime left.
+func (c *Client) CertificateNeedsRenewal(now time.Time) bool {
+	if c.certPath == "" {
+		return false
+	}
+	cert := c.cert.Load()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return now.Add(lifetime / 3).After(cert.Leaf.NotAfter)
+}
+
+// RenewCertificate requests a device certificate for a fresh key and
+// switches to it.
+func (c *Client) RenewCertificate(ctx context.Context, token string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return err
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	var issued issuedCertificate
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetAuthToken(token).
+		SetBody(&certificateRequest{CSR: string(csrPEM)}).
+		SetResult(&issued).
+		Post(pathCertificate)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair([]byte(issued.Certificate), keyPEM)
+	if err != nil {
+		return fmt.Errorf("issued certificate: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.keyPath), 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.keyPath, keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.certPath, []byte(issued.Certificate), 0o600); err != nil {
+		return err
+	}
+
+	c.cert.Store(&cert)
+	c.resty.GetClient().CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,166 @@
+// Package posture collects device posture facts on Linux.
+//
+// Every check is best effort: a fact that cannot be determined is reported
+// as false or empty, which fails any requirement that depends on it.
+package posture
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/google/nftables"
+
+	"migration-to-zero-trust/agent/internal/controlplane"
+	"migration-to-zero-trust/agent/internal/version"
+)
+
+const (
+	osReleasePath     = "/etc/os-release"
+	kernelReleasePath = "/proc/sys/kernel/osrelease"
+	mountsPath        = "/proc/self/mounts"
+	sysBlockDir       = "/sys/class/block"
+)
+
+// Collect gathers the current posture of this device.
+func Collect() controlplane.PostureReport {
+	osID, osVersion := readOSRelease()
+	return controlplane.PostureReport{
+		OS:                osID,
+		OSVersion:         osVersion,
+		KernelVersion:     readKernelVersion(),
+		AgentVersion:      version.Version,
+		DiskEncrypted:     rootDiskEncrypted(),
+		FirewallEnabled:   firewallEnabled(),
+		ScreenLockEnabled: screenLockEnabled(),
+	}
+}
+
+func readOSRelease() (id, versionID string) {
+	f, err := os.Open(osReleasePath)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		value = strings.Trim(value, `"'`)
+		switch key {
+		case "ID":
+			id = value
+		case "VERSION_ID":
+			versionID = value
+		}
+	}
+	return id, versionID
+}
+
+func readKernelVersion() string {
+	data, err := os.ReadFile(kernelReleasePath)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// rootDiskEncrypted reports whether the root filesystem sits on a dm-crypt
+// device, either directly or below other device-mapper layers such as LVM.
+func rootDiskEncrypted() bool {
+	device := rootDevice()
+	if device == "" {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return false
+	}
+	return isCryptDevice(filepath.Base(resolved), 0)
+}
+
+func rootDevice() string {
+	f, err := os.Open(mountsPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[1] == "/" && strings.HasPrefix(fields[0], "/dev/") {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+func isCryptDevice(name string, depth int) bool {
+	if depth > 8 {
+		return false
+	}
+	if uuid, err := os.ReadFile(filepath.Join(sysBlockDir, name, "dm", "uuid")); err == nil {
+		if strings.HasPrefix(string(uuid), "CRYPT-") {
+			return true
+		}
+	}
+	slaves, err := os.ReadDir(filepath.Join(sysBlockDir, name, "slaves"))
+	if err != nil {
+		return false
+	}
+	for _, slave := range slaves {
+		if isCryptDevice(slave.Name(), depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// firewallEnabled reports whether an nftables input hook filters traffic,
+// either with a drop policy or with at least one rule.
+func firewallEnabled() bool {
+	conn := &nftables.Conn{}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return false
+	}
+	for _, c := range chains {
+		if c.Hooknum == nil || *c.Hooknum != *nftables.ChainHookInput {
+			continue
+		}
+		if c.Policy != nil && *c.Policy == nftables.ChainPolicyDrop {
+			return true
+		}
+		rules, err := conn.GetRules(c.Table, c)
+		if err == nil && len(rules) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// screenLockEnabled reads the GNOME screensaver lock setting of the user who
+// invoked the agent through sudo. Other desktops report false.
+func screenLockEnabled() bool {
+	cmd := exec.Command("gsettings", "get", "org.gnome.desktop.screensaver", "lock-enabled")
+	if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+		gid, _ := strconv.Atoi(os.Getenv("SUDO_GID"))
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+		cmd.Env = append(os.Environ(), "DBUS_SESSION_BUS_ADDRESS=unix:path=/run/user/"+strconv.Itoa(uid)+"/bus")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return false
+	}
+	return strings.TrimSpace(string(out)) == "true"
+}
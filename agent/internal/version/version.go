@@ -0,0 +1,5 @@
+package version
+
+// Version is the agent release, set at build time with
+// -ldflags "-X migration-to-zero-trust/agent/internal/version.Version=<version>".
+var Version = "dev"
@@ -201,6 +201,27 @@ func Down(ifaceName string) error {
 	return nil
 }
 
+// SetPrivateKey swaps the private key of a running interface, keeping its
+// peers. It is a no-op if the interface does not exist.
+func SetPrivateKey(ifaceName string, key wgtypes.Key) error {
+	if _, err := netlink.LinkByName(ifaceName); err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("link lookup: %w", err)
+	}
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("wgctrl init: %w", err)
+	}
+	defer client.Close()
+	if err := client.ConfigureDevice(ifaceName, wgtypes.Config{PrivateKey: &key}); err != nil {
+		return fmt.Errorf("configure device: %w", err)
+	}
+	return nil
+}
+
 // ReadState returns the current state of the WireGuard interface.
 func ReadState(ifaceName string) (State, error) {
 	if ifaceName == "" {
@@ -231,3 +252,35 @@ func ReadState(ifaceName string) (State, error) {
 		PeerCount:     len(dev.Peers),
 	}, nil
 }
+
+// PeerStats is the traffic and last handshake of one peer.
+type PeerStats struct {
+	PublicKey     string
+	LastHandshake time.Time // zero if there has been none
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// ReadPeerStats returns the stats of every peer of the interface.
+func ReadPeerStats(ifaceName string) ([]PeerStats, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("wgctrl init: %w", err)
+	}
+	defer client.Close()
+
+	dev, err := client.Device(ifaceName)
+	if err != nil {
+		return nil, fmt.Errorf("wg device: %w", err)
+	}
+	stats := make([]PeerStats, len(dev.Peers))
+	for i, p := range dev.Peers {
+		stats[i] = PeerStats{
+			PublicKey:     p.PublicKey.String(),
+			LastHandshake: p.LastHandshakeTime,
+			ReceiveBytes:  p.ReceiveBytes,
+			TransmitBytes: p.TransmitBytes,
+		}
+	}
+	return stats, nil
+}
@@ -42,3 +42,31 @@ func LoadOrGenerateKeyPair(path string) (wgtypes.Key, wgtypes.Key, error) {
 
 	return key, key.PublicKey(), nil
 }
+
+// LoadKeyPair loads an existing private key from path.
+func LoadKeyPair(path string) (wgtypes.Key, wgtypes.Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return wgtypes.Key{}, wgtypes.Key{}, err
+	}
+	key, err := wgtypes.ParseKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return wgtypes.Key{}, wgtypes.Key{}, fmt.Errorf("parse private key: %w", err)
+	}
+	return key, key.PublicKey(), nil
+}
+
+// SaveKey writes a private key to path, replacing any existing file atomically.
+func SaveKey(path string, key wgtypes.Key) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("mkdir: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(key.String()), 0o600); err != nil {
+		return fmt.Errorf("write key: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace key: %w", err)
+	}
+	return nil
+}
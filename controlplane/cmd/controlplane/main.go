@@ -1,33 +1,53 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi/v5"
 	chimw "github.com/go-chi/chi/v5/middleware"
 	"github.com/joho/godotenv"
 
+	"migration-to-zero-trust/controlplane/internal/alert"
 	apiHandler "migration-to-zero-trust/controlplane/internal/handler/api"
 	uiHandler "migration-to-zero-trust/controlplane/internal/handler/ui"
 	"migration-to-zero-trust/controlplane/internal/infra"
 	appmw "migration-to-zero-trust/controlplane/internal/middleware"
 	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/pki"
 	"migration-to-zero-trust/controlplane/internal/repository"
 	"migration-to-zero-trust/controlplane/internal/service"
+	"migration-to-zero-trust/internal/metrics"
 )
 
 type config struct {
 	basicUser string
 	basicPass string
 	jwtSecret string
+	addr      string
+	pkiDir    string
+	// TLS is served with tlsCertFile/tlsKeyFile if set, otherwise with a
+	// CA-issued certificate for tlsHosts. Without either, plain HTTP.
+	tlsCertFile string
+	tlsKeyFile  string
+	tlsHosts    []string
+	// Enforcer health alerts are logged and, if set, posted here
+	alertWebhookURL string
+	// Days raw logs are kept unless their resource or enforcer says otherwise
+	logRetentionDays int
 }
 
 const (
 	defaultAddr   = ":8080"
 	defaultDBPath = "controlplane.db"
+	defaultPKIDir = "pki"
 )
 
 func main() {
@@ -41,15 +61,44 @@ func main() {
 
 	service.InitJWT(cfg.jwtSecret)
 
+	ca, err := pki.LoadOrCreateCA(cfg.pkiDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.InitPKI(ca)
+
+	signingKey, err := pki.LoadOrCreateSigningKey(cfg.pkiDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.InitConfigSigning(signingKey)
+	log.Printf("config signing public key: %s", service.ConfigSigningPublicKey())
+
 	db, err := infra.OpenDB(defaultDBPath)
 	if err != nil {
 		log.Fatal(err)
 	}
-	if err := db.AutoMigrate(&model.Client{}, &model.Resource{}, &model.Enforcer{}, &model.Pair{}, &model.LogEntry{}); err != nil {
+	if err := db.AutoMigrate(&model.Client{}, &model.Device{}, &model.Resource{}, &model.Enforcer{}, &model.EnrollmentToken{}, &model.TunnelIP{}, &model.Pair{}, &model.LogEntry{}, &model.DevicePosture{}, &model.ConfigVersion{}, &model.EnforcerHeartbeat{}, &model.ApplyAttempt{}, &model.PolicyRevision{}, &model.LogRollup{}, &model.LogSink{}, &model.LogSinkAttempt{}, &model.DiscoveredDestination{}); err != nil {
 		log.Fatal(err)
 	}
 
-	repo := repository.NewGormRepository(db)
+	logDB, err := infra.OpenLogDB(defaultDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	repo := repository.NewGormRepository(db, logDB)
+	if n, err := service.MigrateClientKeys(context.Background(), repo); err != nil {
+		log.Fatalf("migrate client keys: %v", err)
+	} else if n > 0 {
+		log.Printf("migrated %d client keys into devices", n)
+	}
+
+	service.InitAlerts(alert.NewNotifier(cfg.alertWebhookURL))
+	go service.RunHealthMonitor(context.Background(), repo)
+	go service.RunLogIngester(context.Background(), repo)
+	go service.RunLogSinks(context.Background(), repo)
+	service.InitLogRetention(cfg.logRetentionDays)
+	go service.RunLogCompactor(context.Background(), repo)
 
 	ui, err := uiHandler.NewHandler(repo)
 	if err != nil {
@@ -72,23 +121,90 @@ func main() {
 	// Register API routes with Huma
 	api.RegisterRoutes(r)
 
-	// UI routes with basic auth
+	// UI routes and metrics with basic auth
 	r.Group(func(r chi.Router) {
 		r.Use(appmw.BasicAuth(cfg.basicUser, cfg.basicPass))
+		r.Handle("/metrics", metrics.Handler())
 		r.Mount("/", ui.Routes())
 	})
 
-	log.Printf("controlplane listening on %s", defaultAddr)
-	if err := http.ListenAndServe(defaultAddr, r); err != nil {
+	srv := &http.Server{Addr: cfg.addr, Handler: r}
+	tlsCfg, err := serverTLSConfig(cfg, ca)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if tlsCfg == nil {
+		log.Printf("controlplane listening on %s (plain HTTP; mTLS disabled)", cfg.addr)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	srv.TLSConfig = tlsCfg
+	log.Printf("controlplane listening on %s (TLS)", cfg.addr)
+	if err := srv.ListenAndServeTLS("", ""); err != nil {
 		log.Fatal(err)
 	}
 }
 
+// serverTLSConfig requests but does not require client certificates, so
+// agents logging in and enforcers still on API keys can connect.
+func serverTLSConfig(cfg config, ca *pki.CA) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case cfg.tlsCertFile != "" || cfg.tlsKeyFile != "":
+		cert, err = tls.LoadX509KeyPair(cfg.tlsCertFile, cfg.tlsKeyFile)
+	case len(cfg.tlsHosts) > 0:
+		cert, err = ca.ServerCertificate(cfg.tlsHosts)
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tls certificate: %w", err)
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    ca.CertPool(),
+	}, nil
+}
+
 func loadConfig() (config, error) {
 	cfg := config{
 		basicUser: os.Getenv("CONTROLPLANE_BASIC_USER"),
 		basicPass: os.Getenv("CONTROLPLANE_BASIC_PASS"),
 		jwtSecret: os.Getenv("JWT_SECRET"),
+		addr:      os.Getenv("CONTROLPLANE_ADDR"),
+		pkiDir:    os.Getenv("CONTROLPLANE_PKI_DIR"),
+
+		tlsCertFile: os.Getenv("CONTROLPLANE_TLS_CERT_FILE"),
+		tlsKeyFile:  os.Getenv("CONTROLPLANE_TLS_KEY_FILE"),
+
+		alertWebhookURL: os.Getenv("CONTROLPLANE_ALERT_WEBHOOK_URL"),
+
+		logRetentionDays: model.DefaultLogRetentionDays,
+	}
+	if hosts := os.Getenv("CONTROLPLANE_TLS_HOSTS"); hosts != "" {
+		for _, h := range strings.Split(hosts, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				cfg.tlsHosts = append(cfg.tlsHosts, h)
+			}
+		}
+	}
+	if days := os.Getenv("CONTROLPLANE_LOG_RETENTION_DAYS"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return config{}, errors.New("CONTROLPLANE_LOG_RETENTION_DAYS must be a positive number of days")
+		}
+		cfg.logRetentionDays = n
+	}
+	if cfg.addr == "" {
+		cfg.addr = defaultAddr
+	}
+	if cfg.pkiDir == "" {
+		cfg.pkiDir = defaultPKIDir
 	}
 	if cfg.basicUser == "" || cfg.basicPass == "" {
 		return config{}, errors.New("CONTROLPLANE_BASIC_USER and CONTROLPLANE_BASIC_PASS are required")
@@ -96,5 +212,8 @@ func loadConfig() (config, error) {
 	if cfg.jwtSecret == "" {
 		return config{}, errors.New("JWT_SECRET is required")
 	}
+	if (cfg.tlsCertFile == "") != (cfg.tlsKeyFile == "") {
+		return config{}, errors.New("CONTROLPLANE_TLS_CERT_FILE and CONTROLPLANE_TLS_KEY_FILE must be set together")
+	}
 	return cfg, nil
 }
@@ -0,0 +1,65 @@
+// Package alert delivers operational alerts: always to the log and, if
+// configured, as JSON POSTs to a webhook.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type Alert struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`    // e.g. "enforcer_health"
+	Subject string    `json:"subject"` // ID of the affected entity
+	Name    string    `json:"name"`
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+}
+
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// NewNotifier returns a notifier that logs every alert and posts it to
+// webhookURL unless it is empty.
+func NewNotifier(webhookURL string) Notifier {
+	return &notifier{
+		webhookURL: webhookURL,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type notifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+func (n *notifier) Notify(ctx context.Context, a Alert) error {
+	log.Printf("ALERT [%s] %s", a.Kind, a.Message)
+	if n.webhookURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("alert webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook: status %d", resp.StatusCode)
+	}
+	return nil
+}
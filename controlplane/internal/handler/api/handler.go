@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/danielgtaylor/huma/v2"
@@ -26,8 +27,9 @@ func NewHandler(repo repository.Repository) *Handler {
 
 type LoginInput struct {
 	Body struct {
-		Username string `json:"username" required:"true"`
-		Password string `json:"password" required:"true"`
+		Username    string `json:"username" required:"true"`
+		Password    string `json:"password" required:"true"`
+		WGPublicKey string `json:"wg_public_key" required:"true"`
 	}
 }
 
@@ -37,8 +39,63 @@ type LoginOutput struct {
 	}
 }
 
-type ClientConfigOutput struct {
-	Body service.ClientConfig
+type DeviceChallengeInput struct {
+	Body struct {
+		Username    string `json:"username" required:"true"`
+		Password    string `json:"password" required:"true"`
+		WGPublicKey string `json:"wg_public_key" required:"true"`
+	}
+}
+
+type DeviceKeyChallengeInput struct {
+	Body struct {
+		WGPublicKey string `json:"wg_public_key" required:"true"`
+	}
+}
+
+type DeviceChallengeOutput struct {
+	Body service.DeviceChallenge
+}
+
+type RegisterDeviceInput struct {
+	Body struct {
+		Username    string `json:"username" required:"true"`
+		Password    string `json:"password" required:"true"`
+		Name        string `json:"name,omitempty"`
+		WGPublicKey string `json:"wg_public_key" required:"true"`
+		ChallengeID string `json:"challenge_id" required:"true"`
+		Proof       string `json:"proof" required:"true"`
+	}
+}
+
+type RotateDeviceKeyInput struct {
+	Body struct {
+		WGPublicKey string `json:"wg_public_key" required:"true"`
+		ChallengeID string `json:"challenge_id" required:"true"`
+		Proof       string `json:"proof" required:"true"`
+	}
+}
+
+type DeviceOutput struct {
+	Body struct {
+		DeviceID string `json:"device_id"`
+		Status   string `json:"status"`
+	}
+}
+
+type ConfigInput struct {
+	IfNoneMatch string `header:"If-None-Match" doc:"ETag of the config the caller has applied"`
+	Wait        int    `query:"wait" minimum:"0" maximum:"60" doc:"seconds to wait for a change when the config still matches If-None-Match"`
+}
+
+type ConfigOutput struct {
+	Status int
+	ETag   string `header:"ETag"`
+	Body   service.SignedConfig
+}
+
+type ReportPostureInput struct {
+	Body service.PostureReport
 }
 
 type UpdateKeyInput struct {
@@ -54,25 +111,85 @@ type StatusOutput struct {
 }
 
 type LogEntry struct {
-	Timestamp    time.Time `json:"ts" required:"true"`
-	SrcIP        string    `json:"src_ip" required:"true"`
-	SrcPort      int       `json:"src_port"`
-	DstIP        string    `json:"dst_ip" required:"true"`
-	DstPort      int       `json:"dst_port"`
-	Protocol     string    `json:"proto" required:"true"`
-	ClientID     string    `json:"client_id"`
-	ClientName   string    `json:"client_name"`
-	ResourceID   string    `json:"resource_id"`
-	ResourceName string    `json:"resource_name"`
-	Length       int       `json:"length"`
+	ID        string    `json:"id,omitempty" doc:"Stable ID given by the enforcer; an entry resent with the same ID is stored once"`
+	Timestamp time.Time `json:"ts" required:"true"`
+	SrcIP     string    `json:"src_ip" required:"true"`
+	SrcPort   int       `json:"src_port"`
+	DstIP     string    `json:"dst_ip" required:"true"`
+	DstPort   int       `json:"dst_port"`
+	Protocol  string    `json:"proto" required:"true"`
+	// Client, device and resource are derived from the tunnel IP and
+	// destination at ingest; the values sent here are ignored
+	ClientID     string `json:"client_id,omitempty"`
+	ClientName   string `json:"client_name,omitempty"`
+	DeviceID     string `json:"device_id,omitempty"`
+	DeviceName   string `json:"device_name,omitempty"`
+	ResourceID   string `json:"resource_id,omitempty"`
+	ResourceName string `json:"resource_name,omitempty"`
+	Length       int    `json:"length" doc:"Length in bytes of the first packet"`
+	Verdict      string `json:"verdict,omitempty" doc:"Verdict of the enforcer rule that logged the connection: allow, observe, deny or out_of_scope"`
+	// Enforcers that track connections send one entry per connection with
+	// its totals in both directions. Without them the entry counts as the
+	// single packet of Length bytes.
+	Packets    int64 `json:"packets,omitempty" doc:"Packets of the connection in both directions"`
+	Bytes      int64 `json:"bytes,omitempty" doc:"Bytes of the connection in both directions"`
+	DurationMs int64 `json:"duration_ms,omitempty" doc:"How long the connection lasted in milliseconds"`
+}
+
+// LogBatch is a batch of log entries. Seq numbers the batches of one
+// enforcer in the order they are sent.
+type LogBatch struct {
+	Seq     uint64     `json:"seq,omitempty" doc:"Enforcer-scoped batch sequence number"`
+	Entries []LogEntry `json:"entries"`
 }
 
 type IngestLogsInput struct {
-	Body []LogEntry
+	Body LogBatch
+}
+
+type IngestLogsOutput struct {
+	Body LogAck
+}
+
+// LogAck acknowledges a log batch.
+type LogAck struct {
+	Status   string `json:"status"`
+	AckedSeq uint64 `json:"acked_seq" doc:"Highest batch sequence number written for the enforcer"`
+}
+
+type EnrollInput struct {
+	Body struct {
+		Token string `json:"token" required:"true"`
+		CSR   string `json:"csr,omitempty" doc:"PEM certificate request for an mTLS client certificate"`
+	}
+}
+
+type CredentialOutput struct {
+	Body service.EnforcerCredential
+}
+
+type CertificateInput struct {
+	Body struct {
+		CSR string `json:"csr" required:"true" doc:"PEM certificate request"`
+	}
+}
+
+type CertificateOutput struct {
+	Body service.IssuedCertificate
+}
+
+type HeartbeatInput struct {
+	Body service.HeartbeatReport
 }
 
-type EnforcerConfigOutput struct {
-	Body service.EnforcerConfig
+type ApplyResultInput struct {
+	Body service.ApplyReport
+}
+
+type SigningKeyOutput struct {
+	Body struct {
+		PublicKey string `json:"public_key" doc:"base64 Ed25519 key that signs config bundles"`
+	}
 }
 
 // --- Register routes ---
@@ -87,6 +204,30 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 			Path:        "/api/client/login",
 			Summary:     "Client login",
 		}, h.clientLogin)
+		huma.Register(api, huma.Operation{
+			OperationID: "device-challenge",
+			Method:      http.MethodPost,
+			Path:        "/api/client/devices/challenge",
+			Summary:     "Issue a proof-of-possession challenge for a device key to register",
+		}, h.deviceChallenge)
+		huma.Register(api, huma.Operation{
+			OperationID: "register-device",
+			Method:      http.MethodPost,
+			Path:        "/api/client/devices",
+			Summary:     "Register a device key pending admin approval",
+		}, h.registerDevice)
+		huma.Register(api, huma.Operation{
+			OperationID: "enforcer-enroll",
+			Method:      http.MethodPost,
+			Path:        "/api/enforcer/enroll",
+			Summary:     "Redeem an enrollment token for an enforcer credential",
+		}, h.enrollEnforcer)
+		huma.Register(api, huma.Operation{
+			OperationID: "config-signing-key",
+			Method:      http.MethodGet,
+			Path:        "/api/config-signing-key",
+			Summary:     "Get the public key that signs config bundles",
+		}, h.configSigningKey)
 	})
 
 	// Client auth endpoints
@@ -99,11 +240,35 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 			Path:        "/api/client/config",
 			Summary:     "Get client configuration",
 		}, h.clientConfig)
+		huma.Register(api, huma.Operation{
+			OperationID: "client-posture",
+			Method:      http.MethodPut,
+			Path:        "/api/client/posture",
+			Summary:     "Report device posture",
+		}, h.reportPosture)
+		huma.Register(api, huma.Operation{
+			OperationID: "device-key-challenge",
+			Method:      http.MethodPost,
+			Path:        "/api/client/device/challenge",
+			Summary:     "Issue a proof-of-possession challenge for a device key to rotate to",
+		}, h.deviceKeyChallenge)
+		huma.Register(api, huma.Operation{
+			OperationID: "rotate-device-key",
+			Method:      http.MethodPut,
+			Path:        "/api/client/device/public-key",
+			Summary:     "Rotate the device public key",
+		}, h.rotateDeviceKey)
+		huma.Register(api, huma.Operation{
+			OperationID: "device-certificate",
+			Method:      http.MethodPost,
+			Path:        "/api/client/device/certificate",
+			Summary:     "Issue a device client certificate",
+		}, h.issueDeviceCertificate)
 	})
 
 	// Enforcer auth endpoints
 	r.Group(func(r chi.Router) {
-		r.Use(middleware.EnforcerAPIKey(h.repo))
+		r.Use(middleware.EnforcerAuth(h.repo))
 		api := humachi.New(r, huma.DefaultConfig("Zero Trust API", "1.0.0"))
 		huma.Register(api, huma.Operation{
 			OperationID: "enforcer-config",
@@ -117,19 +282,46 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 			Path:        "/api/enforcer/public-key",
 			Summary:     "Update enforcer public key",
 		}, h.updateEnforcerKey)
+		huma.Register(api, huma.Operation{
+			OperationID: "rotate-enforcer-credential",
+			Method:      http.MethodPost,
+			Path:        "/api/enforcer/credential",
+			Summary:     "Rotate the enforcer credential",
+		}, h.rotateEnforcerCredential)
+		huma.Register(api, huma.Operation{
+			OperationID: "renew-enforcer-certificate",
+			Method:      http.MethodPost,
+			Path:        "/api/enforcer/certificate",
+			Summary:     "Issue a new enforcer client certificate",
+		}, h.renewEnforcerCertificate)
+		huma.Register(api, huma.Operation{
+			OperationID: "enforcer-heartbeat",
+			Method:      http.MethodPost,
+			Path:        "/api/enforcer/heartbeat",
+			Summary:     "Report enforcer health and inventory",
+		}, h.enforcerHeartbeat)
+		huma.Register(api, huma.Operation{
+			OperationID: "enforcer-apply-result",
+			Method:      http.MethodPost,
+			Path:        "/api/enforcer/apply-result",
+			Summary:     "Report the outcome of a config apply attempt",
+		}, h.enforcerApplyResult)
 		huma.Register(api, huma.Operation{
 			OperationID: "ingest-logs",
 			Method:      http.MethodPost,
 			Path:        "/api/logs",
 			Summary:     "Ingest logs from enforcer",
 		}, h.ingestLogs)
+
+		// Not a Huma operation: the stream is a WebSocket
+		r.Get(pathEnforcerStream, h.enforcerStream)
 	})
 }
 
 // --- Handlers ---
 
 func (h *Handler) clientLogin(ctx context.Context, input *LoginInput) (*LoginOutput, error) {
-	token, err := service.ClientLogin(ctx, h.repo, input.Body.Username, input.Body.Password)
+	token, err := service.ClientLogin(ctx, h.repo, input.Body.Username, input.Body.Password, input.Body.WGPublicKey)
 	if err != nil {
 		return nil, toHumaError(err)
 	}
@@ -138,28 +330,108 @@ func (h *Handler) clientLogin(ctx context.Context, input *LoginInput) (*LoginOut
 	return resp, nil
 }
 
-func (h *Handler) clientConfig(ctx context.Context, input *struct{}) (*ClientConfigOutput, error) {
+func (h *Handler) deviceChallenge(ctx context.Context, input *DeviceChallengeInput) (*DeviceChallengeOutput, error) {
+	client, err := service.AuthenticateClient(ctx, h.repo, input.Body.Username, input.Body.Password)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	challenge, err := service.IssueDeviceChallenge(client.ID, input.Body.WGPublicKey)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &DeviceChallengeOutput{Body: challenge}, nil
+}
+
+func (h *Handler) deviceKeyChallenge(ctx context.Context, input *DeviceKeyChallengeInput) (*DeviceChallengeOutput, error) {
 	claims, ok := service.ClaimsFromContext(ctx)
 	if !ok {
 		return nil, huma.Error401Unauthorized("unauthorized")
 	}
-	cfg, err := service.GetClientConfig(ctx, h.repo, claims)
+	challenge, err := service.IssueDeviceChallenge(claims.ClientID, input.Body.WGPublicKey)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &DeviceChallengeOutput{Body: challenge}, nil
+}
+
+func (h *Handler) registerDevice(ctx context.Context, input *RegisterDeviceInput) (*DeviceOutput, error) {
+	in := input.Body
+	device, err := service.RegisterDevice(ctx, h.repo, in.Username, in.Password, in.Name, in.WGPublicKey, in.ChallengeID, in.Proof)
 	if err != nil {
 		return nil, toHumaError(err)
 	}
-	return &ClientConfigOutput{Body: cfg}, nil
+	resp := &DeviceOutput{}
+	resp.Body.DeviceID = device.ID
+	resp.Body.Status = device.Status
+	return resp, nil
 }
 
-func (h *Handler) enforcerConfig(ctx context.Context, input *struct{}) (*EnforcerConfigOutput, error) {
+func (h *Handler) rotateDeviceKey(ctx context.Context, input *RotateDeviceKeyInput) (*DeviceOutput, error) {
+	claims, ok := service.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	in := input.Body
+	device, err := service.RotateDeviceKey(ctx, h.repo, claims, in.WGPublicKey, in.ChallengeID, in.Proof)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	resp := &DeviceOutput{}
+	resp.Body.DeviceID = device.ID
+	resp.Body.Status = device.Status
+	return resp, nil
+}
+
+func (h *Handler) clientConfig(ctx context.Context, input *ConfigInput) (*ConfigOutput, error) {
+	claims, ok := service.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	signed, modified, err := service.WatchClientConfig(ctx, h.repo, claims, input.IfNoneMatch, time.Duration(input.Wait)*time.Second)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return configOutput(signed, modified), nil
+}
+
+func (h *Handler) reportPosture(ctx context.Context, input *ReportPostureInput) (*StatusOutput, error) {
+	claims, ok := service.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	if err := service.ReportPosture(ctx, h.repo, claims.DeviceID, input.Body); err != nil {
+		return nil, toHumaError(err)
+	}
+	resp := &StatusOutput{}
+	resp.Body.Status = "ok"
+	return resp, nil
+}
+
+func (h *Handler) enforcerConfig(ctx context.Context, input *ConfigInput) (*ConfigOutput, error) {
 	enforcer, ok := middleware.EnforcerFromContext(ctx)
 	if !ok {
 		return nil, huma.Error401Unauthorized("unauthorized")
 	}
-	cfg, err := service.GetEnforcerConfig(ctx, h.repo, enforcer.ID)
+	signed, modified, err := service.WatchEnforcerConfig(ctx, h.repo, enforcer.ID, input.IfNoneMatch, time.Duration(input.Wait)*time.Second)
 	if err != nil {
 		return nil, toHumaError(err)
 	}
-	return &EnforcerConfigOutput{Body: cfg}, nil
+	return configOutput(signed, modified), nil
+}
+
+func configOutput(signed service.SignedConfig, modified bool) *ConfigOutput {
+	out := &ConfigOutput{Status: http.StatusOK, ETag: service.ConfigETag(signed), Body: signed}
+	if !modified {
+		out.Status = http.StatusNotModified
+		out.Body = service.SignedConfig{}
+	}
+	return out
+}
+
+func (h *Handler) configSigningKey(ctx context.Context, input *struct{}) (*SigningKeyOutput, error) {
+	resp := &SigningKeyOutput{}
+	resp.Body.PublicKey = service.ConfigSigningPublicKey()
+	return resp, nil
 }
 
 func (h *Handler) updateEnforcerKey(ctx context.Context, input *UpdateKeyInput) (*StatusOutput, error) {
@@ -175,21 +447,114 @@ func (h *Handler) updateEnforcerKey(ctx context.Context, input *UpdateKeyInput)
 	return resp, nil
 }
 
-func (h *Handler) ingestLogs(ctx context.Context, input *IngestLogsInput) (*StatusOutput, error) {
+func (h *Handler) enrollEnforcer(ctx context.Context, input *EnrollInput) (*CredentialOutput, error) {
+	cred, err := service.EnrollEnforcer(ctx, h.repo, input.Body.Token, input.Body.CSR)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &CredentialOutput{Body: cred}, nil
+}
+
+func (h *Handler) rotateEnforcerCredential(ctx context.Context, input *struct{}) (*CredentialOutput, error) {
 	enforcer, ok := middleware.EnforcerFromContext(ctx)
 	if !ok {
 		return nil, huma.Error401Unauthorized("unauthorized")
 	}
-	for _, e := range input.Body {
-		if err := service.CreateLog(ctx, h.repo, enforcer.ID, e.ClientID, e.ClientName, e.ResourceID, e.ResourceName, e.SrcIP, e.DstIP, e.Protocol, e.SrcPort, e.DstPort, e.Timestamp); err != nil {
-			return nil, toHumaError(err)
-		}
+	cred, err := service.RotateEnforcerCredential(ctx, h.repo, enforcer.ID)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &CredentialOutput{Body: cred}, nil
+}
+
+func (h *Handler) enforcerHeartbeat(ctx context.Context, input *HeartbeatInput) (*StatusOutput, error) {
+	enforcer, ok := middleware.EnforcerFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	if err := service.RecordHeartbeat(ctx, h.repo, enforcer.ID, input.Body); err != nil {
+		return nil, toHumaError(err)
+	}
+	resp := &StatusOutput{}
+	resp.Body.Status = "ok"
+	return resp, nil
+}
+
+func (h *Handler) enforcerApplyResult(ctx context.Context, input *ApplyResultInput) (*StatusOutput, error) {
+	enforcer, ok := middleware.EnforcerFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	if err := service.RecordApplyResult(ctx, h.repo, enforcer.ID, input.Body); err != nil {
+		return nil, toHumaError(err)
 	}
 	resp := &StatusOutput{}
 	resp.Body.Status = "ok"
 	return resp, nil
 }
 
+func (h *Handler) renewEnforcerCertificate(ctx context.Context, input *CertificateInput) (*CertificateOutput, error) {
+	enforcer, ok := middleware.EnforcerFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	cert, err := service.IssueEnforcerCertificate(ctx, h.repo, enforcer.ID, input.Body.CSR)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &CertificateOutput{Body: cert}, nil
+}
+
+func (h *Handler) issueDeviceCertificate(ctx context.Context, input *CertificateInput) (*CertificateOutput, error) {
+	claims, ok := service.ClaimsFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	cert, err := service.IssueDeviceCertificate(ctx, h.repo, claims, input.Body.CSR)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &CertificateOutput{Body: cert}, nil
+}
+
+func (h *Handler) ingestLogs(ctx context.Context, input *IngestLogsInput) (*IngestLogsOutput, error) {
+	enforcer, ok := middleware.EnforcerFromContext(ctx)
+	if !ok {
+		return nil, huma.Error401Unauthorized("unauthorized")
+	}
+	acked, err := h.ingest(ctx, enforcer.ID, input.Body)
+	if err != nil {
+		return nil, toHumaError(err)
+	}
+	return &IngestLogsOutput{Body: LogAck{Status: "ok", AckedSeq: acked}}, nil
+}
+
+// ingest writes a batch and returns the highest batch sequence number
+// written for the enforcer.
+func (h *Handler) ingest(ctx context.Context, enforcerID string, batch LogBatch) (uint64, error) {
+	reports := make([]service.LogReport, len(batch.Entries))
+	for i, e := range batch.Entries {
+		packets, bytes := e.Packets, e.Bytes
+		if packets == 0 {
+			packets, bytes = 1, int64(e.Length)
+		}
+		reports[i] = service.LogReport{
+			ID:         e.ID,
+			Timestamp:  e.Timestamp,
+			SrcIP:      e.SrcIP,
+			SrcPort:    e.SrcPort,
+			DstIP:      e.DstIP,
+			DstPort:    e.DstPort,
+			Protocol:   e.Protocol,
+			Packets:    packets,
+			Bytes:      bytes,
+			DurationMs: e.DurationMs,
+			Verdict:    e.Verdict,
+		}
+	}
+	return service.IngestLogs(ctx, h.repo, enforcerID, batch.Seq, reports)
+}
+
 func toHumaError(err error) error {
 	if service.IsValidation(err) {
 		return huma.Error400BadRequest(err.Error())
@@ -200,5 +565,12 @@ func toHumaError(err error) error {
 	if service.IsAuth(err) {
 		return huma.Error401Unauthorized("unauthorized")
 	}
+	if service.IsForbidden(err) {
+		return huma.Error403Forbidden(err.Error())
+	}
+	if busy, ok := service.AsBusy(err); ok {
+		retryAfter := strconv.Itoa(int(busy.RetryAfter.Round(time.Second).Seconds()))
+		return huma.ErrorWithHeaders(huma.Error429TooManyRequests(busy.Msg), http.Header{"Retry-After": {retryAfter}})
+	}
 	return huma.Error500InternalServerError(err.Error())
 }
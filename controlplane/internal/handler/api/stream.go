@@ -0,0 +1,254 @@
+// stream.go serves the enforcer stream: one WebSocket per enforcer that
+// carries config pushes from the controlplane and heartbeats, log batches and
+// apply results from the enforcer over a single connection.
+//
+// Messages are JSON objects {"type", "seq", "data", "error"}. The enforcer
+// opens with "hello" carrying the config version it applied last, and the
+// controlplane pushes "config" whenever the signed config differs from the
+// one the enforcer holds, so a reconnect resumes from that version. Enforcer
+// messages with a seq are answered by an "ack" with the same seq, and an
+// error text if they could not be handled. A "logs" message is acked once
+// its batch is written, with the highest log batch sequence number written.
+// The credential the stream was opened with is checked again before every
+// push, so a revoked enforcer is disconnected within MaxConfigWait.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"migration-to-zero-trust/controlplane/internal/middleware"
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/service"
+)
+
+const (
+	pathEnforcerStream = "/api/enforcer/stream"
+
+	streamHelloTimeout  = 10 * time.Second
+	streamWriteTimeout  = 10 * time.Second
+	streamRetryInterval = 30 * time.Second
+	// Enforcers send a heartbeat every 30 seconds, so a stream silent for
+	// longer than a stale heartbeat is dead.
+	streamReadTimeout = model.HeartbeatStaleAfter
+)
+
+// Stream message types.
+const (
+	streamHello            = "hello"
+	streamHeartbeat        = "heartbeat"
+	streamLogs             = "logs"
+	streamApplyResult      = "apply_result"
+	streamConfig           = "config"
+	streamAck              = "ack"
+	streamRotateCredential = "rotate_credential"
+)
+
+type streamMessage struct {
+	Type  string          `json:"type"`
+	Seq   uint64          `json:"seq,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type streamHelloData struct {
+	AppliedVersion uint64 `json:"applied_version"`
+}
+
+type enforcerStream struct {
+	h        *Handler
+	ws       *websocket.Conn
+	enforcer model.Enforcer
+
+	writeMu sync.Mutex
+}
+
+func (h *Handler) enforcerStream(w http.ResponseWriter, r *http.Request) {
+	enforcer, ok := middleware.EnforcerFromContext(r.Context())
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	srv := websocket.Server{
+		// Enforcers authenticate with a client certificate or an API key
+		// header, not cookies, so the Origin header is not checked
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			s := &enforcerStream{h: h, ws: ws, enforcer: enforcer}
+			s.serve(r.Context())
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+func (s *enforcerStream) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer s.ws.Close()
+
+	var hello streamHelloData
+	if err := s.receiveHello(&hello); err != nil {
+		log.Printf("enforcer %s stream: %v", s.enforcer.ID, err)
+		return
+	}
+	log.Printf("enforcer %s stream connected (applied config version %d)", s.enforcer.ID, hello.AppliedVersion)
+
+	go func() {
+		defer cancel()
+		s.receive(ctx)
+	}()
+	s.push(ctx, hello.AppliedVersion)
+	log.Printf("enforcer %s stream closed", s.enforcer.ID)
+}
+
+func (s *enforcerStream) receiveHello(hello *streamHelloData) error {
+	s.ws.SetReadDeadline(time.Now().Add(streamHelloTimeout))
+	var msg streamMessage
+	if err := websocket.JSON.Receive(s.ws, &msg); err != nil {
+		return err
+	}
+	if msg.Type != streamHello {
+		return fmt.Errorf("expected hello, got %q", msg.Type)
+	}
+	if len(msg.Data) > 0 {
+		if err := json.Unmarshal(msg.Data, hello); err != nil {
+			return fmt.Errorf("hello: %w", err)
+		}
+	}
+	return nil
+}
+
+// push sends the enforcer's config whenever it differs from the one the
+// enforcer holds, starting from the applied version.
+func (s *enforcerStream) push(ctx context.Context, applied uint64) {
+	etag := ""
+	if applied > 0 {
+		etag = strconv.Quote(strconv.FormatUint(applied, 10))
+	}
+	rotateSent := false
+	for {
+		enforcer, rotate, err := middleware.AuthenticateEnforcerRequest(ctx, s.h.repo, s.ws.Request())
+		if err != nil || enforcer.ID != s.enforcer.ID {
+			if ctx.Err() == nil {
+				log.Printf("enforcer %s stream: credential no longer valid", s.enforcer.ID)
+			}
+			return
+		}
+		if rotate && !rotateSent {
+			if err := s.send(streamMessage{Type: streamRotateCredential}); err != nil {
+				return
+			}
+			rotateSent = true
+		}
+
+		signed, modified, err := service.WatchEnforcerConfig(ctx, s.h.repo, s.enforcer.ID, etag, service.MaxConfigWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("enforcer %s stream: build config: %v", s.enforcer.ID, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(streamRetryInterval):
+			}
+			continue
+		}
+		if !modified {
+			continue
+		}
+		data, err := json.Marshal(signed)
+		if err != nil {
+			log.Printf("enforcer %s stream: %v", s.enforcer.ID, err)
+			return
+		}
+		if err := s.send(streamMessage{Type: streamConfig, Data: data}); err != nil {
+			return
+		}
+		etag = service.ConfigETag(signed)
+	}
+}
+
+func (s *enforcerStream) receive(ctx context.Context) {
+	for {
+		s.ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		var msg streamMessage
+		if err := websocket.JSON.Receive(s.ws, &msg); err != nil {
+			if ctx.Err() == nil && !errors.Is(err, io.EOF) {
+				log.Printf("enforcer %s stream: %v", s.enforcer.ID, err)
+			}
+			return
+		}
+		reply, err := s.handle(ctx, msg)
+		if msg.Seq == 0 {
+			if err != nil {
+				log.Printf("enforcer %s stream: %s: %v", s.enforcer.ID, msg.Type, err)
+			}
+			continue
+		}
+		ack := streamMessage{Type: streamAck, Seq: msg.Seq}
+		if err != nil {
+			ack.Error = err.Error()
+		} else if reply != nil {
+			if ack.Data, err = json.Marshal(reply); err != nil {
+				ack.Error = err.Error()
+			}
+		}
+		if err := s.send(ack); err != nil {
+			return
+		}
+	}
+}
+
+// handle handles a message from the enforcer and returns the data of its ack,
+// if any.
+func (s *enforcerStream) handle(ctx context.Context, msg streamMessage) (any, error) {
+	switch msg.Type {
+	case streamHeartbeat:
+		var report service.HeartbeatReport
+		if err := json.Unmarshal(msg.Data, &report); err != nil {
+			return nil, err
+		}
+		return nil, service.RecordHeartbeat(ctx, s.h.repo, s.enforcer.ID, report)
+	case streamLogs:
+		var batch LogBatch
+		if err := json.Unmarshal(msg.Data, &batch); err != nil {
+			return nil, err
+		}
+		for _, e := range batch.Entries {
+			if e.Timestamp.IsZero() || e.SrcIP == "" || e.DstIP == "" || e.Protocol == "" {
+				return nil, errors.New("log entry needs ts, src_ip, dst_ip and proto")
+			}
+		}
+		acked, err := s.h.ingest(ctx, s.enforcer.ID, batch)
+		if err != nil {
+			return nil, err
+		}
+		return LogAck{Status: "ok", AckedSeq: acked}, nil
+	case streamApplyResult:
+		var report service.ApplyReport
+		if err := json.Unmarshal(msg.Data, &report); err != nil {
+			return nil, err
+		}
+		return nil, service.RecordApplyResult(ctx, s.h.repo, s.enforcer.ID, report)
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Type)
+	}
+}
+
+func (s *enforcerStream) send(msg streamMessage) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return websocket.JSON.Send(s.ws, msg)
+}
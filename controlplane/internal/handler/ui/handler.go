@@ -4,10 +4,13 @@ import (
 	"embed"
 	"html/template"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-playground/validator/v10"
 
+	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
 	"migration-to-zero-trust/controlplane/internal/service"
 )
@@ -34,14 +37,25 @@ type createClientRequest struct {
 	Name        string `validate:"required"`
 	Username    string `validate:"required"`
 	Password    string `validate:"required"`
-	WGPublicKey string `validate:"required"`
+	WGPublicKey string `validate:"omitempty,base64"`
+}
+
+type createDeviceRequest struct {
+	Name        string `validate:"required"`
+	WGPublicKey string `validate:"required,base64"`
 }
 
 type createResourceRequest struct {
 	Name       string `validate:"required"`
 	CIDR       string `validate:"required,cidr"`
 	EnforcerID string `validate:"required"`
-	Mode       string `validate:"required,oneof=observe enforce"`
+	Mode       string `validate:"required,oneof=observe enforce discovery"`
+	Posture    model.PostureRequirement
+}
+
+type createProposedResourceRequest struct {
+	Name string `validate:"required"`
+	CIDR string `validate:"required,cidr"`
 }
 
 type createEnforcerRequest struct {
@@ -55,10 +69,44 @@ type createPairRequest struct {
 	ResourceID string `validate:"required"`
 }
 
+type createLogSinkRequest struct {
+	Name      string `validate:"required"`
+	Kind      string `validate:"required,oneof=syslog file webhook"`
+	Format    string `validate:"required,oneof=rfc5424 cef leef json"`
+	Transport string `validate:"omitempty,oneof=udp tcp tls"`
+	Target    string `validate:"required"`
+	CAFile    string
+	Verdicts  []string `validate:"dive,oneof=allow observe deny"`
+}
+
 type updateModeRequest struct {
 	Mode string `validate:"required,oneof=observe enforce"`
 }
 
+type logRetentionRequest struct {
+	Days string `validate:"omitempty,number"`
+}
+
+func (req logRetentionRequest) days() int {
+	n, _ := strconv.Atoi(req.Days)
+	return n
+}
+
+type summaryRange struct {
+	Key      string
+	Label    string
+	Duration time.Duration
+}
+
+// summaryRanges are the ranges offered for the traffic summary.
+var summaryRanges = []summaryRange{
+	{"24h", "last 24 hours", 24 * time.Hour},
+	{"7d", "last 7 days", 7 * 24 * time.Hour},
+	{"30d", "last 30 days", 30 * 24 * time.Hour},
+	{"90d", "last 90 days", 90 * 24 * time.Hour},
+	{"365d", "last year", 365 * 24 * time.Hour},
+}
+
 func (h *Handler) Routes() chi.Router {
 	r := chi.NewRouter()
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -67,20 +115,38 @@ func (h *Handler) Routes() chi.Router {
 	r.Get("/clients", h.clients)
 	r.Post("/clients", h.createClient)
 	r.Post("/clients/{id}/delete", h.deleteClient)
+	r.Post("/clients/{id}/devices", h.createDevice)
+	r.Post("/devices/{id}/approve", h.approveDevice)
+	r.Post("/devices/{id}/delete", h.deleteDevice)
 
 	r.Get("/resources", h.resources)
 	r.Post("/resources", h.createResource)
 	r.Post("/resources/{id}/mode", h.updateResourceMode)
+	r.Post("/resources/{id}/log-retention", h.updateResourceLogRetention)
 	r.Post("/resources/{id}/delete", h.deleteResource)
+	r.Get("/resources/{id}/discovery", h.discovery)
+	r.Post("/resources/{id}/discovery", h.createProposedResource)
 
 	r.Get("/enforcers", h.enforcers)
 	r.Get("/enforcers/{id}", h.enforcerDetail)
 	r.Post("/enforcers", h.createEnforcer)
+	r.Post("/enforcers/{id}/enrollment-token", h.issueEnrollmentToken)
+	r.Post("/enforcers/{id}/rotate-credential", h.rotateEnforcerCredential)
+	r.Post("/enforcers/{id}/revoke-credential", h.revokeEnforcerCredential)
+	r.Post("/enforcers/{id}/log-retention", h.updateEnforcerLogRetention)
 	r.Post("/enforcers/{id}/delete", h.deleteEnforcer)
 
 	r.Get("/pairs", h.pairs)
 	r.Post("/pairs", h.createPair)
 	r.Post("/pairs/{id}/delete", h.deletePair)
+
+	r.Get("/logs", h.logs)
+	r.Get("/logs/search", h.searchLogs)
+	r.Get("/logs/export", h.exportLogs)
+
+	r.Get("/sinks", h.logSinks)
+	r.Post("/sinks", h.createLogSink)
+	r.Post("/sinks/{id}/delete", h.deleteLogSink)
 	return r
 }
 
@@ -104,12 +170,12 @@ func handleForm[T any](w http.ResponseWriter, r *http.Request, req T, action fun
 }
 
 func (h *Handler) clients(w http.ResponseWriter, r *http.Request) {
-	clients, err := h.repo.ListClients(r.Context())
+	pageData, err := h.repo.FetchClientsPageData(r.Context())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	h.render(w, "clients.html", clients)
+	h.render(w, "clients.html", pageData)
 }
 
 func (h *Handler) createClient(w http.ResponseWriter, r *http.Request) {
@@ -127,7 +193,37 @@ func (h *Handler) createClient(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) deleteClient(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if _, err := h.repo.DeleteClient(r.Context(), id); err != nil {
+	if err := service.DeleteClient(r.Context(), h.repo, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/clients", http.StatusSeeOther)
+}
+
+func (h *Handler) createDevice(w http.ResponseWriter, r *http.Request) {
+	clientID := chi.URLParam(r, "id")
+	req := createDeviceRequest{
+		Name:        r.FormValue("name"),
+		WGPublicKey: r.FormValue("wg_public_key"),
+	}
+	handleForm(w, r, req, func() error {
+		_, err := service.CreateDevice(r.Context(), h.repo, clientID, req.Name, req.WGPublicKey)
+		return err
+	}, "/clients")
+}
+
+func (h *Handler) approveDevice(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := service.ApproveDevice(r.Context(), h.repo, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/clients", http.StatusSeeOther)
+}
+
+func (h *Handler) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := service.DeleteDevice(r.Context(), h.repo, id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -149,9 +245,20 @@ func (h *Handler) createResource(w http.ResponseWriter, r *http.Request) {
 		CIDR:       r.FormValue("cidr"),
 		EnforcerID: r.FormValue("enforcer_id"),
 		Mode:       r.FormValue("mode"),
+		Posture: model.PostureRequirement{
+			DiskEncryption:   r.FormValue("posture_disk_encryption") != "",
+			Firewall:         r.FormValue("posture_firewall") != "",
+			ScreenLock:       r.FormValue("posture_screen_lock") != "",
+			MinKernelVersion: r.FormValue("posture_min_kernel_version"),
+			MinAgentVersion:  r.FormValue("posture_min_agent_version"),
+		},
 	}
 	handleForm(w, r, req, func() error {
-		_, err := service.CreateResource(r.Context(), h.repo, req.Name, req.CIDR, req.EnforcerID, req.Mode)
+		if req.Mode == "discovery" {
+			_, err := service.CreateDiscoveryResource(r.Context(), h.repo, req.Name, req.CIDR, req.EnforcerID, req.Posture)
+			return err
+		}
+		_, err := service.CreateResource(r.Context(), h.repo, req.Name, req.CIDR, req.EnforcerID, req.Mode, req.Posture)
 		return err
 	}, "/resources")
 }
@@ -162,13 +269,49 @@ func (h *Handler) updateResourceMode(w http.ResponseWriter, r *http.Request) {
 		Mode: r.FormValue("mode"),
 	}
 	handleForm(w, r, req, func() error {
-		return h.repo.UpdateResourceMode(r.Context(), id, req.Mode)
+		return service.UpdateResourceMode(r.Context(), h.repo, id, req.Mode)
+	}, "/resources")
+}
+
+func (h *Handler) updateResourceLogRetention(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	req := logRetentionRequest{Days: r.FormValue("days")}
+	handleForm(w, r, req, func() error {
+		return service.SetResourceLogRetention(r.Context(), h.repo, id, req.days())
 	}, "/resources")
 }
 
+func (h *Handler) discovery(w http.ResponseWriter, r *http.Request) {
+	discovery, err := service.DiscoverResources(r.Context(), h.repo, chi.URLParam(r, "id"))
+	switch {
+	case service.IsNotFound(err):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case service.IsValidation(err):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.render(w, "discovery.html", discovery)
+}
+
+func (h *Handler) createProposedResource(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	req := createProposedResourceRequest{
+		Name: r.FormValue("name"),
+		CIDR: r.FormValue("cidr"),
+	}
+	handleForm(w, r, req, func() error {
+		_, err := service.CreateProposedResource(r.Context(), h.repo, id, req.Name, req.CIDR)
+		return err
+	}, "/resources/"+id+"/discovery")
+}
+
 func (h *Handler) deleteResource(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if _, err := h.repo.DeleteResource(r.Context(), id); err != nil {
+	if err := service.DeleteResource(r.Context(), h.repo, id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -176,7 +319,7 @@ func (h *Handler) deleteResource(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) enforcers(w http.ResponseWriter, r *http.Request) {
-	enforcers, err := h.repo.ListEnforcers(r.Context())
+	enforcers, err := service.ListEnforcerHealth(r.Context(), h.repo)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -192,10 +335,34 @@ func (h *Handler) enforcerDetail(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	selected := summaryRanges[1]
+	for _, sr := range summaryRanges {
+		if sr.Key == r.URL.Query().Get("range") {
+			selected = sr
+		}
+	}
+	summary, err := service.SummarizeLogs(r.Context(), h.repo, id, resourceID, time.Now().Add(-selected.Duration), 100)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	h.render(w, "enforcer_detail.html", struct {
 		repository.EnforcerDetailPageData
+		Health             string
 		SelectedResourceID string
-	}{pageData, resourceID})
+		Summary            []repository.LogRollupSummary
+		SummaryRange       string
+		SummaryRanges      []summaryRange
+		DefaultRetention   int
+	}{pageData, model.HealthStatus(pageData.Heartbeat, time.Now()), resourceID, summary, selected.Key, summaryRanges, service.LogRetentionDays()})
+}
+
+func (h *Handler) updateEnforcerLogRetention(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	req := logRetentionRequest{Days: r.FormValue("days")}
+	handleForm(w, r, req, func() error {
+		return service.SetEnforcerLogRetention(r.Context(), h.repo, id, req.days())
+	}, "/enforcers/"+id)
 }
 
 func (h *Handler) createEnforcer(w http.ResponseWriter, r *http.Request) {
@@ -208,17 +375,50 @@ func (h *Handler) createEnforcer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	enforcer, err := service.CreateEnforcer(r.Context(), h.repo, req.Name, req.Endpoint, req.TunnelSubnet)
+	enforcer, token, err := service.CreateEnforcer(r.Context(), h.repo, req.Name, req.Endpoint, req.TunnelSubnet)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.render(w, "enforcer_created.html", map[string]any{"Enforcer": enforcer, "Token": token, "SigningKey": service.ConfigSigningPublicKey()})
+}
+
+func (h *Handler) issueEnrollmentToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	enforcer, err := h.repo.GetEnforcer(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	token, err := service.IssueEnrollmentToken(r.Context(), h.repo, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	h.render(w, "enforcer_created.html", map[string]any{"Enforcer": enforcer})
+	h.render(w, "enforcer_created.html", map[string]any{"Enforcer": enforcer, "Token": token, "SigningKey": service.ConfigSigningPublicKey()})
+}
+
+func (h *Handler) rotateEnforcerCredential(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := service.RequestEnforcerRotation(r.Context(), h.repo, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/enforcers/"+id, http.StatusSeeOther)
+}
+
+func (h *Handler) revokeEnforcerCredential(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := service.RevokeEnforcerCredential(r.Context(), h.repo, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/enforcers/"+id, http.StatusSeeOther)
 }
 
 func (h *Handler) deleteEnforcer(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if _, err := h.repo.DeleteEnforcer(r.Context(), id); err != nil {
+	if err := service.DeleteEnforcer(r.Context(), h.repo, id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -247,9 +447,47 @@ func (h *Handler) createPair(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) deletePair(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	if _, err := h.repo.DeletePair(r.Context(), id); err != nil {
+	if err := service.DeletePair(r.Context(), h.repo, id); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 	http.Redirect(w, r, "/pairs", http.StatusSeeOther)
 }
+
+func (h *Handler) logSinks(w http.ResponseWriter, r *http.Request) {
+	pageData, err := h.repo.FetchLogSinksPageData(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.render(w, "sinks.html", pageData)
+}
+
+func (h *Handler) createLogSink(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := createLogSinkRequest{
+		Name:      r.FormValue("name"),
+		Kind:      r.FormValue("kind"),
+		Format:    r.FormValue("format"),
+		Transport: r.FormValue("transport"),
+		Target:    r.FormValue("target"),
+		CAFile:    r.FormValue("ca_file"),
+		Verdicts:  r.Form["verdicts"],
+	}
+	handleForm(w, r, req, func() error {
+		_, err := service.CreateLogSink(r.Context(), h.repo, req.Name, req.Kind, req.Format, req.Target, req.Transport, req.CAFile, req.Verdicts)
+		return err
+	}, "/sinks")
+}
+
+func (h *Handler) deleteLogSink(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if err := service.DeleteLogSink(r.Context(), h.repo, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/sinks", http.StatusSeeOther)
+}
@@ -0,0 +1,263 @@
+package ui
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+	"migration-to-zero-trust/controlplane/internal/service"
+)
+
+// logTimeLayouts are accepted for the from and to parameters. Times without
+// a zone are UTC.
+var logTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// logCSVHeader names the columns of a CSV export.
+var logCSVHeader = []string{
+	"id", "timestamp", "enforcer_id", "client_id", "client_name", "device_id", "device_name",
+	"resource_id", "resource_name", "src_ip", "src_port", "dst_ip", "dst_port", "protocol",
+	"packets", "bytes", "duration_ms", "mode", "verdict", "enforcer_verdict", "revision_id",
+}
+
+// parseLogSearch reads a log search from the query string shared by the
+// logs page, the search API and exports.
+func parseLogSearch(query url.Values) (service.LogSearch, error) {
+	s := service.LogSearch{
+		EnforcerID: query.Get("enforcer_id"),
+		ClientID:   query.Get("client_id"),
+		ResourceID: query.Get("resource_id"),
+		SrcIP:      query.Get("src_ip"),
+		DstIP:      query.Get("dst_ip"),
+		Protocol:   query.Get("protocol"),
+		Verdicts:   query["verdict"],
+		Sort:       query.Get("sort"),
+		Asc:        query.Get("order") == "asc",
+		Cursor:     query.Get("cursor"),
+	}
+	var err error
+	if s.From, err = parseLogTime(query.Get("from")); err != nil {
+		return s, fmt.Errorf("from: %w", err)
+	}
+	if s.To, err = parseLogTime(query.Get("to")); err != nil {
+		return s, fmt.Errorf("to: %w", err)
+	}
+	if v := query.Get("dst_port"); v != "" {
+		if s.DstPort, err = strconv.Atoi(v); err != nil {
+			return s, fmt.Errorf("dst_port: %w", err)
+		}
+	}
+	if v := query.Get("has_pair"); v != "" {
+		hasPair, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, fmt.Errorf("has_pair: %w", err)
+		}
+		s.HasPair = &hasPair
+	}
+	if v := query.Get("limit"); v != "" {
+		if s.Limit, err = strconv.Atoi(v); err != nil {
+			return s, fmt.Errorf("limit: %w", err)
+		}
+	}
+	if order := query.Get("order"); order != "" && order != "asc" && order != "desc" {
+		return s, fmt.Errorf("order must be asc or desc")
+	}
+	return s, nil
+}
+
+func parseLogTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range logTimeLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time", v)
+}
+
+func logSearchError(w http.ResponseWriter, err error) {
+	if service.IsValidation(err) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (h *Handler) logs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search, err := parseLogSearch(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := service.SearchLogs(r.Context(), h.repo, search)
+	if err != nil {
+		logSearchError(w, err)
+		return
+	}
+	pageData, err := h.repo.FetchLogsPageData(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Links keep the filters; exports start from the first page
+	filters := make(url.Values, len(query))
+	for k, v := range query {
+		if k != "cursor" {
+			filters[k] = v
+		}
+	}
+	link := func(path string, set ...string) string {
+		v := make(url.Values, len(filters)+1)
+		for k, vals := range filters {
+			v[k] = vals
+		}
+		for i := 0; i < len(set); i += 2 {
+			v.Set(set[i], set[i+1])
+		}
+		return path + "?" + v.Encode()
+	}
+	var firstURL, nextURL string
+	if search.Cursor != "" {
+		firstURL = link("/logs")
+	}
+	if page.NextCursor != "" {
+		nextURL = link("/logs", "cursor", page.NextCursor)
+	}
+	filters.Del("limit")
+	verdicts := make(map[string]bool)
+	for _, v := range search.Verdicts {
+		verdicts[v] = true
+	}
+	h.render(w, "logs.html", struct {
+		repository.LogsPageData
+		Query      url.Values
+		Verdicts   map[string]bool
+		Entries    []model.LogEntry
+		FirstURL   string
+		NextURL    string
+		ExportCSV  string
+		ExportJSON string
+	}{pageData, query, verdicts, page.Entries, firstURL, nextURL, link("/logs/export", "format", "csv"), link("/logs/export", "format", "json")})
+}
+
+func (h *Handler) searchLogs(w http.ResponseWriter, r *http.Request) {
+	search, err := parseLogSearch(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := service.SearchLogs(r.Context(), h.repo, search)
+	if err != nil {
+		logSearchError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// exportLogs streams every entry matching the search as CSV or as a JSON
+// array. The response starts with the first page, so a search that fails
+// later ends it early: a JSON export is then left unterminated.
+func (h *Handler) exportLogs(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	search, err := parseLogSearch(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+
+	// begin sends the headers and what precedes the first entry, write one
+	// page and end what follows the last entry
+	var begin func()
+	var write func([]model.LogEntry) error
+	var end func()
+	rc := http.NewResponseController(w)
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		begin = func() {
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", `attachment; filename="logs.csv"`)
+			cw.Write(logCSVHeader)
+		}
+		write = func(entries []model.LogEntry) error {
+			for _, e := range entries {
+				cw.Write(logCSVRecord(e))
+			}
+			cw.Flush()
+			return cw.Error()
+		}
+		end = cw.Flush
+	case "json":
+		sep := "\n"
+		begin = func() {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="logs.json"`)
+			w.Write([]byte("["))
+		}
+		write = func(entries []model.LogEntry) error {
+			for _, e := range entries {
+				data, err := json.Marshal(e)
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "%s%s", sep, data); err != nil {
+					return err
+				}
+				sep = ",\n"
+			}
+			return nil
+		}
+		end = func() { w.Write([]byte("\n]\n")) }
+	default:
+		http.Error(w, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+
+	started := false
+	err = service.ExportLogs(r.Context(), h.repo, search, func(entries []model.LogEntry) error {
+		if !started {
+			begin()
+			started = true
+		}
+		if err := write(entries); err != nil {
+			return err
+		}
+		rc.Flush()
+		return nil
+	})
+	switch {
+	case err != nil && !started:
+		logSearchError(w, err)
+	case err != nil:
+		// Too late for an error status
+		log.Printf("log export: %v", err)
+	default:
+		if !started {
+			begin()
+		}
+		end()
+	}
+}
+
+func logCSVRecord(e model.LogEntry) []string {
+	return []string{
+		e.ID, e.Timestamp.UTC().Format(time.RFC3339Nano), e.EnforcerID, e.ClientID, e.ClientName, e.DeviceID, e.DeviceName,
+		e.ResourceID, e.ResourceName, e.SrcIP, strconv.Itoa(e.SrcPort), e.DstIP, strconv.Itoa(e.DstPort), e.Protocol,
+		strconv.FormatInt(e.Packets, 10), strconv.FormatInt(e.Bytes, 10), strconv.FormatInt(e.DurationMs, 10), e.Mode, e.Verdict, e.EnforcerVerdict, e.RevisionID,
+	}
+}
@@ -1,22 +1,66 @@
 package infra
 
 import (
+	"errors"
+
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+
+	"migration-to-zero-trust/internal/metrics"
 )
 
+// sqliteParams apply to every connection. WAL lets readers proceed while a
+// write is in progress, and immediate transactions take the write lock up
+// front so two handles wait on each other through the busy timeout instead
+// of failing on a lock upgrade.
+const sqliteParams = "?_foreign_keys=on&_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_txlock=immediate"
+
+var dbErrors = metrics.NewCounter("controlplane_db_errors_total", "Failed database statements by handle and operation; missing records are not counted.", "db", "operation")
+
+// OpenDB opens the database that serves the UI, the API and config builds.
 func OpenDB(path string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open(path), &gorm.Config{})
+	return open(path, "main")
+}
+
+// OpenLogDB opens a second handle on the same database for log ingestion,
+// so bulk log writes never queue behind, or hold up, config reads.
+func OpenLogDB(path string) (*gorm.DB, error) {
+	return open(path, "log")
+}
+
+func open(path, name string) (*gorm.DB, error) {
+	db, err := gorm.Open(sqlite.Open(path+sqliteParams), &gorm.Config{})
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Exec("PRAGMA foreign_keys = ON;").Error; err != nil {
-		return nil, err
-	}
 	sqlDB, err := db.DB()
 	if err != nil {
 		return nil, err
 	}
 	sqlDB.SetMaxOpenConns(1)
+	if err := countErrors(db, name); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
+
+// countErrors adds a callback after every kind of statement that counts the
+// ones that failed.
+func countErrors(db *gorm.DB, name string) error {
+	count := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+				dbErrors.Inc(name, operation)
+			}
+		}
+	}
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Register("metrics:create", count("create")),
+		cb.Query().Register("metrics:query", count("query")),
+		cb.Update().Register("metrics:update", count("update")),
+		cb.Delete().Register("metrics:delete", count("delete")),
+		cb.Row().Register("metrics:row", count("row")),
+		cb.Raw().Register("metrics:raw", count("raw")),
+	)
+}
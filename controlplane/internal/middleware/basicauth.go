@@ -3,6 +3,8 @@ package middleware
 import (
 	"crypto/subtle"
 	"net/http"
+
+	"migration-to-zero-trust/controlplane/internal/service"
 )
 
 func BasicAuth(user, pass string) func(http.Handler) http.Handler {
@@ -13,6 +15,9 @@ func BasicAuth(user, pass string) func(http.Handler) http.Handler {
 			if !ok ||
 				subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
 				subtle.ConstantTimeCompare([]byte(p), []byte(pass)) != 1 {
+				if ok {
+					service.RecordLoginFailure(service.LoginUI)
+				}
 				w.Header().Set("WWW-Authenticate", realm)
 				http.Error(w, "unauthorized", http.StatusUnauthorized)
 				return
@@ -23,6 +23,13 @@ func ClientTokenAuth(next http.Handler) http.Handler {
 			http.Error(w, "unauthorized", http.StatusUnauthorized)
 			return
 		}
+		// A device certificate, when presented, must belong to the token's device
+		if cert := verifiedClientCert(r); cert != nil {
+			if deviceID, ok := service.DeviceIDFromCertificate(cert); !ok || deviceID != claims.DeviceID {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
 		ctx := service.ContextWithClaims(r.Context(), claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -2,13 +2,21 @@ package middleware
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
+	"migration-to-zero-trust/controlplane/internal/service"
 )
 
+// CredentialRotateHeader is set on responses to an enforcer that should
+// rotate its credential.
+const CredentialRotateHeader = "X-Credential-Rotate"
+
 type enforcerKey struct{}
 
 func EnforcerFromContext(ctx context.Context) (model.Enforcer, bool) {
@@ -16,34 +24,55 @@ func EnforcerFromContext(ctx context.Context) (model.Enforcer, bool) {
 	return enf, ok
 }
 
-func EnforcerAPIKey(repo repository.Repository) func(http.Handler) http.Handler {
+// EnforcerAuth authenticates enforcers by their mTLS client certificate,
+// falling back to the X-API-Key header for enforcers without one.
+func EnforcerAuth(repo repository.Repository) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			apiKey := strings.TrimSpace(r.Header.Get("X-API-Key"))
-			if apiKey == "" {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			enforcerID, ok := model.ParseAPIKey(apiKey)
-			if !ok {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			enforcer, err := repo.GetEnforcer(r.Context(), enforcerID)
+			enforcer, rotate, err := AuthenticateEnforcerRequest(r.Context(), repo, r)
 			if err != nil {
+				if errors.As(err, new(service.AuthError)) {
+					service.RecordLoginFailure(service.LoginEnforcer)
+				}
 				http.Error(w, "unauthorized", http.StatusUnauthorized)
 				return
 			}
-
-			if !enforcer.VerifyAPIKey(apiKey) {
-				http.Error(w, "unauthorized", http.StatusUnauthorized)
-				return
+			if rotate {
+				w.Header().Set(CredentialRotateHeader, "true")
 			}
-
 			ctx := context.WithValue(r.Context(), enforcerKey{}, enforcer)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
+
+// AuthenticateEnforcerRequest authenticates r as EnforcerAuth does and
+// reports whether the enforcer should rotate its credential. Long-lived
+// connections call it again to notice revocation.
+func AuthenticateEnforcerRequest(ctx context.Context, repo repository.Repository, r *http.Request) (model.Enforcer, bool, error) {
+	if cert := verifiedClientCert(r); cert != nil {
+		enforcer, err := service.AuthenticateEnforcerCertificate(ctx, repo, cert)
+		if err == nil {
+			return enforcer, enforcer.HasCredential() && enforcer.NeedsRotation(time.Now()), nil
+		}
+	}
+
+	apiKey := strings.TrimSpace(r.Header.Get("X-API-Key"))
+	if apiKey == "" {
+		return model.Enforcer{}, false, service.AuthError{Msg: "unauthorized"}
+	}
+	enforcer, err := service.AuthenticateEnforcer(ctx, repo, apiKey)
+	if err != nil {
+		return model.Enforcer{}, false, err
+	}
+	return enforcer, enforcer.NeedsRotation(time.Now()), nil
+}
+
+// verifiedClientCert returns the client certificate if the TLS handshake
+// verified it against the controlplane CA.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
@@ -0,0 +1,64 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ApplyAttemptsKept is how many apply attempts are kept per enforcer.
+const ApplyAttemptsKept = 20
+
+// StateDigests are digests of the firewall rules and WireGuard peers an
+// enforcer should have installed for its applied config, and of those it
+// read back from nftables and wgctrl. Empty digests were not reported.
+type StateDigests struct {
+	ExpectedRulesetDigest  string `gorm:"column:expected_ruleset_digest" json:"expected_ruleset_digest"`
+	InstalledRulesetDigest string `gorm:"column:installed_ruleset_digest" json:"installed_ruleset_digest"`
+	ExpectedPeersDigest    string `gorm:"column:expected_peers_digest" json:"expected_peers_digest"`
+	InstalledPeersDigest   string `gorm:"column:installed_peers_digest" json:"installed_peers_digest"`
+}
+
+// RulesetDrifted reports whether the installed firewall rules differ from
+// the intended ones.
+func (d StateDigests) RulesetDrifted() bool {
+	return d.ExpectedRulesetDigest != "" && d.InstalledRulesetDigest != d.ExpectedRulesetDigest
+}
+
+// PeersDrifted reports whether the installed WireGuard peers differ from the
+// intended ones.
+func (d StateDigests) PeersDrifted() bool {
+	return d.ExpectedPeersDigest != "" && d.InstalledPeersDigest != d.ExpectedPeersDigest
+}
+
+func (d StateDigests) Drifted() bool {
+	return d.RulesetDrifted() || d.PeersDrifted()
+}
+
+// ApplyAttempt is one attempt of an enforcer to apply a config revision.
+type ApplyAttempt struct {
+	ID         string `gorm:"primaryKey" json:"id"`
+	EnforcerID string `gorm:"column:enforcer_id;index" json:"enforcer_id"`
+	// Version is 0 when the bundle was rejected before its version was known
+	Version      uint64       `gorm:"column:version" json:"version"`
+	Success      bool         `gorm:"column:success" json:"success"`
+	Error        string       `gorm:"column:error" json:"error"`
+	StateDigests StateDigests `gorm:"embedded" json:"state_digests"`
+	AttemptedAt  time.Time    `gorm:"column:attempted_at;index" json:"attempted_at"`
+}
+
+func (ApplyAttempt) TableName() string {
+	return "apply_attempts"
+}
+
+func NewApplyAttempt(enforcerID string, version uint64, applyErr string, digests StateDigests, attemptedAt time.Time) ApplyAttempt {
+	return ApplyAttempt{
+		ID:           uuid.NewString(),
+		EnforcerID:   enforcerID,
+		Version:      version,
+		Success:      applyErr == "",
+		Error:        applyErr,
+		StateDigests: digests,
+		AttemptedAt:  attemptedAt,
+	}
+}
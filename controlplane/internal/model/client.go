@@ -6,15 +6,15 @@ import (
 )
 
 type Client struct {
-	ID           string `gorm:"primaryKey" json:"id"`
-	Name         string `gorm:"not null" json:"name"`
-	Username     string `gorm:"uniqueIndex" json:"username"`
-	WGPublicKey  string `gorm:"column:wg_public_key;uniqueIndex" json:"wg_public_key"`
-	Password     string `gorm:"-" json:"password,omitempty"`
-	PasswordHash string `gorm:"column:password_hash" json:"-"`
+	ID           string   `gorm:"primaryKey" json:"id"`
+	Name         string   `gorm:"not null" json:"name"`
+	Username     string   `gorm:"uniqueIndex" json:"username"`
+	Password     string   `gorm:"-" json:"password,omitempty"`
+	PasswordHash string   `gorm:"column:password_hash" json:"-"`
+	Devices      []Device `gorm:"foreignKey:ClientID" json:"devices,omitempty"`
 }
 
-func NewClient(name, username, password, wgPublicKey string) (Client, error) {
+func NewClient(name, username, password string) (Client, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		return Client{}, err
@@ -24,6 +24,5 @@ func NewClient(name, username, password, wgPublicKey string) (Client, error) {
 		Name:         name,
 		Username:     username,
 		PasswordHash: string(hash),
-		WGPublicKey:  wgPublicKey,
 	}, nil
 }
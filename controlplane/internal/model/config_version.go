@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// ConfigVersion tracks the version of the configuration served to one
+// enforcer or device. The version increases whenever the content changes, so
+// holders can refuse a bundle older than the one they applied.
+type ConfigVersion struct {
+	Target    string    `gorm:"primaryKey;column:target" json:"target"`
+	Version   uint64    `gorm:"column:version;not null" json:"version"`
+	Digest    string    `gorm:"column:digest;not null" json:"digest"` // SHA-256 of the config JSON
+	UpdatedAt time.Time `gorm:"column:updated_at" json:"updated_at"`
+}
+
+func (ConfigVersion) TableName() string {
+	return "config_versions"
+}
+
+// EnforcerConfigTarget and DeviceConfigTarget name the holder a signed
+// configuration bundle is meant for.
+func EnforcerConfigTarget(enforcerID string) string {
+	return "enforcer:" + enforcerID
+}
+
+func DeviceConfigTarget(deviceID string) string {
+	return "device:" + deviceID
+}
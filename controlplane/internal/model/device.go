@@ -0,0 +1,56 @@
+package model
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Device approval states. Devices added by an admin are approved at once;
+// devices that register themselves wait in pending until an admin approves.
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+)
+
+// Device is a machine owned by a Client. Access policies are granted to the
+// Client; WireGuard peers and log attribution are per Device.
+type Device struct {
+	ID           string    `gorm:"primaryKey" json:"id"`
+	ClientID     string    `gorm:"column:client_id;not null;index" json:"client_id"`
+	Name         string    `gorm:"not null" json:"name"`
+	WGPublicKey  string    `gorm:"column:wg_public_key;uniqueIndex;not null" json:"wg_public_key"`
+	Status       string    `gorm:"not null;default:approved" json:"status"`
+	KeyRotatedAt time.Time `gorm:"column:key_rotated_at" json:"key_rotated_at"`
+	LastSeenAt   time.Time `gorm:"column:last_seen_at" json:"last_seen_at"`
+	CreatedAt    time.Time `gorm:"column:created_at" json:"created_at"`
+	Client       Client    `gorm:"constraint:OnDelete:CASCADE;foreignKey:ClientID" json:"-"`
+}
+
+func NewDevice(clientID, name, wgPublicKey, status string) Device {
+	return Device{
+		ID:          uuid.NewString(),
+		ClientID:    clientID,
+		Name:        name,
+		WGPublicKey: wgPublicKey,
+		Status:      status,
+		CreatedAt:   time.Now(),
+	}
+}
+
+func (d Device) IsApproved() bool {
+	return d.Status == DeviceStatusApproved
+}
+
+// TunnelIP is a device's address inside one enforcer's tunnel subnet.
+type TunnelIP struct {
+	EnforcerID string   `gorm:"primaryKey;column:enforcer_id;uniqueIndex:idx_tunnel_ip_enforcer_ip" json:"enforcer_id"`
+	DeviceID   string   `gorm:"primaryKey;column:device_id" json:"device_id"`
+	IP         string   `gorm:"column:ip;not null;uniqueIndex:idx_tunnel_ip_enforcer_ip" json:"ip"`
+	Enforcer   Enforcer `gorm:"constraint:OnDelete:CASCADE;foreignKey:EnforcerID" json:"-"`
+	Device     Device   `gorm:"constraint:OnDelete:CASCADE;foreignKey:DeviceID" json:"-"`
+}
+
+func (TunnelIP) TableName() string {
+	return "tunnel_ips"
+}
@@ -0,0 +1,21 @@
+package model
+
+import "time"
+
+// DiscoveredDestination counts the connections logged under a discovery
+// resource to one destination address, protocol and port.
+type DiscoveredDestination struct {
+	ResourceID  string    `gorm:"primaryKey;column:resource_id" json:"resource_id"`
+	Resource    Resource  `gorm:"constraint:OnDelete:CASCADE;foreignKey:ResourceID" json:"-"`
+	DstIP       string    `gorm:"primaryKey;column:dst_ip" json:"dst_ip"`
+	Protocol    string    `gorm:"primaryKey;column:protocol" json:"protocol"`
+	DstPort     int       `gorm:"primaryKey;column:dst_port" json:"dst_port"`
+	FirstSeen   time.Time `gorm:"column:first_seen" json:"first_seen"`
+	LastSeen    time.Time `gorm:"column:last_seen" json:"last_seen"`
+	Connections int64     `gorm:"column:connections;not null" json:"connections"`
+	Bytes       int64     `gorm:"column:bytes;not null" json:"bytes"`
+}
+
+func (DiscoveredDestination) TableName() string {
+	return "discovered_destinations"
+}
@@ -6,11 +6,20 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Enforcer credential lifetimes. Enforcers rotate their credential on their
+// own once it is within CredentialRenewBefore of expiring.
+const (
+	CredentialTTL           = 30 * 24 * time.Hour
+	CredentialRenewBefore   = 10 * 24 * time.Hour
+	CredentialRotationGrace = 10 * time.Minute
+)
+
 type Enforcer struct {
 	ID           string `gorm:"primaryKey" json:"id"`
 	Name         string `gorm:"uniqueIndex;not null" json:"name"`
@@ -19,37 +28,148 @@ type Enforcer struct {
 	WGPublicKey  string `gorm:"column:wg_public_key" json:"wg_public_key"`
 	Endpoint     string `gorm:"not null" json:"endpoint"`
 	TunnelSubnet string `gorm:"column:tunnel_subnet;not null" json:"tunnel_subnet"`
+
+	// CredentialExpiresAt is zero for keys issued before credentials expired.
+	CredentialExpiresAt time.Time `gorm:"column:credential_expires_at" json:"credential_expires_at"`
+	// RotateRequested asks the enforcer to rotate on its next request.
+	RotateRequested bool `gorm:"column:rotate_requested" json:"rotate_requested"`
+	// The previous key keeps working for a short grace period after rotation.
+	PreviousAPIKeyHash      string    `gorm:"column:previous_api_key_hash" json:"-"`
+	PreviousAPIKeyExpiresAt time.Time `gorm:"column:previous_api_key_expires_at" json:"-"`
+
+	// Client certificate issued by the controlplane CA, identified by serial.
+	// The replaced certificate also keeps working for CredentialRotationGrace.
+	CertSerial             string    `gorm:"column:cert_serial" json:"-"`
+	CertExpiresAt          time.Time `gorm:"column:cert_expires_at" json:"cert_expires_at"`
+	PreviousCertSerial     string    `gorm:"column:previous_cert_serial" json:"-"`
+	PreviousCertValidUntil time.Time `gorm:"column:previous_cert_valid_until" json:"-"`
+
+	// LogRetentionDays is how long raw log entries are kept; 0 uses the
+	// controlplane default.
+	LogRetentionDays int `gorm:"column:log_retention_days;not null;default:0" json:"log_retention_days"`
+	// LogSeq is the highest log batch sequence number written from the
+	// enforcer.
+	LogSeq uint64 `gorm:"column:log_seq;not null;default:0" json:"log_seq"`
 }
 
 func (Enforcer) TableName() string {
 	return "enforcers"
 }
 
-func NewEnforcer(name, endpoint, tunnelSubnet string) (Enforcer, error) {
-	id := uuid.NewString()
-	secret := uuid.NewString()
-	apiKey := "enf_" + id + "_" + secret
-
-	// SHA-256 first to handle keys longer than bcrypt's 72-byte limit
-	h := sha256.Sum256([]byte(apiKey))
-	hash, err := bcrypt.GenerateFromPassword(h[:], bcrypt.DefaultCost)
-	if err != nil {
-		return Enforcer{}, err
-	}
-
+// NewEnforcer creates an enforcer without a credential. It obtains one by
+// redeeming an EnrollmentToken.
+func NewEnforcer(name, endpoint, tunnelSubnet string) Enforcer {
 	return Enforcer{
-		ID:           id,
+		ID:           uuid.NewString(),
 		Name:         name,
-		APIKey:       apiKey,
-		APIKeyHash:   string(hash),
 		Endpoint:     endpoint,
 		TunnelSubnet: tunnelSubnet,
-	}, nil
+	}
+}
+
+// IssueCredential replaces the credential with a new "enf_<id>_<secret>" API
+// key, returned once in APIKey. The replaced key stays valid for
+// CredentialRotationGrace.
+func (e *Enforcer) IssueCredential(now time.Time) error {
+	apiKey := "enf_" + e.ID + "_" + uuid.NewString()
+	hash, err := hashSecret(apiKey)
+	if err != nil {
+		return err
+	}
+	if e.APIKeyHash != "" {
+		e.PreviousAPIKeyHash = e.APIKeyHash
+		e.PreviousAPIKeyExpiresAt = now.Add(CredentialRotationGrace)
+	}
+	e.APIKey = apiKey
+	e.APIKeyHash = hash
+	e.CredentialExpiresAt = now.Add(CredentialTTL)
+	e.RotateRequested = false
+	return nil
+}
+
+// SetCertificate records a newly issued client certificate.
+func (e *Enforcer) SetCertificate(serial string, expiresAt, now time.Time) {
+	if e.CertSerial != "" {
+		e.PreviousCertSerial = e.CertSerial
+		e.PreviousCertValidUntil = now.Add(CredentialRotationGrace)
+	}
+	e.CertSerial = serial
+	e.CertExpiresAt = expiresAt
+}
+
+// AuthenticateCertificate reports whether a CA-verified certificate with the
+// given serial is still the enforcer's certificate.
+func (e Enforcer) AuthenticateCertificate(serial string, now time.Time) bool {
+	if serial == "" {
+		return false
+	}
+	if serial == e.CertSerial {
+		return true
+	}
+	return serial == e.PreviousCertSerial && now.Before(e.PreviousCertValidUntil)
+}
+
+// RevokeCredential invalidates the current and previous keys and
+// certificates. The enforcer has to enroll again with a new token.
+func (e *Enforcer) RevokeCredential() {
+	e.APIKeyHash = ""
+	e.PreviousAPIKeyHash = ""
+	e.PreviousAPIKeyExpiresAt = time.Time{}
+	e.CredentialExpiresAt = time.Time{}
+	e.RotateRequested = false
+	e.CertSerial = ""
+	e.CertExpiresAt = time.Time{}
+	e.PreviousCertSerial = ""
+	e.PreviousCertValidUntil = time.Time{}
+}
+
+func (e Enforcer) HasCredential() bool {
+	return e.APIKeyHash != ""
 }
 
 func (e Enforcer) VerifyAPIKey(apiKey string) bool {
-	h := sha256.Sum256([]byte(apiKey))
-	return bcrypt.CompareHashAndPassword([]byte(e.APIKeyHash), h[:]) == nil
+	return e.APIKeyHash != "" && verifySecret(e.APIKeyHash, apiKey)
+}
+
+// AuthenticateAPIKey checks apiKey against the current key, then against the
+// previous key during its grace period. previous reports which one matched.
+func (e Enforcer) AuthenticateAPIKey(apiKey string, now time.Time) (ok, previous bool) {
+	if e.VerifyAPIKey(apiKey) {
+		if !e.CredentialExpiresAt.IsZero() && now.After(e.CredentialExpiresAt) {
+			return false, false
+		}
+		return true, false
+	}
+	if e.PreviousAPIKeyHash != "" && now.Before(e.PreviousAPIKeyExpiresAt) &&
+		verifySecret(e.PreviousAPIKeyHash, apiKey) {
+		return true, true
+	}
+	return false, false
+}
+
+// NeedsRotation reports whether the enforcer should rotate its credential:
+// on admin request, close to expiry, or for keys that never expire.
+func (e Enforcer) NeedsRotation(now time.Time) bool {
+	if e.RotateRequested || e.CredentialExpiresAt.IsZero() {
+		return true
+	}
+	return now.Add(CredentialRenewBefore).After(e.CredentialExpiresAt)
+}
+
+// hashSecret hashes a high-entropy secret. SHA-256 first to handle secrets
+// longer than bcrypt's 72-byte limit.
+func hashSecret(secret string) (string, error) {
+	h := sha256.Sum256([]byte(secret))
+	hash, err := bcrypt.GenerateFromPassword(h[:], bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func verifySecret(hash, secret string) bool {
+	h := sha256.Sum256([]byte(secret))
+	return bcrypt.CompareHashAndPassword([]byte(hash), h[:]) == nil
 }
 
 func (e Enforcer) TunnelAddress() (string, error) {
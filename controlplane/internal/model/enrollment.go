@@ -0,0 +1,61 @@
+package model
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EnrollmentTokenTTL is how long an unused enrollment token can be redeemed.
+const EnrollmentTokenTTL = time.Hour
+
+// EnrollmentToken is a single-use secret an enforcer exchanges for its
+// credential.
+type EnrollmentToken struct {
+	ID         string    `gorm:"primaryKey" json:"id"`
+	EnforcerID string    `gorm:"column:enforcer_id;not null;index" json:"enforcer_id"`
+	Token      string    `gorm:"-" json:"token,omitempty"`
+	TokenHash  string    `gorm:"column:token_hash;not null" json:"-"`
+	ExpiresAt  time.Time `gorm:"column:expires_at;not null" json:"expires_at"`
+	Used       bool      `gorm:"not null;default:false" json:"used"`
+	UsedAt     time.Time `gorm:"column:used_at" json:"used_at"`
+	CreatedAt  time.Time `gorm:"column:created_at" json:"created_at"`
+	Enforcer   Enforcer  `gorm:"constraint:OnDelete:CASCADE;foreignKey:EnforcerID" json:"-"`
+}
+
+func (EnrollmentToken) TableName() string {
+	return "enrollment_tokens"
+}
+
+// NewEnrollmentToken creates a token in the form "enr_<id>_<secret>". The
+// plaintext is only available in Token until the value is discarded.
+func NewEnrollmentToken(enforcerID string, now time.Time) (EnrollmentToken, error) {
+	id := uuid.NewString()
+	token := "enr_" + id + "_" + uuid.NewString()
+	hash, err := hashSecret(token)
+	if err != nil {
+		return EnrollmentToken{}, err
+	}
+	return EnrollmentToken{
+		ID:         id,
+		EnforcerID: enforcerID,
+		Token:      token,
+		TokenHash:  hash,
+		ExpiresAt:  now.Add(EnrollmentTokenTTL),
+		CreatedAt:  now,
+	}, nil
+}
+
+func (t EnrollmentToken) Verify(token string, now time.Time) bool {
+	return !t.Used && now.Before(t.ExpiresAt) && verifySecret(t.TokenHash, token)
+}
+
+// ParseEnrollmentToken extracts the token ID from "enr_<id>_<secret>".
+func ParseEnrollmentToken(token string) (id string, ok bool) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != "enr" {
+		return "", false
+	}
+	return parts[1], true
+}
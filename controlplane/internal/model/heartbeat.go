@@ -0,0 +1,65 @@
+package model
+
+import "time"
+
+// Enforcers send a heartbeat every 30 seconds. One missed heartbeat is
+// tolerated before an enforcer counts as stale.
+const (
+	HeartbeatStaleAfter   = 90 * time.Second
+	HeartbeatOfflineAfter = 5 * time.Minute
+)
+
+// Enforcer health states derived from the latest heartbeat.
+const (
+	HealthUnknown = "unknown" // never sent a heartbeat
+	HealthOnline  = "online"
+	HealthStale   = "stale"
+	HealthOffline = "offline"
+)
+
+// EnforcerHeartbeat holds the latest health and inventory report of an
+// enforcer.
+type EnforcerHeartbeat struct {
+	EnforcerID    string `gorm:"primaryKey;column:enforcer_id" json:"enforcer_id"`
+	Version       string `gorm:"column:version" json:"version"`
+	UptimeSeconds int64  `gorm:"column:uptime_seconds" json:"uptime_seconds"`
+	ConfigVersion uint64 `gorm:"column:config_version" json:"config_version"`
+	PeerCount     int    `gorm:"column:peer_count" json:"peer_count"`
+	LogsDropped   uint64 `gorm:"column:logs_dropped" json:"logs_dropped"`
+	// LogsSpooled is how many log entries wait in the enforcer's spool
+	LogsSpooled    uint64 `gorm:"column:logs_spooled" json:"logs_spooled"`
+	FirewallRules  int    `gorm:"column:firewall_rules" json:"firewall_rules"`
+	LastApplyError string `gorm:"column:last_apply_error" json:"last_apply_error"`
+	// StateDigests are from the latest heartbeat or apply attempt, whichever
+	// came last
+	StateDigests StateDigests `gorm:"embedded" json:"state_digests"`
+	ReceivedAt   time.Time    `gorm:"column:received_at" json:"received_at"`
+	// AlertedStatus is the health state last alerted on, so each transition
+	// is alerted once, also across controlplane restarts.
+	AlertedStatus string `gorm:"column:alerted_status" json:"alerted_status"`
+}
+
+func (EnforcerHeartbeat) TableName() string {
+	return "enforcer_heartbeats"
+}
+
+// HealthStatus derives the health state from the latest heartbeat, which
+// may be nil.
+func HealthStatus(h *EnforcerHeartbeat, now time.Time) string {
+	if h == nil {
+		return HealthUnknown
+	}
+	age := now.Sub(h.ReceivedAt)
+	switch {
+	case age > HeartbeatOfflineAfter:
+		return HealthOffline
+	case age > HeartbeatStaleAfter:
+		return HealthStale
+	default:
+		return HealthOnline
+	}
+}
+
+func (h EnforcerHeartbeat) Uptime() time.Duration {
+	return time.Duration(h.UptimeSeconds) * time.Second
+}
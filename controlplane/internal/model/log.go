@@ -11,6 +11,8 @@ type LogEntry struct {
 	EnforcerID   string    `gorm:"column:enforcer_id;index" json:"enforcer_id"`
 	ClientID     string    `gorm:"column:client_id;index" json:"client_id"`
 	ClientName   string    `gorm:"column:client_name" json:"client_name"`
+	DeviceID     string    `gorm:"column:device_id;index" json:"device_id"`
+	DeviceName   string    `gorm:"column:device_name" json:"device_name"`
 	ResourceID   string    `gorm:"column:resource_id;index" json:"resource_id"`
 	ResourceName string    `gorm:"column:resource_name" json:"resource_name"`
 	SrcIP        string    `gorm:"column:src_ip;index" json:"src_ip"`
@@ -19,25 +21,57 @@ type LogEntry struct {
 	SrcPort      int       `gorm:"column:src_port" json:"src_port"`
 	DstPort      int       `gorm:"column:dst_port" json:"dst_port"`
 	Timestamp    time.Time `gorm:"column:timestamp;index" json:"timestamp"`
+	Packets      int64     `gorm:"column:packets;not null;default:1" json:"packets"`
+	Bytes        int64     `gorm:"column:bytes;not null;default:0" json:"bytes"`
+	// DurationMs is how long the connection lasted, 0 if it was not seen
+	// ending (blocked, or logged before the enforcer tracked connections).
+	DurationMs int64 `gorm:"column:duration_ms;not null;default:0" json:"duration_ms"`
+
+	// Verdict and Mode are decided at ingest under the policy revision in
+	// effect at Timestamp, so later policy changes do not rewrite them.
+	Verdict    string `gorm:"column:verdict;index" json:"verdict"`
+	Mode       string `gorm:"column:mode" json:"mode"`
+	RevisionID string `gorm:"column:revision_id" json:"revision_id"`
+	// EnforcerVerdict is the verdict of the enforcer rule that logged the
+	// connection, empty from enforcers that do not report it. Verdict is
+	// deny whenever it is deny or out_of_scope.
+	EnforcerVerdict string `gorm:"column:enforcer_verdict" json:"enforcer_verdict,omitempty"`
+
+	// RolledUp is set once the entry is counted in the hourly and daily
+	// LogRollups. Only rolled up entries are deleted by retention.
+	RolledUp bool `gorm:"column:rolled_up;index" json:"-"`
 }
 
-func NewLogEntry(enforcerID, clientID, clientName, resourceID, resourceName, srcIP, dstIP, protocol string, srcPort, dstPort int, timestamp time.Time) LogEntry {
+func NewLogEntry(enforcerID, revisionID string, decision PolicyDecision, srcIP, dstIP, protocol string, srcPort, dstPort int, packets, bytes int64, timestamp time.Time) LogEntry {
 	return LogEntry{
 		ID:           uuid.NewString(),
 		EnforcerID:   enforcerID,
-		ClientID:     clientID,
-		ClientName:   clientName,
-		ResourceID:   resourceID,
-		ResourceName: resourceName,
+		ClientID:     decision.ClientID,
+		ClientName:   decision.ClientName,
+		DeviceID:     decision.DeviceID,
+		DeviceName:   decision.DeviceName,
+		ResourceID:   decision.ResourceID,
+		ResourceName: decision.ResourceName,
 		SrcIP:        srcIP,
 		DstIP:        dstIP,
 		Protocol:     protocol,
 		SrcPort:      srcPort,
 		DstPort:      dstPort,
-		Timestamp:    timestamp,
+		Timestamp:    timestamp.UTC(),
+		Packets:      packets,
+		Bytes:        bytes,
+		Verdict:      decision.Verdict,
+		Mode:         decision.Mode,
+		RevisionID:   revisionID,
 	}
 }
 
+// LogEntryID derives the ID of an entry from the ID its enforcer gave it, so
+// an entry sent twice is stored once.
+func LogEntryID(enforcerID, entryID string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(enforcerID+"/"+entryID)).String()
+}
+
 func (LogEntry) TableName() string {
 	return "logs"
 }
@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+// Rollup periods.
+const (
+	RollupHour = "hour"
+	RollupDay  = "day"
+)
+
+// HourlyRollupsKept is how long hourly rollups are kept. Daily rollups are
+// kept indefinitely.
+const HourlyRollupsKept = 90 * 24 * time.Hour
+
+// DefaultLogRetentionDays is how long raw log entries are kept when neither
+// their resource nor their enforcer sets a retention.
+const DefaultLogRetentionDays = 30
+
+// LogRollup counts the log entries of one hour or day with the same client,
+// resource, protocol, destination port and verdict. Names are those of the
+// latest entry rolled up.
+type LogRollup struct {
+	Period       string    `gorm:"primaryKey;column:period" json:"period"`
+	BucketStart  time.Time `gorm:"primaryKey;column:bucket_start" json:"bucket_start"` // UTC
+	EnforcerID   string    `gorm:"primaryKey;column:enforcer_id" json:"enforcer_id"`
+	ClientID     string    `gorm:"primaryKey;column:client_id" json:"client_id"`
+	ResourceID   string    `gorm:"primaryKey;column:resource_id" json:"resource_id"`
+	Protocol     string    `gorm:"primaryKey;column:protocol" json:"protocol"`
+	DstPort      int       `gorm:"primaryKey;column:dst_port" json:"dst_port"`
+	Verdict      string    `gorm:"primaryKey;column:verdict" json:"verdict"`
+	ClientName   string    `gorm:"column:client_name" json:"client_name"`
+	ResourceName string    `gorm:"column:resource_name" json:"resource_name"`
+	Entries      int64     `gorm:"column:entries;not null" json:"entries"`
+	Packets      int64     `gorm:"column:packets;not null" json:"packets"`
+	Bytes        int64     `gorm:"column:bytes;not null" json:"bytes"`
+}
+
+func (LogRollup) TableName() string {
+	return "log_rollups"
+}
@@ -0,0 +1,84 @@
+package model
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LogSinkAttemptsKept is how many delivery attempts are kept per sink.
+const LogSinkAttemptsKept = 20
+
+// LogSink forwards ingested log entries to an external system such as a
+// SIEM. Kind, Format and Transport take the values of the sink package.
+type LogSink struct {
+	ID        string `gorm:"primaryKey" json:"id"`
+	Name      string `gorm:"not null" json:"name"`
+	Kind      string `gorm:"not null" json:"kind"`
+	Format    string `gorm:"not null" json:"format"`
+	Target    string `gorm:"not null" json:"target"`
+	Transport string `gorm:"column:transport" json:"transport"`
+	CAFile    string `gorm:"column:ca_file" json:"ca_file"`
+	// Verdicts is a comma-separated list of the verdicts forwarded; empty
+	// forwards all.
+	Verdicts  string    `gorm:"column:verdicts" json:"verdicts"`
+	CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+
+	// Delivered and Dropped count entries delivered and given up on.
+	Delivered int64 `gorm:"column:delivered;not null;default:0" json:"delivered"`
+	Dropped   int64 `gorm:"column:dropped;not null;default:0" json:"dropped"`
+}
+
+func (LogSink) TableName() string {
+	return "log_sinks"
+}
+
+func NewLogSink(name, kind, format, target, transport, caFile string, verdicts []string) LogSink {
+	return LogSink{
+		ID:        uuid.NewString(),
+		Name:      name,
+		Kind:      kind,
+		Format:    format,
+		Target:    target,
+		Transport: transport,
+		CAFile:    caFile,
+		Verdicts:  strings.Join(verdicts, ","),
+		CreatedAt: time.Now().UTC(),
+	}
+}
+
+// Forwards reports whether entries with verdict are sent to the sink.
+func (s LogSink) Forwards(verdict string) bool {
+	return s.Verdicts == "" || slices.Contains(strings.Split(s.Verdicts, ","), verdict)
+}
+
+// LogSinkAttempt is one failed attempt to deliver a batch to a sink, or the
+// delivery that succeeded after failed attempts.
+type LogSinkAttempt struct {
+	ID     string `gorm:"primaryKey" json:"id"`
+	SinkID string `gorm:"column:sink_id;index" json:"sink_id"`
+	// Attempt counts the tries of the batch, from 1
+	Attempt     int       `gorm:"column:attempt" json:"attempt"`
+	Entries     int       `gorm:"column:entries" json:"entries"`
+	Success     bool      `gorm:"column:success" json:"success"`
+	Error       string    `gorm:"column:error" json:"error"`
+	AttemptedAt time.Time `gorm:"column:attempted_at;index" json:"attempted_at"`
+}
+
+func (LogSinkAttempt) TableName() string {
+	return "log_sink_attempts"
+}
+
+func NewLogSinkAttempt(sinkID string, attempt, entries int, sendErr string, attemptedAt time.Time) LogSinkAttempt {
+	return LogSinkAttempt{
+		ID:          uuid.NewString(),
+		SinkID:      sinkID,
+		Attempt:     attempt,
+		Entries:     entries,
+		Success:     sendErr == "",
+		Error:       sendErr,
+		AttemptedAt: attemptedAt.UTC(),
+	}
+}
@@ -0,0 +1,172 @@
+package model
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Verdicts recorded on log entries.
+const (
+	VerdictAllow   = "allow"   // the client is paired with the resource
+	VerdictObserve = "observe" // allowed only because the resource is in observe mode
+	VerdictDeny    = "deny"    // dropped by the enforcer
+	// VerdictOutOfScope is only reported by enforcers, for connections
+	// dropped because the destination is outside every resource of the
+	// enforcer. Their Verdict is deny.
+	VerdictOutOfScope = "out_of_scope"
+)
+
+// PolicyRevision is the access policy of one enforcer as it stood from
+// CreatedAt until the next revision. A revision is recorded whenever the
+// enforcer's config is built and its policy differs from the latest one, so
+// log entries can be judged against the policy in effect when they happened.
+type PolicyRevision struct {
+	ID         string    `gorm:"primaryKey" json:"id"`
+	EnforcerID string    `gorm:"column:enforcer_id;index" json:"enforcer_id"`
+	Digest     string    `gorm:"column:digest;not null" json:"digest"`     // SHA-256 of Snapshot
+	Snapshot   string    `gorm:"column:snapshot;not null" json:"snapshot"` // PolicySnapshot JSON
+	CreatedAt  time.Time `gorm:"column:created_at;index" json:"created_at"`
+}
+
+func (PolicyRevision) TableName() string {
+	return "policy_revisions"
+}
+
+func NewPolicyRevision(enforcerID, digest, snapshot string, createdAt time.Time) PolicyRevision {
+	return PolicyRevision{
+		ID:         uuid.NewString(),
+		EnforcerID: enforcerID,
+		Digest:     digest,
+		Snapshot:   snapshot,
+		CreatedAt:  createdAt,
+	}
+}
+
+// PolicySnapshot holds what is needed to tell who a connection came from,
+// which resource it went to and whether the enforcer let it through.
+type PolicySnapshot struct {
+	Devices   []SnapshotDevice   `json:"devices"`
+	Resources []SnapshotResource `json:"resources"`
+}
+
+// SnapshotDevice is a WireGuard peer of the enforcer.
+type SnapshotDevice struct {
+	TunnelIP   string   `json:"tunnel_ip"`
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	DeviceID   string   `json:"device_id"`
+	DeviceName string   `json:"device_name"`
+	Granted    []string `json:"granted"` // resource IDs the device may reach
+}
+
+type SnapshotResource struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	CIDR    string   `json:"cidr"`
+	Mode    string   `json:"mode"`
+	Clients []string `json:"clients"` // IDs of paired clients
+	// Discovery resources are observed whatever their mode
+	Discovery bool `json:"discovery,omitempty"`
+	// Gated resources have posture requirements
+	Gated bool `json:"gated,omitempty"`
+}
+
+// PolicyDecision is the outcome of a connection under a PolicySnapshot.
+// Client and resource fields are empty when no device or resource matched.
+type PolicyDecision struct {
+	ClientID     string
+	ClientName   string
+	DeviceID     string
+	DeviceName   string
+	ResourceID   string
+	ResourceName string
+	Mode         string
+	Verdict      string
+}
+
+// Decide derives the client from the source tunnel IP and the resource from
+// the destination. Like the enforcer, it takes the most specific resource
+// containing the destination, an enforce one over others with the same
+// CIDR and then a gated one, and counts discovery resources as observe ones. The connection is
+// allowed if the device is granted the resource and its client is paired
+// with it, observed if granted an observe resource, and denied otherwise.
+func (s PolicySnapshot) Decide(srcIP, dstIP string) PolicyDecision {
+	d := PolicyDecision{Verdict: VerdictDeny}
+	src, err := netip.ParseAddr(srcIP)
+	if err != nil {
+		return d
+	}
+	dst, err := netip.ParseAddr(dstIP)
+	if err != nil {
+		return d
+	}
+
+	var device *SnapshotDevice
+	for i := range s.Devices {
+		if ip, err := netip.ParseAddr(s.Devices[i].TunnelIP); err == nil && ip == src {
+			device = &s.Devices[i]
+			break
+		}
+	}
+	granted := make(map[string]bool)
+	if device != nil {
+		d.ClientID, d.ClientName = device.ClientID, device.ClientName
+		d.DeviceID, d.DeviceName = device.DeviceID, device.DeviceName
+		for _, id := range device.Granted {
+			granted[id] = true
+		}
+	}
+
+	var match *SnapshotResource
+	bits := -1
+	for i := range s.Resources {
+		r := &s.Resources[i]
+		prefix, err := netip.ParsePrefix(r.CIDR)
+		if err != nil || !prefix.Contains(dst) {
+			continue
+		}
+		// Among resources with the same CIDR, which only differ in what the
+		// log says, a registered and granted one names the connection best
+		better := prefix.Bits() > bits
+		if !better && prefix.Bits() == bits {
+			switch {
+			case r.enforced() != match.enforced():
+				better = r.enforced()
+			case r.Gated != match.Gated:
+				better = r.Gated
+			case r.Discovery != match.Discovery:
+				better = !r.Discovery
+			default:
+				better = granted[r.ID] && !granted[match.ID]
+			}
+		}
+		if better {
+			match, bits = r, prefix.Bits()
+		}
+	}
+	if match == nil {
+		return d
+	}
+	d.ResourceID, d.ResourceName, d.Mode = match.ID, match.Name, match.Mode
+
+	if !granted[match.ID] {
+		return d
+	}
+	for _, id := range match.Clients {
+		if id == d.ClientID {
+			d.Verdict = VerdictAllow
+			return d
+		}
+	}
+	if !match.enforced() {
+		d.Verdict = VerdictObserve
+	}
+	return d
+}
+
+// enforced reports whether the enforcer enforces the resource.
+func (r SnapshotResource) enforced() bool {
+	return r.Mode == ModeEnforce && !r.Discovery
+}
@@ -0,0 +1,65 @@
+package model
+
+import "testing"
+
+// The cases follow the compiler golden tests of the enforcer
+// (enforcer/internal/policy/testdata), whose rulesets Decide must agree with.
+func TestPolicySnapshotDecide(t *testing.T) {
+	s := PolicySnapshot{
+		Devices: []SnapshotDevice{
+			{TunnelIP: "100.64.0.2", ClientID: "c-alice", Granted: []string{"r-office", "r-finance", "r-intranet", "r-lab", "r-corp", "r-vpc", "r-hr", "r-wiki", "r-wiki-gated"}},
+			{TunnelIP: "100.64.0.3", ClientID: "c-bob", Granted: []string{"r-office", "r-intranet", "r-lab", "r-ledger", "r-vpc", "r-build", "r-wiki"}},
+		},
+		Resources: []SnapshotResource{
+			// nested: enforce inside observe, observe inside that
+			{ID: "r-office", CIDR: "10.0.0.0/16", Mode: ModeObserve},
+			{ID: "r-finance", CIDR: "10.0.5.0/24", Mode: ModeEnforce, Clients: []string{"c-alice"}},
+			{ID: "r-intranet", CIDR: "10.0.5.80/32", Mode: ModeObserve},
+			// the same CIDR in both modes is enforced
+			{ID: "r-lab", CIDR: "10.0.6.0/24", Mode: ModeObserve},
+			{ID: "r-lab-admin", CIDR: "10.0.6.0/24", Mode: ModeEnforce},
+			// nested_enforce: enforce inside enforce
+			{ID: "r-corp", CIDR: "10.1.0.0/16", Mode: ModeEnforce, Clients: []string{"c-alice"}},
+			{ID: "r-ledger", CIDR: "10.1.5.0/24", Mode: ModeEnforce, Clients: []string{"c-bob"}},
+			// a discovery range around a registered host
+			{ID: "r-vpc", CIDR: "10.2.0.0/16", Mode: ModeObserve, Discovery: true},
+			{ID: "r-build", CIDR: "10.2.0.10/32", Mode: ModeObserve},
+			// posture_observe: observe resources with posture requirements,
+			// granted only to the devices meeting them
+			{ID: "r-hr", CIDR: "10.3.0.0/24", Mode: ModeObserve, Gated: true},
+			{ID: "r-wiki", CIDR: "10.4.0.0/24", Mode: ModeObserve},
+			{ID: "r-wiki-gated", CIDR: "10.4.0.0/24", Mode: ModeObserve, Gated: true},
+		},
+	}
+	tests := []struct {
+		name         string
+		src, dst     string
+		wantResource string
+		wantVerdict  string
+	}{
+		{"paired with nested enforce", "100.64.0.2", "10.0.5.1", "r-finance", VerdictAllow},
+		{"unpaired with nested enforce", "100.64.0.3", "10.0.5.1", "r-finance", VerdictDeny},
+		{"observe around nested enforce", "100.64.0.3", "10.0.4.1", "r-office", VerdictObserve},
+		{"observe inside enforce", "100.64.0.3", "10.0.5.80", "r-intranet", VerdictObserve},
+		{"CIDR in both modes", "100.64.0.3", "10.0.6.1", "r-lab-admin", VerdictDeny},
+		{"paired with outer enforce only", "100.64.0.2", "10.1.5.1", "r-ledger", VerdictDeny},
+		{"paired with outer enforce", "100.64.0.2", "10.1.0.1", "r-corp", VerdictAllow},
+		{"paired with inner enforce", "100.64.0.3", "10.1.5.1", "r-ledger", VerdictAllow},
+		{"discovery", "100.64.0.3", "10.2.0.11", "r-vpc", VerdictObserve},
+		{"registered inside discovery", "100.64.0.3", "10.2.0.10", "r-build", VerdictObserve},
+		{"gated observe, posture met", "100.64.0.2", "10.3.0.1", "r-hr", VerdictObserve},
+		{"gated observe, posture not met", "100.64.0.3", "10.3.0.1", "r-hr", VerdictDeny},
+		{"CIDR gated and not, posture met", "100.64.0.2", "10.4.0.1", "r-wiki-gated", VerdictObserve},
+		{"CIDR gated and not, posture not met", "100.64.0.3", "10.4.0.1", "r-wiki-gated", VerdictDeny},
+		{"unknown source", "100.64.0.9", "10.0.4.1", "r-office", VerdictDeny},
+		{"outside every resource", "100.64.0.2", "10.9.0.1", "", VerdictDeny},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := s.Decide(tt.src, tt.dst)
+			if d.ResourceID != tt.wantResource || d.Verdict != tt.wantVerdict {
+				t.Errorf("Decide(%s, %s) = %s/%s, want %s/%s", tt.src, tt.dst, d.ResourceID, d.Verdict, tt.wantResource, tt.wantVerdict)
+			}
+		})
+	}
+}
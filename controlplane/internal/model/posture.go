@@ -0,0 +1,118 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostureMaxAge is how long a posture report is trusted. A device that has not
+// reported within this window is treated as meeting no requirements.
+const PostureMaxAge = 5 * time.Minute
+
+// DevicePosture holds the latest posture facts reported by an agent.
+type DevicePosture struct {
+	DeviceID          string    `gorm:"primaryKey;column:device_id" json:"device_id"`
+	OS                string    `gorm:"column:os" json:"os"`
+	OSVersion         string    `gorm:"column:os_version" json:"os_version"`
+	KernelVersion     string    `gorm:"column:kernel_version" json:"kernel_version"`
+	AgentVersion      string    `gorm:"column:agent_version" json:"agent_version"`
+	DiskEncrypted     bool      `gorm:"column:disk_encrypted" json:"disk_encrypted"`
+	FirewallEnabled   bool      `gorm:"column:firewall_enabled" json:"firewall_enabled"`
+	ScreenLockEnabled bool      `gorm:"column:screen_lock_enabled" json:"screen_lock_enabled"`
+	ReportedAt        time.Time `gorm:"column:reported_at" json:"reported_at"`
+}
+
+func (DevicePosture) TableName() string {
+	return "device_postures"
+}
+
+// SameFacts reports whether two reports carry the same facts, ignoring
+// when they were made.
+func (p DevicePosture) SameFacts(other DevicePosture) bool {
+	p.ReportedAt, other.ReportedAt = time.Time{}, time.Time{}
+	return p == other
+}
+
+// PostureRequirement is the set of posture checks a Resource demands.
+// The zero value requires nothing.
+type PostureRequirement struct {
+	DiskEncryption   bool   `gorm:"column:disk_encryption" json:"disk_encryption"`
+	Firewall         bool   `gorm:"column:firewall" json:"firewall"`
+	ScreenLock       bool   `gorm:"column:screen_lock" json:"screen_lock"`
+	MinKernelVersion string `gorm:"column:min_kernel_version" json:"min_kernel_version"`
+	MinAgentVersion  string `gorm:"column:min_agent_version" json:"min_agent_version"`
+}
+
+func (r PostureRequirement) IsEmpty() bool {
+	return r == PostureRequirement{}
+}
+
+// SatisfiedBy reports whether the posture meets every requirement.
+// A missing or stale posture only satisfies an empty requirement.
+func (r PostureRequirement) SatisfiedBy(p *DevicePosture, now time.Time) bool {
+	if r.IsEmpty() {
+		return true
+	}
+	if p == nil || now.Sub(p.ReportedAt) > PostureMaxAge {
+		return false
+	}
+	if r.DiskEncryption && !p.DiskEncrypted {
+		return false
+	}
+	if r.Firewall && !p.FirewallEnabled {
+		return false
+	}
+	if r.ScreenLock && !p.ScreenLockEnabled {
+		return false
+	}
+	if r.MinKernelVersion != "" && CompareVersions(p.KernelVersion, r.MinKernelVersion) < 0 {
+		return false
+	}
+	if r.MinAgentVersion != "" && CompareVersions(p.AgentVersion, r.MinAgentVersion) < 0 {
+		return false
+	}
+	return true
+}
+
+// CompareVersions compares the leading dotted numeric parts of two version
+// strings, e.g. "6.1.0-18-amd64" is compared as 6.1.0. It returns -1, 0 or 1.
+func CompareVersions(a, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x < y {
+			return -1
+		}
+		if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(v string) []int {
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		end := 0
+		for end < len(field) && field[end] >= '0' && field[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, _ := strconv.Atoi(field[:end])
+		parts = append(parts, n)
+		if end < len(field) {
+			break
+		}
+	}
+	return parts
+}
@@ -15,14 +15,27 @@ type Resource struct {
 	Mode       string   `gorm:"not null;default:observe" json:"mode"`
 	EnforcerID string   `gorm:"column:enforcer_id;not null" json:"enforcer_id"`
 	Enforcer   Enforcer `gorm:"constraint:OnDelete:CASCADE;foreignKey:EnforcerID" json:"enforcer,omitempty"`
+
+	// Discovery marks a broad range, such as a whole VPC, that stays in
+	// observe mode while the destinations seen in it are counted to propose
+	// narrower resources. Registered resources inside it take precedence.
+	Discovery bool `gorm:"column:discovery;not null;default:false" json:"discovery"`
+
+	// Posture lists the device checks a client must pass to reach this resource.
+	Posture PostureRequirement `gorm:"embedded;embeddedPrefix:posture_" json:"posture"`
+
+	// LogRetentionDays is how long raw log entries for this resource are
+	// kept; 0 uses the enforcer's retention.
+	LogRetentionDays int `gorm:"column:log_retention_days;not null;default:0" json:"log_retention_days"`
 }
 
-func NewResource(name, cidr, enforcerID, mode string) Resource {
+func NewResource(name, cidr, enforcerID, mode string, posture PostureRequirement) Resource {
 	return Resource{
 		ID:         uuid.NewString(),
 		Name:       name,
 		CIDR:       cidr,
 		Mode:       mode,
 		EnforcerID: enforcerID,
+		Posture:    posture,
 	}
 }
@@ -0,0 +1,220 @@
+// Package pki is the controlplane's embedded certificate authority. It issues
+// client certificates to enforcers and devices and, unless an operator
+// supplies one, the controlplane's own TLS server certificate.
+//
+// Client certificates carry the holder kind in the subject OU and its ID in
+// the CN, e.g. OU=enforcer, CN=<enforcer id>.
+package pki
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Certificate holder kinds.
+const (
+	KindEnforcer = "enforcer"
+	KindDevice   = "device"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	caTTL         = 10 * 365 * 24 * time.Hour
+	serverCertTTL = 365 * 24 * time.Hour
+	// ClientCertTTL is the lifetime of enforcer and device certificates.
+	// Holders renew once a third of it is left.
+	ClientCertTTL = 7 * 24 * time.Hour
+)
+
+type CA struct {
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *ecdsa.PrivateKey
+}
+
+// LoadOrCreateCA loads the CA from dir, creating a new one on first start.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	if certErr == nil && keyErr == nil {
+		return parseCA(certPEM, keyPEM)
+	}
+	if !errors.Is(certErr, os.ErrNotExist) || !errors.Is(keyErr, os.ErrNotExist) {
+		return nil, fmt.Errorf("incomplete CA in %s: %v, %v", dir, certErr, keyErr)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "migration-to-zero-trust controlplane CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(caTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0o600); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(certPath, certPEM, 0o644); err != nil {
+		return nil, err
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+func parseCA(certPEM, keyPEM []byte) (*CA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, errors.New("decode CA certificate")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("decode CA key")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, certPEM: certPEM, key: key}, nil
+}
+
+// CertPEM returns the CA certificate clients pin to verify the controlplane
+// and that the controlplane uses to verify client certificates.
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+func (ca *CA) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// IssuedCertificate is a signed client certificate.
+type IssuedCertificate struct {
+	PEM      []byte
+	Serial   string
+	NotAfter time.Time
+}
+
+// SignClientCSR issues a client certificate for the key in csrPEM. The
+// subject is set from kind and id; whatever the CSR asks for is ignored.
+func (ca *CA) SignClientCSR(csrPEM []byte, kind, id string) (IssuedCertificate, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return IssuedCertificate{}, errors.New("csr must be a PEM encoded CERTIFICATE REQUEST")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return IssuedCertificate{}, fmt.Errorf("parse csr: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return IssuedCertificate{}, fmt.Errorf("csr signature: %w", err)
+	}
+
+	now := time.Now()
+	serial := randomSerial()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: id, OrganizationalUnit: []string{kind}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ClientCertTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	return IssuedCertificate{
+		PEM:      pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Serial:   serial.Text(16),
+		NotAfter: tmpl.NotAfter,
+	}, nil
+}
+
+// ServerCertificate issues a TLS server certificate for hosts (DNS names or
+// IP addresses).
+func (ca *CA) ServerCertificate(hosts []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "controlplane"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(serverCertTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der, ca.cert.Raw}, PrivateKey: key}, nil
+}
+
+// Identity returns the holder kind, ID and serial of a client certificate
+// that has already been verified against the CA.
+func Identity(cert *x509.Certificate) (kind, id, serial string, ok bool) {
+	if cert == nil || len(cert.Subject.OrganizationalUnit) != 1 || cert.Subject.CommonName == "" {
+		return "", "", "", false
+	}
+	return cert.Subject.OrganizationalUnit[0], cert.Subject.CommonName, cert.SerialNumber.Text(16), true
+}
+
+func randomSerial() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+	if err != nil {
+		panic(err)
+	}
+	return serial
+}
@@ -9,15 +9,18 @@ import (
 
 type GormRepository struct {
 	db *gorm.DB
+	// logDB serves log ingestion, so it does not compete with db for its
+	// connection. It may be db itself.
+	logDB *gorm.DB
 }
 
-func NewGormRepository(db *gorm.DB) *GormRepository {
-	return &GormRepository{db: db}
+func NewGormRepository(db, logDB *gorm.DB) *GormRepository {
+	return &GormRepository{db: db, logDB: logDB}
 }
 
 func (r *GormRepository) WithTx(ctx context.Context, fn func(repo Repository) error) error {
 	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		return fn(&GormRepository{db: tx})
+		return fn(&GormRepository{db: tx, logDB: r.logDB})
 	})
 }
 
@@ -0,0 +1,22 @@
+package repository
+
+import (
+	"context"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+// CreateApplyAttempt stores an apply attempt and drops the enforcer's
+// attempts beyond the newest model.ApplyAttemptsKept.
+func (r *GormRepository) CreateApplyAttempt(ctx context.Context, a *model.ApplyAttempt) error {
+	db := r.db.WithContext(ctx)
+	if err := db.Create(a).Error; err != nil {
+		return err
+	}
+	keep := db.Model(&model.ApplyAttempt{}).Select("id").
+		Where("enforcer_id = ?", a.EnforcerID).
+		Order("attempted_at DESC").
+		Limit(model.ApplyAttemptsKept)
+	return db.Where("enforcer_id = ? AND id NOT IN (?)", a.EnforcerID, keep).
+		Delete(&model.ApplyAttempt{}).Error
+}
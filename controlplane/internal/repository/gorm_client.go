@@ -12,7 +12,7 @@ func (r *GormRepository) CreateClient(ctx context.Context, c *model.Client) erro
 
 func (r *GormRepository) ListClients(ctx context.Context) ([]model.Client, error) {
 	var out []model.Client
-	if err := r.db.WithContext(ctx).Find(&out).Error; err != nil {
+	if err := r.db.WithContext(ctx).Preload("Devices").Find(&out).Error; err != nil {
 		return nil, err
 	}
 	return out, nil
@@ -42,12 +42,15 @@ func (r *GormRepository) DeleteClient(ctx context.Context, id string) (bool, err
 	return res.RowsAffected > 0, nil
 }
 
-func (r *GormRepository) FetchClientConfigData(ctx context.Context, clientID string) (ClientConfigData, error) {
+func (r *GormRepository) FetchClientConfigData(ctx context.Context, clientID, deviceID string) (ClientConfigData, error) {
 	var data ClientConfigData
 
 	if err := r.db.WithContext(ctx).First(&data.Client, "id = ?", clientID).Error; err != nil {
 		return ClientConfigData{}, mapErr(err)
 	}
+	if err := r.db.WithContext(ctx).First(&data.Device, "id = ? AND client_id = ?", deviceID, clientID).Error; err != nil {
+		return ClientConfigData{}, mapErr(err)
+	}
 
 	if err := r.db.WithContext(ctx).
 		Preload("Resource").
@@ -57,6 +60,13 @@ func (r *GormRepository) FetchClientConfigData(ctx context.Context, clientID str
 		return ClientConfigData{}, err
 	}
 
+	var posture model.DevicePosture
+	if err := r.db.WithContext(ctx).First(&posture, "device_id = ?", deviceID).Error; err == nil {
+		data.Posture = &posture
+	} else if mapErr(err) != ErrNotFound {
+		return ClientConfigData{}, err
+	}
+
 	// Collect enforcer IDs from pairs (for enforce mode)
 	enforcerIDs := make(map[string]struct{})
 	for _, p := range data.Pairs {
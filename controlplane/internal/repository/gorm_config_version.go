@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+// BumpConfigVersion returns the config version of target for content with
+// the given digest, incrementing it if the digest changed since last time.
+func (r *GormRepository) BumpConfigVersion(ctx context.Context, target, digest string, now time.Time) (uint64, error) {
+	var version uint64
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var v model.ConfigVersion
+		err := tx.First(&v, "target = ?", target).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			v = model.ConfigVersion{Target: target, Version: 1, Digest: digest, UpdatedAt: now}
+			version = v.Version
+			return tx.Create(&v).Error
+		}
+		if err != nil {
+			return err
+		}
+		if v.Digest == digest {
+			version = v.Version
+			return nil
+		}
+		res := tx.Model(&model.ConfigVersion{}).
+			Where("target = ? AND version = ?", target, v.Version).
+			Updates(map[string]any{"version": v.Version + 1, "digest": digest, "updated_at": now})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("config version changed concurrently")
+		}
+		version = v.Version + 1
+		return nil
+	})
+	return version, err
+}
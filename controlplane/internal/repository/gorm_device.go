@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+func (r *GormRepository) CreateDevice(ctx context.Context, d *model.Device) error {
+	return r.db.WithContext(ctx).Create(d).Error
+}
+
+func (r *GormRepository) GetDevice(ctx context.Context, id string) (model.Device, error) {
+	var d model.Device
+	if err := r.db.WithContext(ctx).First(&d, "id = ?", id).Error; err != nil {
+		return model.Device{}, mapErr(err)
+	}
+	return d, nil
+}
+
+func (r *GormRepository) GetDeviceByPublicKey(ctx context.Context, wgPublicKey string) (model.Device, error) {
+	var d model.Device
+	if err := r.db.WithContext(ctx).First(&d, "wg_public_key = ?", wgPublicKey).Error; err != nil {
+		return model.Device{}, mapErr(err)
+	}
+	return d, nil
+}
+
+func (r *GormRepository) ListDevicesByClient(ctx context.Context, clientID string) ([]model.Device, error) {
+	var out []model.Device
+	if err := r.db.WithContext(ctx).Where("client_id = ?", clientID).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *GormRepository) UpdateDeviceStatus(ctx context.Context, id, status string) error {
+	res := r.db.WithContext(ctx).Model(&model.Device{}).Where("id = ?", id).Update("status", status)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormRepository) UpdateDevicePublicKey(ctx context.Context, id, pubKey string, rotatedAt time.Time) error {
+	res := r.db.WithContext(ctx).Model(&model.Device{}).Where("id = ?", id).
+		Updates(map[string]any{"wg_public_key": pubKey, "key_rotated_at": rotatedAt})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *GormRepository) TouchDevice(ctx context.Context, id string, seenAt time.Time) error {
+	return r.db.WithContext(ctx).Model(&model.Device{}).Where("id = ?", id).
+		Update("last_seen_at", seenAt).Error
+}
+
+// DeleteDevice deletes a device with its tunnel IPs and posture in one
+// transaction, so a failure never leaves an address or posture behind for
+// a device that is gone.
+func (r *GormRepository) DeleteDevice(ctx context.Context, id string) (bool, error) {
+	var deleted bool
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&model.TunnelIP{}, "device_id = ?", id).Error; err != nil {
+			return err
+		}
+		if err := tx.Delete(&model.DevicePosture{}, "device_id = ?", id).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&model.Device{}, "id = ?", id)
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted = res.RowsAffected > 0
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// MigrateClientKeys moves the WireGuard keys that clients held before they
+// had devices into one approved device per client, named deviceName, then
+// drops the legacy column, so it runs once. It returns the devices it
+// created.
+func (r *GormRepository) MigrateClientKeys(ctx context.Context, deviceName string) ([]model.Device, error) {
+	var created []model.Device
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		m := tx.Migrator()
+		if !m.HasColumn(&model.Client{}, "wg_public_key") {
+			return nil
+		}
+		var legacy []struct {
+			ID          string
+			WGPublicKey string
+		}
+		if err := tx.Table("clients").Select("id, wg_public_key").
+			Where("wg_public_key IS NOT NULL AND wg_public_key <> ''").
+			Scan(&legacy).Error; err != nil {
+			return err
+		}
+		for _, c := range legacy {
+			var n int64
+			if err := tx.Model(&model.Device{}).Where("wg_public_key = ?", c.WGPublicKey).Count(&n).Error; err != nil {
+				return err
+			}
+			if n > 0 {
+				continue
+			}
+			d := model.NewDevice(c.ID, deviceName, c.WGPublicKey, model.DeviceStatusApproved)
+			if err := tx.Create(&d).Error; err != nil {
+				return err
+			}
+			created = append(created, d)
+		}
+		if m.HasIndex("clients", "idx_clients_wg_public_key") {
+			if err := m.DropIndex("clients", "idx_clients_wg_public_key"); err != nil {
+				return err
+			}
+		}
+		return tx.Exec("ALTER TABLE clients DROP COLUMN wg_public_key").Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (r *GormRepository) ListTunnelIPs(ctx context.Context, enforcerID string) ([]model.TunnelIP, error) {
+	var out []model.TunnelIP
+	if err := r.db.WithContext(ctx).Where("enforcer_id = ?", enforcerID).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *GormRepository) CreateTunnelIP(ctx context.Context, t *model.TunnelIP) error {
+	return r.db.WithContext(ctx).Create(t).Error
+}
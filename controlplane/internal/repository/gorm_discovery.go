@@ -0,0 +1,20 @@
+package repository
+
+import (
+	"context"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+// ListDiscoveredDestinations returns the destinations counted under a
+// discovery resource, ordered by address, protocol and port.
+func (r *GormRepository) ListDiscoveredDestinations(ctx context.Context, resourceID string) ([]model.DiscoveredDestination, error) {
+	var out []model.DiscoveredDestination
+	if err := r.db.WithContext(ctx).
+		Where("resource_id = ?", resourceID).
+		Order("dst_ip, protocol, dst_port").
+		Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -43,6 +43,25 @@ func (r *GormRepository) DeleteEnforcer(ctx context.Context, id string) (bool, e
 	return res.RowsAffected > 0, nil
 }
 
+// AdvanceEnforcerLogSeq raises the enforcer's log sequence number to seq if
+// it is lower.
+func (r *GormRepository) AdvanceEnforcerLogSeq(ctx context.Context, id string, seq uint64) error {
+	return r.db.WithContext(ctx).Model(&model.Enforcer{}).
+		Where("id = ? AND log_seq < ?", id, seq).
+		Update("log_seq", seq).Error
+}
+
+func (r *GormRepository) UpdateEnforcerLogRetention(ctx context.Context, id string, days int) error {
+	res := r.db.WithContext(ctx).Model(&model.Enforcer{}).Where("id = ?", id).Update("log_retention_days", days)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func (r *GormRepository) FetchEnforcerConfigData(ctx context.Context, enforcerID string) (EnforcerConfigData, error) {
 	var data EnforcerConfigData
 
@@ -79,5 +98,38 @@ func (r *GormRepository) FetchEnforcerConfigData(ctx context.Context, enforcerID
 		}
 	}
 
+	// Devices of every client that may appear in a policy
+	clientIDs := make(map[string]struct{})
+	for _, c := range data.Clients {
+		clientIDs[c.ID] = struct{}{}
+	}
+	for _, p := range data.Pairs {
+		clientIDs[p.ClientID] = struct{}{}
+	}
+	ids := make([]string, 0, len(clientIDs))
+	for id := range clientIDs {
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		if err := r.db.WithContext(ctx).Where("client_id IN ? AND status = ?", ids, model.DeviceStatusApproved).Find(&data.Devices).Error; err != nil {
+			return EnforcerConfigData{}, err
+		}
+	}
+
+	var tunnelIPs []model.TunnelIP
+	if err := r.db.WithContext(ctx).Where("enforcer_id = ?", enforcerID).Find(&tunnelIPs).Error; err != nil {
+		return EnforcerConfigData{}, err
+	}
+	data.TunnelIPs = make(map[string]string, len(tunnelIPs))
+	for _, t := range tunnelIPs {
+		data.TunnelIPs[t.DeviceID] = t.IP
+	}
+
+	var postures []model.DevicePosture
+	if err := r.db.WithContext(ctx).Find(&postures).Error; err != nil {
+		return EnforcerConfigData{}, err
+	}
+	data.Postures = postureMap(postures)
+
 	return data, nil
 }
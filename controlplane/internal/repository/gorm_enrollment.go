@@ -0,0 +1,42 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+func (r *GormRepository) CreateEnrollmentToken(ctx context.Context, t *model.EnrollmentToken) error {
+	return r.db.WithContext(ctx).Create(t).Error
+}
+
+func (r *GormRepository) GetEnrollmentToken(ctx context.Context, id string) (model.EnrollmentToken, error) {
+	var t model.EnrollmentToken
+	if err := r.db.WithContext(ctx).First(&t, "id = ?", id).Error; err != nil {
+		return model.EnrollmentToken{}, mapErr(err)
+	}
+	return t, nil
+}
+
+// MarkEnrollmentTokenUsed flags the token as redeemed. It returns ErrNotFound
+// if the token does not exist or was already used, so a token can only be
+// redeemed once even under concurrent requests.
+func (r *GormRepository) MarkEnrollmentTokenUsed(ctx context.Context, id string, usedAt time.Time) error {
+	res := r.db.WithContext(ctx).Model(&model.EnrollmentToken{}).
+		Where("id = ? AND used = ?", id, false).
+		Updates(map[string]any{"used": true, "used_at": usedAt})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteUnusedEnrollmentTokens removes the unused tokens of an enforcer.
+func (r *GormRepository) DeleteUnusedEnrollmentTokens(ctx context.Context, enforcerID string) error {
+	return r.db.WithContext(ctx).Where("enforcer_id = ? AND used = ?", enforcerID, false).
+		Delete(&model.EnrollmentToken{}).Error
+}
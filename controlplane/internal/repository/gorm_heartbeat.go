@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm/clause"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+// UpsertHeartbeat stores the latest heartbeat of an enforcer, keeping the
+// alerted status of the previous one.
+func (r *GormRepository) UpsertHeartbeat(ctx context.Context, h *model.EnforcerHeartbeat) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "enforcer_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"version", "uptime_seconds", "config_version", "peer_count",
+			"logs_dropped", "logs_spooled", "firewall_rules", "last_apply_error", "received_at",
+			"expected_ruleset_digest", "installed_ruleset_digest",
+			"expected_peers_digest", "installed_peers_digest",
+		}),
+	}).Create(h).Error
+}
+
+func (r *GormRepository) GetHeartbeat(ctx context.Context, enforcerID string) (model.EnforcerHeartbeat, error) {
+	var h model.EnforcerHeartbeat
+	if err := r.db.WithContext(ctx).First(&h, "enforcer_id = ?", enforcerID).Error; err != nil {
+		return model.EnforcerHeartbeat{}, mapErr(err)
+	}
+	return h, nil
+}
+
+func (r *GormRepository) ListHeartbeats(ctx context.Context) ([]model.EnforcerHeartbeat, error) {
+	var out []model.EnforcerHeartbeat
+	if err := r.db.WithContext(ctx).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (r *GormRepository) UpdateHeartbeatAlertedStatus(ctx context.Context, enforcerID, status string) error {
+	return r.db.WithContext(ctx).Model(&model.EnforcerHeartbeat{}).
+		Where("enforcer_id = ?", enforcerID).
+		Update("alerted_status", status).Error
+}
+
+// UpdateHeartbeatApplyResult records an apply attempt in an existing
+// heartbeat: its error, its state digests and, if it succeeded, its version.
+func (r *GormRepository) UpdateHeartbeatApplyResult(ctx context.Context, a *model.ApplyAttempt) error {
+	updates := map[string]any{
+		"last_apply_error":         a.Error,
+		"expected_ruleset_digest":  a.StateDigests.ExpectedRulesetDigest,
+		"installed_ruleset_digest": a.StateDigests.InstalledRulesetDigest,
+		"expected_peers_digest":    a.StateDigests.ExpectedPeersDigest,
+		"installed_peers_digest":   a.StateDigests.InstalledPeersDigest,
+	}
+	if a.Success {
+		updates["config_version"] = a.Version
+	}
+	return r.db.WithContext(ctx).Model(&model.EnforcerHeartbeat{}).
+		Where("enforcer_id = ?", a.EnforcerID).
+		Updates(updates).Error
+}
+
+func heartbeatMap(heartbeats []model.EnforcerHeartbeat) map[string]model.EnforcerHeartbeat {
+	out := make(map[string]model.EnforcerHeartbeat, len(heartbeats))
+	for _, h := range heartbeats {
+		out[h.EnforcerID] = h
+	}
+	return out
+}
@@ -2,22 +2,66 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 )
 
-func (r *GormRepository) CreateLog(ctx context.Context, entry *model.LogEntry) error {
-	return r.db.WithContext(ctx).Create(entry).Error
+// logInsertBatchSize keeps a multi-row insert well below SQLite's limit of
+// 32766 bound parameters.
+const logInsertBatchSize = 500
+
+// CreateLogs stores entries in one transaction on the log handle and
+// returns the ones it inserted. Entries whose ID is already stored are
+// skipped.
+func (r *GormRepository) CreateLogs(ctx context.Context, entries []model.LogEntry) ([]model.LogEntry, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	var inserted []model.LogEntry
+	err := r.logDB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		seen := make(map[string]bool, len(entries))
+		for start := 0; start < len(entries); start += logInsertBatchSize {
+			ids := make([]string, 0, logInsertBatchSize)
+			for _, e := range entries[start:min(start+logInsertBatchSize, len(entries))] {
+				ids = append(ids, e.ID)
+			}
+			var stored []string
+			if err := tx.Model(&model.LogEntry{}).Where("id IN ?", ids).Pluck("id", &stored).Error; err != nil {
+				return err
+			}
+			for _, id := range stored {
+				seen[id] = true
+			}
+		}
+		inserted = make([]model.LogEntry, 0, len(entries))
+		for _, e := range entries {
+			if !seen[e.ID] {
+				seen[e.ID] = true
+				inserted = append(inserted, e)
+			}
+		}
+		if len(inserted) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).
+			CreateInBatches(inserted, logInsertBatchSize).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
 }
 
-func (r *GormRepository) ListLogsByEnforcer(ctx context.Context, enforcerID string, limit int) ([]LogEntryWithPair, error) {
-	var out []LogEntryWithPair
+func (r *GormRepository) ListLogsByEnforcer(ctx context.Context, enforcerID string, limit int) ([]model.LogEntry, error) {
+	var out []model.LogEntry
 	query := r.db.WithContext(ctx).
-		Table("logs").
-		Select("logs.*, (pairs.id IS NOT NULL) as has_pair").
-		Joins("LEFT JOIN pairs ON logs.client_id = pairs.client_id AND logs.resource_id = pairs.resource_id").
-		Where("logs.enforcer_id = ?", enforcerID).
-		Order("logs.timestamp DESC")
+		Where("enforcer_id = ?", enforcerID).
+		Order("timestamp DESC")
 	if limit > 0 {
 		query = query.Limit(limit)
 	}
@@ -27,14 +71,11 @@ func (r *GormRepository) ListLogsByEnforcer(ctx context.Context, enforcerID stri
 	return out, nil
 }
 
-func (r *GormRepository) ListLogsByEnforcerAndResourceID(ctx context.Context, enforcerID, resourceID string, limit int) ([]LogEntryWithPair, error) {
-	var out []LogEntryWithPair
+func (r *GormRepository) ListLogsByEnforcerAndResourceID(ctx context.Context, enforcerID, resourceID string, limit int) ([]model.LogEntry, error) {
+	var out []model.LogEntry
 	query := r.db.WithContext(ctx).
-		Table("logs").
-		Select("logs.*, (pairs.id IS NOT NULL) as has_pair").
-		Joins("LEFT JOIN pairs ON logs.client_id = pairs.client_id AND logs.resource_id = pairs.resource_id").
-		Where("logs.enforcer_id = ? AND logs.resource_id = ?", enforcerID, resourceID).
-		Order("logs.timestamp DESC")
+		Where("enforcer_id = ? AND resource_id = ?", enforcerID, resourceID).
+		Order("timestamp DESC")
 	if limit > 0 {
 		query = query.Limit(limit)
 	}
@@ -43,3 +84,60 @@ func (r *GormRepository) ListLogsByEnforcerAndResourceID(ctx context.Context, en
 	}
 	return out, nil
 }
+
+// SearchLogs returns the entries matching q, in the order it asks for.
+func (r *GormRepository) SearchLogs(ctx context.Context, q LogQuery) ([]model.LogEntry, error) {
+	switch q.Sort {
+	case LogSortTime, LogSortBytes, LogSortPackets, LogSortDuration:
+	default:
+		return nil, fmt.Errorf("unknown log sort %q", q.Sort)
+	}
+	query := r.db.WithContext(ctx).Model(&model.LogEntry{})
+	if !q.From.IsZero() {
+		query = query.Where("timestamp >= ?", q.From.UTC())
+	}
+	if !q.To.IsZero() {
+		query = query.Where("timestamp < ?", q.To.UTC())
+	}
+	for _, f := range []struct{ column, value string }{
+		{"enforcer_id", q.EnforcerID},
+		{"client_id", q.ClientID},
+		{"resource_id", q.ResourceID},
+		{"src_ip", q.SrcIP},
+		{"dst_ip", q.DstIP},
+		{"protocol", q.Protocol},
+	} {
+		if f.value != "" {
+			query = query.Where(f.column+" = ?", f.value)
+		}
+	}
+	if q.DstPort != 0 {
+		query = query.Where("dst_port = ?", q.DstPort)
+	}
+	if len(q.Verdicts) > 0 {
+		query = query.Where("verdict IN ?", q.Verdicts)
+	}
+
+	// Keyset pagination: continue strictly past the cursor entry
+	op, dir := ">", "ASC"
+	if q.Desc {
+		op, dir = "<", "DESC"
+	}
+	if q.After != nil {
+		value := q.After.Value
+		if t, ok := value.(time.Time); ok {
+			value = t.UTC()
+		}
+		query = query.Where(fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND id %[2]s ?)", q.Sort, op), value, value, q.After.ID)
+	}
+	query = query.Order(q.Sort + " " + dir).Order("id " + dir)
+	if q.Limit > 0 {
+		query = query.Limit(q.Limit)
+	}
+
+	var out []model.LogEntry
+	if err := query.Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
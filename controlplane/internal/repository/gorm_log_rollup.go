@@ -0,0 +1,136 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"gorm.io/gorm"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+// rollupChunk bounds the time span of log entries rolled up in one
+// transaction, so a large backlog does not hold the write lock for long.
+const rollupChunk = 24 * time.Hour
+
+// sqliteTime formats t like strftime in SQLite, for comparing with bucket
+// starts.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+const rollupInsert = `
+INSERT INTO log_rollups (period, bucket_start, enforcer_id, client_id, resource_id, protocol, dst_port, verdict,
+	client_name, resource_name, entries, packets, bytes)
+SELECT ?, strftime(?, timestamp), enforcer_id, client_id, resource_id, protocol, dst_port, verdict,
+	MAX(client_name), MAX(resource_name), COUNT(*), SUM(packets), SUM(bytes)
+FROM logs
+WHERE NOT rolled_up AND timestamp < ?
+GROUP BY 2, enforcer_id, client_id, resource_id, protocol, dst_port, verdict
+ON CONFLICT (period, bucket_start, enforcer_id, client_id, resource_id, protocol, dst_port, verdict) DO UPDATE SET
+	client_name = excluded.client_name,
+	resource_name = excluded.resource_name,
+	entries = entries + excluded.entries,
+	packets = packets + excluded.packets,
+	bytes = bytes + excluded.bytes`
+
+// discoveryInsert counts the destinations of the same entries when they
+// belong to a discovery resource.
+const discoveryInsert = `
+INSERT INTO discovered_destinations (resource_id, dst_ip, protocol, dst_port, first_seen, last_seen, connections, bytes)
+SELECT resource_id, dst_ip, protocol, dst_port, MIN(timestamp), MAX(timestamp), COUNT(*), SUM(bytes)
+FROM logs
+WHERE NOT rolled_up AND timestamp < ? AND resource_id IN (SELECT id FROM resources WHERE discovery)
+GROUP BY resource_id, dst_ip, protocol, dst_port
+ON CONFLICT (resource_id, dst_ip, protocol, dst_port) DO UPDATE SET
+	first_seen = MIN(first_seen, excluded.first_seen),
+	last_seen = MAX(last_seen, excluded.last_seen),
+	connections = connections + excluded.connections,
+	bytes = bytes + excluded.bytes`
+
+// RollUpLogs adds the log entries before the given time that were not
+// rolled up yet to the hourly and daily rollups, and marks them rolled up.
+// It returns how many entries were rolled up.
+func (r *GormRepository) RollUpLogs(ctx context.Context, before time.Time) (int64, error) {
+	db := r.logDB.WithContext(ctx)
+	var total int64
+	for {
+		var oldest []time.Time
+		if err := db.Model(&model.LogEntry{}).
+			Where("NOT rolled_up AND timestamp < ?", before).
+			Order("timestamp").Limit(1).
+			Pluck("timestamp", &oldest).Error; err != nil {
+			return total, err
+		}
+		if len(oldest) == 0 {
+			return total, nil
+		}
+		end := oldest[0].Truncate(time.Hour).Add(rollupChunk)
+		if end.After(before) {
+			end = before
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec(rollupInsert, model.RollupHour, "%Y-%m-%d %H:00:00", end).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec(rollupInsert, model.RollupDay, "%Y-%m-%d 00:00:00", end).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec(discoveryInsert, end).Error; err != nil {
+				return err
+			}
+			res := tx.Model(&model.LogEntry{}).Where("NOT rolled_up AND timestamp < ?", end).Update("rolled_up", true)
+			total += res.RowsAffected
+			return res.Error
+		})
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// DeleteExpiredLogs deletes rolled up log entries older than their
+// retention: the resource's if set, otherwise the enforcer's, otherwise
+// defaultDays. It returns how many entries were deleted.
+func (r *GormRepository) DeleteExpiredLogs(ctx context.Context, defaultDays int, now time.Time) (int64, error) {
+	res := r.logDB.WithContext(ctx).Exec(`
+DELETE FROM logs
+WHERE rolled_up AND julianday(timestamp) < julianday(?) - COALESCE(
+	(SELECT NULLIF(log_retention_days, 0) FROM resources WHERE resources.id = logs.resource_id),
+	(SELECT NULLIF(log_retention_days, 0) FROM enforcers WHERE enforcers.id = logs.enforcer_id),
+	?)`, sqliteTime(now), defaultDays)
+	return res.RowsAffected, res.Error
+}
+
+// DeleteLogRollupsBefore deletes rollups of the period starting before the
+// given time.
+func (r *GormRepository) DeleteLogRollupsBefore(ctx context.Context, period string, before time.Time) (int64, error) {
+	res := r.logDB.WithContext(ctx).
+		Where("period = ? AND bucket_start < ?", period, sqliteTime(before)).
+		Delete(&model.LogRollup{})
+	return res.RowsAffected, res.Error
+}
+
+// SummarizeLogRollups adds up an enforcer's rollups of the period whose
+// buckets start in [from, to), largest byte count first. An empty resourceID
+// matches all resources.
+func (r *GormRepository) SummarizeLogRollups(ctx context.Context, enforcerID, resourceID, period string, from, to time.Time, limit int) ([]LogRollupSummary, error) {
+	query := r.db.WithContext(ctx).Model(&model.LogRollup{}).
+		Select(`client_id, MAX(client_name) AS client_name, resource_id, MAX(resource_name) AS resource_name,
+			protocol, dst_port, verdict, SUM(entries) AS entries, SUM(packets) AS packets, SUM(bytes) AS bytes`).
+		Where("enforcer_id = ? AND period = ? AND bucket_start >= ? AND bucket_start < ?", enforcerID, period, sqliteTime(from), sqliteTime(to)).
+		Group("client_id, resource_id, protocol, dst_port, verdict").
+		Order("bytes DESC, entries DESC")
+	if resourceID != "" {
+		query = query.Where("resource_id = ?", resourceID)
+	}
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var out []LogRollupSummary
+	if err := query.Scan(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
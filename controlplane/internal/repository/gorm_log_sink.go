@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+func (r *GormRepository) CreateLogSink(ctx context.Context, s *model.LogSink) error {
+	return r.db.WithContext(ctx).Create(s).Error
+}
+
+func (r *GormRepository) ListLogSinks(ctx context.Context) ([]model.LogSink, error) {
+	var out []model.LogSink
+	if err := r.db.WithContext(ctx).Order("created_at").Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteLogSink deletes a sink with its delivery attempts.
+func (r *GormRepository) DeleteLogSink(ctx context.Context, id string) (bool, error) {
+	var deleted bool
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&model.LogSinkAttempt{}, "sink_id = ?", id).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&model.LogSink{}, "id = ?", id)
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted = res.RowsAffected > 0
+		return nil
+	})
+	return deleted, err
+}
+
+// AddLogSinkCounts adds to the sink's delivered and dropped entry counts.
+func (r *GormRepository) AddLogSinkCounts(ctx context.Context, id string, delivered, dropped int64) error {
+	return r.db.WithContext(ctx).Model(&model.LogSink{}).Where("id = ?", id).Updates(map[string]any{
+		"delivered": gorm.Expr("delivered + ?", delivered),
+		"dropped":   gorm.Expr("dropped + ?", dropped),
+	}).Error
+}
+
+// CreateLogSinkAttempt stores a delivery attempt and drops the sink's
+// attempts beyond the newest model.LogSinkAttemptsKept.
+func (r *GormRepository) CreateLogSinkAttempt(ctx context.Context, a *model.LogSinkAttempt) error {
+	db := r.db.WithContext(ctx)
+	if err := db.Create(a).Error; err != nil {
+		return err
+	}
+	keep := db.Model(&model.LogSinkAttempt{}).Select("id").
+		Where("sink_id = ?", a.SinkID).
+		Order("attempted_at DESC").
+		Limit(model.LogSinkAttemptsKept)
+	return db.Where("sink_id = ? AND id NOT IN (?)", a.SinkID, keep).
+		Delete(&model.LogSinkAttempt{}).Error
+}
+
+func (r *GormRepository) FetchLogSinksPageData(ctx context.Context) (LogSinksPageData, error) {
+	var data LogSinksPageData
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Order("created_at").Find(&data.Sinks).Error; err != nil {
+			return err
+		}
+		var attempts []model.LogSinkAttempt
+		if err := tx.Order("attempted_at DESC").Find(&attempts).Error; err != nil {
+			return err
+		}
+		data.Attempts = make(map[string][]model.LogSinkAttempt)
+		for _, a := range attempts {
+			data.Attempts[a.SinkID] = append(data.Attempts[a.SinkID], a)
+		}
+		return nil
+	})
+	return data, err
+}
@@ -2,10 +2,30 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"strings"
 
 	"gorm.io/gorm"
+
+	"migration-to-zero-trust/controlplane/internal/model"
 )
 
+func (r *GormRepository) FetchClientsPageData(ctx context.Context) (ClientsPageData, error) {
+	var data ClientsPageData
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Preload("Devices").Find(&data.Clients).Error; err != nil {
+			return err
+		}
+		var postures []model.DevicePosture
+		if err := tx.Find(&postures).Error; err != nil {
+			return err
+		}
+		data.Postures = postureMap(postures)
+		return nil
+	})
+	return data, err
+}
+
 func (r *GormRepository) FetchPairsPageData(ctx context.Context) (PairsPageData, error) {
 	var data PairsPageData
 	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
@@ -37,6 +57,30 @@ func (r *GormRepository) FetchResourcesPageData(ctx context.Context) (ResourcesP
 	return data, err
 }
 
+func (r *GormRepository) FetchEnforcersPageData(ctx context.Context) (EnforcersPageData, error) {
+	var data EnforcersPageData
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Find(&data.Enforcers).Error; err != nil {
+			return err
+		}
+		var heartbeats []model.EnforcerHeartbeat
+		if err := tx.Find(&heartbeats).Error; err != nil {
+			return err
+		}
+		data.Heartbeats = heartbeatMap(heartbeats)
+		var versions []model.ConfigVersion
+		if err := tx.Where("target LIKE ?", model.EnforcerConfigTarget("%")).Find(&versions).Error; err != nil {
+			return err
+		}
+		data.ConfigVersions = make(map[string]uint64, len(versions))
+		for _, v := range versions {
+			data.ConfigVersions[strings.TrimPrefix(v.Target, model.EnforcerConfigTarget(""))] = v.Version
+		}
+		return nil
+	})
+	return data, err
+}
+
 func (r *GormRepository) FetchEnforcerDetailPageData(ctx context.Context, enforcerID, resourceID string, logLimit int) (EnforcerDetailPageData, error) {
 	var data EnforcerDetailPageData
 	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
@@ -46,13 +90,24 @@ func (r *GormRepository) FetchEnforcerDetailPageData(ctx context.Context, enforc
 		if err := tx.Where("enforcer_id = ?", enforcerID).Find(&data.Resources).Error; err != nil {
 			return err
 		}
-		query := tx.Table("logs").
-			Select("logs.*, (pairs.id IS NOT NULL) as has_pair").
-			Joins("LEFT JOIN pairs ON logs.client_id = pairs.client_id AND logs.resource_id = pairs.resource_id").
-			Where("logs.enforcer_id = ?", enforcerID).
-			Order("logs.timestamp DESC")
+		var hb model.EnforcerHeartbeat
+		if err := tx.First(&hb, "enforcer_id = ?", enforcerID).Error; err == nil {
+			data.Heartbeat = &hb
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		var version model.ConfigVersion
+		if err := tx.First(&version, "target = ?", model.EnforcerConfigTarget(enforcerID)).Error; err == nil {
+			data.ServedConfigVersion = version.Version
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if err := tx.Where("enforcer_id = ?", enforcerID).Order("attempted_at DESC").Limit(model.ApplyAttemptsKept).Find(&data.ApplyAttempts).Error; err != nil {
+			return err
+		}
+		query := tx.Where("enforcer_id = ?", enforcerID).Order("timestamp DESC")
 		if resourceID != "" {
-			query = query.Where("logs.resource_id = ?", resourceID)
+			query = query.Where("resource_id = ?", resourceID)
 		}
 		if logLimit > 0 {
 			query = query.Limit(logLimit)
@@ -64,3 +119,20 @@ func (r *GormRepository) FetchEnforcerDetailPageData(ctx context.Context, enforc
 	})
 	return data, err
 }
+
+func (r *GormRepository) FetchLogsPageData(ctx context.Context) (LogsPageData, error) {
+	var data LogsPageData
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Order("name").Find(&data.Enforcers).Error; err != nil {
+			return err
+		}
+		if err := tx.Order("name").Find(&data.Clients).Error; err != nil {
+			return err
+		}
+		if err := tx.Order("name").Find(&data.Resources).Error; err != nil {
+			return err
+		}
+		return nil
+	})
+	return data, err
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+// RecordPolicyRevision stores rev unless the enforcer's latest revision has
+// the same digest, in which case rev is replaced by that revision.
+func (r *GormRepository) RecordPolicyRevision(ctx context.Context, rev *model.PolicyRevision) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var latest model.PolicyRevision
+		err := tx.Where("enforcer_id = ?", rev.EnforcerID).Order("created_at DESC").First(&latest).Error
+		if err == nil && latest.Digest == rev.Digest {
+			*rev = latest
+			return nil
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		return tx.Create(rev).Error
+	})
+}
+
+// ListPolicyRevisions returns the enforcer's revisions in effect between from
+// and to, oldest first: the one in effect at from and those created after it
+// up to to. If none was in effect at from, the list starts with the first
+// revision created after it. It reads on the log handle, as it runs for
+// every ingested batch.
+func (r *GormRepository) ListPolicyRevisions(ctx context.Context, enforcerID string, from, to time.Time) ([]model.PolicyRevision, error) {
+	// Times are compared as text, and created_at is stored in UTC
+	from, to = from.UTC(), to.UTC()
+	db := r.logDB.WithContext(ctx)
+	var out []model.PolicyRevision
+	var first model.PolicyRevision
+	err := db.Where("enforcer_id = ? AND created_at <= ?", enforcerID, from).Order("created_at DESC").First(&first).Error
+	if err == nil {
+		out = append(out, first)
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	var later []model.PolicyRevision
+	if err := db.Where("enforcer_id = ? AND created_at > ? AND created_at <= ?", enforcerID, from, to).
+		Order("created_at ASC").Find(&later).Error; err != nil {
+		return nil, err
+	}
+	out = append(out, later...)
+	if len(out) > 0 {
+		return out, nil
+	}
+	var next model.PolicyRevision
+	err = db.Where("enforcer_id = ? AND created_at > ?", enforcerID, to).Order("created_at ASC").First(&next).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []model.PolicyRevision{next}, nil
+}
@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"context"
+
+	"gorm.io/gorm/clause"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+)
+
+func (r *GormRepository) UpsertPosture(ctx context.Context, p *model.DevicePosture) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(p).Error
+}
+
+func (r *GormRepository) GetPosture(ctx context.Context, deviceID string) (model.DevicePosture, error) {
+	var p model.DevicePosture
+	if err := r.db.WithContext(ctx).First(&p, "device_id = ?", deviceID).Error; err != nil {
+		return model.DevicePosture{}, mapErr(err)
+	}
+	return p, nil
+}
+
+func postureMap(postures []model.DevicePosture) map[string]model.DevicePosture {
+	out := make(map[string]model.DevicePosture, len(postures))
+	for _, p := range postures {
+		out[p.DeviceID] = p
+	}
+	return out
+}
@@ -37,6 +37,17 @@ func (r *GormRepository) UpdateResourceMode(ctx context.Context, id, mode string
 	return nil
 }
 
+func (r *GormRepository) UpdateResourceLogRetention(ctx context.Context, id string, days int) error {
+	res := r.db.WithContext(ctx).Model(&model.Resource{}).Where("id = ?", id).Update("log_retention_days", days)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 func (r *GormRepository) DeleteResource(ctx context.Context, id string) (bool, error) {
 	res := r.db.WithContext(ctx).Delete(&model.Resource{}, "id = ?", id)
 	if res.Error != nil {
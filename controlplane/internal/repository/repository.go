@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"errors"
+	"time"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 )
@@ -12,23 +13,78 @@ var ErrNotFound = errors.New("not found")
 type EnforcerConfigData struct {
 	Enforcer  model.Enforcer
 	Resources []model.Resource
-	Pairs     []model.Pair   // with Client preloaded
-	Clients   []model.Client // all clients (for observe mode)
+	Pairs     []model.Pair                   // with Client preloaded
+	Clients   []model.Client                 // all clients (for observe mode)
+	Devices   []model.Device                 // approved devices of every client above
+	TunnelIPs map[string]string              // deviceID -> tunnel IP on this enforcer
+	Postures  map[string]model.DevicePosture // deviceID -> latest posture
 }
 
 type ClientConfigData struct {
 	Client            model.Client
-	Pairs             []model.Pair                 // with Resource and Enforcer preloaded
-	EnforcerResources map[string][]model.Resource  // enforcerID -> resources (for observe mode per enforcer)
-	Enforcers         map[string]model.Enforcer    // enforcerID -> enforcer (includes observe enforcers without pairs)
+	Device            model.Device
+	Pairs             []model.Pair                // with Resource and Enforcer preloaded
+	EnforcerResources map[string][]model.Resource // enforcerID -> resources (for observe mode per enforcer)
+	Enforcers         map[string]model.Enforcer   // enforcerID -> enforcer (includes observe enforcers without pairs)
+	Posture           *model.DevicePosture        // nil if the device has never reported
 }
 
-type LogEntryWithPair struct {
-	model.LogEntry
-	HasPair bool `gorm:"column:has_pair"`
+// LogRollupSummary adds up the rollups of one client, resource, protocol,
+// destination port and verdict over a time range.
+type LogRollupSummary struct {
+	ClientID     string
+	ClientName   string
+	ResourceID   string
+	ResourceName string
+	Protocol     string
+	DstPort      int
+	Verdict      string
+	Entries      int64
+	Packets      int64
+	Bytes        int64
+}
+
+// Columns log searches can be sorted by.
+const (
+	LogSortTime     = "timestamp"
+	LogSortBytes    = "bytes"
+	LogSortPackets  = "packets"
+	LogSortDuration = "duration_ms"
+)
+
+// LogQuery selects log entries for a search. Empty fields match all entries.
+type LogQuery struct {
+	From, To   time.Time // To is exclusive
+	EnforcerID string
+	ClientID   string
+	ResourceID string
+	SrcIP      string
+	DstIP      string
+	DstPort    int
+	Protocol   string
+	Verdicts   []string
+
+	// Entries are ordered by Sort, then ID, in the same direction.
+	Sort string
+	Desc bool
+	// After resumes the search behind the entry the cursor points at.
+	After *LogCursor
+	Limit int
+}
+
+// LogCursor is the position of an entry in a search: its sort value and ID.
+// Value is a time.Time when sorting by time, else an int64.
+type LogCursor struct {
+	Value any
+	ID    string
 }
 
 // UI page data structs
+type ClientsPageData struct {
+	Clients  []model.Client                 // with Devices preloaded
+	Postures map[string]model.DevicePosture // deviceID -> latest posture
+}
+
 type PairsPageData struct {
 	Pairs     []model.Pair
 	Clients   []model.Client
@@ -40,10 +96,30 @@ type ResourcesPageData struct {
 	Enforcers []model.Enforcer
 }
 
+type EnforcersPageData struct {
+	Enforcers      []model.Enforcer
+	Heartbeats     map[string]model.EnforcerHeartbeat // enforcerID -> latest heartbeat
+	ConfigVersions map[string]uint64                  // enforcerID -> config version served
+}
+
 type EnforcerDetailPageData struct {
-	Enforcer  model.Enforcer
+	Enforcer            model.Enforcer
+	Heartbeat           *model.EnforcerHeartbeat // nil if the enforcer never sent one
+	ServedConfigVersion uint64
+	ApplyAttempts       []model.ApplyAttempt // newest first
+	Resources           []model.Resource
+	Logs                []model.LogEntry
+}
+
+type LogsPageData struct {
+	Enforcers []model.Enforcer
+	Clients   []model.Client
 	Resources []model.Resource
-	Logs      []LogEntryWithPair
+}
+
+type LogSinksPageData struct {
+	Sinks    []model.LogSink
+	Attempts map[string][]model.LogSinkAttempt // sinkID -> delivery attempts, newest first
 }
 
 type Repository interface {
@@ -54,12 +130,25 @@ type Repository interface {
 	GetClient(ctx context.Context, id string) (model.Client, error)
 	GetClientByUsername(ctx context.Context, username string) (model.Client, error)
 	DeleteClient(ctx context.Context, id string) (bool, error)
-	FetchClientConfigData(ctx context.Context, clientID string) (ClientConfigData, error)
+	FetchClientConfigData(ctx context.Context, clientID, deviceID string) (ClientConfigData, error)
+
+	CreateDevice(ctx context.Context, d *model.Device) error
+	GetDevice(ctx context.Context, id string) (model.Device, error)
+	GetDeviceByPublicKey(ctx context.Context, wgPublicKey string) (model.Device, error)
+	ListDevicesByClient(ctx context.Context, clientID string) ([]model.Device, error)
+	UpdateDeviceStatus(ctx context.Context, id, status string) error
+	UpdateDevicePublicKey(ctx context.Context, id, pubKey string, rotatedAt time.Time) error
+	TouchDevice(ctx context.Context, id string, seenAt time.Time) error
+	DeleteDevice(ctx context.Context, id string) (bool, error)
+	MigrateClientKeys(ctx context.Context, deviceName string) ([]model.Device, error)
+	ListTunnelIPs(ctx context.Context, enforcerID string) ([]model.TunnelIP, error)
+	CreateTunnelIP(ctx context.Context, t *model.TunnelIP) error
 
 	CreateResource(ctx context.Context, r *model.Resource) error
 	ListResources(ctx context.Context) ([]model.Resource, error)
 	GetResource(ctx context.Context, id string) (model.Resource, error)
 	UpdateResourceMode(ctx context.Context, id, mode string) error
+	UpdateResourceLogRetention(ctx context.Context, id string, days int) error
 	DeleteResource(ctx context.Context, id string) (bool, error)
 
 	CreateEnforcer(ctx context.Context, e *model.Enforcer) error
@@ -68,20 +157,60 @@ type Repository interface {
 	GetEnforcer(ctx context.Context, id string) (model.Enforcer, error)
 	UpdateEnforcerPublicKey(ctx context.Context, id, pubKey string) error
 	DeleteEnforcer(ctx context.Context, id string) (bool, error)
+	UpdateEnforcerLogRetention(ctx context.Context, id string, days int) error
+	AdvanceEnforcerLogSeq(ctx context.Context, id string, seq uint64) error
 	FetchEnforcerConfigData(ctx context.Context, enforcerID string) (EnforcerConfigData, error)
 
+	CreateEnrollmentToken(ctx context.Context, t *model.EnrollmentToken) error
+	GetEnrollmentToken(ctx context.Context, id string) (model.EnrollmentToken, error)
+	MarkEnrollmentTokenUsed(ctx context.Context, id string, usedAt time.Time) error
+	DeleteUnusedEnrollmentTokens(ctx context.Context, enforcerID string) error
+
+	BumpConfigVersion(ctx context.Context, target, digest string, now time.Time) (uint64, error)
+
+	UpsertHeartbeat(ctx context.Context, h *model.EnforcerHeartbeat) error
+	GetHeartbeat(ctx context.Context, enforcerID string) (model.EnforcerHeartbeat, error)
+	ListHeartbeats(ctx context.Context) ([]model.EnforcerHeartbeat, error)
+	UpdateHeartbeatAlertedStatus(ctx context.Context, enforcerID, status string) error
+	UpdateHeartbeatApplyResult(ctx context.Context, a *model.ApplyAttempt) error
+
+	CreateApplyAttempt(ctx context.Context, a *model.ApplyAttempt) error
+
 	CreatePair(ctx context.Context, p *model.Pair) error
 	ListPairs(ctx context.Context) ([]model.Pair, error)
 	ListPairsByClient(ctx context.Context, clientID string) ([]model.Pair, error)
 	ListPairsByEnforcer(ctx context.Context, enforcerID string) ([]model.Pair, error)
 	DeletePair(ctx context.Context, id string) (bool, error)
 
-	CreateLog(ctx context.Context, entry *model.LogEntry) error
-	ListLogsByEnforcer(ctx context.Context, enforcerID string, limit int) ([]LogEntryWithPair, error)
-	ListLogsByEnforcerAndResourceID(ctx context.Context, enforcerID, resourceID string, limit int) ([]LogEntryWithPair, error)
+	UpsertPosture(ctx context.Context, p *model.DevicePosture) error
+	GetPosture(ctx context.Context, deviceID string) (model.DevicePosture, error)
+
+	CreateLogs(ctx context.Context, entries []model.LogEntry) ([]model.LogEntry, error)
+	ListLogsByEnforcer(ctx context.Context, enforcerID string, limit int) ([]model.LogEntry, error)
+	ListLogsByEnforcerAndResourceID(ctx context.Context, enforcerID, resourceID string, limit int) ([]model.LogEntry, error)
+	SearchLogs(ctx context.Context, q LogQuery) ([]model.LogEntry, error)
+
+	RollUpLogs(ctx context.Context, before time.Time) (int64, error)
+	DeleteExpiredLogs(ctx context.Context, defaultDays int, now time.Time) (int64, error)
+	DeleteLogRollupsBefore(ctx context.Context, period string, before time.Time) (int64, error)
+	SummarizeLogRollups(ctx context.Context, enforcerID, resourceID, period string, from, to time.Time, limit int) ([]LogRollupSummary, error)
+	ListDiscoveredDestinations(ctx context.Context, resourceID string) ([]model.DiscoveredDestination, error)
+
+	CreateLogSink(ctx context.Context, s *model.LogSink) error
+	ListLogSinks(ctx context.Context) ([]model.LogSink, error)
+	DeleteLogSink(ctx context.Context, id string) (bool, error)
+	AddLogSinkCounts(ctx context.Context, id string, delivered, dropped int64) error
+	CreateLogSinkAttempt(ctx context.Context, a *model.LogSinkAttempt) error
+
+	RecordPolicyRevision(ctx context.Context, rev *model.PolicyRevision) error
+	ListPolicyRevisions(ctx context.Context, enforcerID string, from, to time.Time) ([]model.PolicyRevision, error)
 
 	// UI page data
+	FetchClientsPageData(ctx context.Context) (ClientsPageData, error)
 	FetchPairsPageData(ctx context.Context) (PairsPageData, error)
 	FetchResourcesPageData(ctx context.Context) (ResourcesPageData, error)
+	FetchEnforcersPageData(ctx context.Context) (EnforcersPageData, error)
 	FetchEnforcerDetailPageData(ctx context.Context, enforcerID, resourceID string, logLimit int) (EnforcerDetailPageData, error)
+	FetchLogsPageData(ctx context.Context) (LogsPageData, error)
+	FetchLogSinksPageData(ctx context.Context) (LogSinksPageData, error)
 }
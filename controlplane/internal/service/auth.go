@@ -8,13 +8,29 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 
+	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
+	"migration-to-zero-trust/internal/metrics"
 )
 
 const clientTokenTTL = 24 * time.Hour
 
+// Kinds of login failures.
+const (
+	LoginClient   = "client"   // agent username and password
+	LoginEnforcer = "enforcer" // enforcer API key or certificate
+	LoginUI       = "ui"       // admin basic auth
+)
+
 var jwtSecret []byte
 
+var loginFailures = metrics.NewCounter("controlplane_login_failures_total", "Rejected logins and credentials by kind.", "kind")
+
+// RecordLoginFailure counts a rejected login of the given kind.
+func RecordLoginFailure(kind string) {
+	loginFailures.Inc(kind)
+}
+
 func InitJWT(secret string) {
 	if secret == "" {
 		panic("JWT secret is required")
@@ -24,31 +40,59 @@ func InitJWT(secret string) {
 
 type ClientClaims struct {
 	ClientID string `json:"client_id"`
+	DeviceID string `json:"device_id"`
 	jwt.RegisteredClaims
 }
 
-func ClientLogin(ctx context.Context, repo repository.Repository, user, pass string) (string, error) {
+// AuthenticateClient returns the client with the username and password.
+func AuthenticateClient(ctx context.Context, repo repository.Repository, user, pass string) (model.Client, error) {
 	client, err := repo.GetClientByUsername(ctx, user)
 	if err != nil {
 		if errors.Is(err, repository.ErrNotFound) {
-			return "", AuthError{Msg: "unauthorized"}
+			return model.Client{}, AuthError{Msg: "unauthorized"}
 		}
-		return "", err
+		return model.Client{}, err
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(client.PasswordHash), []byte(pass)); err != nil {
+		return model.Client{}, AuthError{Msg: "unauthorized"}
+	}
+	return client, nil
+}
+
+// ClientLogin authenticates a client and binds the session to the device
+// owning wgPublicKey.
+func ClientLogin(ctx context.Context, repo repository.Repository, user, pass, wgPublicKey string) (token string, err error) {
+	defer func() {
+		if errors.As(err, new(AuthError)) {
+			RecordLoginFailure(LoginClient)
+		}
+	}()
+	client, err := AuthenticateClient(ctx, repo, user, pass)
+	if err != nil {
+		return "", err
+	}
+	device, err := repo.GetDeviceByPublicKey(ctx, wgPublicKey)
+	if err != nil {
+		// Not found tells the agent to register its key as a new device
+		return "", err
+	}
+	if device.ClientID != client.ID {
 		return "", AuthError{Msg: "unauthorized"}
 	}
+	if !device.IsApproved() {
+		return "", ForbiddenError{Msg: "device pending approval"}
+	}
 
 	claims := ClientClaims{
 		ClientID: client.ID,
+		DeviceID: device.ID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(clientTokenTTL)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
 }
 
 func ValidateClientToken(tokenString string) (ClientClaims, error) {
@@ -2,18 +2,92 @@ package service
 
 import (
 	"context"
+	"fmt"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
 )
 
+// defaultDeviceName names the device created together with a client.
+const defaultDeviceName = "default"
+
+// CreateClient creates a client. If wgPublicKey is set, a first device
+// holding that key is created along with it.
 func CreateClient(ctx context.Context, repo repository.Repository, name, username, password, wgPublicKey string) (model.Client, error) {
-	c, err := model.NewClient(name, username, password, wgPublicKey)
+	c, err := model.NewClient(name, username, password)
 	if err != nil {
 		return model.Client{}, err
 	}
-	if err := repo.CreateClient(ctx, &c); err != nil {
+	err = repo.WithTx(ctx, func(tx repository.Repository) error {
+		if err := tx.CreateClient(ctx, &c); err != nil {
+			return err
+		}
+		if wgPublicKey == "" {
+			return nil
+		}
+		d := model.NewDevice(c.ID, defaultDeviceName, wgPublicKey, model.DeviceStatusApproved)
+		if err := tx.CreateDevice(ctx, &d); err != nil {
+			return err
+		}
+		c.Devices = append(c.Devices, d)
+		return nil
+	})
+	if err != nil {
 		return model.Client{}, err
 	}
+	NotifyConfigChange()
 	return c, nil
 }
+
+// DeleteClient deletes a client with its devices and pairs.
+func DeleteClient(ctx context.Context, repo repository.Repository, id string) error {
+	if _, err := repo.DeleteClient(ctx, id); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
+
+// CreateDevice adds an approved device for a client on behalf of an admin.
+func CreateDevice(ctx context.Context, repo repository.Repository, clientID, name, wgPublicKey string) (model.Device, error) {
+	if _, err := repo.GetClient(ctx, clientID); err != nil {
+		return model.Device{}, err
+	}
+	d := model.NewDevice(clientID, name, wgPublicKey, model.DeviceStatusApproved)
+	if err := repo.CreateDevice(ctx, &d); err != nil {
+		return model.Device{}, err
+	}
+	NotifyConfigChange()
+	return d, nil
+}
+
+// MigrateClientKeys gives every client that still has a WireGuard key from
+// before devices existed an approved device with that key, and a tunnel IP
+// on every enforcer, so it keeps its access after the upgrade. It returns
+// how many devices it created; once done, it finds nothing to migrate.
+func MigrateClientKeys(ctx context.Context, repo repository.Repository) (int, error) {
+	devices, err := repo.MigrateClientKeys(ctx, defaultDeviceName)
+	if err != nil || len(devices) == 0 {
+		return 0, err
+	}
+	enforcers, err := repo.ListEnforcers(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, d := range devices {
+		for _, e := range enforcers {
+			if _, err := allocateTunnelIP(ctx, repo, e.ID, d.ID, e.TunnelSubnet); err != nil {
+				return 0, fmt.Errorf("allocate tunnel IP for device %s on enforcer %s: %w", d.ID, e.ID, err)
+			}
+		}
+	}
+	return len(devices), nil
+}
+
+func DeleteDevice(ctx context.Context, repo repository.Repository, id string) error {
+	if _, err := repo.DeleteDevice(ctx, id); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
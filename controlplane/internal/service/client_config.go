@@ -1,8 +1,8 @@
-// client_config.go generates WireGuard configuration for clients.
+// client_config.go generates WireGuard configuration for client devices.
 //
-// When a client authenticates and requests its configuration, this service:
+// When a device authenticates and requests its configuration, this service:
 //  1. Groups the client's resource pairs by enforcer
-//  2. Allocates a tunnel IP for each enforcer
+//  2. Allocates a tunnel IP for the device on each enforcer
 //  3. Determines which resource CIDRs the client can access per enforcer
 //  4. Returns configurations for all enforcers the client needs to connect to
 //
@@ -12,6 +12,9 @@
 //   - enforce mode: Only clients explicitly paired with the resource can access it.
 //     Used after migration when Zero Trust policies are fully enforced.
 //
+// In both modes, a resource with posture requirements is left out unless the
+// device's latest posture report meets them.
+//
 // The returned config is used by the client agent to configure WireGuard peers.
 package service
 
@@ -20,15 +23,17 @@ import (
 	"net"
 	"sort"
 	"strconv"
+	"time"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
 )
 
-// ClientConfig contains everything a client needs to establish WireGuard tunnels
+// ClientConfig contains everything a device needs to establish WireGuard tunnels
 // to one or more enforcers.
 type ClientConfig struct {
 	ClientID    string                 `json:"client_id"`
+	DeviceID    string                 `json:"device_id"`
 	WGPublicKey string                 `json:"wg_public_key"`
 	Enforcers   []ClientEnforcerConfig `json:"enforcers"`
 }
@@ -36,19 +41,26 @@ type ClientConfig struct {
 // ClientEnforcerConfig contains the configuration for connecting to a single enforcer.
 type ClientEnforcerConfig struct {
 	EnforcerID        string   `json:"enforcer_id"`
-	TunnelIP          string   `json:"tunnel_ip"`           // Client's IP in this enforcer's tunnel (e.g., "10.0.0.2/24")
+	TunnelIP          string   `json:"tunnel_ip"`           // Device's IP in this enforcer's tunnel (e.g., "10.0.0.2/24")
 	EnforcerPublicKey string   `json:"enforcer_public_key"` // Enforcer's WireGuard public key
 	EnforcerEndpoint  string   `json:"enforcer_endpoint"`   // Enforcer's public endpoint (e.g., "enf.example.com:51820")
 	AllowedCIDRs      []string `json:"allowed_cidrs"`       // Resource CIDRs to route through this enforcer
 }
 
-// GetClientConfig generates the WireGuard configuration for an authenticated client.
-// Returns configurations for all enforcers the client has access to.
+// GetClientConfig generates the WireGuard configuration for an authenticated device.
+// Returns configurations for all enforcers the device's client has access to.
 func GetClientConfig(ctx context.Context, repo repository.Repository, claims ClientClaims) (ClientConfig, error) {
-	data, err := repo.FetchClientConfigData(ctx, claims.ClientID)
+	data, err := repo.FetchClientConfigData(ctx, claims.ClientID, claims.DeviceID)
 	if err != nil {
 		return ClientConfig{}, err
 	}
+	if !data.Device.IsApproved() {
+		return ClientConfig{}, AuthError{Msg: "unauthorized"}
+	}
+	now := time.Now()
+	if err := repo.TouchDevice(ctx, data.Device.ID, now); err != nil {
+		return ClientConfig{}, err
+	}
 	if len(data.Enforcers) == 0 {
 		return ClientConfig{}, ValidationError{Msg: "no resources available for client"}
 	}
@@ -62,8 +74,8 @@ func GetClientConfig(ctx context.Context, repo repository.Repository, claims Cli
 	// Build enforcer configs for all enforcers (both paired and observe-only)
 	var enforcers []ClientEnforcerConfig
 	for enforcerID, enforcer := range data.Enforcers {
-		// Allocate or retrieve existing tunnel IP for this client on this enforcer
-		tunnelIP, err := allocateTunnelIP(enforcerID, data.Client.ID, enforcer.TunnelSubnet)
+		// Allocate or retrieve existing tunnel IP for this device on this enforcer
+		tunnelIP, err := allocateTunnelIP(ctx, repo, enforcerID, data.Device.ID, enforcer.TunnelSubnet)
 		if err != nil {
 			return ClientConfig{}, err
 		}
@@ -82,14 +94,16 @@ func GetClientConfig(ctx context.Context, repo repository.Repository, claims Cli
 
 		// Add observe resources for this enforcer
 		for _, r := range data.EnforcerResources[enforcerID] {
-			if r.Mode == model.ModeObserve {
+			if r.Mode == model.ModeObserve && r.Posture.SatisfiedBy(data.Posture, now) {
 				cidrSet[r.CIDR] = struct{}{}
 			}
 		}
 
 		// Add paired resources (enforce mode)
 		for _, p := range enforcerPairs[enforcerID] {
-			cidrSet[p.Resource.CIDR] = struct{}{}
+			if p.Resource.Posture.SatisfiedBy(data.Posture, now) {
+				cidrSet[p.Resource.CIDR] = struct{}{}
+			}
 		}
 
 		cidrs := make([]string, 0, len(cidrSet))
@@ -114,7 +128,8 @@ func GetClientConfig(ctx context.Context, repo repository.Repository, claims Cli
 
 	return ClientConfig{
 		ClientID:    data.Client.ID,
-		WGPublicKey: data.Client.WGPublicKey,
+		DeviceID:    data.Device.ID,
+		WGPublicKey: data.Device.WGPublicKey,
 		Enforcers:   enforcers,
 	}, nil
 }
@@ -0,0 +1,179 @@
+// config_watch.go serves configs by revision and lets holders long-poll for
+// changes.
+//
+// Every mutation that can change an enforcer or client config calls
+// NotifyConfigChange, which bumps a global generation and wakes all waiting
+// requests. A signed config is cached per target together with the
+// generation it was built at, so polls between changes do not rebuild it.
+// Cached configs are still rebuilt after configRecheckInterval because some
+// content depends on time alone (posture reports age out).
+//
+// Every build also records the enforcer's policy revision, so logs can be
+// judged against the policy in effect when they happened.
+//
+// The ETag of a config is its signed version, so a holder sends the version
+// it applied in If-None-Match and gets 304 Not Modified until it changes.
+package service
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+	"migration-to-zero-trust/internal/metrics"
+)
+
+const (
+	// MaxConfigWait caps the long-poll wait a holder can ask for.
+	MaxConfigWait         = 60 * time.Second
+	configRecheckInterval = 30 * time.Second
+)
+
+var (
+	configMu      sync.Mutex
+	configGen     uint64
+	configChanged = make(chan struct{})
+
+	configCacheMu sync.Mutex
+	configCache   = make(map[string]cachedConfig) // target -> latest signed config
+
+	configRequestDuration = metrics.NewHistogram("controlplane_config_request_duration_seconds",
+		"Time to answer config requests by holder kind, excluding long-poll waits.", metrics.DefaultBuckets, "holder")
+)
+
+type cachedConfig struct {
+	gen     uint64
+	builtAt time.Time
+	signed  SignedConfig
+}
+
+// NotifyConfigChange wakes every request waiting for a config change and
+// invalidates cached configs. Call it after committing a change to anything
+// configs are built from.
+func NotifyConfigChange() {
+	configMu.Lock()
+	defer configMu.Unlock()
+	configGen++
+	close(configChanged)
+	configChanged = make(chan struct{})
+}
+
+func configGeneration() (uint64, <-chan struct{}) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return configGen, configChanged
+}
+
+// ConfigETag returns the ETag of a signed config.
+func ConfigETag(signed SignedConfig) string {
+	return strconv.Quote(strconv.FormatUint(signed.Version, 10))
+}
+
+// etagMatches reports whether an If-None-Match header names etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchEnforcerConfig returns the enforcer's signed config, or modified=false
+// if it still matches ifNoneMatch after waiting up to wait for a change.
+func WatchEnforcerConfig(ctx context.Context, repo repository.Repository, enforcerID, ifNoneMatch string, wait time.Duration) (signed SignedConfig, modified bool, err error) {
+	return watchConfig(ctx, model.EnforcerConfigTarget(enforcerID), ifNoneMatch, wait, func() (SignedConfig, error) {
+		data, err := repo.FetchEnforcerConfigData(ctx, enforcerID)
+		if err != nil {
+			return SignedConfig{}, err
+		}
+		cfg, err := buildEnforcerConfig(data)
+		if err != nil {
+			return SignedConfig{}, err
+		}
+		signed, err := SignEnforcerConfig(ctx, repo, cfg)
+		if err != nil {
+			return SignedConfig{}, err
+		}
+		if _, err := recordPolicyRevision(ctx, repo, data, cfg); err != nil {
+			return SignedConfig{}, err
+		}
+		return signed, nil
+	})
+}
+
+// WatchClientConfig is WatchEnforcerConfig for the device of claims.
+func WatchClientConfig(ctx context.Context, repo repository.Repository, claims ClientClaims, ifNoneMatch string, wait time.Duration) (signed SignedConfig, modified bool, err error) {
+	return watchConfig(ctx, model.DeviceConfigTarget(claims.DeviceID), ifNoneMatch, wait, func() (SignedConfig, error) {
+		cfg, err := GetClientConfig(ctx, repo, claims)
+		if err != nil {
+			return SignedConfig{}, err
+		}
+		return SignClientConfig(ctx, repo, cfg)
+	})
+}
+
+func watchConfig(ctx context.Context, target, ifNoneMatch string, wait time.Duration, build func() (SignedConfig, error)) (SignedConfig, bool, error) {
+	if wait > MaxConfigWait {
+		wait = MaxConfigWait
+	}
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	// Only time spent building counts towards the request's latency
+	var busy time.Duration
+	holder, _, _ := strings.Cut(target, ":")
+	defer func() { configRequestDuration.Observe(busy.Seconds(), holder) }()
+
+	for {
+		gen, changed := configGeneration()
+		start := time.Now()
+		signed, err := cachedBuild(target, gen, build)
+		busy += time.Since(start)
+		if err != nil {
+			return SignedConfig{}, false, err
+		}
+		if ifNoneMatch == "" || !etagMatches(ifNoneMatch, ConfigETag(signed)) {
+			return signed, true, nil
+		}
+		if wait <= 0 {
+			return signed, false, nil
+		}
+
+		recheck := time.NewTimer(configRecheckInterval)
+		select {
+		case <-changed:
+		case <-recheck.C:
+		case <-deadline.C:
+			recheck.Stop()
+			return signed, false, nil
+		case <-ctx.Done():
+			recheck.Stop()
+			return SignedConfig{}, false, ctx.Err()
+		}
+		recheck.Stop()
+	}
+}
+
+func cachedBuild(target string, gen uint64, build func() (SignedConfig, error)) (SignedConfig, error) {
+	configCacheMu.Lock()
+	c, ok := configCache[target]
+	configCacheMu.Unlock()
+	if ok && c.gen == gen && time.Since(c.builtAt) < configRecheckInterval {
+		return c.signed, nil
+	}
+
+	signed, err := build()
+	if err != nil {
+		return SignedConfig{}, err
+	}
+	configCacheMu.Lock()
+	configCache[target] = cachedConfig{gen: gen, builtAt: time.Now(), signed: signed}
+	configCacheMu.Unlock()
+	return signed, nil
+}
@@ -0,0 +1,231 @@
+// device_registration.go lets agents register and rotate their own
+// WireGuard keys.
+//
+// Proof of possession: the agent asks for a challenge for a public key,
+// authenticated with the client's credentials to register or with its
+// session to rotate, and receives an ephemeral X25519 server key and a nonce. Both sides derive the
+// same shared secret (agent private key x server key, server private key x
+// agent key), and the agent answers with HMAC-SHA256(secret, nonce || key).
+// Only the holder of the WireGuard private key can compute the answer.
+//
+// Challenges are bound to the client that asked for them, and each client
+// may only hold a few at a time, so nobody can crowd out the challenges of
+// other clients.
+//
+// A registered device starts pending and cannot log in until an admin
+// approves it. A rotated key replaces the key of an existing device, which
+// keeps its approval, tunnel IPs and posture.
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+const (
+	deviceChallengeTTL = 2 * time.Minute
+	// maxClientChallenges bounds the outstanding challenges of one client.
+	maxClientChallenges = 4
+)
+
+// DeviceChallenge is sent to an agent that wants to prove it holds the
+// private key for a WireGuard public key.
+type DeviceChallenge struct {
+	ChallengeID     string    `json:"challenge_id"`
+	ServerPublicKey string    `json:"server_public_key"` // ephemeral X25519 key, base64
+	Nonce           string    `json:"nonce"`             // base64
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+type deviceChallenge struct {
+	clientID    string
+	wgPublicKey []byte
+	serverKey   *ecdh.PrivateKey
+	nonce       []byte
+	expiresAt   time.Time
+}
+
+var (
+	challengesMu sync.Mutex
+	challenges   = make(map[string]deviceChallenge)
+)
+
+// IssueDeviceChallenge creates a single-use challenge for the authenticated
+// client, bound to wgPublicKey.
+func IssueDeviceChallenge(clientID, wgPublicKey string) (DeviceChallenge, error) {
+	pub, err := parseWGPublicKey(wgPublicKey)
+	if err != nil {
+		return DeviceChallenge{}, err
+	}
+	serverKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return DeviceChallenge{}, err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return DeviceChallenge{}, err
+	}
+
+	now := time.Now()
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+	outstanding := 0
+	for id, c := range challenges {
+		if now.After(c.expiresAt) {
+			delete(challenges, id)
+		} else if c.clientID == clientID {
+			outstanding++
+		}
+	}
+	if outstanding >= maxClientChallenges {
+		return DeviceChallenge{}, BusyError{Msg: "too many outstanding challenges", RetryAfter: deviceChallengeTTL}
+	}
+
+	id := uuid.NewString()
+	c := deviceChallenge{
+		clientID:    clientID,
+		wgPublicKey: pub,
+		serverKey:   serverKey,
+		nonce:       nonce,
+		expiresAt:   now.Add(deviceChallengeTTL),
+	}
+	challenges[id] = c
+	return DeviceChallenge{
+		ChallengeID:     id,
+		ServerPublicKey: base64.StdEncoding.EncodeToString(serverKey.PublicKey().Bytes()),
+		Nonce:           base64.StdEncoding.EncodeToString(nonce),
+		ExpiresAt:       c.expiresAt,
+	}, nil
+}
+
+// verifyDeviceProof consumes the challenge and checks that it was issued to
+// the client and that proof was made with the private key behind
+// wgPublicKey.
+func verifyDeviceProof(clientID, challengeID, wgPublicKey, proof string) error {
+	challengesMu.Lock()
+	c, ok := challenges[challengeID]
+	delete(challenges, challengeID)
+	challengesMu.Unlock()
+
+	if !ok || c.clientID != clientID || time.Now().After(c.expiresAt) {
+		return AuthError{Msg: "unauthorized"}
+	}
+	pub, err := parseWGPublicKey(wgPublicKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pub, c.wgPublicKey) {
+		return AuthError{Msg: "unauthorized"}
+	}
+	peer, err := ecdh.X25519().NewPublicKey(pub)
+	if err != nil {
+		return ValidationError{Msg: "invalid wg_public_key"}
+	}
+	secret, err := c.serverKey.ECDH(peer)
+	if err != nil {
+		return AuthError{Msg: "unauthorized"}
+	}
+	got, err := base64.StdEncoding.DecodeString(proof)
+	if err != nil {
+		return AuthError{Msg: "unauthorized"}
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(c.nonce)
+	mac.Write(pub)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return AuthError{Msg: "unauthorized"}
+	}
+	return nil
+}
+
+func parseWGPublicKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		return nil, ValidationError{Msg: "invalid wg_public_key"}
+	}
+	return b, nil
+}
+
+// RegisterDevice creates a pending device for the client after checking its
+// credentials and the proof of key possession. Registering a key the client
+// already owns returns the existing device.
+func RegisterDevice(ctx context.Context, repo repository.Repository, user, pass, name, wgPublicKey, challengeID, proof string) (model.Device, error) {
+	client, err := AuthenticateClient(ctx, repo, user, pass)
+	if err != nil {
+		return model.Device{}, err
+	}
+	if err := verifyDeviceProof(client.ID, challengeID, wgPublicKey, proof); err != nil {
+		return model.Device{}, err
+	}
+
+	existing, err := repo.GetDeviceByPublicKey(ctx, wgPublicKey)
+	if err == nil {
+		if existing.ClientID != client.ID {
+			return model.Device{}, AuthError{Msg: "unauthorized"}
+		}
+		return existing, nil
+	}
+	if !errors.Is(err, repository.ErrNotFound) {
+		return model.Device{}, err
+	}
+
+	if name == "" {
+		name = defaultDeviceName
+	}
+	d := model.NewDevice(client.ID, name, wgPublicKey, model.DeviceStatusPending)
+	if err := repo.CreateDevice(ctx, &d); err != nil {
+		return model.Device{}, err
+	}
+	return d, nil
+}
+
+// RotateDeviceKey replaces the key of the authenticated device with a new key
+// the agent has proven to hold.
+func RotateDeviceKey(ctx context.Context, repo repository.Repository, claims ClientClaims, wgPublicKey, challengeID, proof string) (model.Device, error) {
+	device, err := repo.GetDevice(ctx, claims.DeviceID)
+	if err != nil {
+		return model.Device{}, err
+	}
+	if device.ClientID != claims.ClientID || !device.IsApproved() {
+		return model.Device{}, AuthError{Msg: "unauthorized"}
+	}
+	if err := verifyDeviceProof(claims.ClientID, challengeID, wgPublicKey, proof); err != nil {
+		return model.Device{}, err
+	}
+	if _, err := repo.GetDeviceByPublicKey(ctx, wgPublicKey); err == nil {
+		return model.Device{}, ValidationError{Msg: "wg_public_key is already registered"}
+	} else if !errors.Is(err, repository.ErrNotFound) {
+		return model.Device{}, err
+	}
+
+	now := time.Now()
+	if err := repo.UpdateDevicePublicKey(ctx, device.ID, wgPublicKey, now); err != nil {
+		return model.Device{}, err
+	}
+	device.WGPublicKey = wgPublicKey
+	device.KeyRotatedAt = now
+	NotifyConfigChange()
+	return device, nil
+}
+
+// ApproveDevice lets a pending device log in.
+func ApproveDevice(ctx context.Context, repo repository.Repository, id string) error {
+	if err := repo.UpdateDeviceStatus(ctx, id, model.DeviceStatusApproved); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
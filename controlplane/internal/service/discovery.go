@@ -0,0 +1,184 @@
+// discovery.go turns the traffic seen under discovery resources into
+// proposals for narrower resources.
+//
+// A discovery resource covers a broad range in observe mode, so every client
+// reaches it and every connection is logged. Log compaction counts each
+// destination address, protocol and port seen under it. Proposals group
+// those counts by host, leaving out hosts already inside a registered
+// resource, and suggest a name from the busiest port.
+package service
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+// wellKnownPorts name the service behind common destination ports, for
+// suggesting resource names.
+var wellKnownPorts = map[string]string{
+	"tcp/22":    "ssh",
+	"tcp/25":    "smtp",
+	"udp/53":    "dns",
+	"tcp/53":    "dns",
+	"tcp/80":    "http",
+	"udp/123":   "ntp",
+	"tcp/389":   "ldap",
+	"tcp/443":   "https",
+	"tcp/445":   "smb",
+	"tcp/636":   "ldaps",
+	"tcp/1433":  "mssql",
+	"tcp/1521":  "oracle",
+	"tcp/2049":  "nfs",
+	"tcp/3306":  "mysql",
+	"tcp/3389":  "rdp",
+	"tcp/5432":  "postgres",
+	"tcp/5672":  "amqp",
+	"tcp/6379":  "redis",
+	"tcp/8080":  "http",
+	"tcp/8443":  "https",
+	"tcp/9092":  "kafka",
+	"tcp/9200":  "elasticsearch",
+	"tcp/11211": "memcached",
+	"tcp/27017": "mongodb",
+}
+
+// ResourceProposal is a single host seen under a discovery resource.
+type ResourceProposal struct {
+	Name        string    // suggested
+	Host        string    // destination address
+	CIDR        string    // the host alone
+	Ports       []string  // "tcp/443", "icmp", in protocol and port order
+	Connections int64     // over all ports
+	Bytes       int64     // over all ports
+	LastSeen    time.Time // over all ports
+}
+
+// Discovery is what was seen under a discovery resource.
+type Discovery struct {
+	Resource  model.Resource
+	Proposals []ResourceProposal // most connections first
+}
+
+// DiscoverResources proposes a resource for every host seen under the
+// discovery resource that no registered resource contains yet.
+func DiscoverResources(ctx context.Context, repo repository.Repository, id string) (Discovery, error) {
+	r, err := getDiscoveryResource(ctx, repo, id)
+	if err != nil {
+		return Discovery{}, err
+	}
+	resources, err := repo.ListResources(ctx)
+	if err != nil {
+		return Discovery{}, err
+	}
+	var registered []netip.Prefix
+	for _, res := range resources {
+		if res.Discovery {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(res.CIDR); err == nil {
+			registered = append(registered, prefix)
+		}
+	}
+	destinations, err := repo.ListDiscoveredDestinations(ctx, id)
+	if err != nil {
+		return Discovery{}, err
+	}
+
+	type host struct {
+		proposal ResourceProposal
+		busiest  int64
+	}
+	hosts := make(map[netip.Addr]*host)
+	var order []netip.Addr
+	for _, d := range destinations {
+		addr, err := netip.ParseAddr(d.DstIP)
+		if err != nil || slices.ContainsFunc(registered, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+			continue
+		}
+		h, ok := hosts[addr]
+		if !ok {
+			h = &host{proposal: ResourceProposal{
+				Name: "host-" + hostLabel(addr),
+				Host: addr.String(),
+				CIDR: netip.PrefixFrom(addr, addr.BitLen()).String(),
+			}}
+			hosts[addr] = h
+			order = append(order, addr)
+		}
+		port := portLabel(d.Protocol, d.DstPort)
+		h.proposal.Ports = append(h.proposal.Ports, port)
+		h.proposal.Connections += d.Connections
+		h.proposal.Bytes += d.Bytes
+		if d.LastSeen.After(h.proposal.LastSeen) {
+			h.proposal.LastSeen = d.LastSeen
+		}
+		if name, ok := wellKnownPorts[port]; ok && d.Connections > h.busiest {
+			h.proposal.Name = name + "-" + hostLabel(addr)
+			h.busiest = d.Connections
+		}
+	}
+
+	discovery := Discovery{Resource: r, Proposals: make([]ResourceProposal, 0, len(order))}
+	for _, addr := range order {
+		discovery.Proposals = append(discovery.Proposals, hosts[addr].proposal)
+	}
+	slices.SortStableFunc(discovery.Proposals, func(a, b ResourceProposal) int {
+		return cmp.Compare(b.Connections, a.Connections)
+	})
+	return discovery, nil
+}
+
+// CreateProposedResource creates a resource inside a discovery resource, on
+// its enforcer and with its posture requirements. It starts in observe mode,
+// so creating it does not cut off anyone already using the host.
+func CreateProposedResource(ctx context.Context, repo repository.Repository, discoveryID, name, cidr string) (model.Resource, error) {
+	r, err := getDiscoveryResource(ctx, repo, discoveryID)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	outer, err := netip.ParsePrefix(r.CIDR)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	inner, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return model.Resource{}, ValidationError{Msg: "invalid CIDR " + cidr}
+	}
+	if inner.Bits() < outer.Bits() || !outer.Contains(inner.Addr()) {
+		return model.Resource{}, ValidationError{Msg: fmt.Sprintf("%s is not inside %s", cidr, r.CIDR)}
+	}
+	return CreateResource(ctx, repo, name, inner.Masked().String(), r.EnforcerID, model.ModeObserve, r.Posture)
+}
+
+func getDiscoveryResource(ctx context.Context, repo repository.Repository, id string) (model.Resource, error) {
+	r, err := repo.GetResource(ctx, id)
+	if err != nil {
+		return model.Resource{}, err
+	}
+	if !r.Discovery {
+		return model.Resource{}, ValidationError{Msg: "not a discovery resource"}
+	}
+	return r, nil
+}
+
+// hostLabel writes an address with dashes, for use in names.
+func hostLabel(addr netip.Addr) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(addr.String())
+}
+
+// portLabel writes a protocol and port as "tcp/443". Protocols without
+// ports, such as ICMP, are written alone.
+func portLabel(protocol string, port int) string {
+	if port == 0 {
+		return protocol
+	}
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
@@ -2,19 +2,194 @@ package service
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
 )
 
-func CreateEnforcer(ctx context.Context, repo repository.Repository, name, endpoint, tunnelSubnet string) (model.Enforcer, error) {
-	e, err := model.NewEnforcer(name, endpoint, tunnelSubnet)
+// CreateEnforcer creates an enforcer together with the enrollment token it
+// uses to obtain its credential.
+func CreateEnforcer(ctx context.Context, repo repository.Repository, name, endpoint, tunnelSubnet string) (model.Enforcer, model.EnrollmentToken, error) {
+	e := model.NewEnforcer(name, endpoint, tunnelSubnet)
+	var token model.EnrollmentToken
+	err := repo.WithTx(ctx, func(tx repository.Repository) error {
+		if err := tx.CreateEnforcer(ctx, &e); err != nil {
+			return err
+		}
+		var err error
+		token, err = issueEnrollmentToken(ctx, tx, e.ID)
+		return err
+	})
 	if err != nil {
-		return model.Enforcer{}, err
+		return model.Enforcer{}, model.EnrollmentToken{}, err
+	}
+	NotifyConfigChange()
+	return e, token, nil
+}
+
+// IssueEnrollmentToken creates a new single-use enrollment token for an
+// existing enforcer, replacing any unused one.
+func IssueEnrollmentToken(ctx context.Context, repo repository.Repository, enforcerID string) (model.EnrollmentToken, error) {
+	if _, err := repo.GetEnforcer(ctx, enforcerID); err != nil {
+		return model.EnrollmentToken{}, err
+	}
+	var token model.EnrollmentToken
+	err := repo.WithTx(ctx, func(tx repository.Repository) error {
+		var err error
+		token, err = issueEnrollmentToken(ctx, tx, enforcerID)
+		return err
+	})
+	return token, err
+}
+
+func issueEnrollmentToken(ctx context.Context, repo repository.Repository, enforcerID string) (model.EnrollmentToken, error) {
+	if err := repo.DeleteUnusedEnrollmentTokens(ctx, enforcerID); err != nil {
+		return model.EnrollmentToken{}, err
+	}
+	t, err := model.NewEnrollmentToken(enforcerID, time.Now())
+	if err != nil {
+		return model.EnrollmentToken{}, err
+	}
+	if err := repo.CreateEnrollmentToken(ctx, &t); err != nil {
+		return model.EnrollmentToken{}, err
+	}
+	return t, nil
+}
+
+// EnforcerCredential is what an enforcer receives on enrollment or rotation.
+type EnforcerCredential struct {
+	EnforcerID string    `json:"enforcer_id"`
+	APIKey     string    `json:"api_key"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Certificate is set when the enforcer sent a CSR.
+	Certificate *IssuedCertificate `json:"certificate,omitempty"`
+}
+
+// EnrollEnforcer redeems an enrollment token and issues a new API key to its
+// enforcer, plus a client certificate if csrPEM is set.
+func EnrollEnforcer(ctx context.Context, repo repository.Repository, token, csrPEM string) (EnforcerCredential, error) {
+	id, ok := model.ParseEnrollmentToken(token)
+	if !ok {
+		return EnforcerCredential{}, AuthError{Msg: "unauthorized"}
+	}
+	var e model.Enforcer
+	var cert *IssuedCertificate
+	err := repo.WithTx(ctx, func(tx repository.Repository) error {
+		t, err := tx.GetEnrollmentToken(ctx, id)
+		if err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				return AuthError{Msg: "unauthorized"}
+			}
+			return err
+		}
+		now := time.Now()
+		if !t.Verify(token, now) {
+			return AuthError{Msg: "unauthorized"}
+		}
+		if err := tx.MarkEnrollmentTokenUsed(ctx, t.ID, now); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				return AuthError{Msg: "unauthorized"}
+			}
+			return err
+		}
+		if e, err = tx.GetEnforcer(ctx, t.EnforcerID); err != nil {
+			return err
+		}
+		// Enrolling replaces the old credential outright
+		e.RevokeCredential()
+		if err := e.IssueCredential(now); err != nil {
+			return err
+		}
+		if csrPEM != "" {
+			issued, err := issueEnforcerCertificate(&e, csrPEM)
+			if err != nil {
+				return err
+			}
+			cert = &issued
+		}
+		return tx.UpsertEnforcer(ctx, &e)
+	})
+	if err != nil {
+		return EnforcerCredential{}, err
+	}
+	cred := enforcerCredential(e)
+	cred.Certificate = cert
+	return cred, nil
+}
+
+// RotateEnforcerCredential issues a new API key to an authenticated
+// enforcer. The old key stays valid for a short grace period.
+func RotateEnforcerCredential(ctx context.Context, repo repository.Repository, enforcerID string) (EnforcerCredential, error) {
+	e, err := repo.GetEnforcer(ctx, enforcerID)
+	if err != nil {
+		return EnforcerCredential{}, err
+	}
+	if err := e.IssueCredential(time.Now()); err != nil {
+		return EnforcerCredential{}, err
 	}
-	if err := repo.CreateEnforcer(ctx, &e); err != nil {
+	if err := repo.UpsertEnforcer(ctx, &e); err != nil {
+		return EnforcerCredential{}, err
+	}
+	return enforcerCredential(e), nil
+}
+
+func enforcerCredential(e model.Enforcer) EnforcerCredential {
+	return EnforcerCredential{EnforcerID: e.ID, APIKey: e.APIKey, ExpiresAt: e.CredentialExpiresAt}
+}
+
+// RequestEnforcerRotation asks the enforcer to rotate its credential on its
+// next request.
+func RequestEnforcerRotation(ctx context.Context, repo repository.Repository, enforcerID string) error {
+	e, err := repo.GetEnforcer(ctx, enforcerID)
+	if err != nil {
+		return err
+	}
+	if !e.HasCredential() {
+		return ValidationError{Msg: "enforcer has no credential"}
+	}
+	e.RotateRequested = true
+	return repo.UpsertEnforcer(ctx, &e)
+}
+
+// RevokeEnforcerCredential invalidates the enforcer's credential and any
+// unused enrollment token. Resources and pairs are kept.
+func RevokeEnforcerCredential(ctx context.Context, repo repository.Repository, enforcerID string) error {
+	return repo.WithTx(ctx, func(tx repository.Repository) error {
+		e, err := tx.GetEnforcer(ctx, enforcerID)
+		if err != nil {
+			return err
+		}
+		e.RevokeCredential()
+		if err := tx.UpsertEnforcer(ctx, &e); err != nil {
+			return err
+		}
+		return tx.DeleteUnusedEnrollmentTokens(ctx, enforcerID)
+	})
+}
+
+// AuthenticateEnforcer resolves an API key to its enforcer.
+func AuthenticateEnforcer(ctx context.Context, repo repository.Repository, apiKey string) (model.Enforcer, error) {
+	enforcerID, ok := model.ParseAPIKey(apiKey)
+	if !ok {
+		return model.Enforcer{}, AuthError{Msg: "unauthorized"}
+	}
+	e, err := repo.GetEnforcer(ctx, enforcerID)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return model.Enforcer{}, AuthError{Msg: "unauthorized"}
+		}
 		return model.Enforcer{}, err
 	}
+	ok, previous := e.AuthenticateAPIKey(apiKey, time.Now())
+	if !ok {
+		return model.Enforcer{}, AuthError{Msg: "unauthorized"}
+	}
+	if previous {
+		// Still on the old key: the enforcer missed the rotated one
+		e.RotateRequested = true
+	}
 	return e, nil
 }
 
@@ -22,5 +197,18 @@ func UpdateEnforcerPublicKey(ctx context.Context, repo repository.Repository, id
 	if _, err := repo.GetEnforcer(ctx, id); err != nil {
 		return err
 	}
-	return repo.UpdateEnforcerPublicKey(ctx, id, wgPublicKey)
+	if err := repo.UpdateEnforcerPublicKey(ctx, id, wgPublicKey); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
+
+// DeleteEnforcer deletes an enforcer with its resources.
+func DeleteEnforcer(ctx context.Context, repo repository.Repository, id string) error {
+	if _, err := repo.DeleteEnforcer(ctx, id); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
 }
@@ -1,17 +1,21 @@
 // enforcer_config.go generates policy configuration for enforcers.
 //
 // Enforcers periodically poll this configuration to update their:
-//  1. WireGuard peer list (which clients can connect)
+//  1. WireGuard peer list (which devices can connect)
 //  2. Access control policies (which clients can access which resources)
 //
 // The enforcer uses this config to:
-//   - Configure WireGuard peers with client public keys and allowed IPs
+//   - Configure WireGuard peers with device public keys and allowed IPs
 //   - Enforce or observe traffic based on resource mode
 //
 // Policy Building Logic:
-//   - Each client with at least one pair gets a Policy entry
+//   - Access is decided per client; every device of that client gets its own
+//     Policy entry so it becomes a separate WireGuard peer
 //   - observe mode resources: added to ALL clients' allowed CIDRs
 //   - enforce mode resources: added only to paired clients' allowed CIDRs
+//   - resources with posture requirements: skipped for devices whose latest
+//     posture report does not meet them, and marked gated so the enforcer
+//     denies gated observe resources to devices whose policies lack them
 //
 // This enables gradual Zero Trust migration:
 //   - Start with "observe" to monitor traffic without blocking
@@ -21,18 +25,21 @@ package service
 import (
 	"context"
 	"sort"
+	"time"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
 )
 
-// Policy defines access control for a single client on an enforcer.
+// Policy defines access control for a single device on an enforcer.
 type Policy struct {
 	ClientID     string         `json:"client_id"`
 	ClientName   string         `json:"client_name"`
+	DeviceID     string         `json:"device_id"`
+	DeviceName   string         `json:"device_name"`
 	WGPublicKey  string         `json:"wg_public_key"` // For WireGuard peer configuration
-	AllowedIPs   []string       `json:"allowed_ips"`   // Client's tunnel IPs (for WireGuard AllowedIPs)
-	AllowedCIDRs []PolicyTarget `json:"allowed_cidrs"` // Resources this client can access
+	AllowedIPs   []string       `json:"allowed_ips"`   // Device's tunnel IPs (for WireGuard AllowedIPs)
+	AllowedCIDRs []PolicyTarget `json:"allowed_cidrs"` // Resources this device can access
 }
 
 // PolicyTarget represents a resource CIDR with its access mode.
@@ -41,13 +48,19 @@ type PolicyTarget struct {
 	Mode         string `json:"mode"` // "observe" (log only) or "enforce" (block unauthorized)
 	ResourceID   string `json:"resource_id"`
 	ResourceName string `json:"resource_name"`
+	// Gated resources have posture requirements, so an observe one is only
+	// observed for the devices whose policies list it
+	Gated bool `json:"gated,omitempty"`
 }
 
 // EnforcerConfig is the complete configuration an enforcer needs to operate.
 type EnforcerConfig struct {
 	EnforcerID    string   `json:"enforcer_id"`
 	TunnelAddress string   `json:"tunnel_address"` // Enforcer's tunnel IP (e.g., "10.0.0.1/24")
-	Policies      []Policy `json:"policies"`       // Per-client access policies
+	Policies      []Policy `json:"policies"`       // Per-device access policies
+	// Every resource of the enforcer, so it denies enforce resources to
+	// clients without a pair even if no client has one
+	Resources []PolicyTarget `json:"resources"`
 }
 
 // GetEnforcerConfig generates the complete configuration for an enforcer.
@@ -57,7 +70,10 @@ func GetEnforcerConfig(ctx context.Context, repo repository.Repository, id strin
 	if err != nil {
 		return EnforcerConfig{}, err
 	}
+	return buildEnforcerConfig(data)
+}
 
+func buildEnforcerConfig(data repository.EnforcerConfigData) (EnforcerConfig, error) {
 	tunnelAddr, err := data.Enforcer.TunnelAddress()
 	if err != nil {
 		return EnforcerConfig{}, err
@@ -76,71 +92,101 @@ func GetEnforcerConfig(ctx context.Context, repo repository.Repository, id strin
 		}
 	}
 
-	// Build policies for all clients
-	policyMap := make(map[string]*Policy)
+	// Collect the resources each client is granted
+	clientNames := make(map[string]string)
+	clientResources := make(map[string][]model.Resource)
 
-	// If there are observe resources, create policies for ALL clients
+	// If there are observe resources, grant them to ALL clients
 	for _, c := range data.Clients {
-		entry := &Policy{
-			ClientID:    c.ID,
-			ClientName:  c.Name,
-			WGPublicKey: c.WGPublicKey,
-		}
-		// Add all observe resources
-		for _, r := range observeResources {
-			entry.AllowedCIDRs = append(entry.AllowedCIDRs, PolicyTarget{
-				CIDR:         r.CIDR,
-				Mode:         r.Mode,
-				ResourceID:   r.ID,
-				ResourceName: r.Name,
-			})
-		}
-		policyMap[c.ID] = entry
+		clientNames[c.ID] = c.Name
+		clientResources[c.ID] = append(clientResources[c.ID], observeResources...)
 	}
 
 	// Add enforce resources for paired clients
 	for _, p := range data.Pairs {
-		entry := policyMap[p.ClientID]
-		if entry == nil {
-			// Client not in Clients list (no observe resources) - create new policy
-			entry = &Policy{
-				ClientID:    p.ClientID,
-				ClientName:  p.Client.Name,
-				WGPublicKey: p.Client.WGPublicKey,
-			}
-			policyMap[p.ClientID] = entry
+		clientNames[p.ClientID] = p.Client.Name
+		if _, ok := clientResources[p.ClientID]; !ok {
+			// Client not in Clients list (no observe resources)
+			clientResources[p.ClientID] = nil
 		}
 
 		// Add enforce resource only if this specific pair grants access
 		if res, isEnforce := enforceResourceIDs[p.ResourceID]; isEnforce {
-			entry.AllowedCIDRs = append(entry.AllowedCIDRs, PolicyTarget{
-				CIDR:         res.CIDR,
-				Mode:         res.Mode,
-				ResourceID:   res.ID,
-				ResourceName: res.Name,
-			})
+			clientResources[p.ClientID] = append(clientResources[p.ClientID], res)
 		}
 	}
 
-	// Convert map to sorted slice for deterministic output
-	policies := make([]Policy, 0, len(policyMap))
-	for _, entry := range policyMap {
-		// Include client's tunnel IP for WireGuard AllowedIPs
-		if tunnelIP := getAllocatedTunnelIP(data.Enforcer.ID, entry.ClientID); tunnelIP != "" {
+	// Build one policy per device of every granted client
+	now := time.Now()
+	policies := make([]Policy, 0, len(data.Devices))
+	for _, d := range data.Devices {
+		resources, ok := clientResources[d.ClientID]
+		if !ok {
+			continue
+		}
+		var posture *model.DevicePosture
+		if p, ok := data.Postures[d.ID]; ok {
+			posture = &p
+		}
+
+		entry := Policy{
+			ClientID:    d.ClientID,
+			ClientName:  clientNames[d.ClientID],
+			DeviceID:    d.ID,
+			DeviceName:  d.Name,
+			WGPublicKey: d.WGPublicKey,
+		}
+		for _, r := range resources {
+			if !r.Posture.SatisfiedBy(posture, now) {
+				continue
+			}
+			entry.AllowedCIDRs = append(entry.AllowedCIDRs, PolicyTarget{
+				CIDR:         r.CIDR,
+				Mode:         r.Mode,
+				ResourceID:   r.ID,
+				ResourceName: r.Name,
+				Gated:        !r.Posture.IsEmpty(),
+			})
+		}
+		// Include device's tunnel IP for WireGuard AllowedIPs
+		if tunnelIP := data.TunnelIPs[d.ID]; tunnelIP != "" {
 			entry.AllowedIPs = []string{tunnelIP + "/32"}
 		}
 		sort.Slice(entry.AllowedCIDRs, func(i, j int) bool {
 			return entry.AllowedCIDRs[i].CIDR < entry.AllowedCIDRs[j].CIDR
 		})
-		policies = append(policies, *entry)
+		policies = append(policies, entry)
 	}
+
+	// Sort for deterministic output
 	sort.Slice(policies, func(i, j int) bool {
-		return policies[i].ClientID < policies[j].ClientID
+		if policies[i].ClientID != policies[j].ClientID {
+			return policies[i].ClientID < policies[j].ClientID
+		}
+		return policies[i].DeviceID < policies[j].DeviceID
+	})
+
+	resources := make([]PolicyTarget, 0, len(data.Resources))
+	for _, r := range data.Resources {
+		resources = append(resources, PolicyTarget{
+			CIDR:         r.CIDR,
+			Mode:         r.Mode,
+			ResourceID:   r.ID,
+			ResourceName: r.Name,
+			Gated:        !r.Posture.IsEmpty(),
+		})
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].CIDR != resources[j].CIDR {
+			return resources[i].CIDR < resources[j].CIDR
+		}
+		return resources[i].ResourceID < resources[j].ResourceID
 	})
 
 	return EnforcerConfig{
-		EnforcerID:    id,
+		EnforcerID:    data.Enforcer.ID,
 		TunnelAddress: tunnelAddr,
 		Policies:      policies,
+		Resources:     resources,
 	}, nil
 }
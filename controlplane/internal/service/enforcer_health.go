@@ -0,0 +1,189 @@
+// enforcer_health.go records enforcer heartbeats and alerts when an
+// enforcer goes quiet.
+//
+// Health is derived from the age of the latest heartbeat: online, stale
+// after one missed interval, offline after five minutes. The monitor alerts
+// on every transition to stale or offline and when an alerted enforcer comes
+// back online. The last alerted state is stored with the heartbeat, so a
+// restart of the controlplane neither repeats nor loses an alert.
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/alert"
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+const healthCheckInterval = 30 * time.Second
+
+var alertNotifier = alert.NewNotifier("")
+
+func InitAlerts(n alert.Notifier) {
+	if n == nil {
+		panic("alert notifier is required")
+	}
+	alertNotifier = n
+}
+
+// HeartbeatReport is the health and inventory an enforcer reports.
+type HeartbeatReport struct {
+	Version        string `json:"version"`
+	UptimeSeconds  int64  `json:"uptime_seconds" minimum:"0"`
+	ConfigVersion  uint64 `json:"config_version"`
+	PeerCount      int    `json:"peer_count" minimum:"0"`
+	LogsDropped    uint64 `json:"logs_dropped"`
+	LogsSpooled    uint64 `json:"logs_spooled,omitempty" doc:"log entries waiting in the enforcer's spool"`
+	FirewallRules  int    `json:"firewall_rules" minimum:"0"`
+	LastApplyError string `json:"last_apply_error,omitempty"`
+	StateReport
+}
+
+// StateReport carries the digests of the firewall rules and WireGuard peers
+// an enforcer should have installed and of those it has installed.
+type StateReport struct {
+	ExpectedRulesetDigest  string `json:"expected_ruleset_digest,omitempty"`
+	InstalledRulesetDigest string `json:"installed_ruleset_digest,omitempty"`
+	ExpectedPeersDigest    string `json:"expected_peers_digest,omitempty"`
+	InstalledPeersDigest   string `json:"installed_peers_digest,omitempty"`
+}
+
+func (r StateReport) digests() model.StateDigests {
+	return model.StateDigests{
+		ExpectedRulesetDigest:  r.ExpectedRulesetDigest,
+		InstalledRulesetDigest: r.InstalledRulesetDigest,
+		ExpectedPeersDigest:    r.ExpectedPeersDigest,
+		InstalledPeersDigest:   r.InstalledPeersDigest,
+	}
+}
+
+// ApplyReport is the outcome of one attempt of an enforcer to apply a
+// config revision.
+type ApplyReport struct {
+	Version uint64 `json:"version" doc:"config version attempted; 0 if the bundle was rejected unread"`
+	Error   string `json:"error,omitempty" doc:"why the attempt failed; empty on success"`
+	StateReport
+}
+
+// RecordHeartbeat stores the enforcer's latest heartbeat.
+func RecordHeartbeat(ctx context.Context, repo repository.Repository, enforcerID string, report HeartbeatReport) error {
+	return repo.UpsertHeartbeat(ctx, &model.EnforcerHeartbeat{
+		EnforcerID:     enforcerID,
+		Version:        report.Version,
+		UptimeSeconds:  report.UptimeSeconds,
+		ConfigVersion:  report.ConfigVersion,
+		PeerCount:      report.PeerCount,
+		LogsDropped:    report.LogsDropped,
+		LogsSpooled:    report.LogsSpooled,
+		FirewallRules:  report.FirewallRules,
+		LastApplyError: report.LastApplyError,
+		StateDigests:   report.digests(),
+		ReceivedAt:     time.Now(),
+	})
+}
+
+// RecordApplyResult stores an apply attempt and updates the enforcer's
+// latest heartbeat with it, so the outcome shows without waiting for the
+// next heartbeat.
+func RecordApplyResult(ctx context.Context, repo repository.Repository, enforcerID string, report ApplyReport) error {
+	attempt := model.NewApplyAttempt(enforcerID, report.Version, report.Error, report.digests(), time.Now())
+	if !attempt.Success {
+		log.Printf("enforcer %s failed to apply config version %d: %s", enforcerID, report.Version, report.Error)
+	}
+	return repo.WithTx(ctx, func(tx repository.Repository) error {
+		if err := tx.CreateApplyAttempt(ctx, &attempt); err != nil {
+			return err
+		}
+		return tx.UpdateHeartbeatApplyResult(ctx, &attempt)
+	})
+}
+
+// EnforcerHealth is an enforcer with its latest heartbeat and derived state.
+type EnforcerHealth struct {
+	model.Enforcer
+	Heartbeat           *model.EnforcerHeartbeat
+	Status              string
+	ServedConfigVersion uint64
+}
+
+// ListEnforcerHealth returns every enforcer with its health.
+func ListEnforcerHealth(ctx context.Context, repo repository.Repository) ([]EnforcerHealth, error) {
+	data, err := repo.FetchEnforcersPageData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := make([]EnforcerHealth, 0, len(data.Enforcers))
+	for _, e := range data.Enforcers {
+		h := EnforcerHealth{Enforcer: e, ServedConfigVersion: data.ConfigVersions[e.ID]}
+		if hb, ok := data.Heartbeats[e.ID]; ok {
+			h.Heartbeat = &hb
+		}
+		h.Status = model.HealthStatus(h.Heartbeat, now)
+		out = append(out, h)
+	}
+	return out, nil
+}
+
+// RunHealthMonitor checks enforcer health until ctx is done.
+func RunHealthMonitor(ctx context.Context, repo repository.Repository) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := checkEnforcerHealth(ctx, repo); err != nil && ctx.Err() == nil {
+			log.Printf("enforcer health check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkEnforcerHealth(ctx context.Context, repo repository.Repository) error {
+	enforcers, err := ListEnforcerHealth(ctx, repo)
+	if err != nil {
+		return err
+	}
+	for _, e := range enforcers {
+		if e.Heartbeat == nil || e.Status == e.Heartbeat.AlertedStatus {
+			continue
+		}
+		// The first heartbeat of an enforcer is not worth an alert
+		if e.Status != model.HealthOnline || e.Heartbeat.AlertedStatus != "" {
+			a := alert.Alert{
+				Time:    time.Now(),
+				Kind:    "enforcer_health",
+				Subject: e.ID,
+				Name:    e.Name,
+				Status:  e.Status,
+				Message: healthMessage(e),
+			}
+			if err := alertNotifier.Notify(ctx, a); err != nil {
+				log.Printf("send alert failed: %v", err)
+				continue // retry on the next check
+			}
+		}
+		if err := repo.UpdateHeartbeatAlertedStatus(ctx, e.ID, e.Status); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func healthMessage(e EnforcerHealth) string {
+	last := e.Heartbeat.ReceivedAt.Format(time.RFC3339)
+	switch e.Status {
+	case model.HealthOnline:
+		return fmt.Sprintf("enforcer %s is back online", e.Name)
+	case model.HealthStale:
+		return fmt.Sprintf("enforcer %s missed its heartbeat (last at %s)", e.Name, last)
+	default:
+		return fmt.Sprintf("enforcer %s is offline (last heartbeat at %s)", e.Name, last)
+	}
+}
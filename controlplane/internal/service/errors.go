@@ -2,6 +2,7 @@ package service
 
 import (
 	"errors"
+	"time"
 
 	"migration-to-zero-trust/controlplane/internal/repository"
 )
@@ -22,6 +23,27 @@ func (e AuthError) Error() string {
 	return e.Msg
 }
 
+// ForbiddenError means the caller is authenticated but may not proceed yet,
+// e.g. a device still waiting for admin approval.
+type ForbiddenError struct {
+	Msg string
+}
+
+func (e ForbiddenError) Error() string {
+	return e.Msg
+}
+
+// BusyError means the request was refused for lack of capacity and may be
+// retried after RetryAfter.
+type BusyError struct {
+	Msg        string
+	RetryAfter time.Duration
+}
+
+func (e BusyError) Error() string {
+	return e.Msg
+}
+
 func IsNotFound(err error) bool {
 	return errors.Is(err, repository.ErrNotFound)
 }
@@ -35,3 +57,14 @@ func IsAuth(err error) bool {
 	var a AuthError
 	return errors.As(err, &a)
 }
+
+func IsForbidden(err error) bool {
+	var f ForbiddenError
+	return errors.As(err, &f)
+}
+
+func AsBusy(err error) (BusyError, bool) {
+	var b BusyError
+	ok := errors.As(err, &b)
+	return b, ok
+}
@@ -1,14 +1,274 @@
+// log.go ingests enforcer logs.
+//
+// Handlers queue log batches and wait for RunLogIngester to write them,
+// which merges whatever is queued into one multi-row insert on the log
+// database handle. The queue is bounded by entries, and a batch that does
+// not fit is refused with a BusyError so the enforcer backs off and retries
+// instead of the controlplane buffering without limit. Newly stored entries
+// are forwarded to the log sinks, so a resent entry is forwarded once.
+//
+// Delivery is at least once: an enforcer resends a batch until it is
+// acknowledged, and a batch is acknowledged only once it is written. A batch
+// that cannot be judged or written, or is still queued when the controlplane
+// stops, is left unacknowledged. Entries carry an ID given by the enforcer,
+// from which the stored ID is derived, so a resent entry is stored once.
+// Batches carry an enforcer-scoped sequence number, and the highest one
+// written is reported back.
 package service
 
 import (
 	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"migration-to-zero-trust/controlplane/internal/model"
 	"migration-to-zero-trust/controlplane/internal/repository"
+	"migration-to-zero-trust/internal/metrics"
 )
 
-func CreateLog(ctx context.Context, repo repository.Repository, enforcerID, clientID, clientName, resourceID, resourceName, srcIP, dstIP, protocol string, srcPort, dstPort int, timestamp time.Time) error {
-	entry := model.NewLogEntry(enforcerID, clientID, clientName, resourceID, resourceName, srcIP, dstIP, protocol, srcPort, dstPort, timestamp)
-	return repo.CreateLog(ctx, &entry)
+const (
+	// LogQueueCapacity is how many log entries may wait to be written
+	// before new batches are refused.
+	LogQueueCapacity = 100_000
+	// LogRetryAfter is how long an enforcer whose batch was refused is asked
+	// to wait.
+	LogRetryAfter = 5 * time.Second
+	// logWriteSize caps the entries merged into one write.
+	logWriteSize = 5_000
+)
+
+var (
+	logQueue  = make(chan logBatch, 4096)
+	logQueued atomic.Int64 // entries in logQueue
+
+	logSeqMu sync.Mutex
+	logSeqs  = make(map[string]uint64) // enforcer ID -> highest batch sequence written
+
+	logEntriesQueued  = metrics.NewCounter("controlplane_log_entries_queued_total", "Log entries accepted for writing.")
+	logEntriesRefused = metrics.NewCounter("controlplane_log_entries_refused_total", "Log entries refused because the queue was full.")
+	logEntriesWritten = metrics.NewCounter("controlplane_log_entries_written_total", "Log entries written to the database.")
+	logEntriesFailed  = metrics.NewCounter("controlplane_log_entries_failed_total", "Log entries left unacknowledged because they could not be judged or written.")
+	logWriteDuration  = metrics.NewHistogram("controlplane_log_write_duration_seconds", "Time to judge and write one merged log batch.", metrics.DefaultBuckets)
+)
+
+func init() {
+	metrics.NewGaugeFunc("controlplane_log_queue_entries", "Log entries waiting to be written.", func() float64 {
+		return float64(logQueued.Load())
+	})
+}
+
+type logBatch struct {
+	enforcerID string
+	seq        uint64
+	reports    []LogReport
+	done       chan error // receives the outcome of the write
+}
+
+// LogReport is one connection logged by an enforcer. Client, device and
+// resource are not taken from the enforcer but derived at ingest.
+type LogReport struct {
+	// ID is given by the enforcer and stable across resends; empty from
+	// enforcers that do not resend
+	ID        string
+	Timestamp time.Time
+	SrcIP     string
+	SrcPort   int
+	DstIP     string
+	DstPort   int
+	Protocol  string
+	Packets   int64
+	Bytes     int64
+	// DurationMs is 0 for connections not seen ending
+	DurationMs int64
+	// Verdict is that of the enforcer rule that logged the connection;
+	// empty from enforcers that do not report it
+	Verdict string
+}
+
+// IngestLogs queues the enforcer's log batch with sequence number seq (0 if
+// unnumbered) for RunLogIngester, waits until it is written and returns the
+// highest sequence number written for the enforcer. It returns a BusyError
+// if the queue is full.
+func IngestLogs(ctx context.Context, repo repository.Repository, enforcerID string, seq uint64, reports []LogReport) (uint64, error) {
+	n := int64(len(reports))
+	if n == 0 {
+		return ackedLogSeq(ctx, repo, enforcerID)
+	}
+	busy := BusyError{Msg: "log queue full", RetryAfter: LogRetryAfter}
+	if logQueued.Add(n) > LogQueueCapacity {
+		logQueued.Add(-n)
+		logEntriesRefused.Add(float64(n))
+		return 0, busy
+	}
+	// Buffered so the ingester never waits for a handler that gave up
+	done := make(chan error, 1)
+	select {
+	case logQueue <- logBatch{enforcerID: enforcerID, seq: seq, reports: reports, done: done}:
+	default:
+		logQueued.Add(-n)
+		logEntriesRefused.Add(float64(n))
+		return 0, busy
+	}
+	logEntriesQueued.Add(float64(n))
+
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return 0, err
+		}
+	}
+	return ackedLogSeq(ctx, repo, enforcerID)
+}
+
+// ackedLogSeq returns the highest log batch sequence number written for the
+// enforcer, loading it from the database after a restart.
+func ackedLogSeq(ctx context.Context, repo repository.Repository, enforcerID string) (uint64, error) {
+	logSeqMu.Lock()
+	seq, ok := logSeqs[enforcerID]
+	logSeqMu.Unlock()
+	if ok {
+		return seq, nil
+	}
+	enforcer, err := repo.GetEnforcer(ctx, enforcerID)
+	if err != nil {
+		return 0, err
+	}
+	logSeqMu.Lock()
+	defer logSeqMu.Unlock()
+	if enforcer.LogSeq > logSeqs[enforcerID] {
+		logSeqs[enforcerID] = enforcer.LogSeq
+	}
+	return logSeqs[enforcerID], nil
+}
+
+// RunLogIngester writes queued logs until ctx is done.
+func RunLogIngester(ctx context.Context, repo repository.Repository) {
+	for {
+		var batches []logBatch
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-logQueue:
+			batches = append(batches, b)
+		}
+		n := len(batches[0].reports)
+	gather:
+		for n < logWriteSize {
+			select {
+			case b := <-logQueue:
+				batches = append(batches, b)
+				n += len(b.reports)
+			default:
+				break gather
+			}
+		}
+
+		start := time.Now()
+		var entries []model.LogEntry
+		var written []logBatch
+		seqs := make(map[string]uint64) // enforcer ID -> highest sequence written
+		for _, b := range batches {
+			decided, err := decideLogs(ctx, repo, b.enforcerID, b.reports)
+			if err != nil {
+				log.Printf("enforcer %s: judge %d log entries: %v", b.enforcerID, len(b.reports), err)
+				logEntriesFailed.Add(float64(len(b.reports)))
+				b.done <- err
+				continue
+			}
+			entries = append(entries, decided...)
+			written = append(written, b)
+			seqs[b.enforcerID] = max(seqs[b.enforcerID], b.seq)
+		}
+		inserted, err := repo.CreateLogs(ctx, entries)
+		if err != nil {
+			log.Printf("write %d log entries: %v", len(entries), err)
+			logEntriesFailed.Add(float64(len(entries)))
+		} else {
+			logEntriesWritten.Add(float64(len(inserted)))
+			// Resent entries already stored were forwarded the first time
+			forwardLogs(inserted)
+			for id, seq := range seqs {
+				if seq == 0 {
+					continue
+				}
+				if err := repo.AdvanceEnforcerLogSeq(ctx, id, seq); err != nil {
+					log.Printf("enforcer %s: record log sequence %d: %v", id, seq, err)
+				}
+				logSeqMu.Lock()
+				if seq > logSeqs[id] {
+					logSeqs[id] = seq
+				}
+				logSeqMu.Unlock()
+			}
+		}
+		for _, b := range written {
+			b.done <- err
+		}
+		logWriteDuration.ObserveSince(start)
+		logQueued.Add(-int64(n))
+	}
+}
+
+// decideLogs judges each report under the enforcer's policy revision in
+// effect at its timestamp: the client comes from the source tunnel IP, the
+// resource from the destination, and the verdict from the grants and pairs
+// of that revision. A connection the enforcer reports it dropped, as denied
+// or out of scope, is denied whatever the revision says.
+func decideLogs(ctx context.Context, repo repository.Repository, enforcerID string, reports []LogReport) ([]model.LogEntry, error) {
+	from, to := reports[0].Timestamp, reports[0].Timestamp
+	for _, r := range reports[1:] {
+		if r.Timestamp.Before(from) {
+			from = r.Timestamp
+		}
+		if r.Timestamp.After(to) {
+			to = r.Timestamp
+		}
+	}
+	revisions, err := repo.ListPolicyRevisions(ctx, enforcerID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		// No config was built for the enforcer yet
+		rev, err := currentPolicyRevision(ctx, repo, enforcerID)
+		if err != nil {
+			return nil, err
+		}
+		revisions = []model.PolicyRevision{rev}
+	}
+
+	entries := make([]model.LogEntry, 0, len(reports))
+	for _, r := range reports {
+		// Reports older than the first revision are judged under it
+		rev := revisions[0]
+		for _, next := range revisions[1:] {
+			if next.CreatedAt.After(r.Timestamp) {
+				break
+			}
+			rev = next
+		}
+		snapshot, err := decodeSnapshot(rev)
+		if err != nil {
+			return nil, fmt.Errorf("policy revision %s: %w", rev.ID, err)
+		}
+		entry := model.NewLogEntry(enforcerID, rev.ID, snapshot.Decide(r.SrcIP, r.DstIP), r.SrcIP, r.DstIP, r.Protocol, r.SrcPort, r.DstPort, r.Packets, r.Bytes, r.Timestamp)
+		entry.DurationMs = r.DurationMs
+		switch r.Verdict {
+		case model.VerdictAllow, model.VerdictObserve:
+			entry.EnforcerVerdict = r.Verdict
+		case model.VerdictDeny, model.VerdictOutOfScope:
+			entry.EnforcerVerdict = r.Verdict
+			entry.Verdict = model.VerdictDeny
+		}
+		if r.ID != "" {
+			entry.ID = model.LogEntryID(enforcerID, r.ID)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
 }
@@ -0,0 +1,242 @@
+// log_search.go searches stored log entries a page at a time and exports
+// whole result sets.
+//
+// Pages are cut with keyset pagination: the cursor of a page holds the sort
+// value and ID of its last entry, and the next page starts strictly behind
+// it. Entries written while a user pages through a search therefore never
+// shift or repeat entries across pages. An export walks the same pages
+// until the result set is exhausted, so it never holds a database
+// connection for longer than one page.
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+const (
+	DefaultLogSearchLimit = 100
+	MaxLogSearchLimit     = 1000
+	logExportPageSize     = 1000
+)
+
+// LogSearch is a search over stored log entries. Empty fields match all
+// entries.
+type LogSearch struct {
+	From, To   time.Time // To is exclusive
+	EnforcerID string
+	ClientID   string
+	ResourceID string
+	SrcIP      string
+	DstIP      string
+	DstPort    int
+	Protocol   string
+	Verdicts   []string
+	// HasPair keeps only allowed entries if true, and only observed and
+	// denied ones if false.
+	HasPair *bool
+
+	// Sort is a repository.LogSort* column, by default the timestamp.
+	// Entries come newest or largest first unless Asc is set.
+	Sort   string
+	Asc    bool
+	Cursor string // from the previous page
+	Limit  int
+}
+
+// LogPage is one page of a search. NextCursor is empty on the last page.
+type LogPage struct {
+	Entries    []model.LogEntry `json:"entries"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// logCursor is the encoded form of a repository.LogCursor. Sort guards
+// against resuming a search under a different order.
+type logCursor struct {
+	Sort  string    `json:"s"`
+	Time  time.Time `json:"t,omitzero"`
+	Value int64     `json:"v,omitempty"`
+	ID    string    `json:"id"`
+}
+
+// SearchLogs returns one page of the entries matching s.
+func SearchLogs(ctx context.Context, repo repository.Repository, s LogSearch) (LogPage, error) {
+	q, ok, err := logQuery(s)
+	if err != nil || !ok {
+		return LogPage{Entries: []model.LogEntry{}}, err
+	}
+	switch {
+	case s.Limit == 0:
+		q.Limit = DefaultLogSearchLimit
+	case s.Limit < 0 || s.Limit > MaxLogSearchLimit:
+		return LogPage{}, ValidationError{Msg: "limit must be between 1 and 1000"}
+	default:
+		q.Limit = s.Limit
+	}
+	// One entry more than asked for tells whether another page follows
+	q.Limit++
+	entries, err := repo.SearchLogs(ctx, q)
+	if err != nil {
+		return LogPage{}, err
+	}
+	page := LogPage{Entries: entries}
+	if len(entries) == q.Limit {
+		page.Entries = entries[:len(entries)-1]
+		page.NextCursor = encodeLogCursor(q.Sort, page.Entries[len(page.Entries)-1])
+	}
+	return page, nil
+}
+
+// ExportLogs passes every entry matching s, starting at its cursor, to write
+// a page at a time, and stops at the first error write returns.
+func ExportLogs(ctx context.Context, repo repository.Repository, s LogSearch, write func([]model.LogEntry) error) error {
+	q, ok, err := logQuery(s)
+	if err != nil || !ok {
+		return err
+	}
+	q.Limit = logExportPageSize
+	for {
+		entries, err := repo.SearchLogs(ctx, q)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			if err := write(entries); err != nil {
+				return err
+			}
+		}
+		if len(entries) < q.Limit {
+			return nil
+		}
+		last := entries[len(entries)-1]
+		q.After = &repository.LogCursor{Value: logSortValue(q.Sort, last), ID: last.ID}
+	}
+}
+
+// logQuery checks s and turns it into a repository query. It reports false
+// if the filters exclude every entry.
+func logQuery(s LogSearch) (repository.LogQuery, bool, error) {
+	q := repository.LogQuery{
+		From:       s.From,
+		To:         s.To,
+		EnforcerID: s.EnforcerID,
+		ClientID:   s.ClientID,
+		ResourceID: s.ResourceID,
+		DstPort:    s.DstPort,
+		Protocol:   strings.ToLower(s.Protocol),
+		Sort:       s.Sort,
+		Desc:       !s.Asc,
+	}
+	if !s.From.IsZero() && !s.To.IsZero() && !s.To.After(s.From) {
+		return q, false, ValidationError{Msg: "to must be after from"}
+	}
+	for _, ip := range []struct {
+		name  string
+		value string
+		dst   *string
+	}{{"src_ip", s.SrcIP, &q.SrcIP}, {"dst_ip", s.DstIP, &q.DstIP}} {
+		if ip.value == "" {
+			continue
+		}
+		parsed := net.ParseIP(ip.value)
+		if parsed == nil {
+			return q, false, ValidationError{Msg: ip.name + " must be an IP address"}
+		}
+		*ip.dst = parsed.String()
+	}
+	if s.DstPort < 0 || s.DstPort > 65535 {
+		return q, false, ValidationError{Msg: "dst_port must be 1-65535"}
+	}
+	if q.Sort == "" {
+		q.Sort = repository.LogSortTime
+	}
+	switch q.Sort {
+	case repository.LogSortTime, repository.LogSortBytes, repository.LogSortPackets, repository.LogSortDuration:
+	default:
+		return q, false, ValidationError{Msg: "unknown sort " + s.Sort}
+	}
+	for _, v := range s.Verdicts {
+		switch v {
+		case model.VerdictAllow, model.VerdictObserve, model.VerdictDeny:
+		default:
+			return q, false, ValidationError{Msg: "unknown verdict " + v}
+		}
+	}
+	q.Verdicts = s.Verdicts
+	if s.HasPair != nil {
+		paired := []string{model.VerdictObserve, model.VerdictDeny}
+		if *s.HasPair {
+			paired = []string{model.VerdictAllow}
+		}
+		if len(q.Verdicts) == 0 {
+			q.Verdicts = paired
+		} else {
+			q.Verdicts = slices.DeleteFunc(slices.Clone(q.Verdicts), func(v string) bool {
+				return !slices.Contains(paired, v)
+			})
+			if len(q.Verdicts) == 0 {
+				return q, false, nil
+			}
+		}
+	}
+	if s.Cursor != "" {
+		after, err := decodeLogCursor(q.Sort, s.Cursor)
+		if err != nil {
+			return q, false, err
+		}
+		q.After = &after
+	}
+	return q, true, nil
+}
+
+func logSortValue(sort string, e model.LogEntry) any {
+	switch sort {
+	case repository.LogSortBytes:
+		return e.Bytes
+	case repository.LogSortPackets:
+		return e.Packets
+	case repository.LogSortDuration:
+		return e.DurationMs
+	default:
+		return e.Timestamp
+	}
+}
+
+func encodeLogCursor(sort string, last model.LogEntry) string {
+	c := logCursor{Sort: sort, ID: last.ID}
+	switch v := logSortValue(sort, last).(type) {
+	case time.Time:
+		c.Time = v
+	case int64:
+		c.Value = v
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeLogCursor(sort, s string) (repository.LogCursor, error) {
+	invalid := ValidationError{Msg: "invalid cursor"}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return repository.LogCursor{}, invalid
+	}
+	var c logCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return repository.LogCursor{}, invalid
+	}
+	if c.Sort != sort {
+		return repository.LogCursor{}, ValidationError{Msg: "cursor is for a search sorted by " + c.Sort}
+	}
+	if sort == repository.LogSortTime {
+		return repository.LogCursor{Value: c.Time, ID: c.ID}, nil
+	}
+	return repository.LogCursor{Value: c.Value, ID: c.ID}, nil
+}
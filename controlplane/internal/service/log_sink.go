@@ -0,0 +1,290 @@
+// log_sink.go forwards ingested logs to the configured log sinks.
+//
+// Every sink has a worker with a bounded queue. The ingester hands each
+// written batch to the workers of the sinks whose verdict filter it passes;
+// a worker whose queue is full drops the entries instead of holding up
+// ingestion. A failed delivery is retried with backoff up to
+// sinkMaxAttempts times before the batch is dropped. Failed attempts, and
+// the delivery that ends them, are recorded for the sink. Queued entries are
+// lost if the controlplane stops before delivering them.
+package service
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+	"migration-to-zero-trust/controlplane/internal/sink"
+	"migration-to-zero-trust/internal/metrics"
+)
+
+const (
+	// sinkQueueCapacity is how many entries may wait for one sink.
+	sinkQueueCapacity = 50_000
+	// sinkBatchSize caps the entries sent to a sink at once.
+	sinkBatchSize = 500
+	// sinkMaxAttempts is how often a batch is tried before it is dropped.
+	sinkMaxAttempts = 5
+	sinkRetryMin    = time.Second
+	sinkRetryMax    = time.Minute
+)
+
+var (
+	sinkMu      sync.Mutex
+	sinkWorkers = make(map[string]*sinkWorker) // sink ID -> worker
+	sinkReload  = make(chan struct{}, 1)
+
+	sinkEntries = metrics.NewCounter("controlplane_log_sink_entries_total", "Log entries delivered to or dropped by each sink.", "sink", "result")
+)
+
+type sinkWorker struct {
+	sink   model.LogSink
+	queue  chan []sink.Event
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	queued  int
+	dropped int64 // not yet added to the sink's count
+}
+
+// CreateLogSink validates and stores a sink and starts forwarding to it.
+func CreateLogSink(ctx context.Context, repo repository.Repository, name, kind, format, target, transport, caFile string, verdicts []string) (model.LogSink, error) {
+	if kind != sink.KindSyslog {
+		transport = ""
+	}
+	cfg := sink.Config{Kind: kind, Format: format, Target: target, Transport: transport, CAFile: caFile}
+	if err := sink.Validate(cfg); err != nil {
+		return model.LogSink{}, ValidationError{Msg: err.Error()}
+	}
+	for _, v := range verdicts {
+		switch v {
+		case model.VerdictAllow, model.VerdictObserve, model.VerdictDeny:
+		default:
+			return model.LogSink{}, ValidationError{Msg: "unknown verdict " + v}
+		}
+	}
+	s := model.NewLogSink(name, kind, format, target, transport, caFile, verdicts)
+	if err := repo.CreateLogSink(ctx, &s); err != nil {
+		return model.LogSink{}, err
+	}
+	reloadLogSinks()
+	return s, nil
+}
+
+func DeleteLogSink(ctx context.Context, repo repository.Repository, id string) error {
+	if _, err := repo.DeleteLogSink(ctx, id); err != nil {
+		return err
+	}
+	reloadLogSinks()
+	return nil
+}
+
+func reloadLogSinks() {
+	select {
+	case sinkReload <- struct{}{}:
+	default:
+	}
+}
+
+// RunLogSinks runs a worker for every configured sink until ctx is done,
+// starting and stopping workers as sinks are created and deleted.
+func RunLogSinks(ctx context.Context, repo repository.Repository) {
+	for {
+		sinks, err := repo.ListLogSinks(ctx)
+		if err != nil {
+			log.Printf("log sinks: %v", err)
+		} else {
+			syncSinkWorkers(ctx, repo, sinks)
+		}
+		select {
+		case <-ctx.Done():
+			syncSinkWorkers(ctx, repo, nil)
+			return
+		case <-sinkReload:
+		}
+	}
+}
+
+func syncSinkWorkers(ctx context.Context, repo repository.Repository, sinks []model.LogSink) {
+	keep := make(map[string]bool, len(sinks))
+	var stopped []*sinkWorker
+
+	sinkMu.Lock()
+	for _, s := range sinks {
+		keep[s.ID] = true
+		if _, ok := sinkWorkers[s.ID]; ok {
+			continue
+		}
+		workerCtx, cancel := context.WithCancel(ctx)
+		w := &sinkWorker{
+			sink:   s,
+			queue:  make(chan []sink.Event, sinkQueueCapacity/sinkBatchSize),
+			cancel: cancel,
+			done:   make(chan struct{}),
+		}
+		sinkWorkers[s.ID] = w
+		go w.run(workerCtx, repo)
+	}
+	for id, w := range sinkWorkers {
+		if !keep[id] {
+			delete(sinkWorkers, id)
+			stopped = append(stopped, w)
+		}
+	}
+	sinkMu.Unlock()
+
+	for _, w := range stopped {
+		w.cancel()
+		<-w.done
+	}
+}
+
+// forwardLogs hands written entries to the sinks that forward them.
+func forwardLogs(entries []model.LogEntry) {
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+	for _, w := range sinkWorkers {
+		var events []sink.Event
+		for _, e := range entries {
+			if w.sink.Forwards(e.Verdict) {
+				events = append(events, sinkEvent(e))
+			}
+		}
+		for len(events) > 0 {
+			n := min(len(events), sinkBatchSize)
+			w.enqueue(events[:n])
+			events = events[n:]
+		}
+	}
+}
+
+func (w *sinkWorker) enqueue(events []sink.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.queued+len(events) <= sinkQueueCapacity {
+		select {
+		case w.queue <- events:
+			w.queued += len(events)
+			return
+		default:
+		}
+	}
+	w.dropped += int64(len(events))
+}
+
+func sinkEvent(e model.LogEntry) sink.Event {
+	return sink.Event{
+		ID:           e.ID,
+		Time:         e.Timestamp,
+		EnforcerID:   e.EnforcerID,
+		ClientID:     e.ClientID,
+		ClientName:   e.ClientName,
+		DeviceID:     e.DeviceID,
+		DeviceName:   e.DeviceName,
+		ResourceID:   e.ResourceID,
+		ResourceName: e.ResourceName,
+		SrcIP:        e.SrcIP,
+		SrcPort:      e.SrcPort,
+		DstIP:        e.DstIP,
+		DstPort:      e.DstPort,
+		Protocol:     e.Protocol,
+		Packets:      e.Packets,
+		Bytes:        e.Bytes,
+		DurationMs:   e.DurationMs,
+		Mode:         e.Mode,
+		Verdict:      e.Verdict,
+		RevisionID:   e.RevisionID,
+	}
+}
+
+func (w *sinkWorker) run(ctx context.Context, repo repository.Repository) {
+	defer close(w.done)
+	out, err := sink.New(sink.Config{Kind: w.sink.Kind, Format: w.sink.Format, Target: w.sink.Target, Transport: w.sink.Transport, CAFile: w.sink.CAFile})
+	if err != nil {
+		// Entries are dropped until the sink is recreated
+		log.Printf("log sink %s: %v", w.sink.Name, err)
+		w.record(ctx, repo, 1, 0, err)
+	} else {
+		defer out.Close()
+	}
+
+	for {
+		var events []sink.Event
+		select {
+		case <-ctx.Done():
+			return
+		case batch := <-w.queue:
+			events = append(events, batch...)
+		}
+	gather:
+		for len(events) < sinkBatchSize {
+			select {
+			case batch := <-w.queue:
+				events = append(events, batch...)
+			default:
+				break gather
+			}
+		}
+		w.mu.Lock()
+		w.queued -= len(events)
+		w.mu.Unlock()
+
+		var delivered, dropped int64
+		if out != nil && w.deliver(ctx, repo, out, events) {
+			delivered = int64(len(events))
+		} else {
+			dropped = int64(len(events))
+		}
+		w.mu.Lock()
+		dropped += w.dropped
+		w.dropped = 0
+		w.mu.Unlock()
+		sinkEntries.Add(float64(delivered), w.sink.Name, "delivered")
+		sinkEntries.Add(float64(dropped), w.sink.Name, "dropped")
+		if err := repo.AddLogSinkCounts(context.WithoutCancel(ctx), w.sink.ID, delivered, dropped); err != nil {
+			log.Printf("log sink %s: record counts: %v", w.sink.Name, err)
+		}
+	}
+}
+
+// deliver sends events, retrying with backoff, and reports whether they were
+// delivered.
+func (w *sinkWorker) deliver(ctx context.Context, repo repository.Repository, out sink.Sink, events []sink.Event) bool {
+	delay := sinkRetryMin
+	for attempt := 1; ; attempt++ {
+		err := out.Send(ctx, events)
+		if err == nil {
+			if attempt > 1 {
+				w.record(ctx, repo, attempt, len(events), nil)
+			}
+			return true
+		}
+		log.Printf("log sink %s: attempt %d: %v", w.sink.Name, attempt, err)
+		w.record(ctx, repo, attempt, len(events), err)
+		if attempt == sinkMaxAttempts {
+			log.Printf("log sink %s: dropped %d entries", w.sink.Name, len(events))
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, sinkRetryMax)
+	}
+}
+
+func (w *sinkWorker) record(ctx context.Context, repo repository.Repository, attempt, entries int, sendErr error) {
+	msg := ""
+	if sendErr != nil {
+		msg = sendErr.Error()
+	}
+	a := model.NewLogSinkAttempt(w.sink.ID, attempt, entries, msg, time.Now())
+	if err := repo.CreateLogSinkAttempt(context.WithoutCancel(ctx), &a); err != nil {
+		log.Printf("log sink %s: record attempt: %v", w.sink.Name, err)
+	}
+}
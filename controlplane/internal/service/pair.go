@@ -18,5 +18,14 @@ func CreatePair(ctx context.Context, repo repository.Repository, clientID, resou
 	if err := repo.CreatePair(ctx, &p); err != nil {
 		return model.Pair{}, err
 	}
+	NotifyConfigChange()
 	return p, nil
 }
+
+func DeletePair(ctx context.Context, repo repository.Repository, id string) error {
+	if _, err := repo.DeletePair(ctx, id); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
@@ -0,0 +1,100 @@
+package service
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/pki"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+var certAuthority *pki.CA
+
+func InitPKI(ca *pki.CA) {
+	if ca == nil {
+		panic("certificate authority is required")
+	}
+	certAuthority = ca
+}
+
+// IssuedCertificate is a client certificate returned to an enforcer or device.
+type IssuedCertificate struct {
+	Certificate string    `json:"certificate"` // PEM
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// IssueEnforcerCertificate signs a client certificate for the enforcer and
+// makes it the enforcer's current certificate.
+func IssueEnforcerCertificate(ctx context.Context, repo repository.Repository, enforcerID string, csrPEM string) (IssuedCertificate, error) {
+	e, err := repo.GetEnforcer(ctx, enforcerID)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	cert, err := issueEnforcerCertificate(&e, csrPEM)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	if err := repo.UpsertEnforcer(ctx, &e); err != nil {
+		return IssuedCertificate{}, err
+	}
+	return cert, nil
+}
+
+func issueEnforcerCertificate(e *model.Enforcer, csrPEM string) (IssuedCertificate, error) {
+	issued, err := certAuthority.SignClientCSR([]byte(csrPEM), pki.KindEnforcer, e.ID)
+	if err != nil {
+		return IssuedCertificate{}, ValidationError{Msg: err.Error()}
+	}
+	e.SetCertificate(issued.Serial, issued.NotAfter, time.Now())
+	return IssuedCertificate{Certificate: string(issued.PEM), ExpiresAt: issued.NotAfter}, nil
+}
+
+// AuthenticateEnforcerCertificate resolves a CA-verified client certificate
+// to its enforcer. Revoked and superseded certificates are rejected.
+func AuthenticateEnforcerCertificate(ctx context.Context, repo repository.Repository, cert *x509.Certificate) (model.Enforcer, error) {
+	kind, id, serial, ok := pki.Identity(cert)
+	if !ok || kind != pki.KindEnforcer {
+		return model.Enforcer{}, AuthError{Msg: "unauthorized"}
+	}
+	e, err := repo.GetEnforcer(ctx, id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return model.Enforcer{}, AuthError{Msg: "unauthorized"}
+		}
+		return model.Enforcer{}, err
+	}
+	if !e.AuthenticateCertificate(serial, time.Now()) {
+		return model.Enforcer{}, AuthError{Msg: "unauthorized"}
+	}
+	return e, nil
+}
+
+// IssueDeviceCertificate signs a client certificate for the authenticated
+// device.
+func IssueDeviceCertificate(ctx context.Context, repo repository.Repository, claims ClientClaims, csrPEM string) (IssuedCertificate, error) {
+	device, err := repo.GetDevice(ctx, claims.DeviceID)
+	if err != nil {
+		return IssuedCertificate{}, err
+	}
+	if device.ClientID != claims.ClientID || !device.IsApproved() {
+		return IssuedCertificate{}, AuthError{Msg: "unauthorized"}
+	}
+	issued, err := certAuthority.SignClientCSR([]byte(csrPEM), pki.KindDevice, device.ID)
+	if err != nil {
+		return IssuedCertificate{}, ValidationError{Msg: err.Error()}
+	}
+	return IssuedCertificate{Certificate: string(issued.PEM), ExpiresAt: issued.NotAfter}, nil
+}
+
+// DeviceIDFromCertificate returns the device ID of a CA-verified device
+// certificate.
+func DeviceIDFromCertificate(cert *x509.Certificate) (string, bool) {
+	kind, id, _, ok := pki.Identity(cert)
+	if !ok || kind != pki.KindDevice {
+		return "", false
+	}
+	return id, true
+}
@@ -0,0 +1,118 @@
+// policy_revision.go records the access policy of each enforcer over time.
+//
+// A revision is a snapshot of the enforcer's peers, resources, pairs and
+// per-device grants taken whenever its config is built. Ingested logs are
+// judged against the revision in effect at their timestamp, so deleting or
+// adding a pair later does not change how past connections were recorded.
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+// snapshotCacheSize bounds the decoded revisions kept in memory. Log batches
+// almost always fall into the latest revision or two.
+const snapshotCacheSize = 64
+
+var (
+	snapshotMu    sync.Mutex
+	snapshotCache = make(map[string]model.PolicySnapshot) // revision ID -> snapshot
+)
+
+// recordPolicyRevision stores the policy of cfg as the enforcer's latest
+// revision if it changed.
+func recordPolicyRevision(ctx context.Context, repo repository.Repository, data repository.EnforcerConfigData, cfg EnforcerConfig) (model.PolicyRevision, error) {
+	raw, err := json.Marshal(policySnapshot(data, cfg))
+	if err != nil {
+		return model.PolicyRevision{}, err
+	}
+	digest := sha256.Sum256(raw)
+	rev := model.NewPolicyRevision(cfg.EnforcerID, hex.EncodeToString(digest[:]), string(raw), time.Now().UTC())
+	if err := repo.RecordPolicyRevision(ctx, &rev); err != nil {
+		return model.PolicyRevision{}, err
+	}
+	return rev, nil
+}
+
+func policySnapshot(data repository.EnforcerConfigData, cfg EnforcerConfig) model.PolicySnapshot {
+	var s model.PolicySnapshot
+	for _, p := range cfg.Policies {
+		if len(p.AllowedIPs) == 0 {
+			continue
+		}
+		d := model.SnapshotDevice{
+			TunnelIP:   strings.TrimSuffix(p.AllowedIPs[0], "/32"),
+			ClientID:   p.ClientID,
+			ClientName: p.ClientName,
+			DeviceID:   p.DeviceID,
+			DeviceName: p.DeviceName,
+		}
+		for _, t := range p.AllowedCIDRs {
+			d.Granted = append(d.Granted, t.ResourceID)
+		}
+		s.Devices = append(s.Devices, d)
+	}
+
+	paired := make(map[string][]string)
+	for _, p := range data.Pairs {
+		paired[p.ResourceID] = append(paired[p.ResourceID], p.ClientID)
+	}
+	for _, r := range data.Resources {
+		clients := paired[r.ID]
+		sort.Strings(clients)
+		s.Resources = append(s.Resources, model.SnapshotResource{
+			ID:        r.ID,
+			Name:      r.Name,
+			CIDR:      r.CIDR,
+			Mode:      r.Mode,
+			Clients:   clients,
+			Discovery: r.Discovery,
+			Gated:     !r.Posture.IsEmpty(),
+		})
+	}
+	sort.Slice(s.Resources, func(i, j int) bool { return s.Resources[i].ID < s.Resources[j].ID })
+	return s
+}
+
+// currentPolicyRevision records and returns the enforcer's policy as it
+// stands now.
+func currentPolicyRevision(ctx context.Context, repo repository.Repository, enforcerID string) (model.PolicyRevision, error) {
+	data, err := repo.FetchEnforcerConfigData(ctx, enforcerID)
+	if err != nil {
+		return model.PolicyRevision{}, err
+	}
+	cfg, err := buildEnforcerConfig(data)
+	if err != nil {
+		return model.PolicyRevision{}, err
+	}
+	return recordPolicyRevision(ctx, repo, data, cfg)
+}
+
+func decodeSnapshot(rev model.PolicyRevision) (model.PolicySnapshot, error) {
+	snapshotMu.Lock()
+	s, ok := snapshotCache[rev.ID]
+	snapshotMu.Unlock()
+	if ok {
+		return s, nil
+	}
+	if err := json.Unmarshal([]byte(rev.Snapshot), &s); err != nil {
+		return model.PolicySnapshot{}, err
+	}
+	snapshotMu.Lock()
+	if len(snapshotCache) >= snapshotCacheSize {
+		clear(snapshotCache)
+	}
+	snapshotCache[rev.ID] = s
+	snapshotMu.Unlock()
+	return s, nil
+}
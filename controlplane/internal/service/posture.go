@@ -0,0 +1,50 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
+)
+
+// PostureReport is the set of posture facts an agent sends on each poll.
+type PostureReport struct {
+	OS                string `json:"os"`
+	OSVersion         string `json:"os_version"`
+	KernelVersion     string `json:"kernel_version"`
+	AgentVersion      string `json:"agent_version"`
+	DiskEncrypted     bool   `json:"disk_encrypted"`
+	FirewallEnabled   bool   `json:"firewall_enabled"`
+	ScreenLockEnabled bool   `json:"screen_lock_enabled"`
+}
+
+// ReportPosture records the latest posture of a device. Configs are only
+// re-evaluated if the facts changed or the previous report had expired;
+// a report that merely refreshes the timestamp changes no config.
+func ReportPosture(ctx context.Context, repo repository.Repository, deviceID string, report PostureReport) error {
+	now := time.Now()
+	p := model.DevicePosture{
+		DeviceID:          deviceID,
+		OS:                report.OS,
+		OSVersion:         report.OSVersion,
+		KernelVersion:     report.KernelVersion,
+		AgentVersion:      report.AgentVersion,
+		DiskEncrypted:     report.DiskEncrypted,
+		FirewallEnabled:   report.FirewallEnabled,
+		ScreenLockEnabled: report.ScreenLockEnabled,
+		ReportedAt:        now,
+	}
+	prev, err := repo.GetPosture(ctx, deviceID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return err
+	}
+	if err := repo.UpsertPosture(ctx, &p); err != nil {
+		return err
+	}
+	if err != nil || !p.SameFacts(prev) || now.Sub(prev.ReportedAt) > model.PostureMaxAge {
+		NotifyConfigChange()
+	}
+	return nil
+}
@@ -7,13 +7,50 @@ import (
 	"migration-to-zero-trust/controlplane/internal/repository"
 )
 
-func CreateResource(ctx context.Context, repo repository.Repository, name, cidr, enforcerID, mode string) (model.Resource, error) {
-	if _, err := repo.GetEnforcer(ctx, enforcerID); err != nil {
+func CreateResource(ctx context.Context, repo repository.Repository, name, cidr, enforcerID, mode string, posture model.PostureRequirement) (model.Resource, error) {
+	return createResource(ctx, repo, model.NewResource(name, cidr, enforcerID, mode, posture))
+}
+
+// CreateDiscoveryResource creates a discovery resource, which is always in
+// observe mode.
+func CreateDiscoveryResource(ctx context.Context, repo repository.Repository, name, cidr, enforcerID string, posture model.PostureRequirement) (model.Resource, error) {
+	r := model.NewResource(name, cidr, enforcerID, model.ModeObserve, posture)
+	r.Discovery = true
+	return createResource(ctx, repo, r)
+}
+
+func createResource(ctx context.Context, repo repository.Repository, r model.Resource) (model.Resource, error) {
+	if _, err := repo.GetEnforcer(ctx, r.EnforcerID); err != nil {
 		return model.Resource{}, err
 	}
-	r := model.NewResource(name, cidr, enforcerID, mode)
 	if err := repo.CreateResource(ctx, &r); err != nil {
 		return model.Resource{}, err
 	}
+	NotifyConfigChange()
 	return r, nil
 }
+
+// UpdateResourceMode switches a resource between observe and enforce.
+// Discovery resources stay in observe mode.
+func UpdateResourceMode(ctx context.Context, repo repository.Repository, id, mode string) error {
+	r, err := repo.GetResource(ctx, id)
+	if err != nil {
+		return err
+	}
+	if r.Discovery && mode != model.ModeObserve {
+		return ValidationError{Msg: "a discovery resource is always in observe mode"}
+	}
+	if err := repo.UpdateResourceMode(ctx, id, mode); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
+
+func DeleteResource(ctx context.Context, repo repository.Repository, id string) error {
+	if _, err := repo.DeleteResource(ctx, id); err != nil {
+		return err
+	}
+	NotifyConfigChange()
+	return nil
+}
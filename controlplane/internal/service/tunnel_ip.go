@@ -1,57 +1,52 @@
 // tunnel_ip.go manages WireGuard tunnel IP allocation for the Zero Trust network.
 //
-// Each Enforcer has its own tunnel subnet (e.g., 10.0.0.0/24), and clients connecting
+// Each Enforcer has its own tunnel subnet (e.g., 10.0.0.0/24), and devices connecting
 // to that enforcer are assigned unique IPs from this subnet:
 //   - .1 is reserved for the enforcer itself
-//   - .2-.254 are assigned to clients
+//   - .2-.254 are assigned to devices
 //
 // The allocator ensures:
-//   - Idempotency: the same client always receives the same IP
-//   - Uniqueness: different clients never receive the same IP
+//   - Idempotency: the same device always receives the same IP
+//   - Uniqueness: different devices never receive the same IP
 //   - Thread-safety: concurrent requests are safely handled
 //
-// Note: This is an in-memory allocator. IP assignments are lost on restart.
-// For production, consider persisting allocations to the database.
+// Allocations are stored in the tunnel_ips table, so a device keeps its
+// address across controlplane restarts.
 package service
 
 import (
+	"context"
 	"errors"
 	"net"
 	"sync"
-)
 
-var (
-	tunnelIPMu    sync.Mutex
-	tunnelIPAlloc = make(map[string]map[string]string) // enforcerID -> clientID -> tunnelIP
+	"migration-to-zero-trust/controlplane/internal/model"
+	"migration-to-zero-trust/controlplane/internal/repository"
 )
 
-// getAllocatedTunnelIP returns the tunnel IP previously allocated to a client.
-// Returns empty string if the client has no allocation yet.
-// Used by GetEnforcerConfig to include client IPs in WireGuard peer configuration.
-func getAllocatedTunnelIP(enforcerID, clientID string) string {
-	tunnelIPMu.Lock()
-	defer tunnelIPMu.Unlock()
-	if m := tunnelIPAlloc[enforcerID]; m != nil {
-		return m[clientID]
-	}
-	return ""
-}
+// tunnelIPMu serializes allocation so two devices never race for the same address.
+var tunnelIPMu sync.Mutex
 
-// allocateTunnelIP assigns a tunnel IP to a client within an enforcer's subnet.
-// If the client already has an allocation, returns the existing IP (idempotent).
+// allocateTunnelIP assigns a tunnel IP to a device within an enforcer's subnet.
+// If the device already has an allocation, returns the existing IP (idempotent).
 // Otherwise, finds the next available IP starting from .2.
-// Used by GetClientConfig when a client requests its configuration.
-func allocateTunnelIP(enforcerID, clientID, subnet string) (string, error) {
+// Used by GetClientConfig when a device requests its configuration.
+func allocateTunnelIP(ctx context.Context, repo repository.Repository, enforcerID, deviceID, subnet string) (string, error) {
 	tunnelIPMu.Lock()
 	defer tunnelIPMu.Unlock()
 
-	if tunnelIPAlloc[enforcerID] == nil {
-		tunnelIPAlloc[enforcerID] = make(map[string]string)
+	allocated, err := repo.ListTunnelIPs(ctx, enforcerID)
+	if err != nil {
+		return "", err
 	}
 
 	// Idempotent: return existing allocation if present
-	if ip, ok := tunnelIPAlloc[enforcerID][clientID]; ok {
-		return ip, nil
+	usedIPs := make(map[string]bool, len(allocated))
+	for _, t := range allocated {
+		if t.DeviceID == deviceID {
+			return t.IP, nil
+		}
+		usedIPs[t.IP] = true
 	}
 
 	_, ipNet, err := net.ParseCIDR(subnet)
@@ -63,18 +58,20 @@ func allocateTunnelIP(enforcerID, clientID, subnet string) (string, error) {
 		return "", errors.New("only IPv4 supported")
 	}
 
-	// Build set of already-used IPs
-	usedIPs := make(map[string]bool)
-	for _, allocated := range tunnelIPAlloc[enforcerID] {
-		usedIPs[allocated] = true
-	}
-
 	// Find first available IP (.1 is enforcer, start from .2)
 	ip[3] = 2
 	for ip[3] < 255 {
 		candidate := ip.String()
 		if !usedIPs[candidate] && ipNet.Contains(ip) {
-			tunnelIPAlloc[enforcerID][clientID] = candidate
+			if err := repo.CreateTunnelIP(ctx, &model.TunnelIP{
+				EnforcerID: enforcerID,
+				DeviceID:   deviceID,
+				IP:         candidate,
+			}); err != nil {
+				return "", err
+			}
+			// Enforcers need the new address as the device's AllowedIPs
+			NotifyConfigChange()
 			return candidate, nil
 		}
 		ip[3]++
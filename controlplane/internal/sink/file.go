@@ -0,0 +1,101 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// fileMaxSize is the size at which a file sink is rotated.
+	fileMaxSize = 100 << 20
+	// fileBackups is how many rotated files are kept, as path.1 (newest)
+	// to path.N.
+	fileBackups = 5
+)
+
+// fileSink appends one event per line, as JSON Lines or CEF/LEEF lines.
+type fileSink struct {
+	cfg  Config
+	f    *os.File
+	size int64
+}
+
+func newFile(c Config) (*fileSink, error) {
+	s := &fileSink{cfg: c}
+	if err := os.MkdirAll(filepath.Dir(c.Target), 0o755); err != nil {
+		return nil, fmt.Errorf("file sink: %w", err)
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.cfg.Target, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("file sink: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("file sink: %w", err)
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+func (s *fileSink) Send(_ context.Context, events []Event) error {
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	var buf []byte
+	for _, e := range events {
+		line, err := formatEvent(s.cfg.Format, e)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+	if s.size > 0 && s.size+int64(len(buf)) > fileMaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(buf)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("file sink: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts path.i to path.i+1, dropping the oldest, moves the current
+// file to path.1 and starts a new one.
+func (s *fileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return fmt.Errorf("file sink: %w", err)
+	}
+	s.f = nil
+	for i := fileBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", s.cfg.Target, i), fmt.Sprintf("%s.%d", s.cfg.Target, i+1))
+	}
+	if err := os.Rename(s.cfg.Target, s.cfg.Target+".1"); err != nil {
+		return fmt.Errorf("file sink: rotate: %w", err)
+	}
+	return s.open()
+}
+
+func (s *fileSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Product identification in CEF and LEEF headers and the syslog APP-NAME.
+const (
+	vendor   = "migration-to-zero-trust"
+	product  = "controlplane"
+	version  = "1"
+	appName  = "zt-controlplane"
+	msgID    = "access"
+	sdID     = "access@32473" // 32473 is the example enterprise number (RFC 5612)
+	facility = 16             // local0
+)
+
+// Verdicts as set on log entries.
+const (
+	verdictAllow   = "allow"
+	verdictObserve = "observe"
+	verdictDeny    = "deny"
+)
+
+// formatEvent renders e in format as a single line without a trailing
+// newline. FormatRFC5424 renders only the message text; the structured data
+// is added by the syslog header.
+func formatEvent(format string, e Event) ([]byte, error) {
+	switch format {
+	case FormatCEF:
+		return []byte(formatCEF(e)), nil
+	case FormatLEEF:
+		return []byte(formatLEEF(e)), nil
+	case FormatRFC5424:
+		return []byte(summary(e)), nil
+	default:
+		return json.Marshal(e)
+	}
+}
+
+func summary(e Event) string {
+	who := e.SrcIP
+	if e.ClientName != "" {
+		who = e.ClientName + " (" + e.SrcIP + ")"
+	}
+	what := fmt.Sprintf("%s:%d/%s", e.DstIP, e.DstPort, e.Protocol)
+	if e.ResourceName != "" {
+		what = e.ResourceName + " " + what
+	}
+	return fmt.Sprintf("%s %s -> %s", e.Verdict, who, what)
+}
+
+// severity maps a verdict to a syslog severity.
+func severity(verdict string) int {
+	switch verdict {
+	case verdictDeny:
+		return 4 // warning
+	case verdictObserve:
+		return 5 // notice
+	default:
+		return 6 // informational
+	}
+}
+
+// formatSyslog renders e as an RFC 5424 message. Only FormatRFC5424 carries
+// structured data; other formats are the message text.
+func formatSyslog(format, hostname string, e Event) ([]byte, error) {
+	msg, err := formatEvent(format, e)
+	if err != nil {
+		return nil, err
+	}
+	sd := "-"
+	if format == FormatRFC5424 {
+		sd = structuredData(e)
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %d %s %s ",
+		facility*8+severity(e.Verdict),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		orNil(hostname), appName, os.Getpid(), msgID, sd)
+	return append([]byte(header), msg...), nil
+}
+
+func orNil(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func structuredData(e Event) string {
+	var b strings.Builder
+	b.WriteString("[" + sdID)
+	param := func(name, value string) {
+		if value == "" {
+			return
+		}
+		b.WriteString(" " + name + `="`)
+		b.WriteString(sdEscaper.Replace(value))
+		b.WriteString(`"`)
+	}
+	param("id", e.ID)
+	param("verdict", e.Verdict)
+	param("mode", e.Mode)
+	param("enforcer", e.EnforcerID)
+	param("client", e.ClientName)
+	param("clientID", e.ClientID)
+	param("device", e.DeviceName)
+	param("resource", e.ResourceName)
+	param("resourceID", e.ResourceID)
+	param("src", e.SrcIP)
+	param("srcPort", strconv.Itoa(e.SrcPort))
+	param("dst", e.DstIP)
+	param("dstPort", strconv.Itoa(e.DstPort))
+	param("proto", e.Protocol)
+	param("packets", strconv.FormatInt(e.Packets, 10))
+	param("bytes", strconv.FormatInt(e.Bytes, 10))
+	param("durationMs", strconv.FormatInt(e.DurationMs, 10))
+	b.WriteString("]")
+	return b.String()
+}
+
+var sdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// cefSeverity maps a verdict to a CEF severity from 0 to 10.
+func cefSeverity(verdict string) int {
+	switch verdict {
+	case verdictDeny:
+		return 7
+	case verdictObserve:
+		return 5
+	default:
+		return 1
+	}
+}
+
+func eventName(verdict string) string {
+	switch verdict {
+	case verdictAllow:
+		return "Access allowed"
+	case verdictObserve:
+		return "Access allowed in observe mode"
+	default:
+		return "Access denied"
+	}
+}
+
+var (
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefValueEscaper  = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+func formatCEF(e Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|",
+		cefHeaderEscaper.Replace(vendor), cefHeaderEscaper.Replace(product), version,
+		cefHeaderEscaper.Replace(e.Verdict), cefHeaderEscaper.Replace(eventName(e.Verdict)), cefSeverity(e.Verdict))
+	var ext []string
+	field := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValueEscaper.Replace(value))
+		}
+	}
+	field("rt", strconv.FormatInt(e.Time.UnixMilli(), 10))
+	field("externalId", e.ID)
+	field("act", e.Verdict)
+	field("src", e.SrcIP)
+	field("spt", strconv.Itoa(e.SrcPort))
+	field("dst", e.DstIP)
+	field("dpt", strconv.Itoa(e.DstPort))
+	field("proto", e.Protocol)
+	field("suser", e.ClientName)
+	field("suid", e.ClientID)
+	field("deviceExternalId", e.EnforcerID)
+	custom := func(key, label, value string) {
+		if value != "" {
+			field(key+"Label", label)
+			field(key, value)
+		}
+	}
+	custom("cs1", "resource", e.ResourceName)
+	custom("cs2", "device", e.DeviceName)
+	custom("cs3", "mode", e.Mode)
+	custom("cn1", "packets", strconv.FormatInt(e.Packets, 10))
+	custom("cn2", "bytes", strconv.FormatInt(e.Bytes, 10))
+	custom("cn3", "durationMs", strconv.FormatInt(e.DurationMs, 10))
+	b.WriteString(strings.Join(ext, " "))
+	return b.String()
+}
+
+var leefValueEscaper = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ")
+
+// formatLEEF renders LEEF 1.0 with tab-separated attributes.
+func formatLEEF(e Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|", vendor, product, version, e.Verdict)
+	var attrs []string
+	attr := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, key+"="+leefValueEscaper.Replace(value))
+		}
+	}
+	// Without devTimeFormat, devTime is read as epoch milliseconds
+	attr("devTime", strconv.FormatInt(e.Time.UnixMilli(), 10))
+	attr("cat", "access")
+	attr("sev", strconv.Itoa(cefSeverity(e.Verdict)))
+	attr("action", e.Verdict)
+	attr("src", e.SrcIP)
+	attr("srcPort", strconv.Itoa(e.SrcPort))
+	attr("dst", e.DstIP)
+	attr("dstPort", strconv.Itoa(e.DstPort))
+	attr("proto", e.Protocol)
+	attr("usrName", e.ClientName)
+	attr("identSrc", e.SrcIP)
+	attr("resource", e.ResourceName)
+	attr("device", e.DeviceName)
+	attr("mode", e.Mode)
+	attr("enforcer", e.EnforcerID)
+	attr("eventId", e.ID)
+	attr("packets", strconv.FormatInt(e.Packets, 10))
+	attr("totalBytes", strconv.FormatInt(e.Bytes, 10))
+	attr("durationMs", strconv.FormatInt(e.DurationMs, 10))
+	b.WriteString(strings.Join(attrs, "\t"))
+	return b.String()
+}
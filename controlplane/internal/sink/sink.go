@@ -0,0 +1,164 @@
+// Package sink forwards access events to external systems such as a SIEM:
+// RFC 5424 syslog over UDP, TCP or TLS, JSON Lines files with rotation, and
+// batched HTTP webhooks. Syslog and file sinks can carry events as RFC 5424
+// structured data, CEF, LEEF or JSON.
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Sink kinds.
+const (
+	KindSyslog  = "syslog"
+	KindFile    = "file"
+	KindWebhook = "webhook"
+)
+
+// Event formats.
+const (
+	FormatRFC5424 = "rfc5424" // syslog structured data
+	FormatCEF     = "cef"
+	FormatLEEF    = "leef"
+	FormatJSON    = "json"
+)
+
+// Syslog transports.
+const (
+	TransportUDP = "udp"
+	TransportTCP = "tcp"
+	TransportTLS = "tls"
+)
+
+// Event is one access decision as forwarded to a sink.
+type Event struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	EnforcerID   string    `json:"enforcer_id"`
+	ClientID     string    `json:"client_id,omitempty"`
+	ClientName   string    `json:"client_name,omitempty"`
+	DeviceID     string    `json:"device_id,omitempty"`
+	DeviceName   string    `json:"device_name,omitempty"`
+	ResourceID   string    `json:"resource_id,omitempty"`
+	ResourceName string    `json:"resource_name,omitempty"`
+	SrcIP        string    `json:"src_ip"`
+	SrcPort      int       `json:"src_port"`
+	DstIP        string    `json:"dst_ip"`
+	DstPort      int       `json:"dst_port"`
+	Protocol     string    `json:"protocol"`
+	Packets      int64     `json:"packets"`
+	Bytes        int64     `json:"bytes"`
+	DurationMs   int64     `json:"duration_ms"`
+	Mode         string    `json:"mode,omitempty"`
+	Verdict      string    `json:"verdict"`
+	RevisionID   string    `json:"revision_id,omitempty"`
+}
+
+// Sink delivers batches of events. Send either delivers the whole batch or
+// returns an error, after which the batch may be sent again.
+type Sink interface {
+	Send(ctx context.Context, events []Event) error
+	Close() error
+}
+
+// Config describes a sink.
+type Config struct {
+	Kind   string
+	Format string
+	// Target is host:port for syslog, a file path or a URL.
+	Target string
+	// Transport is the syslog transport.
+	Transport string
+	// CAFile, if set, replaces the system roots for TLS syslog and HTTPS
+	// webhooks.
+	CAFile string
+}
+
+// Validate checks that c describes a sink that can be opened.
+func Validate(c Config) error {
+	switch c.Kind {
+	case KindSyslog:
+		switch c.Format {
+		case FormatRFC5424, FormatCEF, FormatLEEF, FormatJSON:
+		default:
+			return fmt.Errorf("syslog format must be %s, %s, %s or %s", FormatRFC5424, FormatCEF, FormatLEEF, FormatJSON)
+		}
+		switch c.Transport {
+		case TransportUDP, TransportTCP, TransportTLS:
+		default:
+			return fmt.Errorf("syslog transport must be %s, %s or %s", TransportUDP, TransportTCP, TransportTLS)
+		}
+		if _, _, err := net.SplitHostPort(c.Target); err != nil {
+			return fmt.Errorf("syslog target must be host:port: %w", err)
+		}
+	case KindFile:
+		switch c.Format {
+		case FormatJSON, FormatCEF, FormatLEEF:
+		default:
+			return fmt.Errorf("file format must be %s, %s or %s", FormatJSON, FormatCEF, FormatLEEF)
+		}
+		if c.Target == "" {
+			return errors.New("file target must be a path")
+		}
+	case KindWebhook:
+		if c.Format != FormatJSON {
+			return fmt.Errorf("webhook format must be %s", FormatJSON)
+		}
+		u, err := url.Parse(c.Target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("webhook target must be an http or https URL")
+		}
+	default:
+		return fmt.Errorf("sink kind must be %s, %s or %s", KindSyslog, KindFile, KindWebhook)
+	}
+	return nil
+}
+
+// New opens the sink described by c. Network sinks connect lazily, so an
+// unreachable target shows up as failed deliveries rather than here.
+func New(c Config) (Sink, error) {
+	if err := Validate(c); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := loadTLSConfig(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Kind {
+	case KindSyslog:
+		return newSyslog(c, tlsConfig), nil
+	case KindFile:
+		s, err := newFile(c)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	default:
+		return newWebhook(c, tlsConfig), nil
+	}
+}
+
+func loadTLSConfig(caFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return cfg, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("sink CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("sink CA file: no certificates found")
+	}
+	cfg.RootCAs = pool
+	return cfg, nil
+}
@@ -0,0 +1,96 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// syslogTimeout bounds connecting and writing a batch.
+const syslogTimeout = 10 * time.Second
+
+// syslogSink sends one RFC 5424 message per event. Over UDP each message is
+// a datagram (RFC 5426); over TCP and TLS messages are framed by octet
+// counting (RFC 6587, RFC 5425). A stream connection that fails is dropped
+// and reopened by the next Send.
+type syslogSink struct {
+	cfg       Config
+	tlsConfig *tls.Config
+	hostname  string
+	conn      net.Conn
+}
+
+func newSyslog(c Config, tlsConfig *tls.Config) *syslogSink {
+	hostname, _ := os.Hostname()
+	if c.Transport == TransportTLS && tlsConfig.ServerName == "" {
+		host, _, _ := net.SplitHostPort(c.Target)
+		tlsConfig.ServerName = host
+	}
+	return &syslogSink{cfg: c, tlsConfig: tlsConfig, hostname: hostname}
+}
+
+func (s *syslogSink) dial(ctx context.Context) (net.Conn, error) {
+	d := &net.Dialer{Timeout: syslogTimeout}
+	switch s.cfg.Transport {
+	case TransportUDP:
+		return d.DialContext(ctx, "udp", s.cfg.Target)
+	case TransportTCP:
+		return d.DialContext(ctx, "tcp", s.cfg.Target)
+	default:
+		td := &tls.Dialer{NetDialer: d, Config: s.tlsConfig}
+		return td.DialContext(ctx, "tcp", s.cfg.Target)
+	}
+}
+
+func (s *syslogSink) Send(ctx context.Context, events []Event) error {
+	if s.conn == nil {
+		conn, err := s.dial(ctx)
+		if err != nil {
+			return fmt.Errorf("syslog %s: %w", s.cfg.Target, err)
+		}
+		s.conn = conn
+	}
+	var buf []byte
+	for _, e := range events {
+		msg, err := formatSyslog(s.cfg.Format, s.hostname, e)
+		if err != nil {
+			return err
+		}
+		if s.cfg.Transport == TransportUDP {
+			if err := s.write(msg); err != nil {
+				return err
+			}
+			continue
+		}
+		buf = strconv.AppendInt(buf, int64(len(msg)), 10)
+		buf = append(buf, ' ')
+		buf = append(buf, msg...)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return s.write(buf)
+}
+
+func (s *syslogSink) write(b []byte) error {
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := s.conn.Write(b); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("syslog %s: %w", s.cfg.Target, err)
+	}
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 
@@ -13,7 +18,10 @@ import (
 	"migration-to-zero-trust/enforcer/internal/controlplane"
 	"migration-to-zero-trust/enforcer/internal/firewall"
 	"migration-to-zero-trust/enforcer/internal/logging"
+	"migration-to-zero-trust/enforcer/internal/policy"
+	"migration-to-zero-trust/enforcer/internal/version"
 	"migration-to-zero-trust/enforcer/internal/wireguard"
+	"migration-to-zero-trust/internal/configbundle"
 )
 
 func main() {
@@ -24,7 +32,7 @@ func main() {
 		log.Fatalf("config: %v", err)
 	}
 
-	log.Printf("starting enforcer iface=%s", env.WGInterface)
+	log.Printf("starting enforcer version=%s iface=%s", version.Version, env.WGInterface)
 
 	// Load or generate WireGuard key pair
 	keyPair, err := wireguard.LoadOrGenerateKeyPair(config.DefaultKeyDir)
@@ -33,22 +41,69 @@ func main() {
 	}
 	log.Printf("wireguard public key: %s", keyPair.PublicKey.String())
 
-	// Create control plane client
-	cp := controlplane.NewClient(env.ControlPlaneURL, env.APIKey)
+	// Create control plane client. A stored credential from an earlier
+	// enrollment or rotation wins over the static API_KEY.
+	credPath := filepath.Join(config.DefaultKeyDir, config.CredentialFile)
+	apiKey, err := controlplane.LoadCredential(credPath)
+	if err != nil {
+		log.Fatalf("load credential failed: %v", err)
+	}
+	if apiKey == "" {
+		apiKey = env.APIKey
+	}
+	cp := controlplane.NewClient(env.ControlPlaneURL, apiKey)
+	cp.OnCredential = func(apiKey string) error {
+		return controlplane.SaveCredential(credPath, apiKey)
+	}
+	if strings.HasPrefix(env.ControlPlaneURL, "https://") {
+		if err := cp.EnableMTLS(config.DefaultKeyDir, env.CAFile); err != nil {
+			log.Fatalf("mtls setup failed: %v", err)
+		}
+	}
 
-	// Update public key in control plane
 	ctx := context.Background()
-	if err := cp.UpdatePublicKey(ctx, keyPair.PublicKey.String()); err != nil {
+	if apiKey == "" {
+		if env.EnrollmentToken == "" {
+			log.Fatalf("config: ENROLLMENT_TOKEN or API_KEY is required")
+		}
+		enroll(ctx, cp, env.EnrollmentToken)
+	}
+
+	// Update public key in control plane
+	err = cp.UpdatePublicKey(ctx, keyPair.PublicKey.String())
+	if errors.Is(err, controlplane.ErrUnauthorized) && env.EnrollmentToken != "" {
+		// The stored credential was revoked; enroll again with the new token
+		enroll(ctx, cp, env.EnrollmentToken)
+		err = cp.UpdatePublicKey(ctx, keyPair.PublicKey.String())
+	}
+	if err != nil {
 		log.Fatalf("update public key failed: %v", err)
 	}
 	log.Printf("public key registered with control plane")
 
+	if cp.CertificateNeedsRenewal(time.Now()) {
+		if err := cp.RenewCertificate(ctx); err != nil {
+			log.Printf("client certificate request failed, using API key: %v", err)
+		} else {
+			log.Printf("client certificate issued")
+		}
+	}
+
+	signingKey, err := resolveSigningKey(ctx, cp, env.ConfigSigningKey)
+	if err != nil {
+		log.Fatalf("config signing key: %v", err)
+	}
+	cp.Verifier, err = configbundle.NewVerifier(signingKey, filepath.Join(config.DefaultKeyDir, config.ConfigVersionFile))
+	if err != nil {
+		log.Fatalf("config signing key: %v", err)
+	}
+
 	// Fetch initial config from control plane
-	cfg, err := cp.FetchConfig(ctx)
+	cfg, err := cp.FetchConfig(ctx, 0, 0)
 	if err != nil {
 		log.Fatalf("fetch config failed: %v", err)
 	}
-	log.Printf("config fetched: tunnel_address=%s", cfg.TunnelAddress)
+	log.Printf("config fetched: version=%d tunnel_address=%s", cfg.Version, cfg.TunnelAddress)
 
 	// Setup WireGuard interface
 	if err := wireguard.Setup(env.WGInterface, env.WGListenPort, keyPair, cfg.TunnelAddress); err != nil {
@@ -64,44 +119,117 @@ func main() {
 	}
 	log.Printf("firewall configured")
 
-	// Setup logger
-	logger, err := logging.NewLogger(firewall.DefaultLoggingGroup, cp)
+	// Setup logger. Batches wait in the spool until the controlplane takes
+	// them, also across restarts.
+	spool, err := logging.OpenSpool(filepath.Join(config.DefaultKeyDir, config.LogSpoolDir), int64(env.LogSpoolMB)<<20)
+	if err != nil {
+		log.Fatalf("logger init failed: %v", err)
+	}
+	logger, err := logging.NewLogger(firewall.LogGroups, cp, spool)
 	if err != nil {
 		log.Fatalf("logger init failed: %v", err)
 	}
-	log.Printf("logging enabled (group %d)", firewall.DefaultLoggingGroup)
+	log.Printf("logging enabled (groups %d allow, %d deny, %d observe, %d out of scope)", firewall.AllowLogGroup, firewall.DenyLogGroup, firewall.ObserveLogGroup, firewall.OutOfScopeLogGroup)
 
 	// Define apply function
+	var applied atomic.Pointer[controlplane.EnforcerConfig]
 	applyFn := func(cfg *controlplane.EnforcerConfig) error {
-		if err := wireguard.ApplyPeers(env.WGInterface, cfg.Policies); err != nil {
-			return err
-		}
-		if err := fwMgr.ApplyPolicies(cfg.Policies); err != nil {
-			return err
-		}
-		logger.UpdateLookupTables(cfg.Policies)
-		return nil
+		return observeApply(func() error {
+			if err := wireguard.ApplyPeers(env.WGInterface, cfg.Policies); err != nil {
+				return err
+			}
+			rs, err := policy.Compile(cfg.Policies, cfg.Resources, env.UnknownDestinations)
+			if err != nil {
+				return err
+			}
+			if err := fwMgr.ApplyRuleset(rs); err != nil {
+				return err
+			}
+			if old := applied.Load(); old != nil {
+				closeRevoked(old, rs, env.UnknownDestinations)
+			}
+			logger.UpdateLookupTables(cfg.Policies)
+			applied.Store(cfg)
+			return nil
+		})
+	}
+	stateFn := func(cfg *controlplane.EnforcerConfig) controlplane.StateDigests {
+		return stateDigests(fwMgr, env.WGInterface, cfg, env.UnknownDestinations)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	registerMetrics(fwMgr, logger)
+	if env.MetricsAddr != "" {
+		go serveMetrics(ctx, env.MetricsAddr)
+	}
+
 	// Apply initial policies
 	log.Printf("applying initial policies")
 	if err := applyFn(cfg); err != nil {
+		report := controlplane.ApplyResult{Version: cfg.Version, Error: err.Error(), StateDigests: stateFn(cfg)}
+		if err := cp.ReportApply(ctx, report); err != nil {
+			log.Printf("report apply result failed: %v", err)
+		}
 		log.Fatalf("initial apply failed: %v", err)
 	}
+	if err := cp.ReportApply(ctx, controlplane.ApplyResult{Version: cfg.Version, StateDigests: stateFn(cfg)}); err != nil {
+		log.Printf("report apply result failed: %v", err)
+	}
+	if err := cp.ConfigApplied(cfg); err != nil {
+		log.Printf("record config version failed: %v", err)
+	}
 	log.Printf("initial config applied")
 
-	// Start poller
-	poller := &controlplane.Poller{
+	// Start config stream
+	stream := &controlplane.Stream{
+		Client:        cp,
+		OnChange:      applyFn,
+		RetryInterval: controlplane.DefaultRetryInterval,
+		State:         stateFn,
+	}
+	go func() {
+		if err := stream.Run(ctx); err != nil {
+			log.Printf("stream error: %v", err)
+		}
+	}()
+
+	// Start heartbeats
+	startedAt := time.Now()
+	heartbeater := &controlplane.Heartbeater{
 		Client:   cp,
-		Interval: controlplane.DefaultPollInterval,
-		OnChange: applyFn,
+		Interval: controlplane.DefaultHeartbeatInterval,
+		Collect: func() controlplane.Heartbeat {
+			hb := controlplane.Heartbeat{
+				Version:        version.Version,
+				UptimeSeconds:  int64(time.Since(startedAt).Seconds()),
+				ConfigVersion:  cp.Verifier.AppliedVersion(),
+				LogsDropped:    logger.Dropped(),
+				LogsSpooled:    logger.Spooled(),
+				LastApplyError: stream.LastApplyError(),
+			}
+			if n, err := wireguard.PeerCount(env.WGInterface); err == nil {
+				hb.PeerCount = n
+			} else {
+				log.Printf("heartbeat: %v", err)
+			}
+			if n, err := fwMgr.RuleCount(); err == nil {
+				hb.FirewallRules = n
+			} else {
+				log.Printf("heartbeat: %v", err)
+			}
+			// Re-read the installed state so changes made behind the
+			// enforcer's back show up as drift
+			if cfg := applied.Load(); cfg != nil {
+				hb.StateDigests = stateFn(cfg)
+			}
+			return hb
+		},
 	}
 	go func() {
-		if err := poller.Run(ctx); err != nil {
-			log.Printf("poller error: %v", err)
+		if err := heartbeater.Run(ctx); err != nil {
+			log.Printf("heartbeat error: %v", err)
 		}
 	}()
 
@@ -115,3 +243,84 @@ func main() {
 
 	log.Printf("shutting down")
 }
+
+// closeRevoked closes the connections to resources the old config granted
+// and the newly applied ruleset drops. The ruleset already drops their
+// packets, so a failure is only logged.
+func closeRevoked(old *controlplane.EnforcerConfig, rs policy.Ruleset, unknown string) {
+	before, err := policy.Compile(old.Policies, old.Resources, unknown)
+	if err != nil {
+		log.Printf("compile previous config: %v", err)
+		return
+	}
+	revoked := policy.Revoked(old.Policies, before, rs)
+	for _, r := range revoked {
+		log.Printf("access revoked: %s (%s, %s) to %s (%s)", r.ClientName, r.DeviceName, r.Src, r.ResourceName, r.Dst)
+	}
+	n, err := firewall.CloseRevoked(revoked, rs)
+	if err != nil {
+		log.Printf("close revoked connections: %v", err)
+	}
+	if n > 0 {
+		log.Printf("closed %d revoked connections", n)
+	}
+}
+
+// stateDigests digests the firewall rules and peers the config calls for
+// and those installed. A side that cannot be read is left empty.
+func stateDigests(fwMgr *firewall.Manager, iface string, cfg *controlplane.EnforcerConfig, unknown string) controlplane.StateDigests {
+	var d controlplane.StateDigests
+	if rs, err := policy.Compile(cfg.Policies, cfg.Resources, unknown); err == nil {
+		if rules, err := firewall.ExpectedRules(rs); err == nil {
+			d.ExpectedRulesetDigest = controlplane.Digest(rules)
+		}
+	}
+	if rules, err := fwMgr.InstalledRules(); err == nil {
+		d.InstalledRulesetDigest = controlplane.Digest(rules)
+	} else {
+		log.Printf("read installed rules: %v", err)
+	}
+	if peers, err := wireguard.ExpectedPeers(cfg.Policies); err == nil {
+		d.ExpectedPeersDigest = controlplane.Digest(peers)
+	}
+	if peers, err := wireguard.InstalledPeers(iface); err == nil {
+		d.InstalledPeersDigest = controlplane.Digest(peers)
+	} else {
+		log.Printf("read installed peers: %v", err)
+	}
+	return d
+}
+
+func enroll(ctx context.Context, cp *controlplane.Client, token string) {
+	cred, err := cp.Enroll(ctx, token)
+	if err != nil {
+		log.Fatalf("enrollment failed: %v", err)
+	}
+	log.Printf("enrolled as enforcer %s; credential expires %s", cred.EnforcerID, cred.ExpiresAt.Format(time.RFC3339))
+}
+
+// resolveSigningKey returns the pinned config signing key: CONFIG_SIGNING_KEY,
+// else the key stored on first start, else the controlplane's current key,
+// which is stored and pinned from then on.
+func resolveSigningKey(ctx context.Context, cp *controlplane.Client, envKey string) (string, error) {
+	if envKey != "" {
+		return envKey, nil
+	}
+	path := filepath.Join(config.DefaultKeyDir, config.SigningKeyFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	key, err := cp.FetchSigningKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(key+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	log.Printf("pinned config signing key %s (set CONFIG_SIGNING_KEY to pin it explicitly)", key)
+	return key, nil
+}
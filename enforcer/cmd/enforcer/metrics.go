@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"migration-to-zero-trust/enforcer/internal/firewall"
+	"migration-to-zero-trust/enforcer/internal/logging"
+	"migration-to-zero-trust/internal/metrics"
+)
+
+var applyDuration = metrics.NewHistogram("enforcer_config_apply_duration_seconds", "Time taken to apply a config to WireGuard and nftables.", metrics.DefaultBuckets, "result")
+
+// observeApply times apply, labelled by whether it failed.
+func observeApply(apply func() error) error {
+	start := time.Now()
+	err := apply()
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	applyDuration.ObserveSince(start, result)
+	return err
+}
+
+// registerMetrics exposes the logger's queues and the packet and byte
+// counters of the policy and allow chains, read at scrape time.
+func registerMetrics(fwMgr *firewall.Manager, logger *logging.Logger) {
+	metrics.NewGaugeFunc("enforcer_log_queue_entries", "Log entries waiting to be batched into the spool.", func() float64 {
+		return float64(logger.Queued())
+	})
+	metrics.NewGaugeFunc("enforcer_log_tracked_connections", "Logged connections waiting for conntrack to report their end.", func() float64 {
+		return float64(logger.TrackedFlows())
+	})
+	metrics.NewGaugeFunc("enforcer_log_spooled_entries", "Log entries in the spool waiting to be sent.", func() float64 {
+		return float64(logger.Spooled())
+	})
+	metrics.NewCounterFunc("enforcer_log_entries_dropped_total", "Connections not logged because the queue or the spool was full.", func() float64 {
+		return float64(logger.Dropped())
+	})
+
+	ruleCounter := func(emit metrics.Emit, value func(firewall.RuleCounter) uint64) {
+		counters, err := fwMgr.RuleCounters()
+		if err != nil {
+			log.Printf("metrics: %v", err)
+			return
+		}
+		for _, c := range counters {
+			emit(float64(value(c)), c.Chain, strconv.Itoa(c.Position), c.Rule)
+		}
+	}
+	metrics.NewCollector("enforcer_firewall_rule_packets_total", "Packets matched by each rule of the policy and allow chains.", metrics.TypeCounter, func(emit metrics.Emit) {
+		ruleCounter(emit, func(c firewall.RuleCounter) uint64 { return c.Packets })
+	}, "chain", "position", "rule")
+	metrics.NewCollector("enforcer_firewall_rule_bytes_total", "Bytes matched by each rule of the policy and allow chains.", metrics.TypeCounter, func(emit metrics.Emit) {
+		ruleCounter(emit, func(c firewall.RuleCounter) uint64 { return c.Bytes })
+	}, "chain", "position", "rule")
+}
+
+// serveMetrics serves the Prometheus endpoint on addr until ctx is done.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	log.Printf("metrics listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("metrics server: %v", err)
+	}
+}
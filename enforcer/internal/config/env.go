@@ -3,6 +3,7 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strconv"
 	"strings"
@@ -12,22 +13,54 @@ const (
 	DefaultWGInterface  = "wg0"
 	DefaultWGListenPort = 51820
 	DefaultKeyDir       = "/var/lib/enforcer"
+	CredentialFile      = "credential"
+	SigningKeyFile      = "config-signing.pub"
+	ConfigVersionFile   = "config-version"
+	LogSpoolDir         = "log-spool"
+	DefaultLogSpoolMB   = 64
 	maxPort             = 65535
 )
 
+// DefaultUnknownDestinations is the verdict for destinations outside every
+// resource of the enforcer: they are dropped as out of scope.
+const DefaultUnknownDestinations = "deny"
+
 type Env struct {
 	ControlPlaneURL string
+	// APIKey is a static key from before enrollment tokens; EnrollmentToken
+	// is redeemed once for a rotating credential kept in CredentialFile.
 	APIKey          string
+	EnrollmentToken string
+	// CAFile pins the CA that signed the controlplane's TLS certificate.
+	CAFile string
+	// ConfigSigningKey pins the key that signs config bundles. Without it
+	// the key is fetched once and kept in SigningKeyFile.
+	ConfigSigningKey string
 
 	WGInterface  string
 	WGListenPort int
+
+	// LogSpoolMB bounds the on-disk spool of unsent log batches.
+	LogSpoolMB int
+
+	// MetricsAddr is the local address the Prometheus endpoint listens on,
+	// such as 127.0.0.1:9101. Empty turns the endpoint off.
+	MetricsAddr string
+
+	// UnknownDestinations is the verdict for connections to destinations
+	// outside every resource of the enforcer: observe or deny.
+	UnknownDestinations string
 }
 
 func LoadEnv() (Env, error) {
 	env := Env{
-		ControlPlaneURL: os.Getenv("CONTROLPLANE_URL"),
-		APIKey:          os.Getenv("API_KEY"),
-		WGInterface:     os.Getenv("WG_INTERFACE"),
+		ControlPlaneURL:  os.Getenv("CONTROLPLANE_URL"),
+		APIKey:           os.Getenv("API_KEY"),
+		EnrollmentToken:  os.Getenv("ENROLLMENT_TOKEN"),
+		CAFile:           os.Getenv("CONTROLPLANE_CA_FILE"),
+		ConfigSigningKey: os.Getenv("CONFIG_SIGNING_KEY"),
+		WGInterface:      os.Getenv("WG_INTERFACE"),
+		MetricsAddr:      os.Getenv("METRICS_ADDR"),
 	}
 
 	if port := os.Getenv("WG_LISTEN_PORT"); port != "" {
@@ -40,6 +73,20 @@ func LoadEnv() (Env, error) {
 		env.WGListenPort = DefaultWGListenPort
 	}
 
+	env.LogSpoolMB = DefaultLogSpoolMB
+	if mb := os.Getenv("LOG_SPOOL_MAX_MB"); mb != "" {
+		n, err := strconv.Atoi(mb)
+		if err != nil {
+			return Env{}, fmt.Errorf("LOG_SPOOL_MAX_MB: %w", err)
+		}
+		env.LogSpoolMB = n
+	}
+
+	env.UnknownDestinations = DefaultUnknownDestinations
+	if v := os.Getenv("UNKNOWN_DESTINATIONS"); v != "" {
+		env.UnknownDestinations = v
+	}
+
 	if env.WGInterface == "" {
 		env.WGInterface = DefaultWGInterface
 	}
@@ -48,12 +95,20 @@ func LoadEnv() (Env, error) {
 	if strings.TrimSpace(env.ControlPlaneURL) == "" {
 		errs = append(errs, "CONTROLPLANE_URL is required")
 	}
-	if strings.TrimSpace(env.APIKey) == "" {
-		errs = append(errs, "API_KEY is required")
-	}
 	if env.WGListenPort <= 0 || env.WGListenPort > maxPort {
 		errs = append(errs, "WG_LISTEN_PORT must be 1-65535")
 	}
+	if env.LogSpoolMB <= 0 {
+		errs = append(errs, "LOG_SPOOL_MAX_MB must be positive")
+	}
+	if env.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(env.MetricsAddr); err != nil {
+			errs = append(errs, "METRICS_ADDR must be host:port")
+		}
+	}
+	if env.UnknownDestinations != "observe" && env.UnknownDestinations != "deny" {
+		errs = append(errs, "UNKNOWN_DESTINATIONS must be observe or deny")
+	}
 	if len(errs) > 0 {
 		return Env{}, errors.New(strings.Join(errs, "; "))
 	}
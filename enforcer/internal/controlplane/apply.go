@@ -0,0 +1,60 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+const pathApplyResult = "/api/enforcer/apply-result"
+
+// StateDigests are digests of the firewall rules and WireGuard peers the
+// enforcer should have installed for a config, and of those read back from
+// the kernel. The controlplane flags the enforcer when they differ.
+type StateDigests struct {
+	ExpectedRulesetDigest  string `json:"expected_ruleset_digest,omitempty"`
+	InstalledRulesetDigest string `json:"installed_ruleset_digest,omitempty"`
+	ExpectedPeersDigest    string `json:"expected_peers_digest,omitempty"`
+	InstalledPeersDigest   string `json:"installed_peers_digest,omitempty"`
+}
+
+// Digest returns the hex SHA-256 of lines, each terminated by a newline.
+func Digest(lines []string) string {
+	h := sha256.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ApplyResult is the outcome of one attempt to apply a config.
+type ApplyResult struct {
+	Version uint64 `json:"version"`
+	Error   string `json:"error,omitempty"`
+	StateDigests
+}
+
+// ReportApply sends result over the stream if it is connected, otherwise
+// over REST.
+func (c *Client) ReportApply(ctx context.Context, result ApplyResult) error {
+	if sc := c.stream.Load(); sc != nil {
+		return sc.request(ctx, streamApplyResult, result, nil)
+	}
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetBody(&result).
+		Post(pathApplyResult)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+	return nil
+}
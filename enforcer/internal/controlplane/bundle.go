@@ -0,0 +1,29 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+const pathSigningKey = "/api/config-signing-key"
+
+// FetchSigningKey asks the controlplane for its config signing key. Use it
+// only to pin the key on first start; a pinned key must never be replaced
+// with one fetched this way.
+func (c *Client) FetchSigningKey(ctx context.Context) (string, error) {
+	var result struct {
+		PublicKey string `json:"public_key"`
+	}
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetResult(&result).
+		Get(pathSigningKey)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return "", errors.New(resp.String())
+	}
+	return result.PublicKey, nil
+}
@@ -2,10 +2,20 @@ package controlplane
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+
+	"migration-to-zero-trust/internal/configbundle"
 )
 
 const (
@@ -20,8 +30,39 @@ const (
 	ModeEnforce = "enforce" // Block unauthorized access (post-migration)
 )
 
+// Verdicts of the firewall rule that logged a connection.
+const (
+	VerdictAllow      = "allow"        // accepted as a paired client
+	VerdictObserve    = "observe"      // accepted without a policy rule
+	VerdictDeny       = "deny"         // dropped
+	VerdictOutOfScope = "out_of_scope" // dropped, the destination is outside every resource
+)
+
+// LongPollWait is the longest config long-poll wait the client allows for.
+const LongPollWait = 60 * time.Second
+
 type Client struct {
-	resty *resty.Client
+	resty   *resty.Client
+	baseURL string
+
+	mu     sync.RWMutex
+	apiKey string
+	// rotate is set when the control plane asks for a credential rotation.
+	rotate atomic.Bool
+	// OnCredential persists a credential issued by enrollment or rotation
+	// before the client switches to it.
+	OnCredential func(apiKey string) error
+
+	// Verifier checks every fetched config bundle.
+	Verifier *configbundle.Verifier
+
+	// mTLS client certificate, see EnableMTLS
+	certDir   string
+	cert      atomic.Pointer[tls.Certificate]
+	tlsConfig *tls.Config
+
+	// stream is the connected config stream, if any
+	stream atomic.Pointer[streamConn]
 }
 
 type Enforcer struct {
@@ -36,11 +77,18 @@ type EnforcerConfig struct {
 	EnforcerID    string   `json:"enforcer_id"`
 	TunnelAddress string   `json:"tunnel_address"`
 	Policies      []Policy `json:"policies"`
+	// Every resource of the enforcer, whether or not a policy grants it
+	Resources []PolicyTarget `json:"resources"`
+
+	// Version of the signed bundle the config came from
+	Version uint64 `json:"-"`
 }
 
 type Policy struct {
 	ClientID     string         `json:"client_id"`
 	ClientName   string         `json:"client_name"`
+	DeviceID     string         `json:"device_id"`
+	DeviceName   string         `json:"device_name"`
 	WGPublicKey  string         `json:"wg_public_key"`
 	AllowedIPs   []string       `json:"allowed_ips"`
 	AllowedCIDRs []PolicyTarget `json:"allowed_cidrs"`
@@ -51,9 +99,21 @@ type PolicyTarget struct {
 	Mode         string `json:"mode"`
 	ResourceID   string `json:"resource_id"`
 	ResourceName string `json:"resource_name"`
+	// Gated targets have posture requirements; only the devices whose
+	// policies list them meet them
+	Gated bool `json:"gated,omitempty"`
+}
+
+// LogBatch is a batch of log entries. Seq numbers the batches of the
+// enforcer in the order they are sent, and entry IDs stay the same when a
+// batch is resent, so the controlplane stores each entry once.
+type LogBatch struct {
+	Seq     uint64     `json:"seq"`
+	Entries []LogEntry `json:"entries"`
 }
 
 type LogEntry struct {
+	ID           string    `json:"id"`
 	Timestamp    time.Time `json:"ts"`
 	SrcIP        string    `json:"src_ip"`
 	SrcPort      int       `json:"src_port"`
@@ -62,9 +122,17 @@ type LogEntry struct {
 	Proto        string    `json:"proto"`
 	ClientID     string    `json:"client_id"`
 	ClientName   string    `json:"client_name"`
+	DeviceID     string    `json:"device_id"`
+	DeviceName   string    `json:"device_name"`
 	ResourceID   string    `json:"resource_id"`
 	ResourceName string    `json:"resource_name"`
-	Length       int       `json:"length"`
+	Verdict      string    `json:"verdict"`
+	Length       int       `json:"length"` // of the first packet
+	// Totals of the connection in both directions, and how long it lasted;
+	// zero if it was not seen ending
+	Packets    uint64 `json:"packets,omitempty"`
+	Bytes      uint64 `json:"bytes,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
 }
 
 type UpdatePublicKeyRequest struct {
@@ -72,43 +140,148 @@ type UpdatePublicKeyRequest struct {
 }
 
 func NewClient(baseURL, apiKey string) *Client {
-	client := resty.New().
+	c := &Client{apiKey: apiKey, baseURL: strings.TrimRight(baseURL, "/")}
+	c.resty = resty.New().
 		SetBaseURL(baseURL).
-		SetTimeout(30*time.Second).
-		SetHeader("X-API-Key", apiKey)
-	return &Client{resty: client}
+		SetTimeout(LongPollWait + 30*time.Second).
+		OnBeforeRequest(func(_ *resty.Client, req *resty.Request) error {
+			if key := c.APIKey(); key != "" {
+				req.SetHeader("X-API-Key", key)
+			}
+			return nil
+		}).
+		OnAfterResponse(func(_ *resty.Client, resp *resty.Response) error {
+			if resp.Header().Get(credentialRotateHeader) != "" {
+				c.rotate.Store(true)
+			}
+			return nil
+		})
+	return c
 }
 
-func (c *Client) FetchConfig(ctx context.Context) (*EnforcerConfig, error) {
-	var cfg EnforcerConfig
-	resp, err := c.resty.R().
-		SetContext(ctx).
-		SetResult(&cfg).
-		Get(pathConfig)
+// FetchConfig fetches the signed config bundle and returns its config after
+// checking the signature, expiry, target and version. If applied is set, it
+// waits up to wait for a config newer than that version and returns nil if
+// there is none.
+func (c *Client) FetchConfig(ctx context.Context, applied uint64, wait time.Duration) (*EnforcerConfig, error) {
+	if c.Verifier == nil {
+		return nil, errors.New("no config verifier")
+	}
+	req := c.resty.R().SetContext(ctx)
+	if applied > 0 {
+		req.SetHeader("If-None-Match", strconv.Quote(strconv.FormatUint(applied, 10)))
+		if wait > 0 {
+			req.SetQueryParam("wait", strconv.Itoa(int(wait/time.Second)))
+		}
+	}
+	var signed configbundle.Signed
+	resp, err := req.SetResult(&signed).Get(pathConfig)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode() == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return nil, ErrUnauthorized
+	}
 	if resp.IsError() {
 		return nil, errors.New(resp.String())
 	}
+
+	return c.openConfig(signed)
+}
+
+// openConfig checks a signed config bundle's signature, expiry, target and
+// version and returns its config.
+func (c *Client) openConfig(signed configbundle.Signed) (*EnforcerConfig, error) {
+	bundle, err := c.Verifier.Verify(signed, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var cfg EnforcerConfig
+	if err := json.Unmarshal(bundle.Config, &cfg); err != nil {
+		return nil, fmt.Errorf("%w: %v", configbundle.ErrRejected, err)
+	}
+	// The bundle must be for this enforcer: the ID inside the config, and the
+	// one in our API key when it has the enf_<id>_<secret> form.
+	if bundle.Target != "enforcer:"+cfg.EnforcerID {
+		return nil, fmt.Errorf("%w: target %q does not match config", configbundle.ErrRejected, bundle.Target)
+	}
+	if id, ok := enforcerIDFromAPIKey(c.APIKey()); ok && id != cfg.EnforcerID {
+		return nil, fmt.Errorf("%w: bundle is for enforcer %s", configbundle.ErrRejected, cfg.EnforcerID)
+	}
+	cfg.Version = bundle.Version
 	return &cfg, nil
 }
 
-func (c *Client) PushLogs(ctx context.Context, entries []LogEntry) error {
-	if len(entries) == 0 {
-		return nil
+// ConfigApplied records that cfg has been applied, so older bundles are
+// refused from now on.
+func (c *Client) ConfigApplied(cfg *EnforcerConfig) error {
+	return c.Verifier.Applied(cfg.Version)
+}
+
+// enforcerIDFromAPIKey extracts the enforcer ID from an "enf_<id>_<secret>" key.
+func enforcerIDFromAPIKey(apiKey string) (string, bool) {
+	parts := strings.SplitN(apiKey, "_", 3)
+	if len(parts) != 3 || parts[0] != "enf" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// LogAck is the controlplane's answer to a log batch.
+type LogAck struct {
+	// AckedSeq is the highest batch sequence number the controlplane has
+	// written for the enforcer.
+	AckedSeq uint64 `json:"acked_seq"`
+}
+
+// PushLogs sends a log batch over the stream if it is connected, otherwise
+// over REST, and returns the highest batch sequence number written. A batch
+// without entries only asks for that number. A batch that may have arrived
+// despite an error can be sent again.
+func (c *Client) PushLogs(ctx context.Context, batch LogBatch) (uint64, error) {
+	if batch.Entries == nil {
+		batch.Entries = []LogEntry{}
+	}
+	var ack LogAck
+	if sc := c.stream.Load(); sc != nil {
+		err := sc.request(ctx, streamLogs, batch, &ack)
+		return ack.AckedSeq, err
 	}
 	resp, err := c.resty.R().
 		SetContext(ctx).
-		SetBody(entries).
+		SetBody(batch).
+		SetResult(&ack).
 		Post(pathLogs)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	if resp.StatusCode() == http.StatusTooManyRequests {
+		busy := &BusyError{}
+		if secs, err := strconv.Atoi(resp.Header().Get("Retry-After")); err == nil && secs > 0 {
+			busy.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return 0, busy
 	}
 	if resp.IsError() {
-		return errors.New(resp.String())
+		return 0, errors.New(resp.String())
 	}
-	return nil
+	return ack.AckedSeq, nil
+}
+
+// BusyError reports a log batch refused because the controlplane's queue is
+// full. RetryAfter is how long it asked to wait, or 0 if it did not say.
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *BusyError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("controlplane busy, retry after %s", e.RetryAfter)
+	}
+	return "controlplane busy"
 }
 
 func (c *Client) UpdatePublicKey(ctx context.Context, wgPublicKey string) error {
@@ -119,6 +292,9 @@ func (c *Client) UpdatePublicKey(ctx context.Context, wgPublicKey string) error
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
 	if resp.IsError() {
 		return errors.New(resp.String())
 	}
@@ -0,0 +1,149 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	pathEnroll     = "/api/enforcer/enroll"
+	pathCredential = "/api/enforcer/credential"
+
+	credentialRotateHeader = "X-Credential-Rotate"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+type enrollRequest struct {
+	Token string `json:"token"`
+	CSR   string `json:"csr,omitempty"`
+}
+
+// Credential is an API key issued by the control plane, with a client
+// certificate when mTLS is enabled.
+type Credential struct {
+	EnforcerID  string             `json:"enforcer_id"`
+	APIKey      string             `json:"api_key"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	Certificate *IssuedCertificate `json:"certificate,omitempty"`
+}
+
+// APIKey returns the key currently sent with every request.
+func (c *Client) APIKey() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.apiKey
+}
+
+func (c *Client) setCredential(cred Credential) error {
+	if c.OnCredential != nil {
+		if err := c.OnCredential(cred.APIKey); err != nil {
+			return fmt.Errorf("store credential: %w", err)
+		}
+	}
+	c.mu.Lock()
+	c.apiKey = cred.APIKey
+	c.mu.Unlock()
+	return nil
+}
+
+// Enroll redeems a single-use enrollment token and switches to the issued
+// credential. With mTLS enabled it also obtains a client certificate.
+func (c *Client) Enroll(ctx context.Context, token string) (Credential, error) {
+	req := enrollRequest{Token: token}
+	var key *ecdsa.PrivateKey
+	if c.certDir != "" {
+		var csrPEM []byte
+		var err error
+		if key, csrPEM, err = newCSR(); err != nil {
+			return Credential{}, err
+		}
+		req.CSR = string(csrPEM)
+	}
+
+	var cred Credential
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetBody(&req).
+		SetResult(&cred).
+		Post(pathEnroll)
+	if err != nil {
+		return Credential{}, err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return Credential{}, errors.New("enrollment token is invalid, expired or already used")
+	}
+	if resp.IsError() {
+		return Credential{}, errors.New(resp.String())
+	}
+	if err := c.setCredential(cred); err != nil {
+		return Credential{}, err
+	}
+	if key != nil && cred.Certificate != nil {
+		if err := c.storeCertificate(key, *cred.Certificate); err != nil {
+			return Credential{}, err
+		}
+	}
+	return cred, nil
+}
+
+// RotationRequested reports whether the control plane asked for a new
+// credential since the last rotation.
+func (c *Client) RotationRequested() bool {
+	return c.rotate.Load()
+}
+
+// RotateCredential obtains a new credential using the current one. The old
+// key stays valid on the control plane for a short grace period.
+func (c *Client) RotateCredential(ctx context.Context) (Credential, error) {
+	var cred Credential
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetResult(&cred).
+		Post(pathCredential)
+	if err != nil {
+		return Credential{}, err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return Credential{}, ErrUnauthorized
+	}
+	if resp.IsError() {
+		return Credential{}, errors.New(resp.String())
+	}
+	if err := c.setCredential(cred); err != nil {
+		return Credential{}, err
+	}
+	c.rotate.Store(false)
+	return cred, nil
+}
+
+// LoadCredential reads a stored API key. It returns "" if none is stored.
+func LoadCredential(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SaveCredential stores an API key, replacing the previous one atomically.
+func SaveCredential(path, apiKey string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(apiKey+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
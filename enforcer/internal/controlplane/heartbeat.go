@@ -0,0 +1,74 @@
+package controlplane
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	pathHeartbeat = "/api/enforcer/heartbeat"
+
+	DefaultHeartbeatInterval = 30 * time.Second
+)
+
+// Heartbeat reports the enforcer's health and inventory.
+type Heartbeat struct {
+	Version        string `json:"version"`
+	UptimeSeconds  int64  `json:"uptime_seconds"`
+	ConfigVersion  uint64 `json:"config_version"`
+	PeerCount      int    `json:"peer_count"`
+	LogsDropped    uint64 `json:"logs_dropped"`
+	LogsSpooled    uint64 `json:"logs_spooled"`
+	FirewallRules  int    `json:"firewall_rules"`
+	LastApplyError string `json:"last_apply_error,omitempty"`
+	StateDigests
+}
+
+// SendHeartbeat sends hb over the stream if it is connected, otherwise over
+// REST.
+func (c *Client) SendHeartbeat(ctx context.Context, hb Heartbeat) error {
+	if sc := c.stream.Load(); sc != nil {
+		return sc.request(ctx, streamHeartbeat, hb, nil)
+	}
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetBody(&hb).
+		Post(pathHeartbeat)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+	return nil
+}
+
+// Heartbeater sends a heartbeat built by Collect every Interval.
+type Heartbeater struct {
+	Client   *Client
+	Interval time.Duration
+	Collect  func() Heartbeat
+}
+
+func (h *Heartbeater) Run(ctx context.Context) error {
+	interval := h.Interval
+	if interval <= 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	for {
+		if err := h.Client.SendHeartbeat(ctx, h.Collect()); err != nil && ctx.Err() == nil {
+			log.Printf("send heartbeat failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,398 @@
+// stream.go keeps a WebSocket open to the controlplane. Configs arrive over
+// it as soon as they change, and heartbeats, log batches and apply results go
+// back over the same connection. While the stream is down, heartbeats and
+// logs fall back to REST.
+//
+// Messages are JSON objects {"type", "seq", "data", "error"}. The stream
+// opens with "hello" carrying the applied config version, so after a
+// reconnect the controlplane only sends a config newer than that. Requests
+// with a seq are answered by an "ack" with the same seq.
+package controlplane
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"migration-to-zero-trust/internal/configbundle"
+)
+
+const (
+	pathStream = "/api/enforcer/stream"
+
+	// DefaultRetryInterval is the delay before retrying a config that
+	// failed to apply.
+	DefaultRetryInterval = 30 * time.Second
+
+	streamMinBackoff = time.Second
+	streamMaxBackoff = time.Minute
+	streamAckTimeout = 30 * time.Second
+	// Heartbeats are acked every 30 seconds, so a stream silent for longer
+	// than three of them is dead.
+	streamReadTimeout         = 3 * DefaultHeartbeatInterval
+	streamWriteTimeout        = 10 * time.Second
+	streamMaintenanceInterval = time.Minute
+)
+
+// Stream message types.
+const (
+	streamHello            = "hello"
+	streamHeartbeat        = "heartbeat"
+	streamLogs             = "logs"
+	streamApplyResult      = "apply_result"
+	streamConfig           = "config"
+	streamAck              = "ack"
+	streamRotateCredential = "rotate_credential"
+)
+
+var (
+	errStreamClosed = errors.New("stream closed")
+	// errReconnect ends a session that should be reopened right away.
+	errReconnect = errors.New("reconnect")
+)
+
+type streamMessage struct {
+	Type  string          `json:"type"`
+	Seq   uint64          `json:"seq,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type streamHelloData struct {
+	AppliedVersion uint64 `json:"applied_version"`
+}
+
+// Stream applies configs pushed by the controlplane until its context is
+// done, reconnecting with backoff.
+type Stream struct {
+	Client   *Client
+	OnChange func(cfg *EnforcerConfig) error
+	// RetryInterval is the delay before retrying a config that failed to
+	// apply.
+	RetryInterval time.Duration
+	// State, if set, reads the installed state after every apply attempt
+	// for the apply result.
+	State func(cfg *EnforcerConfig) StateDigests
+
+	mu       sync.Mutex
+	applyErr string
+}
+
+// LastApplyError returns why the latest config could not be applied, or ""
+// if it was.
+func (s *Stream) LastApplyError() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applyErr
+}
+
+func (s *Stream) setApplyError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.applyErr = ""
+	} else {
+		s.applyErr = err.Error()
+	}
+}
+
+func (s *Stream) Run(ctx context.Context) error {
+	backoff := streamMinBackoff
+	for {
+		started := time.Now()
+		err := s.session(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errReconnect) {
+			backoff = streamMinBackoff
+			continue
+		}
+		log.Printf("config stream: %v", err)
+		if time.Since(started) > streamMaxBackoff {
+			backoff = streamMinBackoff
+		}
+		// Jitter spreads the reconnects of many enforcers after a
+		// controlplane restart
+		wait(ctx, backoff/2+rand.N(backoff/2))
+		backoff = min(2*backoff, streamMaxBackoff)
+	}
+}
+
+func (s *Stream) session(ctx context.Context) error {
+	retryInterval := s.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = DefaultRetryInterval
+	}
+
+	sc, err := s.Client.dialStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer sc.close()
+	if err := sc.send(streamHello, 0, streamHelloData{AppliedVersion: s.Client.Verifier.AppliedVersion()}); err != nil {
+		return err
+	}
+
+	configs := make(chan configbundle.Signed, 1)
+	readErr := make(chan error, 1)
+	go func() { readErr <- sc.receive(s.Client, configs) }()
+
+	s.Client.stream.Store(sc)
+	defer s.Client.stream.CompareAndSwap(sc, nil)
+	log.Printf("config stream connected")
+
+	maintenance := time.NewTicker(streamMaintenanceInterval)
+	defer maintenance.Stop()
+
+	// A config that failed to apply is retried until it applies or a newer
+	// one arrives
+	var pending *EnforcerConfig
+	var retry <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-readErr:
+			return err
+		case signed := <-configs:
+			cfg, err := s.Client.openConfig(signed)
+			if err != nil {
+				log.Printf("config rejected: %v", err)
+				s.setApplyError(err)
+				s.reportApply(ctx, nil, err)
+				continue
+			}
+			pending, retry = cfg, nil
+		case <-retry:
+			retry = nil
+		case <-maintenance.C:
+			if err := s.maintain(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if pending == nil || retry != nil {
+			continue
+		}
+		if err := s.apply(pending); err != nil {
+			log.Printf("apply failed: %v", err)
+			s.reportApply(ctx, pending, err)
+			retry = time.After(retryInterval)
+			continue
+		}
+		s.reportApply(ctx, pending, nil)
+		pending = nil
+	}
+}
+
+func (s *Stream) apply(cfg *EnforcerConfig) error {
+	if s.OnChange != nil {
+		err := s.OnChange(cfg)
+		s.setApplyError(err)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("config version %d applied", cfg.Version)
+	if err := s.Client.ConfigApplied(cfg); err != nil {
+		log.Printf("record config version failed: %v", err)
+	}
+	return nil
+}
+
+// reportApply reports an apply attempt of cfg, or of a bundle rejected
+// before its config was read if cfg is nil.
+func (s *Stream) reportApply(ctx context.Context, cfg *EnforcerConfig, err error) {
+	var result ApplyResult
+	if cfg != nil {
+		result.Version = cfg.Version
+		if s.State != nil {
+			result.StateDigests = s.State(cfg)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	if err := s.Client.ReportApply(ctx, result); err != nil {
+		log.Printf("report apply result failed: %v", err)
+	}
+}
+
+// maintain renews the client certificate and rotates the credential when
+// due. After a rotation the stream is reopened with the new credential.
+func (s *Stream) maintain(ctx context.Context) error {
+	if s.Client.CertificateNeedsRenewal(time.Now()) {
+		if err := s.Client.RenewCertificate(ctx); err != nil {
+			log.Printf("renew certificate failed: %v", err)
+		} else {
+			log.Printf("client certificate renewed")
+		}
+	}
+	if s.Client.RotationRequested() {
+		if _, err := s.Client.RotateCredential(ctx); err != nil {
+			log.Printf("rotate credential failed: %v", err)
+			return nil
+		}
+		log.Printf("credential rotated")
+		return errReconnect
+	}
+	return nil
+}
+
+func (c *Client) dialStream(ctx context.Context) (*streamConn, error) {
+	location, err := url.Parse(c.baseURL + pathStream)
+	if err != nil {
+		return nil, err
+	}
+	origin := &url.URL{Scheme: location.Scheme, Host: location.Host}
+	switch location.Scheme {
+	case "https":
+		location.Scheme = "wss"
+	case "http":
+		location.Scheme = "ws"
+	default:
+		return nil, fmt.Errorf("unsupported controlplane URL scheme %q", location.Scheme)
+	}
+	cfg, err := websocket.NewConfig(location.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	cfg.TlsConfig = c.tlsConfig
+	cfg.Header = http.Header{}
+	if key := c.APIKey(); key != "" {
+		cfg.Header.Set("X-API-Key", key)
+	}
+	ws, err := cfg.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{ws: ws, pending: make(map[uint64]chan streamMessage), done: make(chan struct{})}, nil
+}
+
+// streamConn is one connection of the stream.
+type streamConn struct {
+	ws      *websocket.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]chan streamMessage // seq -> waiting request
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (sc *streamConn) close() {
+	sc.closeOnce.Do(func() {
+		close(sc.done)
+		sc.ws.Close()
+	})
+}
+
+func (sc *streamConn) send(typ string, seq uint64, v any) error {
+	msg := streamMessage{Type: typ, Seq: seq}
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		msg.Data = data
+	}
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.ws.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	return websocket.JSON.Send(sc.ws, msg)
+}
+
+// request sends v and waits for the controlplane to acknowledge it. The
+// data of the ack is decoded into result unless it is nil.
+func (sc *streamConn) request(ctx context.Context, typ string, v, result any) error {
+	ack := make(chan streamMessage, 1)
+	sc.mu.Lock()
+	sc.seq++
+	seq := sc.seq
+	sc.pending[seq] = ack
+	sc.mu.Unlock()
+	defer func() {
+		sc.mu.Lock()
+		delete(sc.pending, seq)
+		sc.mu.Unlock()
+	}()
+
+	if err := sc.send(typ, seq, v); err != nil {
+		return err
+	}
+	select {
+	case msg := <-ack:
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		if result != nil && len(msg.Data) > 0 {
+			if err := json.Unmarshal(msg.Data, result); err != nil {
+				return fmt.Errorf("%s ack: %w", typ, err)
+			}
+		}
+		return nil
+	case <-sc.done:
+		return errStreamClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(streamAckTimeout):
+		return fmt.Errorf("%s not acknowledged", typ)
+	}
+}
+
+// receive reads messages until the connection fails. Only the latest config
+// is kept in configs.
+func (sc *streamConn) receive(c *Client, configs chan configbundle.Signed) error {
+	for {
+		sc.ws.SetReadDeadline(time.Now().Add(streamReadTimeout))
+		var msg streamMessage
+		if err := websocket.JSON.Receive(sc.ws, &msg); err != nil {
+			return err
+		}
+		switch msg.Type {
+		case streamConfig:
+			var signed configbundle.Signed
+			if err := json.Unmarshal(msg.Data, &signed); err != nil {
+				return fmt.Errorf("config message: %w", err)
+			}
+			select {
+			case <-configs:
+			default:
+			}
+			configs <- signed
+		case streamAck:
+			sc.mu.Lock()
+			ack, ok := sc.pending[msg.Seq]
+			sc.mu.Unlock()
+			if !ok {
+				continue
+			}
+			ack <- msg
+		case streamRotateCredential:
+			c.rotate.Store(true)
+		default:
+			log.Printf("config stream: unknown message type %q", msg.Type)
+		}
+	}
+}
+
+func wait(ctx context.Context, interval time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(interval):
+	}
+}
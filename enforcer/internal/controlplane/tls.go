@@ -0,0 +1,157 @@
+package controlplane
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	pathCertificate = "/api/enforcer/certificate"
+
+	clientCertFile = "client.crt"
+	clientKeyFile  = "client.key"
+)
+
+type certificateRequest struct {
+	CSR string `json:"csr"`
+}
+
+// IssuedCertificate is a client certificate signed by the controlplane CA.
+type IssuedCertificate struct {
+	Certificate string    `json:"certificate"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// EnableMTLS presents a controlplane-issued client certificate kept in dir.
+// caFile, if set, replaces the system roots for verifying the controlplane.
+// Enroll and RenewCertificate store new certificates in dir.
+func (c *Client) EnableMTLS(dir, caFile string) error {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := c.cert.Load(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+	}
+	if caFile != "" {
+		pemData, err := os.ReadFile(caFile)
+		if err != nil {
+			return fmt.Errorf("read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return errors.New("no certificates in CA file")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	c.certDir = dir
+	c.tlsConfig = tlsCfg
+	c.resty.SetTLSClientConfig(tlsCfg)
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, clientCertFile), filepath.Join(dir, clientKeyFile))
+	if err == nil {
+		c.cert.Store(&cert)
+	}
+	// A missing or mismatched pair is replaced on the next renewal
+	return nil
+}
+
+// CertificateNeedsRenewal reports whether mTLS is enabled and the client
+// certificate is missing or has less than a third of its lifetime left.
+func (c *Client) CertificateNeedsRenewal(now time.Time) bool {
+	if c.certDir == "" {
+		return false
+	}
+	cert := c.cert.Load()
+	if cert == nil || cert.Leaf == nil {
+		return true
+	}
+	lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore)
+	return now.Add(lifetime / 3).After(cert.Leaf.NotAfter)
+}
+
+// RenewCertificate requests a certificate for a fresh key and switches to it.
+// Connections opened with the old certificate are closed.
+func (c *Client) RenewCertificate(ctx context.Context) error {
+	key, csrPEM, err := newCSR()
+	if err != nil {
+		return err
+	}
+	var issued IssuedCertificate
+	resp, err := c.resty.R().
+		SetContext(ctx).
+		SetBody(&certificateRequest{CSR: string(csrPEM)}).
+		SetResult(&issued).
+		Post(pathCertificate)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	if resp.IsError() {
+		return errors.New(resp.String())
+	}
+	return c.storeCertificate(key, issued)
+}
+
+// newCSR generates a P-256 key and a certificate request for it. The
+// controlplane sets the subject, so the request carries none.
+func newCSR() (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+func (c *Client) storeCertificate(key *ecdsa.PrivateKey, issued IssuedCertificate) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair([]byte(issued.Certificate), keyPEM)
+	if err != nil {
+		return fmt.Errorf("issued certificate: %w", err)
+	}
+
+	if err := os.MkdirAll(c.certDir, 0o700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.certDir, clientKeyFile), keyPEM); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(c.certDir, clientCertFile), []byte(issued.Certificate)); err != nil {
+		return err
+	}
+
+	c.cert.Store(&cert)
+	c.resty.GetClient().CloseIdleConnections()
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,58 @@
+// conntrack.go closes connections whose access was revoked.
+//
+// Every packet from the WireGuard interface passes the policy chain, so a
+// revoked connection is dropped as soon as the new ruleset is installed.
+// Its conntrack entry would still keep it established, and masqueraded,
+// until it times out. Deleting the entry makes its next packet a new
+// connection, which is dropped and logged under the new ruleset.
+package firewall
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"migration-to-zero-trust/enforcer/internal/policy"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// CloseRevoked deletes the conntrack entries of connections covered by the
+// revocations that the installed ruleset drops, and returns how many it
+// deleted. Call it once the ruleset is applied, so a deleted connection
+// cannot come back.
+func CloseRevoked(revoked []policy.Revocation, installed policy.Ruleset) (uint, error) {
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+	n, err := netlink.ConntrackDeleteFilters(netlink.ConntrackTable, unix.AF_INET, revokedFlows{revoked: revoked, rs: installed})
+	if err != nil {
+		return n, fmt.Errorf("conntrack delete: %w", err)
+	}
+	return n, nil
+}
+
+// revokedFlows matches connections opened from the source of a revocation
+// to its resource that the ruleset no longer accepts.
+type revokedFlows struct {
+	revoked []policy.Revocation
+	rs      policy.Ruleset
+}
+
+func (f revokedFlows) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	// The original direction holds the client's tunnel address and the
+	// resource address before masquerading
+	src, ok := netip.AddrFromSlice(flow.Forward.SrcIP.To4())
+	if !ok {
+		return false
+	}
+	dst, ok := netip.AddrFromSlice(flow.Forward.DstIP.To4())
+	if !ok {
+		return false
+	}
+	if !slices.ContainsFunc(f.revoked, func(r policy.Revocation) bool { return r.Src.Contains(src) && r.Dst.Contains(dst) }) {
+		return false
+	}
+	return !policy.Accepts(f.rs.Verdict(src, dst))
+}
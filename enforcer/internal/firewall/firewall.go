@@ -2,13 +2,22 @@ package firewall
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
 
 	"migration-to-zero-trust/enforcer/internal/controlplane"
+	"migration-to-zero-trust/enforcer/internal/policy"
 
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -16,20 +25,62 @@ const (
 	nftNatTableName     = "nat"
 	nftBaseChainName    = "forward"
 	nftPolicyChain      = "wg-authz"
+	nftSetPrefix        = "wg-"
 	nftPostroutingChain = "postrouting"
 	iifRegister         = 1
-	srcAddrRegister     = 2
 	dstAddrRegister     = 3
 	ipv4SrcAddrOffset   = 12
 	ipv4DstAddrOffset   = 16
+	ctStateRegister     = 4
+	// A concatenated key is loaded into adjacent 32-bit registers
+	// (NFT_REG32_00 and NFT_REG32_01)
+	pairSrcRegister = 8
+	pairDstRegister = 9
 )
 
-const DefaultLoggingGroup = 100
+// ctStateNew masks the NEW bit of the conntrack state, which the kernel
+// keeps in host byte order.
+var ctStateNew = binaryutil.NativeEndian.PutUint32(expr.CtStateBitNEW)
+
+// nflog groups the first packet of a connection is logged to, by the
+// verdict of the rule that matched it.
+const (
+	AllowLogGroup      = 100
+	DenyLogGroup       = 101
+	ObserveLogGroup    = 102
+	OutOfScopeLogGroup = 103
+)
+
+// LogGroups maps each nflog group to the verdict it logs.
+var LogGroups = map[uint16]string{
+	AllowLogGroup:      controlplane.VerdictAllow,
+	DenyLogGroup:       controlplane.VerdictDeny,
+	ObserveLogGroup:    controlplane.VerdictObserve,
+	OutOfScopeLogGroup: controlplane.VerdictOutOfScope,
+}
+
+// verdictChain is the chain connections meeting a verdict jump to. It logs
+// the first packet of a connection to the verdict's nflog group and then
+// accepts or drops it.
+type verdictChain struct {
+	verdict  string
+	name     string
+	logGroup uint16
+	action   string // "accept" or "drop"
+}
+
+var verdictChains = []verdictChain{
+	{controlplane.VerdictAllow, "wg-allow", AllowLogGroup, "accept"},
+	{controlplane.VerdictDeny, "wg-deny", DenyLogGroup, "drop"},
+	{controlplane.VerdictObserve, "wg-observe", ObserveLogGroup, "accept"},
+	{controlplane.VerdictOutOfScope, "wg-out-of-scope", OutOfScopeLogGroup, "drop"},
+}
 
 type Manager struct {
 	iface       string
 	table       *nftables.Table
 	policyChain *nftables.Chain
+	chains      []*nftables.Chain // the policy chain, then one per verdictChains
 }
 
 func NewManager(iface string) *Manager {
@@ -118,6 +169,31 @@ func (m *Manager) Setup() error {
 	}
 	m.policyChain = policyChain
 
+	// --- Create verdict chains ---
+	// Rules of the policy chain jump to the chain of their verdict, which
+	// logs new connections and accepts or drops them
+	m.chains = []*nftables.Chain{policyChain}
+	for _, vc := range verdictChains {
+		var chain *nftables.Chain
+		for _, c := range chains {
+			if c.Table.Name == table.Name && c.Table.Family == table.Family && c.Name == vc.name {
+				chain = c
+				break
+			}
+		}
+		if chain == nil {
+			chain = &nftables.Chain{
+				Name:  vc.name,
+				Table: table,
+			}
+			conn.AddChain(chain)
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("nftables add %s chain: %w", vc.name, err)
+			}
+		}
+		m.chains = append(m.chains, chain)
+	}
+
 	// --- Add jump rule from forward to policy chain ---
 	// Only traffic from WireGuard interface jumps to policy chain
 	rules, err := conn.GetRules(table, baseChain)
@@ -258,91 +334,90 @@ func (m *Manager) Setup() error {
 	return nil
 }
 
-// ApplyPolicies updates the firewall rules based on the given policies.
-// It flushes existing rules and rebuilds them from scratch.
-func (m *Manager) ApplyPolicies(policies []controlplane.Policy) error {
+// ApplyRuleset renders the ruleset into nftables. Chains are rewritten only
+// if their rules changed, sets are created on first use and deleted once no
+// rule looks them up, and only the pairs and ranges that differ are added to
+// or deleted from a set, all in one atomic batch.
+func (m *Manager) ApplyRuleset(compiled policy.Ruleset) error {
+	rs, err := render(compiled)
+	if err != nil {
+		return err
+	}
+
 	conn := &nftables.Conn{}
+	installed, err := m.sets(conn)
+	if err != nil {
+		return err
+	}
 
-	// Flush existing rules in policy chain
-	conn.FlushChain(m.policyChain)
-
-	// --- Add logging rule ---
-	// All traffic through this chain gets logged via nflog
-	conn.AddRule(&nftables.Rule{
-		Table: m.table,
-		Chain: m.policyChain,
-		Exprs: []expr.Any{
-			&expr.Log{Group: DefaultLoggingGroup, Key: 1 << 1},
-		},
-	})
-
-	// --- Build policy rules ---
-	// For each policy in enforce mode, create accept rules for allowed src->dst pairs
-	hasEnforceRules := false
-	for _, policy := range policies {
-		// Parse source CIDRs (client's allowed IPs)
-		srcNets := make([]*net.IPNet, 0, len(policy.AllowedIPs))
-		for _, cidr := range policy.AllowedIPs {
-			_, ipNet, err := net.ParseCIDR(cidr)
+	// --- Sets ---
+	// Added before the rules, so new rules can look them up
+	for _, s := range rs.sets {
+		nset, ok := installed[s.name]
+		have := map[string][]nftables.SetElement{}
+		if ok {
+			elements, err := conn.GetSetElements(nset)
 			if err != nil {
-				return fmt.Errorf("parse allowed_ips: %w", err)
+				return fmt.Errorf("nftables get %s elements: %w", s.name, err)
 			}
-			if ipNet.IP.To4() == nil {
-				continue // Skip IPv6
+			have = groupElements(nset, elements)
+		} else {
+			nset = s.nftSet(m.table)
+			if err := conn.AddSet(nset, nil); err != nil {
+				return fmt.Errorf("nftables add %s set: %w", s.name, err)
 			}
-			srcNets = append(srcNets, ipNet)
 		}
-
-		// For each target in enforce mode, create rules
-		for _, target := range policy.AllowedCIDRs {
-			if target.Mode != controlplane.ModeEnforce {
-				continue
+		want := make(map[string]bool, len(s.elements))
+		var added []nftables.SetElement
+		for _, e := range s.elements {
+			want[e.desc] = true
+			if _, ok := have[e.desc]; !ok {
+				added = append(added, e.elements...)
 			}
-
-			_, dstNet, err := net.ParseCIDR(target.CIDR)
-			if err != nil {
-				return fmt.Errorf("parse allowed_cidrs: %w", err)
+		}
+		var stale []nftables.SetElement
+		for desc, elements := range have {
+			if !want[desc] {
+				stale = append(stale, elements...)
 			}
-			if dstNet.IP.To4() == nil {
-				continue // Skip IPv6
+		}
+		if len(stale) > 0 {
+			if err := conn.SetDeleteElements(nset, stale); err != nil {
+				return fmt.Errorf("nftables delete %s elements: %w", s.name, err)
 			}
-
-			// Create rule for each src->dst pair
-			for _, srcNet := range srcNets {
-				// Build match expressions for src and dst CIDR
-				// Each CIDR match requires: payload load, bitwise mask, compare
-				exprs := []expr.Any{
-					// Match source IP
-					&expr.Payload{DestRegister: srcAddrRegister, Base: expr.PayloadBaseNetworkHeader, Offset: ipv4SrcAddrOffset, Len: 4},
-					&expr.Bitwise{SourceRegister: srcAddrRegister, DestRegister: srcAddrRegister, Len: 4, Mask: srcNet.Mask, Xor: []byte{0, 0, 0, 0}},
-					&expr.Cmp{Op: expr.CmpOpEq, Register: srcAddrRegister, Data: srcNet.IP.To4()},
-					// Match destination IP
-					&expr.Payload{DestRegister: dstAddrRegister, Base: expr.PayloadBaseNetworkHeader, Offset: ipv4DstAddrOffset, Len: 4},
-					&expr.Bitwise{SourceRegister: dstAddrRegister, DestRegister: dstAddrRegister, Len: 4, Mask: dstNet.Mask, Xor: []byte{0, 0, 0, 0}},
-					&expr.Cmp{Op: expr.CmpOpEq, Register: dstAddrRegister, Data: dstNet.IP.To4()},
-					// Accept matching traffic
-					&expr.Verdict{Kind: expr.VerdictAccept},
-				}
-				conn.AddRule(&nftables.Rule{
-					Table: m.table,
-					Chain: m.policyChain,
-					Exprs: exprs,
-				})
-				hasEnforceRules = true
+		}
+		if len(added) > 0 {
+			if err := conn.SetAddElements(nset, added); err != nil {
+				return fmt.Errorf("nftables add %s elements: %w", s.name, err)
 			}
 		}
 	}
 
-	// --- Add default drop rule ---
-	// If any enforce rules exist, drop non-matching traffic
-	if hasEnforceRules {
-		conn.AddRule(&nftables.Rule{
-			Table: m.table,
-			Chain: m.policyChain,
-			Exprs: []expr.Any{
-				&expr.Verdict{Kind: expr.VerdictDrop},
-			},
-		})
+	// --- Chains ---
+	for i, chain := range m.chains {
+		installed, err := conn.GetRules(m.table, chain)
+		if err != nil {
+			return fmt.Errorf("nftables get rules: %w", err)
+		}
+		if slices.Equal(describeRules(installed), renderRules(rs.chains[i])) {
+			continue
+		}
+		conn.FlushChain(chain)
+		for _, r := range rs.chains[i] {
+			conn.AddRule(&nftables.Rule{
+				Table: m.table,
+				Chain: chain,
+				Exprs: r.exprs(),
+			})
+		}
+	}
+
+	// --- Unused sets ---
+	// Deleted after the rules that looked them up are flushed
+	for name, nset := range installed {
+		if !slices.ContainsFunc(rs.sets, func(s set) bool { return s.name == name }) {
+			conn.DelSet(nset)
+		}
 	}
 
 	if err := conn.Flush(); err != nil {
@@ -351,3 +426,525 @@ func (m *Manager) ApplyPolicies(policies []controlplane.Policy) error {
 
 	return nil
 }
+
+// sets returns the sets of the table the enforcer manages, by name.
+func (m *Manager) sets(conn *nftables.Conn) (map[string]*nftables.Set, error) {
+	sets, err := conn.GetSets(m.table)
+	if err != nil {
+		return nil, fmt.Errorf("nftables get sets: %w", err)
+	}
+	out := make(map[string]*nftables.Set)
+	for _, s := range sets {
+		if strings.HasPrefix(s.Name, nftSetPrefix) {
+			out[s.Name] = s
+		}
+	}
+	return out, nil
+}
+
+// ruleset is a policy.Ruleset rendered into nftables: the rules of each
+// chain of the manager, in the same order, and the sets the rules of the
+// policy chain look up, by name.
+type ruleset struct {
+	chains [][]rule
+	sets   []set
+}
+
+// set is a set of destination ranges, or a verdict map of source and
+// destination ranges, looked up by a rule of the policy chain.
+type set struct {
+	name     string
+	pairs    bool
+	elements []element // sorted by desc
+}
+
+// element is a pair or range of a set and the set elements encoding it.
+type element struct {
+	desc     string
+	elements []nftables.SetElement
+}
+
+// rule is one rule of a chain: an optional conntrack state match, an
+// optional lookup of the destination in a set or of source . destination in
+// a verdict map, an optional nflog action, a packet and byte counter and an
+// optional verdict. A verdict map lookup ends the rule, so it has no counter.
+type rule struct {
+	ctNew    bool   // match only the first packet of a connection
+	dstSet   string // match only destinations in this set
+	vmap     string // look up source . destination in this verdict map
+	logGroup uint16 // log to this nflog group if non-zero
+	verdict  string // "accept", "drop", "jump <chain>" or ""
+}
+
+// render turns each rule of the ruleset into a rule of the policy chain and
+// the set it looks up.
+func render(compiled policy.Ruleset) (ruleset, error) {
+	var rs ruleset
+	var authz []rule
+	for _, r := range compiled {
+		i := slices.IndexFunc(verdictChains, func(vc verdictChain) bool { return vc.verdict == r.Verdict })
+		if i < 0 {
+			return ruleset{}, fmt.Errorf("rule %s: unknown verdict %q", r.Name, r.Verdict)
+		}
+		jump := "jump " + verdictChains[i].name
+		name := nftSetPrefix + r.Name
+		switch r.Match {
+		case policy.MatchPairs:
+			s := set{name: name, pairs: true}
+			for _, p := range r.Pairs {
+				s.elements = append(s.elements, pairElement(p, verdictChains[i].name))
+			}
+			rs.sets = append(rs.sets, s)
+			authz = append(authz, rule{vmap: name})
+		case policy.MatchDsts:
+			s := set{name: name}
+			for _, d := range r.Dsts {
+				s.elements = append(s.elements, rangeElement(d))
+			}
+			rs.sets = append(rs.sets, s)
+			authz = append(authz, rule{dstSet: name, verdict: jump})
+		case policy.MatchAll:
+			authz = append(authz, rule{verdict: jump})
+		default:
+			return ruleset{}, fmt.Errorf("rule %s: unknown match %q", r.Name, r.Match)
+		}
+	}
+
+	rs.chains = append(rs.chains, authz)
+	// Every new connection gets logged via nflog, to the group of the
+	// verdict it meets, by a rule right before that verdict's; its packet
+	// and byte counts follow from conntrack when it ends
+	for _, vc := range verdictChains {
+		rs.chains = append(rs.chains, []rule{
+			{ctNew: true, logGroup: vc.logGroup},
+			{verdict: vc.action},
+		})
+	}
+
+	for i := range rs.sets {
+		slices.SortFunc(rs.sets[i].elements, func(a, b element) int { return strings.Compare(a.desc, b.desc) })
+	}
+	slices.SortFunc(rs.sets, func(a, b set) int { return strings.Compare(a.name, b.name) })
+	return rs, nil
+}
+
+func (s set) nftSet(table *nftables.Table) *nftables.Set {
+	if s.pairs {
+		return &nftables.Set{
+			Table:         table,
+			Name:          s.name,
+			KeyType:       nftables.MustConcatSetType(nftables.TypeIPAddr, nftables.TypeIPAddr),
+			DataType:      nftables.TypeVerdict,
+			IsMap:         true,
+			Interval:      true,
+			Concatenation: true,
+		}
+	}
+	return &nftables.Set{
+		Table:    table,
+		Name:     s.name,
+		KeyType:  nftables.TypeIPAddr,
+		Interval: true,
+	}
+}
+
+// pairElement encodes a pair as a map element: the first addresses of both
+// ranges as the key and their last addresses as the key end.
+func pairElement(p policy.Pair, chain string) element {
+	srcFirst, srcLast := prefixRange(p.Src)
+	dstFirst, dstLast := p.Dst.First.As4(), p.Dst.Last.As4()
+	return element{
+		desc: p.String() + " : jump " + chain,
+		elements: []nftables.SetElement{{
+			Key:         append(srcFirst, dstFirst[:]...),
+			KeyEnd:      append(srcLast, dstLast[:]...),
+			VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: chain},
+		}},
+	}
+}
+
+// rangeElement encodes a range as the start of an interval and, unless it
+// runs to the last address, the end of the interval right behind it.
+func rangeElement(r policy.Range) element {
+	first := r.First.As4()
+	e := element{
+		desc:     r.String(),
+		elements: []nftables.SetElement{{Key: first[:]}},
+	}
+	if next := r.Last.Next(); next.IsValid() {
+		end := next.As4()
+		e.elements = append(e.elements, nftables.SetElement{Key: end[:], IntervalEnd: true})
+	}
+	return e
+}
+
+func prefixRange(prefix netip.Prefix) (first, last net.IP) {
+	ipNet := &net.IPNet{IP: net.IP(prefix.Addr().AsSlice()), Mask: net.CIDRMask(prefix.Bits(), 32)}
+	return ipNet.IP, lastAddr(ipNet)
+}
+
+func lastAddr(ipNet *net.IPNet) net.IP {
+	ip := slices.Clone(ipNet.IP.To4())
+	for i := range ip {
+		ip[i] |= ^ipNet.Mask[i]
+	}
+	return ip
+}
+
+func (r rule) exprs() []expr.Any {
+	var exprs []expr.Any
+	if r.ctNew {
+		exprs = append(exprs,
+			&expr.Ct{Register: ctStateRegister, Key: expr.CtKeySTATE},
+			&expr.Bitwise{SourceRegister: ctStateRegister, DestRegister: ctStateRegister, Len: 4, Mask: ctStateNew, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: ctStateRegister, Data: []byte{0, 0, 0, 0}},
+		)
+	}
+	if r.dstSet != "" {
+		exprs = append(exprs,
+			&expr.Payload{DestRegister: dstAddrRegister, Base: expr.PayloadBaseNetworkHeader, Offset: ipv4DstAddrOffset, Len: 4},
+			&expr.Lookup{SourceRegister: dstAddrRegister, SetName: r.dstSet},
+		)
+	}
+	// The map's verdict applies as soon as the lookup matches
+	if r.vmap != "" {
+		return append(exprs,
+			&expr.Payload{DestRegister: pairSrcRegister, Base: expr.PayloadBaseNetworkHeader, Offset: ipv4SrcAddrOffset, Len: 4},
+			&expr.Payload{DestRegister: pairDstRegister, Base: expr.PayloadBaseNetworkHeader, Offset: ipv4DstAddrOffset, Len: 4},
+			&expr.Lookup{SourceRegister: pairSrcRegister, DestRegister: 0, IsDestRegSet: true, SetName: r.vmap},
+		)
+	}
+	// Logged only once all matches passed
+	if r.logGroup != 0 {
+		exprs = append(exprs, &expr.Log{Group: r.logGroup, Key: 1 << 1})
+	}
+	exprs = append(exprs, &expr.Counter{})
+	switch {
+	case r.verdict == "accept":
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+	case r.verdict == "drop":
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+	case strings.HasPrefix(r.verdict, "jump "):
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictJump, Chain: strings.TrimPrefix(r.verdict, "jump ")})
+	}
+	return exprs
+}
+
+// String renders the rule the way describeRule renders it when read back.
+func (r rule) String() string {
+	var parts []string
+	if r.ctNew {
+		parts = append(parts, "ct state new")
+	}
+	if r.dstSet != "" {
+		parts = append(parts, "ip daddr @"+r.dstSet)
+	}
+	if r.vmap != "" {
+		return strings.Join(append(parts, "ip saddr . ip daddr vmap @"+r.vmap), " ")
+	}
+	if r.logGroup != 0 {
+		parts = append(parts, fmt.Sprintf("log group %d", r.logGroup))
+	}
+	parts = append(parts, "counter")
+	if r.verdict != "" {
+		parts = append(parts, r.verdict)
+	}
+	return strings.Join(parts, " ")
+}
+
+func renderRules(rules []rule) []string {
+	out := make([]string, len(rules))
+	for i, r := range rules {
+		out[i] = r.String()
+	}
+	return out
+}
+
+// ExpectedRules returns the firewall state for the given ruleset, one line
+// per rule of the policy and verdict chains, prefixed with the chain, then
+// one line per pair or range of each set, prefixed with the set.
+func ExpectedRules(compiled policy.Ruleset) ([]string, error) {
+	rs, err := render(compiled)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{nftPolicyChain}
+	for _, vc := range verdictChains {
+		names = append(names, vc.name)
+	}
+	var out []string
+	for i, rules := range rs.chains {
+		for _, r := range rules {
+			out = append(out, names[i]+": "+r.String())
+		}
+	}
+	for _, s := range rs.sets {
+		for _, e := range s.elements {
+			out = append(out, "@"+s.name+": "+e.desc)
+		}
+	}
+	return out, nil
+}
+
+// InstalledRules reads the firewall state back from nftables, rendered like
+// ExpectedRules. Expressions the enforcer does not install are rendered by
+// type, so rules added by hand show up as drift.
+func (m *Manager) InstalledRules() ([]string, error) {
+	conn := &nftables.Conn{}
+	var out []string
+	for _, chain := range m.chains {
+		rules, err := conn.GetRules(m.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("nftables get rules: %w", err)
+		}
+		for _, r := range describeRules(rules) {
+			out = append(out, chain.Name+": "+r)
+		}
+	}
+	sets, err := m.sets(conn)
+	if err != nil {
+		return nil, err
+	}
+	names := slices.Sorted(maps.Keys(sets))
+	for _, name := range names {
+		elements, err := conn.GetSetElements(sets[name])
+		if err != nil {
+			return nil, fmt.Errorf("nftables get %s elements: %w", name, err)
+		}
+		for _, desc := range slices.Sorted(maps.Keys(groupElements(sets[name], elements))) {
+			out = append(out, "@"+name+": "+desc)
+		}
+	}
+	return out, nil
+}
+
+func describeRules(rules []*nftables.Rule) []string {
+	out := make([]string, len(rules))
+	for i, r := range rules {
+		out[i] = describeRule(r.Exprs)
+	}
+	return out
+}
+
+func describeRule(exprs []expr.Any) string {
+	var parts []string
+	var loaded []string // fields loaded for the pending compare or lookup
+	var mask []byte
+	for _, e := range exprs {
+		switch exp := e.(type) {
+		case *expr.Log:
+			parts = append(parts, fmt.Sprintf("log group %d", exp.Group))
+		case *expr.Counter:
+			parts = append(parts, "counter")
+		case *expr.Ct:
+			if exp.Key == expr.CtKeySTATE {
+				loaded = []string{"ct state"}
+			} else {
+				parts = append(parts, fmt.Sprintf("ct key %d", exp.Key))
+			}
+		case *expr.Payload:
+			switch {
+			case exp.Base == expr.PayloadBaseNetworkHeader && exp.Offset == ipv4SrcAddrOffset && exp.Len == 4:
+				loaded = append(loaded, "ip saddr")
+			case exp.Base == expr.PayloadBaseNetworkHeader && exp.Offset == ipv4DstAddrOffset && exp.Len == 4:
+				loaded = append(loaded, "ip daddr")
+			default:
+				parts = append(parts, fmt.Sprintf("payload %d/%d/%d", exp.Base, exp.Offset, exp.Len))
+			}
+		case *expr.Bitwise:
+			mask = exp.Mask
+		case *expr.Cmp:
+			field := ""
+			if len(loaded) == 1 {
+				field = loaded[0]
+			}
+			if field == "ct state" && exp.Op == expr.CmpOpNeq && bytes.Equal(exp.Data, []byte{0, 0, 0, 0}) && bytes.Equal(mask, ctStateNew) {
+				parts = append(parts, "ct state new")
+				loaded, mask = nil, nil
+				break
+			}
+			if field == "" || field == "ct state" || exp.Op != expr.CmpOpEq || len(exp.Data) != 4 || len(mask) != 4 {
+				parts = append(parts, fmt.Sprintf("cmp %x", exp.Data))
+				break
+			}
+			ipNet := &net.IPNet{IP: net.IP(exp.Data), Mask: net.IPMask(mask)}
+			parts = append(parts, field+" "+ipNet.String())
+			loaded, mask = nil, nil
+		case *expr.Lookup:
+			op := " @"
+			if exp.IsDestRegSet {
+				op = " vmap @"
+			}
+			parts = append(parts, strings.Join(loaded, " . ")+op+exp.SetName)
+			loaded = nil
+		case *expr.Verdict:
+			parts = append(parts, describeVerdict(exp.Kind, exp.Chain))
+		default:
+			parts = append(parts, fmt.Sprintf("%T", e))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// groupElements groups the elements of a set by the pair or range they
+// encode, keyed the way pairElement and rangeElement describe it.
+func groupElements(s *nftables.Set, elements []nftables.SetElement) map[string][]nftables.SetElement {
+	out := make(map[string][]nftables.SetElement, len(elements))
+	if s.IsMap {
+		for _, e := range elements {
+			out[describeElement(e)] = []nftables.SetElement{{Key: e.Key, KeyEnd: e.KeyEnd}}
+		}
+		return out
+	}
+	// An interval runs from its start to right before the next element,
+	// or to the last address if no element follows
+	elements = slices.Clone(elements)
+	slices.SortFunc(elements, func(a, b nftables.SetElement) int { return bytes.Compare(a.Key, b.Key) })
+	for i, e := range elements {
+		if e.IntervalEnd {
+			continue
+		}
+		start := []nftables.SetElement{{Key: e.Key}}
+		last := net.IPv4bcast.To4()
+		if i+1 < len(elements) {
+			next := elements[i+1]
+			if next.IntervalEnd {
+				start = append(start, nftables.SetElement{Key: next.Key, IntervalEnd: true})
+			}
+			last = prevAddr(next.Key)
+		}
+		if len(e.Key) != 4 || len(last) != 4 {
+			out[fmt.Sprintf("%x-%x", e.Key, last)] = start
+			continue
+		}
+		out[addrRange(e.Key, last)] = start
+	}
+	return out
+}
+
+func prevAddr(ip net.IP) net.IP {
+	prev := slices.Clone(ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// describeElement renders an element of a verdict map the way pairElement
+// describes the pair it was made from.
+func describeElement(e nftables.SetElement) string {
+	if len(e.Key) != 8 || len(e.KeyEnd) != 8 {
+		return fmt.Sprintf("%x-%x : %s", e.Key, e.KeyEnd, describeVerdictData(e.Val))
+	}
+	return addrRange(e.Key[:4], e.KeyEnd[:4]) + " . " + addrRange(e.Key[4:], e.KeyEnd[4:]) + " : " + describeVerdictData(e.Val)
+}
+
+// addrRange renders an address range as a CIDR if it is one.
+func addrRange(first, last net.IP) string {
+	for ones := 0; ones <= 32; ones++ {
+		ipNet := &net.IPNet{IP: first.Mask(net.CIDRMask(ones, 32)), Mask: net.CIDRMask(ones, 32)}
+		if ipNet.IP.Equal(first) && lastAddr(ipNet).Equal(last) {
+			return ipNet.String()
+		}
+	}
+	return first.String() + "-" + last.String()
+}
+
+// describeVerdictData renders the verdict of a verdict map element, which
+// nftables returns as netlink attributes.
+func describeVerdictData(data []byte) string {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return fmt.Sprintf("%x", data)
+	}
+	var code int32
+	var chain string
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_VERDICT_CODE:
+			code = int32(binary.BigEndian.Uint32(ad.Bytes()))
+		case unix.NFTA_VERDICT_CHAIN:
+			chain = ad.String()
+		}
+	}
+	if ad.Err() != nil {
+		return fmt.Sprintf("%x", data)
+	}
+	return describeVerdict(expr.VerdictKind(code), chain)
+}
+
+func describeVerdict(kind expr.VerdictKind, chain string) string {
+	switch kind {
+	case expr.VerdictAccept:
+		return "accept"
+	case expr.VerdictDrop:
+		return "drop"
+	case expr.VerdictJump:
+		return "jump " + chain
+	case expr.VerdictGoto:
+		return "goto " + chain
+	}
+	return fmt.Sprintf("verdict %d %s", kind, chain)
+}
+
+// RuleCount returns the number of rules in the policy and verdict chains
+// plus the number of pairs and ranges in the sets, each of which stands in
+// for a rule.
+func (m *Manager) RuleCount() (int, error) {
+	conn := &nftables.Conn{}
+	n := 0
+	for _, chain := range m.chains {
+		rules, err := conn.GetRules(m.table, chain)
+		if err != nil {
+			return 0, fmt.Errorf("nftables get rules: %w", err)
+		}
+		n += len(rules)
+	}
+	sets, err := m.sets(conn)
+	if err != nil {
+		return 0, err
+	}
+	for name, s := range sets {
+		elements, err := conn.GetSetElements(s)
+		if err != nil {
+			return 0, fmt.Errorf("nftables get %s elements: %w", name, err)
+		}
+		n += len(groupElements(s, elements))
+	}
+	return n, nil
+}
+
+// RuleCounter is the packet and byte count of one rule of the policy or a
+// verdict chain.
+type RuleCounter struct {
+	Chain    string
+	Position int // from 0, in chain order
+	Rule     string
+	Packets  uint64
+	Bytes    uint64
+}
+
+// RuleCounters reads the counters of the rules in the policy and verdict
+// chains. Rules without a counter are skipped.
+func (m *Manager) RuleCounters() ([]RuleCounter, error) {
+	conn := &nftables.Conn{}
+	var out []RuleCounter
+	for _, chain := range m.chains {
+		rules, err := conn.GetRules(m.table, chain)
+		if err != nil {
+			return nil, fmt.Errorf("nftables get rules: %w", err)
+		}
+		for i, r := range rules {
+			for _, e := range r.Exprs {
+				if c, ok := e.(*expr.Counter); ok {
+					out = append(out, RuleCounter{Chain: chain.Name, Position: i, Rule: describeRule(r.Exprs), Packets: c.Packets, Bytes: c.Bytes})
+					break
+				}
+			}
+		}
+	}
+	return out, nil
+}
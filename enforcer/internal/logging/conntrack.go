@@ -0,0 +1,219 @@
+// conntrack.go follows conntrack events so logged connections can be
+// completed with their packet and byte counts and duration once they end.
+package logging
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Conntrack multicast groups of NETLINK_NETFILTER.
+const (
+	nfnlgrpConntrackNew     = 1
+	nfnlgrpConntrackDestroy = 3
+)
+
+// conntrackAcctPath enables per-connection packet and byte counters.
+const conntrackAcctPath = "/proc/sys/net/netfilter/nf_conntrack_acct"
+
+// conntrackEventBuffer is the socket receive buffer; events beyond it are
+// lost and their connections reported without counts.
+const conntrackEventBuffer = 4 << 20
+
+// flowKey identifies a connection by its original direction.
+type flowKey struct {
+	proto   string
+	srcIP   string
+	dstIP   string
+	srcPort int
+	dstPort int
+}
+
+func packetKey(pkt parsedPacket) flowKey {
+	return flowKey{proto: pkt.proto, srcIP: pkt.srcIP, dstIP: pkt.dstIP, srcPort: pkt.srcPort, dstPort: pkt.dstPort}
+}
+
+// ctEvent is a connection confirmed (new) or ended (destroy) by conntrack.
+type ctEvent struct {
+	destroy bool
+	key     flowKey
+	packets uint64 // both directions, on destroy
+	bytes   uint64
+}
+
+var errLostEvents = errors.New("conntrack events lost")
+
+type conntrackEvents struct {
+	sock *nl.NetlinkSocket
+}
+
+// enableConntrackAccounting turns on conntrack counters, without which
+// destroy events carry no packet and byte counts.
+func enableConntrackAccounting() error {
+	return os.WriteFile(conntrackAcctPath, []byte("1"), 0o644)
+}
+
+func openConntrackEvents() (*conntrackEvents, error) {
+	sock, err := nl.Subscribe(unix.NETLINK_NETFILTER, nfnlgrpConntrackNew, nfnlgrpConntrackDestroy)
+	if err != nil {
+		return nil, fmt.Errorf("conntrack subscribe: %w", err)
+	}
+	if err := sock.SetReceiveBufferSize(conntrackEventBuffer, true); err != nil {
+		sock.SetReceiveBufferSize(conntrackEventBuffer, false)
+	}
+	return &conntrackEvents{sock: sock}, nil
+}
+
+func (c *conntrackEvents) Close() {
+	c.sock.Close()
+}
+
+// receive returns the next conntrack events. errLostEvents reports that the
+// receive buffer overflowed; the socket stays usable.
+func (c *conntrackEvents) receive() ([]ctEvent, error) {
+	msgs, _, err := c.sock.Receive()
+	if err != nil {
+		if errors.Is(err, unix.ENOBUFS) {
+			return nil, errLostEvents
+		}
+		return nil, err
+	}
+	var events []ctEvent
+	for _, m := range msgs {
+		if m.Header.Type>>8 != unix.NFNL_SUBSYS_CTNETLINK {
+			continue
+		}
+		var ev ctEvent
+		switch m.Header.Type & 0xff {
+		case nl.IPCTNL_MSG_CT_NEW:
+		case nl.IPCTNL_MSG_CT_DELETE:
+			ev.destroy = true
+		default:
+			continue
+		}
+		if len(m.Data) < nl.SizeofNfgenmsg || m.Data[0] != unix.AF_INET {
+			continue
+		}
+		if parseConntrack(m.Data[nl.SizeofNfgenmsg:], &ev) {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func parseConntrack(b []byte, ev *ctEvent) bool {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return false
+	}
+	ok := false
+	for _, a := range attrs {
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_TUPLE_ORIG:
+			ok = parseTuple(a.Value, &ev.key)
+		case nl.CTA_COUNTERS_ORIG, nl.CTA_COUNTERS_REPLY:
+			packets, bytes := parseCounters(a.Value)
+			ev.packets += packets
+			ev.bytes += bytes
+		}
+	}
+	return ok
+}
+
+func parseTuple(b []byte, key *flowKey) bool {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return false
+	}
+	for _, a := range attrs {
+		nested, err := nl.ParseRouteAttr(a.Value)
+		if err != nil {
+			return false
+		}
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_TUPLE_IP:
+			for _, ip := range nested {
+				switch ip.Attr.Type & nl.NLA_TYPE_MASK {
+				case nl.CTA_IP_V4_SRC:
+					key.srcIP = net.IP(ip.Value).String()
+				case nl.CTA_IP_V4_DST:
+					key.dstIP = net.IP(ip.Value).String()
+				}
+			}
+		case nl.CTA_TUPLE_PROTO:
+			for _, p := range nested {
+				switch p.Attr.Type & nl.NLA_TYPE_MASK {
+				case nl.CTA_PROTO_NUM:
+					if len(p.Value) >= 1 {
+						key.proto = protoName(p.Value[0])
+					}
+				case nl.CTA_PROTO_SRC_PORT:
+					if len(p.Value) >= 2 {
+						key.srcPort = int(binary.BigEndian.Uint16(p.Value))
+					}
+				case nl.CTA_PROTO_DST_PORT:
+					if len(p.Value) >= 2 {
+						key.dstPort = int(binary.BigEndian.Uint16(p.Value))
+					}
+				}
+			}
+		}
+	}
+	// ICMP tuples carry an ID instead of ports; parsed packets have none
+	if key.proto != "tcp" && key.proto != "udp" {
+		key.srcPort, key.dstPort = 0, 0
+	}
+	return key.srcIP != "" && key.dstIP != "" && key.proto != ""
+}
+
+func parseCounters(b []byte) (packets, bytes uint64) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return 0, 0
+	}
+	for _, a := range attrs {
+		if len(a.Value) < 8 {
+			continue
+		}
+		switch a.Attr.Type & nl.NLA_TYPE_MASK {
+		case nl.CTA_COUNTERS_PACKETS:
+			packets = binary.BigEndian.Uint64(a.Value)
+		case nl.CTA_COUNTERS_BYTES:
+			bytes = binary.BigEndian.Uint64(a.Value)
+		}
+	}
+	return packets, bytes
+}
+
+// conntrackCounts reads the current counts of the given connections from the
+// conntrack table, for connections logged before they end.
+func conntrackCounts(keys map[flowKey]bool) (map[flowKey][2]uint64, error) {
+	flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, unix.AF_INET)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[flowKey][2]uint64)
+	for _, f := range flows {
+		key := flowKey{
+			proto:   protoName(f.Forward.Protocol),
+			srcIP:   f.Forward.SrcIP.String(),
+			dstIP:   f.Forward.DstIP.String(),
+			srcPort: int(f.Forward.SrcPort),
+			dstPort: int(f.Forward.DstPort),
+		}
+		if key.proto != "tcp" && key.proto != "udp" {
+			key.srcPort, key.dstPort = 0, 0
+		}
+		if keys[key] {
+			counts[key] = [2]uint64{f.Forward.Packets + f.Reverse.Packets, f.Forward.Bytes + f.Reverse.Bytes}
+		}
+	}
+	return counts, nil
+}
@@ -3,28 +3,55 @@ package logging
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"migration-to-zero-trust/enforcer/internal/controlplane"
+	"migration-to-zero-trust/internal/metrics"
 
 	"github.com/florianl/go-nflog/v2"
+	"github.com/google/uuid"
 )
 
 const (
 	defaultQueueSize = 1024
 	pushInterval     = 10 * time.Second
 	maxBatchSize     = 100
+
+	// Spooled batches that fail to send are retried with exponential
+	// backoff, or after the delay the controlplane asks for.
+	sendMinBackoff = time.Second
+	sendMaxBackoff = 5 * time.Minute
+
+	// A logged connection that conntrack has not confirmed within
+	// flowConfirmTimeout never got through, and is reported as is.
+	flowConfirmTimeout = 5 * time.Second
+	// Connections still open after flowReportAfter are reported with their
+	// counts so far and no longer followed.
+	flowReportAfter   = 10 * time.Minute
+	flowSweepInterval = 5 * time.Second
+	// Beyond maxTrackedFlows new connections are reported right away.
+	maxTrackedFlows = 65536
+)
+
+var (
+	nflogPackets    = metrics.NewCounter("enforcer_nflog_packets_total", "Packets delivered by nflog, by the verdict of the group.", "verdict")
+	conntrackLost   = metrics.NewCounter("enforcer_conntrack_events_lost_total", "Times conntrack events were lost because the socket buffer overflowed.")
+	logPushDuration = metrics.NewHistogram("enforcer_log_push_duration_seconds", "Time taken to push a log batch to the controlplane.", metrics.DefaultBuckets, "result")
 )
 
 type peerNet struct {
-	net  *net.IPNet
-	id   string
-	name string
+	net        *net.IPNet
+	id         string
+	name       string
+	deviceID   string
+	deviceName string
 }
 
 type resourceNet struct {
@@ -41,30 +68,74 @@ type parsedPacket struct {
 	proto   string
 }
 
+// nflogGroup receives the connections logged with one verdict.
+type nflogGroup struct {
+	nf      *nflog.Nflog
+	verdict string
+}
+
+// flow is a logged connection waiting for conntrack to report its end.
+type flow struct {
+	entry     controlplane.LogEntry
+	confirmed bool
+}
+
+// Logger reports one entry per connection: nflog delivers the first packet
+// of every new connection, and conntrack events add its packet and byte
+// counts and duration when it ends. Without conntrack events each connection
+// is reported as soon as its first packet is seen.
 type Logger struct {
-	nf          *nflog.Nflog
+	groups      []nflogGroup
+	ct          *conntrackEvents // nil if conntrack events are unavailable
 	events      chan controlplane.LogEntry
 	peersMu     sync.RWMutex
 	peers       []peerNet
 	resourcesMu sync.RWMutex
 	resources   []resourceNet
 	cp          *controlplane.Client
+	spool       *Spool
 	dropped     uint64
+
+	flowsMu   sync.Mutex
+	flows     map[flowKey]*flow
+	confirmed map[flowKey]time.Time // confirmed by conntrack before nflog delivered the packet
 }
 
-func NewLogger(loggingGroup int, cp *controlplane.Client) (*Logger, error) {
-	nf, err := nflog.Open(&nflog.Config{
-		Group:    uint16(loggingGroup),
-		Copymode: nflog.CopyPacket,
-	})
+// NewLogger listens on the given nflog groups, each mapped to the verdict of
+// the rules that log to it.
+func NewLogger(groups map[uint16]string, cp *controlplane.Client, spool *Spool) (*Logger, error) {
+	var nfGroups []nflogGroup
+	for group, verdict := range groups {
+		nf, err := nflog.Open(&nflog.Config{
+			Group:    group,
+			Copymode: nflog.CopyPacket,
+		})
+		if err != nil {
+			for _, g := range nfGroups {
+				g.nf.Close()
+			}
+			return nil, fmt.Errorf("nflog open group %d: %w", group, err)
+		}
+		nfGroups = append(nfGroups, nflogGroup{nf: nf, verdict: verdict})
+	}
+
+	if err := enableConntrackAccounting(); err != nil {
+		log.Printf("warning: enable conntrack accounting: %v (connections are logged without counts)", err)
+	}
+	ct, err := openConntrackEvents()
 	if err != nil {
-		return nil, fmt.Errorf("nflog open: %w", err)
+		log.Printf("warning: %v (connections are logged without counts or duration)", err)
+		ct = nil
 	}
 
 	return &Logger{
-		nf:     nf,
-		events: make(chan controlplane.LogEntry, defaultQueueSize),
-		cp:     cp,
+		groups:    nfGroups,
+		ct:        ct,
+		events:    make(chan controlplane.LogEntry, defaultQueueSize),
+		cp:        cp,
+		spool:     spool,
+		flows:     make(map[flowKey]*flow),
+		confirmed: make(map[flowKey]time.Time),
 	}, nil
 }
 
@@ -77,7 +148,13 @@ func (l *Logger) UpdateLookupTables(policies []controlplane.Policy) {
 			if err != nil {
 				continue
 			}
-			peers = append(peers, peerNet{net: ipNet, id: policy.ClientID, name: policy.ClientName})
+			peers = append(peers, peerNet{
+				net:        ipNet,
+				id:         policy.ClientID,
+				name:       policy.ClientName,
+				deviceID:   policy.DeviceID,
+				deviceName: policy.DeviceName,
+			})
 		}
 		for _, target := range policy.AllowedCIDRs {
 			if _, exists := resourceMap[target.CIDR]; exists {
@@ -104,33 +181,81 @@ func (l *Logger) UpdateLookupTables(policies []controlplane.Policy) {
 	l.resourcesMu.Unlock()
 }
 
+// Dropped returns how many connections were not logged because the queue or
+// the spool was full.
+func (l *Logger) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped) + l.spool.Dropped()
+}
+
+// Queued returns how many log entries wait to be batched into the spool.
+func (l *Logger) Queued() int {
+	return len(l.events)
+}
+
+// TrackedFlows returns how many logged connections wait for conntrack to
+// report their end.
+func (l *Logger) TrackedFlows() int {
+	l.flowsMu.Lock()
+	defer l.flowsMu.Unlock()
+	return len(l.flows)
+}
+
+// Spooled returns how many log entries wait in the spool to be sent.
+func (l *Logger) Spooled() uint64 {
+	return l.spool.Depth()
+}
+
 func (l *Logger) Close() error {
-	if l == nil || l.nf == nil {
+	if l == nil {
 		return nil
 	}
-	return l.nf.Close()
+	if l.ct != nil {
+		l.ct.Close()
+	}
+	l.spool.Close()
+	var errs []error
+	for _, g := range l.groups {
+		errs = append(errs, g.nf.Close())
+	}
+	return errors.Join(errs...)
 }
 
 func (l *Logger) Run(ctx context.Context) error {
 	if l == nil {
 		return nil
 	}
-	go l.startPusher(ctx)
-	go l.startReceiver(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.startPusher(ctx)
+	}()
+	go l.startSender(ctx)
+	for _, g := range l.groups {
+		go l.startReceiver(ctx, g)
+	}
+	if l.ct != nil {
+		go l.startConntrack(ctx)
+		go l.startSweeper(ctx)
+	}
 	<-ctx.Done()
+	// Wait for the last batch to reach the spool
+	<-done
 	return nil
 }
 
-func (l *Logger) startReceiver(ctx context.Context) {
+func (l *Logger) startReceiver(ctx context.Context, g nflogGroup) {
 	handle := func(attrs nflog.Attribute) int {
+		nflogPackets.Inc(g.verdict)
 		if attrs.Payload == nil || len(*attrs.Payload) == 0 {
 			return 0
 		}
 
 		payload := *attrs.Payload
 		ev := controlplane.LogEntry{
+			ID:        uuid.NewString(),
 			Timestamp: time.Now(),
 			Length:    len(payload),
+			Verdict:   g.verdict,
 		}
 		if attrs.Timestamp != nil {
 			ev.Timestamp = *attrs.Timestamp
@@ -145,32 +270,178 @@ func (l *Logger) startReceiver(ctx context.Context) {
 		ev.SrcPort = pkt.srcPort
 		ev.DstPort = pkt.dstPort
 		ev.Proto = pkt.proto
-		ev.ClientID, ev.ClientName = l.matchClient(net.ParseIP(pkt.srcIP))
+		if peer, ok := l.matchPeer(net.ParseIP(pkt.srcIP)); ok {
+			ev.ClientID, ev.ClientName = peer.id, peer.name
+			ev.DeviceID, ev.DeviceName = peer.deviceID, peer.deviceName
+		}
 		ev.ResourceID, ev.ResourceName = l.matchResource(net.ParseIP(pkt.dstIP))
 
-		select {
-		case l.events <- ev:
-		default:
-			atomic.AddUint64(&l.dropped, 1)
+		if l.ct == nil {
+			l.emit(ev)
+		} else {
+			l.track(packetKey(pkt), ev)
 		}
 		return 0
 	}
 
-	if err := l.nf.RegisterWithErrorFunc(ctx, handle, func(err error) int {
-		log.Printf("nflog error: %v", err)
+	if err := g.nf.RegisterWithErrorFunc(ctx, handle, func(err error) int {
+		log.Printf("nflog %s error: %v", g.verdict, err)
 		return 0
 	}); err != nil {
-		log.Printf("nflog register: %v", err)
+		log.Printf("nflog %s register: %v", g.verdict, err)
+	}
+}
+
+func (l *Logger) emit(ev controlplane.LogEntry) {
+	select {
+	case l.events <- ev:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+// track holds a new connection until conntrack reports its end.
+func (l *Logger) track(key flowKey, ev controlplane.LogEntry) {
+	l.flowsMu.Lock()
+	if len(l.flows) >= maxTrackedFlows {
+		l.flowsMu.Unlock()
+		l.emit(ev)
+		return
+	}
+	f := &flow{entry: ev}
+	if _, ok := l.confirmed[key]; ok {
+		f.confirmed = true
+		delete(l.confirmed, key)
+	}
+	prev := l.flows[key]
+	l.flows[key] = f
+	l.flowsMu.Unlock()
+
+	// A reused tuple replaces a connection whose end was missed
+	if prev != nil {
+		l.emit(prev.entry)
+	}
+}
+
+func (l *Logger) startConntrack(ctx context.Context) {
+	for {
+		events, err := l.ct.receive()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errLostEvents) {
+				conntrackLost.Inc()
+				log.Printf("warning: %v", err)
+				continue
+			}
+			log.Printf("conntrack events: %v", err)
+			return
+		}
+		now := time.Now()
+		for _, ev := range events {
+			l.handleConntrack(ev, now)
+		}
+	}
+}
+
+func (l *Logger) handleConntrack(ev ctEvent, now time.Time) {
+	l.flowsMu.Lock()
+	f, ok := l.flows[ev.key]
+	if !ev.destroy {
+		if ok {
+			f.confirmed = true
+		} else {
+			l.confirmed[ev.key] = now
+		}
+		l.flowsMu.Unlock()
+		return
+	}
+	if ok {
+		delete(l.flows, ev.key)
+	}
+	l.flowsMu.Unlock()
+	if !ok {
+		return
+	}
+
+	entry := f.entry
+	entry.Packets, entry.Bytes = ev.packets, ev.bytes
+	entry.DurationMs = max(now.Sub(entry.Timestamp).Milliseconds(), 0)
+	l.emit(entry)
+}
+
+func (l *Logger) startSweeper(ctx context.Context) {
+	ticker := time.NewTicker(flowSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.sweep(now)
+		}
 	}
 }
 
+// sweep reports connections conntrack never confirmed, and long-lived ones
+// with their counts so far.
+func (l *Logger) sweep(now time.Time) {
+	var unconfirmed []controlplane.LogEntry
+	long := make(map[flowKey]controlplane.LogEntry)
+
+	l.flowsMu.Lock()
+	for key, f := range l.flows {
+		age := now.Sub(f.entry.Timestamp)
+		switch {
+		case !f.confirmed && age > flowConfirmTimeout:
+			unconfirmed = append(unconfirmed, f.entry)
+			delete(l.flows, key)
+		case f.confirmed && age > flowReportAfter:
+			long[key] = f.entry
+			delete(l.flows, key)
+		}
+	}
+	for key, seen := range l.confirmed {
+		if now.Sub(seen) > flowConfirmTimeout {
+			delete(l.confirmed, key)
+		}
+	}
+	l.flowsMu.Unlock()
+
+	for _, entry := range unconfirmed {
+		l.emit(entry)
+	}
+	if len(long) == 0 {
+		return
+	}
+	keys := make(map[flowKey]bool, len(long))
+	for key := range long {
+		keys[key] = true
+	}
+	counts, err := conntrackCounts(keys)
+	if err != nil {
+		log.Printf("conntrack counts: %v", err)
+	}
+	for key, entry := range long {
+		if c, ok := counts[key]; ok {
+			entry.Packets, entry.Bytes = c[0], c[1]
+		}
+		entry.DurationMs = now.Sub(entry.Timestamp).Milliseconds()
+		l.emit(entry)
+	}
+}
+
+// startPusher collects log entries into batches and stores them in the
+// spool, from where startSender sends them.
 func (l *Logger) startPusher(ctx context.Context) {
 	ticker := time.NewTicker(pushInterval)
 	defer ticker.Stop()
 
-	push := func(c context.Context, batch []controlplane.LogEntry) {
-		if err := l.cp.PushLogs(c, batch); err != nil {
-			log.Printf("push logs error: %v", err)
+	spool := func(batch []controlplane.LogEntry) {
+		if err := l.spool.Append(batch); err != nil {
+			log.Printf("spool logs error: %v", err)
+			atomic.AddUint64(&l.dropped, uint64(len(batch)))
 		}
 	}
 
@@ -180,35 +451,95 @@ func (l *Logger) startPusher(ctx context.Context) {
 		case ev := <-l.events:
 			batch = append(batch, ev)
 			if len(batch) >= maxBatchSize {
-				push(ctx, batch)
+				spool(batch)
 				batch = batch[:0]
 			}
 		case <-ticker.C:
 			if len(batch) > 0 {
-				push(ctx, batch)
+				spool(batch)
 				batch = batch[:0]
 			}
 		case <-ctx.Done():
-			if len(batch) > 0 {
-				push(context.Background(), batch)
+			spool(batch)
+			return
+		}
+	}
+}
+
+// startSender sends spooled batches in order, retrying each until the
+// controlplane takes it. Before the first batch it asks which batches the
+// controlplane has already written and drops those from the spool.
+func (l *Logger) startSender(ctx context.Context) {
+	backoff := sendMinBackoff
+	synced := false
+	for {
+		batch, pos, err := l.spool.Peek()
+		if err == nil && batch == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-l.spool.Ready():
 			}
+			continue
+		}
+		if err == nil && !synced {
+			var acked, dropped uint64
+			if acked, err = l.cp.PushLogs(ctx, controlplane.LogBatch{}); err == nil {
+				synced = true
+				if dropped, err = l.spool.DropAcked(acked); dropped > 0 {
+					log.Printf("log spool: dropped %d entries the controlplane already has (up to batch #%d)", dropped, acked)
+				}
+				if err == nil {
+					continue
+				}
+			}
+		}
+		if err == nil {
+			start := time.Now()
+			_, err = l.cp.PushLogs(ctx, *batch)
+			result := "ok"
+			if err != nil {
+				result = "error"
+			}
+			logPushDuration.ObserveSince(start, result)
+		}
+		if ctx.Err() != nil {
 			return
 		}
+		if err != nil {
+			delay := backoff/2 + rand.N(backoff/2)
+			var busy *controlplane.BusyError
+			if errors.As(err, &busy) && busy.RetryAfter > delay {
+				delay = busy.RetryAfter
+			}
+			log.Printf("push logs error (%d entries spooled, retrying in %s): %v", l.spool.Depth(), delay.Round(time.Second), err)
+			backoff = min(2*backoff, sendMaxBackoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		backoff = sendMinBackoff
+		if err := l.spool.Ack(pos); err != nil {
+			log.Printf("spool logs error: %v", err)
+		}
 	}
 }
 
-func (l *Logger) matchClient(ip net.IP) (string, string) {
+func (l *Logger) matchPeer(ip net.IP) (peerNet, bool) {
 	if ip == nil {
-		return "", ""
+		return peerNet{}, false
 	}
 	l.peersMu.RLock()
 	defer l.peersMu.RUnlock()
 	for _, peer := range l.peers {
 		if peer.net.Contains(ip) {
-			return peer.id, peer.name
+			return peer, true
 		}
 	}
-	return "", ""
+	return peerNet{}, false
 }
 
 func (l *Logger) matchResource(ip net.IP) (string, string) {
@@ -0,0 +1,428 @@
+// spool.go keeps log batches on disk until the controlplane has taken them,
+// so they survive controlplane outages and enforcer restarts.
+//
+// The spool is a directory of segment files named by an increasing sequence
+// number, each holding one JSON batch per line. Every batch is given the
+// next batch sequence number when it is appended. Batches are appended to
+// the newest segment and sent from the oldest, in order. The position of the
+// next unsent batch and the sequence number of the last one sent are kept in
+// a cursor file, so a restart resends at most the batch that was in flight
+// and never reuses a sequence number. When the spool outgrows its size, the
+// oldest segment is dropped and its entries are counted as dropped.
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"migration-to-zero-trust/enforcer/internal/controlplane"
+)
+
+const (
+	// DefaultSpoolSize bounds the spool on disk.
+	DefaultSpoolSize = 64 << 20
+	// spoolSegmentSize is the size at which a new segment is started.
+	spoolSegmentSize = 1 << 20
+
+	spoolSegmentExt = ".log"
+	spoolCursorFile = "cursor"
+)
+
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	entries uint64 // unsent entries
+}
+
+func (s *spoolSegment) name() string {
+	return fmt.Sprintf("%016d%s", s.seq, spoolSegmentExt)
+}
+
+// spoolPosition identifies a batch returned by Peek.
+type spoolPosition struct {
+	segment  uint64
+	offset   int64
+	next     int64
+	entries  uint64
+	batchSeq uint64
+}
+
+// Spool is a bounded on-disk queue of log batches.
+type Spool struct {
+	dir     string
+	maxSize int64
+
+	mu       sync.Mutex
+	segments []*spoolSegment // oldest first; the last one is appended to
+	w        *os.File        // the last segment, open for appending
+	offset   int64           // next unsent batch in segments[0]
+	lastSeq  uint64          // batch sequence number last appended
+	ackedSeq uint64          // batch sequence number last sent
+	size     int64
+	entries  uint64
+	dropped  uint64
+	ready    chan struct{}
+}
+
+// OpenSpool opens the spool in dir, creating it if needed. Batches left by
+// an earlier run are kept for sending.
+func OpenSpool(dir string, maxSize int64) (*Spool, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultSpoolSize
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("log spool: %w", err)
+	}
+	s := &Spool{dir: dir, maxSize: maxSize, ready: make(chan struct{}, 1)}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("log spool: %w", err)
+	}
+	if s.entries > 0 {
+		log.Printf("log spool: %d entries left from an earlier run", s.entries)
+		s.signal()
+	}
+	return s, nil
+}
+
+func (s *Spool) load() error {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return err
+	}
+	var seqs []uint64
+	for _, name := range names {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	cursorSeq, cursorOffset, ackedSeq := s.readCursor()
+	s.ackedSeq, s.lastSeq = ackedSeq, ackedSeq
+	for _, seq := range seqs {
+		seg := &spoolSegment{seq: seq}
+		if seq < cursorSeq {
+			os.Remove(s.path(seg))
+			continue
+		}
+		from := int64(0)
+		if seq == cursorSeq {
+			from = cursorOffset
+		}
+		if err := s.scan(seg, from); err != nil {
+			return err
+		}
+		if len(s.segments) == 0 {
+			s.offset = min(from, seg.size)
+		}
+		s.segments = append(s.segments, seg)
+		s.size += seg.size
+		s.entries += seg.entries
+	}
+
+	next := uint64(1)
+	if n := len(s.segments); n > 0 {
+		next = s.segments[n-1].seq
+	}
+	if len(s.segments) == 0 || s.segments[len(s.segments)-1].size >= spoolSegmentSize {
+		if len(s.segments) > 0 {
+			next++
+		}
+		s.segments = append(s.segments, &spoolSegment{seq: next})
+	}
+	w, err := os.OpenFile(s.path(s.segments[len(s.segments)-1]), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.w = w
+	return nil
+}
+
+// scan counts the unsent entries of seg from offset on and cuts off a batch
+// torn by a crash.
+func (s *Spool) scan(seg *spoolSegment, offset int64) error {
+	f, err := os.Open(s.path(seg))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var pos int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if batch, err := decodeBatch(line); err == nil {
+			if pos >= offset {
+				seg.entries += uint64(len(batch.Entries))
+			}
+			s.lastSeq = max(s.lastSeq, batch.Seq)
+		}
+		pos += int64(len(line))
+	}
+	seg.size = pos
+	if info, err := f.Stat(); err == nil && info.Size() > pos {
+		log.Printf("log spool: truncating torn batch in %s", seg.name())
+		return os.Truncate(s.path(seg), pos)
+	}
+	return nil
+}
+
+func (s *Spool) path(seg *spoolSegment) string {
+	return filepath.Join(s.dir, seg.name())
+}
+
+// readCursor returns the segment and offset of the next unsent batch and the
+// sequence number of the last batch sent.
+func (s *Spool) readCursor() (segment uint64, offset int64, acked uint64) {
+	data, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	if err != nil {
+		return 0, 0, 0
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d %d", &segment, &offset, &acked); err != nil {
+		return 0, 0, 0
+	}
+	return segment, offset, acked
+}
+
+func (s *Spool) writeCursor() error {
+	path := filepath.Join(s.dir, spoolCursorFile)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d %d\n", s.segments[0].seq, s.offset, s.ackedSeq)
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Append stores entries as the next batch at the end of the spool, dropping
+// the oldest segments if the spool outgrows its size.
+func (s *Spool) Append(entries []controlplane.LogEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(controlplane.LogBatch{Seq: s.lastSeq + 1, Entries: entries})
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	last := s.segments[len(s.segments)-1]
+	if last.size >= spoolSegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		last = s.segments[len(s.segments)-1]
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	if err := s.w.Sync(); err != nil {
+		return err
+	}
+	s.lastSeq++
+	last.size += int64(len(data))
+	last.entries += uint64(len(entries))
+	s.size += int64(len(data))
+	s.entries += uint64(len(entries))
+
+	for s.size > s.maxSize && len(s.segments) > 1 {
+		head := s.segments[0]
+		log.Printf("log spool full: dropping %d unsent entries", head.entries)
+		s.dropped += head.entries
+		if err := s.removeHead(); err != nil {
+			return err
+		}
+	}
+	s.signal()
+	return nil
+}
+
+func (s *Spool) rotate() error {
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+	seg := &spoolSegment{seq: s.segments[len(s.segments)-1].seq + 1}
+	w, err := os.OpenFile(s.path(seg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	s.segments = append(s.segments, seg)
+	s.w = w
+	return nil
+}
+
+// removeHead deletes the oldest segment, which must not be the last one.
+func (s *Spool) removeHead() error {
+	head := s.segments[0]
+	s.segments = s.segments[1:]
+	s.offset = 0
+	s.size -= head.size
+	s.entries -= head.entries
+	if err := os.Remove(s.path(head)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.writeCursor()
+}
+
+// Peek returns the oldest unsent batch, or nil if there is none. A batch
+// that cannot be decoded is skipped.
+func (s *Spool) Peek() (*controlplane.LogBatch, spoolPosition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peek()
+}
+
+func (s *Spool) peek() (*controlplane.LogBatch, spoolPosition, error) {
+	for {
+		head := s.segments[0]
+		if s.offset >= head.size {
+			if len(s.segments) == 1 {
+				return nil, spoolPosition{}, nil
+			}
+			if err := s.removeHead(); err != nil {
+				return nil, spoolPosition{}, err
+			}
+			continue
+		}
+		line, err := s.readAt(head, s.offset)
+		if err != nil {
+			return nil, spoolPosition{}, err
+		}
+		pos := spoolPosition{segment: head.seq, offset: s.offset, next: s.offset + int64(len(line))}
+		batch, err := decodeBatch(line)
+		if err != nil {
+			log.Printf("log spool: skipping unreadable batch in %s: %v", head.name(), err)
+			s.offset = pos.next
+			continue
+		}
+		pos.entries, pos.batchSeq = uint64(len(batch.Entries)), batch.Seq
+		return &batch, pos, nil
+	}
+}
+
+// decodeBatch decodes a spooled batch. Batches spooled before they were
+// numbered are plain entry arrays and get sequence number 0.
+func decodeBatch(line []byte) (controlplane.LogBatch, error) {
+	var batch controlplane.LogBatch
+	if len(line) > 0 && line[0] == '[' {
+		err := json.Unmarshal(line, &batch.Entries)
+		return batch, err
+	}
+	err := json.Unmarshal(line, &batch)
+	return batch, err
+}
+
+func (s *Spool) readAt(seg *spoolSegment, offset int64) ([]byte, error) {
+	f, err := os.Open(s.path(seg))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("read %s at %d: %w", seg.name(), offset, err)
+	}
+	return line, nil
+}
+
+// Ack marks the batch at pos as sent. It is a no-op if the batch was
+// dropped in the meantime.
+func (s *Spool) Ack(pos spoolPosition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ack(pos)
+}
+
+func (s *Spool) ack(pos spoolPosition) error {
+	head := s.segments[0]
+	if head.seq != pos.segment || s.offset != pos.offset {
+		return nil
+	}
+	s.offset = pos.next
+	s.ackedSeq = max(s.ackedSeq, pos.batchSeq)
+	head.entries -= min(pos.entries, head.entries)
+	s.entries -= min(pos.entries, s.entries)
+	if s.offset >= head.size && len(s.segments) > 1 {
+		return s.removeHead()
+	}
+	return s.writeCursor()
+}
+
+// DropAcked drops the unsent batches up to sequence number acked, which the
+// controlplane reports as written; they were sent before a restart but their
+// ack was not recorded. If acked is beyond the last batch appended, the
+// spool was lost and nothing is dropped, but new batches are numbered after
+// acked. It returns the number of entries dropped.
+func (s *Spool) DropAcked(acked uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if acked > s.lastSeq {
+		s.lastSeq = acked
+		return 0, nil
+	}
+	var dropped uint64
+	for {
+		batch, pos, err := s.peek()
+		if err != nil || batch == nil || batch.Seq == 0 || batch.Seq > acked {
+			return dropped, err
+		}
+		if err := s.ack(pos); err != nil {
+			return dropped, err
+		}
+		dropped += pos.entries
+	}
+}
+
+// Ready is signalled when a batch is appended.
+func (s *Spool) Ready() <-chan struct{} {
+	return s.ready
+}
+
+func (s *Spool) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Depth returns how many entries wait to be sent.
+func (s *Spool) Depth() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.entries
+}
+
+// Dropped returns how many entries were dropped because the spool was full.
+func (s *Spool) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Close()
+}
@@ -0,0 +1,341 @@
+// Package policy compiles the policies of an enforcer config into an
+// ordered ruleset, which the firewall only renders into nftables.
+//
+// A connection meets the verdict of the first rule it matches:
+//
+//  1. observed: an observe resource -> observe
+//  2. observed_pairs: the address of a device meeting the posture of a
+//     gated observe resource, and that resource -> observe
+//  3. pairs: a paired client's address and an enforce resource -> allow
+//  4. enforced: an enforce or gated observe resource, from anyone else -> deny
+//  5. default: any other destination -> the configured verdict
+//
+// By default the enforcer contains its clients: a destination outside every
+// resource is dropped as out of scope, so a client cannot reach networks
+// behind the enforcer that nobody registered, whatever packets it crafts.
+//
+// Resources may nest, and the most specific one decides: an enforce
+// resource inside an observe range is enforced, an observe resource inside
+// an enforce range is observed, and an enforce resource inside another one
+// only admits the clients paired with it. A gated observe resource, one with
+// posture requirements, is observed only from the devices whose policies
+// list it and is denied to the others. The enforced and observed ranges
+// are therefore flattened into disjoint ranges, and a pair only reaches the
+// ranges its resource is the most specific target of. Compile is a pure
+// function, so a config's ruleset is tested without touching the kernel.
+// Only IPv4 is compiled, since the firewall only filters IPv4.
+package policy
+
+import (
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"migration-to-zero-trust/enforcer/internal/controlplane"
+)
+
+// What a rule matches connections by.
+const (
+	MatchPairs = "pairs" // source . destination in Pairs
+	MatchDsts  = "dsts"  // destination in Dsts
+	MatchAll   = "all"   // every connection
+)
+
+// Rule names, which name the nftables set each rule looks up.
+const (
+	RuleObserved      = "observed"
+	RuleObservedPairs = "observed_pairs"
+	RulePairs         = "pairs"
+	RuleEnforced      = "enforced"
+	RuleDefault       = "default"
+)
+
+// modeGated is the mode of an observe target with posture requirements,
+// which only the devices meeting them may reach.
+const modeGated = "gated"
+
+// modeRank orders the modes of targets with the same CIDR; the highest one
+// is kept.
+var modeRank = map[string]int{
+	controlplane.ModeObserve: 0,
+	modeGated:                1,
+	controlplane.ModeEnforce: 2,
+}
+
+// Ruleset is the rules of an enforcer in evaluation order.
+type Ruleset []Rule
+
+// Rule gives a verdict to the connections it matches.
+type Rule struct {
+	Name    string
+	Match   string
+	Pairs   []Pair  // sorted, none inside another
+	Dsts    []Range // sorted, disjoint
+	Verdict string  // a controlplane.Verdict*
+}
+
+// Pair is a client's source range and a destination range it may reach.
+type Pair struct {
+	Src netip.Prefix
+	Dst Range
+}
+
+// Range is an inclusive range of destination addresses.
+type Range struct {
+	First, Last netip.Addr
+}
+
+// Compile builds the ruleset for the policies and resources of an enforcer
+// config. Resources lists every resource of the enforcer; targets of the
+// policies are added to it, so an enforce resource nobody is paired with is
+// still denied, and a config without resources still compiles. Unknown is
+// what happens to destinations outside every resource: observe, or deny,
+// which drops them with the out-of-scope verdict.
+func Compile(policies []controlplane.Policy, resources []controlplane.PolicyTarget, unknown string) (Ruleset, error) {
+	defaultVerdict := controlplane.VerdictObserve
+	switch unknown {
+	case controlplane.VerdictObserve:
+	case controlplane.VerdictDeny:
+		defaultVerdict = controlplane.VerdictOutOfScope
+	default:
+		return nil, fmt.Errorf("verdict for unknown destinations must be %s or %s, not %q", controlplane.VerdictObserve, controlplane.VerdictDeny, unknown)
+	}
+
+	// Mode of every target; a CIDR listed in both modes is enforced, and
+	// one listed with and without posture requirements is gated
+	modes := make(map[netip.Prefix]string)
+	addTarget := func(prefix netip.Prefix, target controlplane.PolicyTarget) {
+		mode := target.Mode
+		if mode != controlplane.ModeEnforce && target.Gated {
+			mode = modeGated
+		}
+		if current, ok := modes[prefix]; !ok || modeRank[mode] > modeRank[current] {
+			modes[prefix] = mode
+		}
+	}
+	for _, r := range resources {
+		prefix, err := parseIPv4Prefix(r.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("parse resources: %w", err)
+		}
+		if prefix.IsValid() {
+			addTarget(prefix, r)
+		}
+	}
+
+	// Enforce and gated targets of the policies, paired once flattened
+	var grants, observeGrants []grant
+	for _, p := range policies {
+		var srcs []netip.Prefix
+		for _, cidr := range p.AllowedIPs {
+			prefix, err := parseIPv4Prefix(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("parse allowed_ips: %w", err)
+			}
+			if prefix.IsValid() {
+				srcs = append(srcs, prefix)
+			}
+		}
+		for _, target := range p.AllowedCIDRs {
+			dst, err := parseIPv4Prefix(target.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("parse allowed_cidrs: %w", err)
+			}
+			if !dst.IsValid() {
+				continue
+			}
+			addTarget(dst, target)
+			for _, src := range srcs {
+				switch {
+				case target.Mode == controlplane.ModeEnforce:
+					grants = append(grants, grant{src: src, dst: dst})
+				case target.Gated:
+					observeGrants = append(observeGrants, grant{src: src, dst: dst})
+				}
+			}
+		}
+	}
+
+	enforced, observed, owned := flatten(modes)
+	// A grant only pairs a target whose CIDR kept the grant's mode
+	pair := func(grants []grant, mode string) []Pair {
+		var pairs []Pair
+		for _, g := range grants {
+			if modes[g.dst] != mode {
+				continue
+			}
+			for _, dst := range owned[g.dst] {
+				pairs = append(pairs, Pair{Src: g.src, Dst: dst})
+			}
+		}
+		return mergePairs(pairs)
+	}
+	return Ruleset{
+		{Name: RuleObserved, Match: MatchDsts, Dsts: observed, Verdict: controlplane.VerdictObserve},
+		{Name: RuleObservedPairs, Match: MatchPairs, Pairs: pair(observeGrants, modeGated), Verdict: controlplane.VerdictObserve},
+		{Name: RulePairs, Match: MatchPairs, Pairs: pair(grants, controlplane.ModeEnforce), Verdict: controlplane.VerdictAllow},
+		{Name: RuleEnforced, Match: MatchDsts, Dsts: enforced, Verdict: controlplane.VerdictDeny},
+		{Name: RuleDefault, Match: MatchAll, Verdict: defaultVerdict},
+	}, nil
+}
+
+// grant is a client's source range and an enforce or gated target it is
+// paired with.
+type grant struct {
+	src, dst netip.Prefix
+}
+
+// parseIPv4Prefix parses a CIDR and masks it. An IPv6 CIDR yields the zero
+// prefix.
+func parseIPv4Prefix(cidr string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, nil
+	}
+	return prefix.Masked(), nil
+}
+
+// flatten splits the targets into disjoint enforced and observed ranges,
+// each address going to the mode of the most specific target containing it;
+// the ranges of gated targets are enforced. Owned maps each enforce and
+// gated target to the ranges it is the most specific target of.
+func flatten(modes map[netip.Prefix]string) (enforced, observed []Range, owned map[netip.Prefix][]Range) {
+	prefixes := make([]netip.Prefix, 0, len(modes))
+	for prefix := range modes {
+		prefixes = append(prefixes, prefix)
+	}
+	// Most specific first, so the first prefix containing an address wins
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		if c := cmp.Compare(b.Bits(), a.Bits()); c != 0 {
+			return c
+		}
+		return a.Addr().Compare(b.Addr())
+	})
+
+	// Between two consecutive boundaries the most specific target is the
+	// same for every address
+	var bounds []uint64
+	for _, prefix := range prefixes {
+		first, last := prefixBounds(prefix)
+		bounds = append(bounds, first, last+1)
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	owned = make(map[netip.Prefix][]Range)
+	for i := 0; i+1 < len(bounds); i++ {
+		addr := addrFrom(bounds[i])
+		j := slices.IndexFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+		if j < 0 {
+			continue
+		}
+		r := Range{First: addr, Last: addrFrom(bounds[i+1] - 1)}
+		if mode := modes[prefixes[j]]; mode == controlplane.ModeEnforce || mode == modeGated {
+			enforced = appendRange(enforced, r)
+			owned[prefixes[j]] = appendRange(owned[prefixes[j]], r)
+		} else {
+			observed = appendRange(observed, r)
+		}
+	}
+	return enforced, observed, owned
+}
+
+// appendRange appends r, merging it into the last range if they touch.
+func appendRange(ranges []Range, r Range) []Range {
+	if n := len(ranges); n > 0 && ranges[n-1].Last.Next() == r.First {
+		ranges[n-1].Last = r.Last
+		return ranges
+	}
+	return append(ranges, r)
+}
+
+func prefixBounds(prefix netip.Prefix) (first, last uint64) {
+	first = addrValue(prefix.Addr())
+	return first, first | (1<<(32-prefix.Bits()) - 1)
+}
+
+func addrValue(addr netip.Addr) uint64 {
+	b := addr.As4()
+	return uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])
+}
+
+func addrFrom(v uint64) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
+
+// mergePairs drops duplicate pairs and pairs inside another one, since
+// every connection they match is matched by the wider pair, and sorts the
+// rest. Destinations of pairs are either the same or disjoint, so the
+// pairs left never overlap.
+func mergePairs(pairs []Pair) []Pair {
+	// Wider sources first, so a pair is checked against every pair that
+	// may contain it
+	slices.SortFunc(pairs, func(a, b Pair) int {
+		return cmp.Compare(a.Src.Bits(), b.Src.Bits())
+	})
+	var out []Pair
+	for _, p := range pairs {
+		if !slices.ContainsFunc(out, p.within) {
+			out = append(out, p)
+		}
+	}
+	slices.SortFunc(out, func(a, b Pair) int {
+		if c := a.Src.Addr().Compare(b.Src.Addr()); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Src.Bits(), b.Src.Bits()); c != 0 {
+			return c
+		}
+		return a.Dst.First.Compare(b.Dst.First)
+	})
+	return out
+}
+
+// within reports whether every connection p matches also matches outer.
+func (p Pair) within(outer Pair) bool {
+	return outer.Src.Bits() <= p.Src.Bits() && outer.Src.Contains(p.Src.Addr()) &&
+		outer.Dst.Contains(p.Dst.First) && outer.Dst.Contains(p.Dst.Last)
+}
+
+func (p Pair) String() string {
+	return p.Src.String() + " . " + p.Dst.String()
+}
+
+// Contains reports whether addr is in the range.
+func (r Range) Contains(addr netip.Addr) bool {
+	return r.First.Compare(addr) <= 0 && addr.Compare(r.Last) <= 0
+}
+
+// String writes the range as a CIDR if it is one, else as first-last.
+func (r Range) String() string {
+	for bits := 0; bits <= 32; bits++ {
+		prefix := netip.PrefixFrom(r.First, bits)
+		if prefix.Masked().Addr() != r.First {
+			continue
+		}
+		if _, last := prefixBounds(prefix); addrFrom(last) == r.Last {
+			return prefix.String()
+		}
+	}
+	return r.First.String() + "-" + r.Last.String()
+}
+
+// String writes one line per rule and one indented line per pair or range.
+func (rs Ruleset) String() string {
+	var b strings.Builder
+	for _, r := range rs {
+		fmt.Fprintf(&b, "%s: %s -> %s\n", r.Name, r.Match, r.Verdict)
+		for _, p := range r.Pairs {
+			fmt.Fprintf(&b, "\t%s\n", p)
+		}
+		for _, d := range r.Dsts {
+			fmt.Fprintf(&b, "\t%s\n", d)
+		}
+	}
+	return b.String()
+}
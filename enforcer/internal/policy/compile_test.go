@@ -0,0 +1,128 @@
+package policy
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"migration-to-zero-trust/enforcer/internal/controlplane"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files")
+
+// compileInput is the input of a golden test in testdata/<name>.json. Its
+// compiled ruleset is kept in testdata/<name>.golden.
+type compileInput struct {
+	Unknown   string                      `json:"unknown"`
+	Resources []controlplane.PolicyTarget `json:"resources"`
+	Policies  []controlplane.Policy       `json:"policies"`
+}
+
+func TestCompileGolden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden inputs in testdata")
+	}
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var in compileInput
+			if err := json.Unmarshal(data, &in); err != nil {
+				t.Fatal(err)
+			}
+			rs, err := Compile(in.Policies, in.Resources, in.Unknown)
+			if err != nil {
+				t.Fatalf("Compile: %v", err)
+			}
+			got := rs.String()
+
+			golden := strings.TrimSuffix(input, ".json") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("ruleset differs from %s\ngot:\n%s\nwant:\n%s", golden, got, want)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		policies  []controlplane.Policy
+		resources []controlplane.PolicyTarget
+		unknown   string
+	}{
+		{
+			name:    "unknown verdict",
+			unknown: controlplane.VerdictAllow,
+		},
+		{
+			name:      "invalid resource CIDR",
+			resources: []controlplane.PolicyTarget{{CIDR: "10.0.0.0/33", Mode: controlplane.ModeEnforce}},
+			unknown:   controlplane.VerdictObserve,
+		},
+		{
+			name:     "invalid allowed IP",
+			policies: []controlplane.Policy{{AllowedIPs: []string{"100.64.0.2"}}},
+			unknown:  controlplane.VerdictObserve,
+		},
+		{
+			name: "invalid allowed CIDR",
+			policies: []controlplane.Policy{{
+				AllowedIPs:   []string{"100.64.0.2/32"},
+				AllowedCIDRs: []controlplane.PolicyTarget{{CIDR: "db.internal", Mode: controlplane.ModeEnforce}},
+			}},
+			unknown: controlplane.VerdictDeny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile(tt.policies, tt.resources, tt.unknown); err == nil {
+				t.Error("Compile succeeded, want an error")
+			}
+		})
+	}
+}
+
+// Compile must not depend on the order policies and resources come in.
+func TestCompileOrderIndependent(t *testing.T) {
+	resources := []controlplane.PolicyTarget{
+		{CIDR: "10.0.0.0/16", Mode: controlplane.ModeObserve},
+		{CIDR: "10.0.5.0/24", Mode: controlplane.ModeEnforce},
+		{CIDR: "10.0.5.0/24", Mode: controlplane.ModeObserve},
+	}
+	policies := []controlplane.Policy{
+		{AllowedIPs: []string{"100.64.0.2/32"}, AllowedCIDRs: resources[1:2]},
+		{AllowedIPs: []string{"100.64.0.0/24"}, AllowedCIDRs: resources[1:2]},
+	}
+	want, err := Compile(policies, resources, controlplane.VerdictDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reversed := []controlplane.PolicyTarget{resources[2], resources[1], resources[0]}
+	got, err := Compile([]controlplane.Policy{policies[1], policies[0]}, reversed, controlplane.VerdictDeny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("reordered input compiles to\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,113 @@
+// revoke.go finds the access a new ruleset takes away, so connections
+// opened under the old one can be closed instead of living on.
+package policy
+
+import (
+	"net/netip"
+	"slices"
+
+	"migration-to-zero-trust/enforcer/internal/controlplane"
+)
+
+// Revocation is a client device's access to a resource that the old
+// ruleset accepted and the new one drops, for all or part of the resource.
+type Revocation struct {
+	ClientID     string
+	ClientName   string
+	DeviceID     string
+	DeviceName   string
+	ResourceID   string
+	ResourceName string
+	Src, Dst     netip.Prefix
+}
+
+// Verdict returns the verdict of the first rule matching a connection from
+// src to dst, or "" if none does.
+func (rs Ruleset) Verdict(src, dst netip.Addr) string {
+	for _, r := range rs {
+		if r.matches(src, dst) {
+			return r.Verdict
+		}
+	}
+	return ""
+}
+
+func (r Rule) matches(src, dst netip.Addr) bool {
+	switch r.Match {
+	case MatchPairs:
+		return slices.ContainsFunc(r.Pairs, func(p Pair) bool { return p.Src.Contains(src) && p.Dst.Contains(dst) })
+	case MatchDsts:
+		return slices.ContainsFunc(r.Dsts, func(d Range) bool { return d.Contains(dst) })
+	case MatchAll:
+		return true
+	}
+	return false
+}
+
+// Accepts reports whether a verdict lets a connection through.
+func Accepts(verdict string) bool {
+	return verdict == controlplane.VerdictAllow || verdict == controlplane.VerdictObserve
+}
+
+// Revoked returns every resource the old policies granted a device, under
+// the old ruleset, that the new ruleset drops for some address of the
+// resource. A device's source range is judged by its first address, which
+// is all there is of a tunnel address.
+func Revoked(policies []controlplane.Policy, before, after Ruleset) []Revocation {
+	var out []Revocation
+	for _, p := range policies {
+		for _, cidr := range p.AllowedIPs {
+			src, err := parseIPv4Prefix(cidr)
+			if err != nil || !src.IsValid() {
+				continue
+			}
+			for _, target := range p.AllowedCIDRs {
+				dst, err := parseIPv4Prefix(target.CIDR)
+				if err != nil || !dst.IsValid() || !revoked(src.Addr(), dst, before, after) {
+					continue
+				}
+				out = append(out, Revocation{
+					ClientID:     p.ClientID,
+					ClientName:   p.ClientName,
+					DeviceID:     p.DeviceID,
+					DeviceName:   p.DeviceName,
+					ResourceID:   target.ResourceID,
+					ResourceName: target.ResourceName,
+					Src:          src,
+					Dst:          dst,
+				})
+			}
+		}
+	}
+	return out
+}
+
+// revoked reports whether some address of dst is accepted from src before
+// and dropped after. Both verdicts only change at the first address of a
+// range or pair of either ruleset, or right behind its last, so only those
+// addresses inside dst are judged.
+func revoked(src netip.Addr, dst netip.Prefix, before, after Ruleset) bool {
+	first, last := prefixBounds(dst)
+	points := []uint64{first}
+	bound := func(start, end uint64) {
+		for _, v := range []uint64{start, end + 1} {
+			if v > first && v <= last {
+				points = append(points, v)
+			}
+		}
+	}
+	for _, rs := range []Ruleset{before, after} {
+		for _, r := range rs {
+			for _, p := range r.Pairs {
+				bound(addrValue(p.Dst.First), addrValue(p.Dst.Last))
+			}
+			for _, d := range r.Dsts {
+				bound(addrValue(d.First), addrValue(d.Last))
+			}
+		}
+	}
+	return slices.ContainsFunc(points, func(v uint64) bool {
+		addr := addrFrom(v)
+		return Accepts(before.Verdict(src, addr)) && !Accepts(after.Verdict(src, addr))
+	})
+}
@@ -0,0 +1,135 @@
+package policy
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+
+	"migration-to-zero-trust/enforcer/internal/controlplane"
+)
+
+func TestRevoked(t *testing.T) {
+	web := controlplane.PolicyTarget{CIDR: "10.0.0.0/24", Mode: controlplane.ModeObserve, ResourceID: "r-web"}
+	db := controlplane.PolicyTarget{CIDR: "10.0.1.10/32", Mode: controlplane.ModeEnforce, ResourceID: "r-db"}
+	finance := controlplane.PolicyTarget{CIDR: "10.0.0.128/25", Mode: controlplane.ModeEnforce, ResourceID: "r-finance"}
+	internal := controlplane.PolicyTarget{CIDR: "10.0.1.0/24", Mode: controlplane.ModeEnforce, ResourceID: "r-internal"}
+	enforced := func(t controlplane.PolicyTarget) controlplane.PolicyTarget {
+		t.Mode = controlplane.ModeEnforce
+		return t
+	}
+	policy := func(client string, targets ...controlplane.PolicyTarget) controlplane.Policy {
+		ip := map[string]string{"alice": "100.64.0.2/32", "bob": "100.64.0.3/32"}[client]
+		return controlplane.Policy{ClientID: client, AllowedIPs: []string{ip}, AllowedCIDRs: targets}
+	}
+	type config struct {
+		policies  []controlplane.Policy
+		resources []controlplane.PolicyTarget
+	}
+
+	tests := []struct {
+		name          string
+		before, after config
+		unknown       string
+		want          []string // client/resource
+	}{
+		{
+			name:    "unchanged",
+			before:  config{[]controlplane.Policy{policy("alice", web, db)}, []controlplane.PolicyTarget{web, db}},
+			after:   config{[]controlplane.Policy{policy("alice", web, db)}, []controlplane.PolicyTarget{web, db}},
+			unknown: controlplane.VerdictDeny,
+		},
+		{
+			name:    "pair deleted",
+			before:  config{[]controlplane.Policy{policy("alice", web, db), policy("bob", web, db)}, []controlplane.PolicyTarget{web, db}},
+			after:   config{[]controlplane.Policy{policy("alice", web, db), policy("bob", web)}, []controlplane.PolicyTarget{web, db}},
+			unknown: controlplane.VerdictDeny,
+			want:    []string{"bob/r-db"},
+		},
+		{
+			name:    "switched to enforce",
+			before:  config{[]controlplane.Policy{policy("alice", web), policy("bob", web)}, []controlplane.PolicyTarget{web}},
+			after:   config{[]controlplane.Policy{policy("alice", enforced(web))}, []controlplane.PolicyTarget{enforced(web)}},
+			unknown: controlplane.VerdictDeny,
+			want:    []string{"bob/r-web"},
+		},
+		{
+			name:    "enforce resource added inside observe range",
+			before:  config{[]controlplane.Policy{policy("alice", web), policy("bob", web)}, []controlplane.PolicyTarget{web}},
+			after:   config{[]controlplane.Policy{policy("alice", web, finance), policy("bob", web)}, []controlplane.PolicyTarget{web, finance}},
+			unknown: controlplane.VerdictDeny,
+			want:    []string{"bob/r-web"},
+		},
+		{
+			name:    "enforce resource added inside enforce range",
+			before:  config{[]controlplane.Policy{policy("alice", internal)}, []controlplane.PolicyTarget{internal}},
+			after:   config{[]controlplane.Policy{policy("alice", internal), policy("bob", db)}, []controlplane.PolicyTarget{internal, db}},
+			unknown: controlplane.VerdictDeny,
+			want:    []string{"alice/r-internal"},
+		},
+		{
+			name:    "resource deleted",
+			before:  config{[]controlplane.Policy{policy("alice", web, db)}, []controlplane.PolicyTarget{web, db}},
+			after:   config{[]controlplane.Policy{policy("alice", db)}, []controlplane.PolicyTarget{db}},
+			unknown: controlplane.VerdictDeny,
+			want:    []string{"alice/r-web"},
+		},
+		{
+			name:    "resource deleted, unknown destinations observed",
+			before:  config{[]controlplane.Policy{policy("alice", web, db)}, []controlplane.PolicyTarget{web, db}},
+			after:   config{[]controlplane.Policy{policy("alice", db)}, []controlplane.PolicyTarget{db}},
+			unknown: controlplane.VerdictObserve,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := Compile(tt.before.policies, tt.before.resources, tt.unknown)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := Compile(tt.after.policies, tt.after.resources, tt.unknown)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range Revoked(tt.before.policies, before, after) {
+				got = append(got, r.ClientID+"/"+r.ResourceID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Revoked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerdict(t *testing.T) {
+	rs, err := Compile(
+		[]controlplane.Policy{{
+			AllowedIPs:   []string{"100.64.0.2/32"},
+			AllowedCIDRs: []controlplane.PolicyTarget{{CIDR: "10.0.5.0/24", Mode: controlplane.ModeEnforce}},
+		}},
+		[]controlplane.PolicyTarget{
+			{CIDR: "10.0.0.0/16", Mode: controlplane.ModeObserve},
+			{CIDR: "10.0.5.0/24", Mode: controlplane.ModeEnforce},
+			{CIDR: "10.0.5.80/32", Mode: controlplane.ModeObserve},
+		},
+		controlplane.VerdictDeny,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		src, dst string
+		want     string
+	}{
+		{"100.64.0.2", "10.0.5.1", controlplane.VerdictAllow},
+		{"100.64.0.3", "10.0.5.1", controlplane.VerdictDeny},
+		{"100.64.0.3", "10.0.5.80", controlplane.VerdictObserve},
+		{"100.64.0.3", "10.0.6.1", controlplane.VerdictObserve},
+		{"100.64.0.2", "10.1.0.1", controlplane.VerdictOutOfScope},
+	}
+	for _, tt := range tests {
+		if got := rs.Verdict(netip.MustParseAddr(tt.src), netip.MustParseAddr(tt.dst)); got != tt.want {
+			t.Errorf("Verdict(%s, %s) = %s, want %s", tt.src, tt.dst, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+package version
+
+// Version is the enforcer release, set at build time with
+// -ldflags "-X migration-to-zero-trust/enforcer/internal/version.Version=<version>".
+var Version = "dev"
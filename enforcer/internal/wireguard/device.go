@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"slices"
+	"sort"
+	"strings"
 	"syscall"
 
 	"migration-to-zero-trust/enforcer/internal/controlplane"
@@ -93,14 +96,14 @@ func ApplyPeers(iface string, policies []controlplane.Policy) error {
 
 		pubKey, err := wgtypes.ParseKey(policy.WGPublicKey)
 		if err != nil {
-			return fmt.Errorf("parse public key for client %s: %w", policy.ClientID, err)
+			return fmt.Errorf("parse public key for device %s: %w", policy.DeviceID, err)
 		}
 
 		allowed := make([]net.IPNet, 0, len(policy.AllowedIPs))
 		for _, cidr := range policy.AllowedIPs {
 			_, ipNet, err := net.ParseCIDR(cidr)
 			if err != nil {
-				return fmt.Errorf("parse allowed_ips for client %s: %w", policy.ClientID, err)
+				return fmt.Errorf("parse allowed_ips for device %s: %w", policy.DeviceID, err)
 			}
 			allowed = append(allowed, *ipNet)
 		}
@@ -123,3 +126,81 @@ func ApplyPeers(iface string, policies []controlplane.Policy) error {
 
 	return nil
 }
+
+// PeerCount returns the number of peers configured on the interface.
+func PeerCount(iface string) (int, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return 0, fmt.Errorf("wgctrl init: %w", err)
+	}
+	defer client.Close()
+
+	dev, err := client.Device(iface)
+	if err != nil {
+		return 0, fmt.Errorf("get device: %w", err)
+	}
+	return len(dev.Peers), nil
+}
+
+// ExpectedPeers returns the peer set ApplyPeers installs for the given
+// policies, one sorted line per peer.
+func ExpectedPeers(policies []controlplane.Policy) ([]string, error) {
+	peers := make(map[string][]string)
+	for _, policy := range policies {
+		if policy.WGPublicKey == "" {
+			continue
+		}
+		pubKey, err := wgtypes.ParseKey(policy.WGPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key for device %s: %w", policy.DeviceID, err)
+		}
+		for _, cidr := range policy.AllowedIPs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("parse allowed_ips for device %s: %w", policy.DeviceID, err)
+			}
+			peers[pubKey.String()] = append(peers[pubKey.String()], ipNet.String())
+		}
+		if _, ok := peers[pubKey.String()]; !ok {
+			peers[pubKey.String()] = nil
+		}
+	}
+	return peerLines(peers), nil
+}
+
+// InstalledPeers reads the peer set back from the interface, in the form of
+// ExpectedPeers.
+func InstalledPeers(iface string) ([]string, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, fmt.Errorf("wgctrl init: %w", err)
+	}
+	defer client.Close()
+
+	dev, err := client.Device(iface)
+	if err != nil {
+		return nil, fmt.Errorf("get device: %w", err)
+	}
+	peers := make(map[string][]string, len(dev.Peers))
+	for _, p := range dev.Peers {
+		allowed := make([]string, 0, len(p.AllowedIPs))
+		for _, ipNet := range p.AllowedIPs {
+			allowed = append(allowed, ipNet.String())
+		}
+		peers[p.PublicKey.String()] = allowed
+	}
+	return peerLines(peers), nil
+}
+
+// peerLines renders peers as "<public key> <allowed ips>" lines, sorted by
+// key with sorted, deduplicated allowed IPs.
+func peerLines(peers map[string][]string) []string {
+	lines := make([]string, 0, len(peers))
+	for key, allowed := range peers {
+		sort.Strings(allowed)
+		allowed = slices.Compact(allowed)
+		lines = append(lines, key+" "+strings.Join(allowed, ","))
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,127 @@
+// Package configbundle verifies the signed config bundles the controlplane
+// serves to enforcers and agents.
+//
+// A holder pins the controlplane's Ed25519 public key, refuses bundles with
+// a bad signature or past their expiry, and refuses versions older than the
+// one it last applied, which it keeps in a state file across restarts.
+// Checking that a bundle is meant for the holder is left to the caller,
+// which knows what its target looks like.
+package configbundle
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRejected wraps every reason a config bundle is refused.
+var ErrRejected = errors.New("config bundle rejected")
+
+// Signed is a config bundle with the controlplane's Ed25519 signature over
+// the decoded bundle bytes.
+type Signed struct {
+	Bundle    string `json:"bundle"`
+	Signature string `json:"signature"`
+}
+
+// Bundle is the signed content of a Signed.
+type Bundle struct {
+	Target    string          `json:"target"`
+	Version   uint64          `json:"version"`
+	IssuedAt  time.Time       `json:"issued_at"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	Config    json.RawMessage `json:"config"`
+}
+
+// Verifier checks config bundles against a pinned public key and refuses
+// versions older than the last applied one.
+type Verifier struct {
+	publicKey ed25519.PublicKey
+	statePath string
+
+	mu      sync.Mutex
+	applied uint64
+}
+
+// NewVerifier pins publicKey (base64) and loads the last applied version
+// from statePath.
+func NewVerifier(publicKey, statePath string) (*Verifier, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("config signing key must be a base64 Ed25519 public key")
+	}
+	v := &Verifier{publicKey: key, statePath: statePath}
+	data, err := os.ReadFile(statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if v.applied, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return nil, fmt.Errorf("config version state %s: %w", statePath, err)
+		}
+	}
+	return v, nil
+}
+
+// Verify checks the signature, expiry and version of signed and returns its
+// bundle.
+func (v *Verifier) Verify(signed Signed, now time.Time) (Bundle, error) {
+	data, err := base64.StdEncoding.DecodeString(signed.Bundle)
+	if err != nil {
+		return Bundle{}, fmt.Errorf("%w: bundle encoding", ErrRejected)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signed.Signature)
+	if err != nil || !ed25519.Verify(v.publicKey, data, sig) {
+		return Bundle{}, fmt.Errorf("%w: bad signature", ErrRejected)
+	}
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return Bundle{}, fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+	if now.After(b.ExpiresAt) {
+		return Bundle{}, fmt.Errorf("%w: expired at %s", ErrRejected, b.ExpiresAt.Format(time.RFC3339))
+	}
+	v.mu.Lock()
+	applied := v.applied
+	v.mu.Unlock()
+	if b.Version < applied {
+		return Bundle{}, fmt.Errorf("%w: version %d is older than applied version %d", ErrRejected, b.Version, applied)
+	}
+	return b, nil
+}
+
+// AppliedVersion returns the last applied config version.
+func (v *Verifier) AppliedVersion() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.applied
+}
+
+// Applied records that version has been applied.
+func (v *Verifier) Applied(version uint64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if version <= v.applied {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(v.statePath), 0o700); err != nil {
+		return err
+	}
+	tmp := v.statePath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(version, 10)+"\n"), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, v.statePath); err != nil {
+		return err
+	}
+	v.applied = version
+	return nil
+}
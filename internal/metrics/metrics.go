@@ -0,0 +1,334 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+//
+// Metrics register themselves with the package on creation, so they are
+// declared as package variables next to the code that updates them. Values
+// that already live elsewhere, such as queue depths, are read at scrape time
+// through collectors instead of being copied into gauges.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric types.
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// DefaultBuckets are histogram bounds in seconds for request and operation
+// latencies.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	registryMu sync.Mutex
+	registry   []family
+	names      = make(map[string]bool)
+)
+
+// family is a registered metric.
+type family interface {
+	write(w *bufio.Writer)
+}
+
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func register(d desc, f family) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if names[d.name] {
+		panic("metrics: " + d.name + " registered twice")
+	}
+	names[d.name] = true
+	registry = append(registry, f)
+}
+
+func (d desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, helpEscaper.Replace(d.help), d.name, d.typ)
+}
+
+func (d desc) check(values []string) {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+}
+
+// series is the value of a metric for one set of label values.
+type series struct {
+	labels []string
+	value  float64
+}
+
+type vec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	v := &vec{desc: desc{name: name, help: help, typ: typ, labels: labels}, series: make(map[string]*series)}
+	if len(labels) == 0 {
+		// Exposed as 0 before the first update
+		v.series[""] = &series{}
+	}
+	register(v.desc, v)
+	return v
+}
+
+func (v *vec) get(values []string) *series {
+	v.check(values)
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: slices.Clone(values)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.header(w)
+	for _, s := range sortedSeries(v.series) {
+		writeSample(w, v.name, v.labels, s.labels, "", "", s.value)
+	}
+}
+
+func sortedSeries(m map[string]*series) []*series {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]*series, len(keys))
+	for i, k := range keys {
+		out[i] = m[k]
+	}
+	return out
+}
+
+// Counter is a value that only goes up, per set of label values.
+type Counter struct{ v *vec }
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{v: newVec(name, help, TypeCounter, labels)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds n, which must not be negative.
+func (c *Counter) Add(n float64, labelValues ...string) {
+	if n < 0 {
+		panic("metrics: counter " + c.v.name + " decreased")
+	}
+	c.v.mu.Lock()
+	defer c.v.mu.Unlock()
+	c.v.get(labelValues).value += n
+}
+
+// Gauge is a value that goes up and down, per set of label values.
+type Gauge struct{ v *vec }
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{v: newVec(name, help, TypeGauge, labels)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.get(labelValues).value = value
+}
+
+func (g *Gauge) Add(n float64, labelValues ...string) {
+	g.v.mu.Lock()
+	defer g.v.mu.Unlock()
+	g.v.get(labelValues).value += n
+}
+
+// Histogram counts observations into buckets, per set of label values.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds,
+// which must be increasing, and label names.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: TypeHistogram, labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	register(h.desc, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.check(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{labels: slices.Clone(labelValues), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+// ObserveSince observes the seconds elapsed since start.
+func (h *Histogram) ObserveSince(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.series[k]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", h.labels, s.labels, "le", "+Inf", float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, "", "", s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labels, "", "", float64(s.count))
+	}
+}
+
+// Emit reports one sample from a collector.
+type Emit func(value float64, labelValues ...string)
+
+type collector struct {
+	desc
+	collect func(emit Emit)
+}
+
+// NewCollector registers a counter or gauge whose samples are read by
+// collect at scrape time.
+func NewCollector(name, help, typ string, collect func(emit Emit), labels ...string) {
+	c := &collector{desc: desc{name: name, help: help, typ: typ, labels: labels}, collect: collect}
+	register(c.desc, c)
+}
+
+// NewGaugeFunc registers a gauge without labels read from value at scrape
+// time.
+func NewGaugeFunc(name, help string, value func() float64) {
+	NewCollector(name, help, TypeGauge, func(emit Emit) { emit(value()) })
+}
+
+// NewCounterFunc registers a counter without labels read from value at
+// scrape time.
+func NewCounterFunc(name, help string, value func() float64) {
+	NewCollector(name, help, TypeCounter, func(emit Emit) { emit(value()) })
+}
+
+func (c *collector) write(w *bufio.Writer) {
+	var samples []series
+	c.collect(func(value float64, labelValues ...string) {
+		c.check(labelValues)
+		samples = append(samples, series{labels: slices.Clone(labelValues), value: value})
+	})
+	c.header(w)
+	for _, s := range samples {
+		writeSample(w, c.name, c.labels, s.labels, "", "", s.value)
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func writeSample(w *bufio.Writer, name string, labels, values []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraLabel != "" {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, l, labelEscaper.Replace(values[i]))
+		}
+		if extraLabel != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraLabel, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves every registered metric.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registryMu.Lock()
+		families := slices.Clone(registry)
+		registryMu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		for _, f := range families {
+			f.write(bw)
+		}
+		bw.Flush()
+	})
+}